@@ -1,11 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
@@ -24,15 +37,72 @@ type DataEntry struct {
 	Unit         string // optional units for the data value
 	CreationTime uint64 // Time when the data was created. It can differ from the blockchain entry time
 	Publisher    string // publisher of the data
+	PublisherID  string // verified identity of the publisher (base64 encoded serialized identity)
 }
 
 // DataEntryAd - represents data created by publisher and advertised for specific price
 type DataEntryAd struct {
-	DataEntry        // anonymous field
-	Price     int64  // Price for data value
-	AccountNo string // account number where to transfer tokens
+	DataEntry             // anonymous field
+	Price     json.Number // Price for data value as decimal number of tokens
+	AccountNo string      // account number where to transfer tokens
 }
 
+// TxDetails - represents transaction returned by getTxDetails of the tokens chaincode
+type TxDetails struct {
+	TxID      string      // ID of the transaction
+	Sender    string      // account ID of the sender
+	Recipient string      // account ID of the recipient
+	Amount    json.Number // amount of transfered tokens as decimal number
+	State     string      // state of the transaction (ValidTx|PendingTx)
+	Timestamp string      // time of the transaction (RFC 3339)
+	Expiry    string      // time after which the pending Tx can be refunded (RFC 3339)
+	SpenderID string      // identity (base64 serialized) of the holder who paid within allowance of the sender
+}
+
+// BuyerKey - represents public key registered by the buyer for encrypted delivery of purchased data
+type BuyerKey struct {
+	RecordType string // RecordType is used to distinguish the various types of objects in state database
+	BuyerID    string // verified identity of the buyer (MSPID::CommonName)
+	PublicKey  string // PEM encoded RSA public key of the buyer
+}
+
+// Purchase - represents data value of the purchased data entry encrypted for the buyer
+type Purchase struct {
+	RecordType     string // RecordType is used to distinguish the various types of objects in state database
+	TxID           string // ID of the tokens transaction that paid for the data
+	DataEntryID    string // ID of the purchased data entry
+	CreationTime   uint64 // creation time of the purchased data entry
+	BuyerID        string // verified identity of the buyer (MSPID::CommonName)
+	EncryptedKey   string // AES-256 key encrypted by RSA-OAEP (SHA-256) with public key of the buyer (base64)
+	Nonce          string // nonce used for AES-GCM (base64)
+	EncryptedValue string // data value encrypted by AES-GCM (base64)
+}
+
+// Account - represents fields of account in the tokens chaincode required by this chaincode
+type Account struct {
+	AccountID string // unique id of the account
+	OwnerID   string // Cryptographic account holder identity (base64 encoded serialized identity)
+}
+
+// Counterpart - represents trusted chaincode on another channel which can be invoked by this chaincode
+type Counterpart struct {
+	RecordType    string // RecordType is used to distinguish the various types of objects in state database
+	Role          string // role of the chaincode (data|tokens)
+	Channel       string // channel where the chaincode is instantiated
+	ChaincodeName string // name of the chaincode
+}
+
+// PurchaseKeySize - number of bytes of the AES-256 key of the purchase and of the OAEP seed used to encrypt the key
+// for the buyer. Both are supplied by the publisher in the transient fields purchaseKey and oaepSeed of revealPaidData
+const PurchaseKeySize = 32
+
+// TimeRangePageSize - number of keys of ID~PaddedTime index read by one query of getDataAdByIDInTimeRange
+const TimeRangePageSize = 100
+
+// MaxMigrationPageSize - limits the number of data entries indexed by one migrateTimeIndex transaction.
+// This keeps the transaction within the size limits of the ordering service.
+const MaxMigrationPageSize = 500
+
 // Main
 //////////
 func main() {
@@ -47,6 +117,60 @@ func main() {
 // Init initializes chaincode
 //////////////////////////////
 func (cc *Chaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	var err error
+	//      0                 1                  2                  3
+	// "channelData", "chaincodeDataName", "channelTokens", "chaincodeTokensName"
+	args := stub.GetStringArgs()
+
+	// GetCreator returns the identity object of the chaincode instantiation's submitter
+	creatorID, err := stub.GetCreator()
+	if err != nil {
+		return shim.Error("Failed to get identity of the administrator: " + err.Error())
+	}
+
+	// The submitter of the instantiation becomes the administrator of the chaincode.
+	// The administrator is not replaced by the submitter of the upgrade
+	adminKey, err := stub.CreateCompositeKey("Admin", []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	adminAsBytes, err := stub.GetState(adminKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	// Administrator saved as "MSPID::CommonName" before is replaced by its serialized identity
+	// when the administrator upgrades the chaincode
+	adminID := base64.StdEncoding.EncodeToString(creatorID)
+	legacyAdmin := adminAsBytes != nil && strings.Contains(string(adminAsBytes), "::")
+	if adminAsBytes == nil || (legacyAdmin && isSameIdentity(string(adminAsBytes), adminID)) {
+		err = stub.PutState(adminKey, []byte(adminID))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// Trusted chaincodes are optional. They can be set later by the administrator
+	if len(args) != 4 {
+		return shim.Success(nil)
+	}
+
+	// Input sanitization
+	for i := 0; i < len(args); i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Save the trusted chaincodes
+	err = putTrustedChaincode(stub, "data", args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putTrustedChaincode(stub, "tokens", args[2], args[3])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	return shim.Success(nil)
 }
 
@@ -62,14 +186,32 @@ func (cc *Chaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return cc.getDataAdByIDAndTime(stub, args)
 	} else if function == "getAllDataAdByID" { // invoke other chaincode and reveal values
 		return cc.getAllDataAdByID(stub, args)
+	} else if function == "getAllDataAdByIDWithPagination" { //read page of data by DataEntryID
+		return cc.getAllDataAdByIDWithPagination(stub, args)
 	} else if function == "getLatestDataAdByID" { // invoke other chaincode and reveal values
 		return cc.getLatestDataAdByID(stub, args)
+	} else if function == "getDataAdByIDInTimeRange" { //read data by DataEntryID created within time window
+		return cc.getDataAdByIDInTimeRange(stub, args)
 	} else if function == "getDataAdByPub" { //find data created by publisher using compound key
 		return cc.getDataAdByPub(stub, args)
+	} else if function == "getDataAdByPubWithPagination" { //read page of data created by publisher
+		return cc.getDataAdByPubWithPagination(stub, args)
 	} else if function == "revealPaidData" { // invoke other chaincode and reveal values
 		return cc.revealPaidData(stub, args)
 	} else if function == "checkTXState" { // check if TxID is used for data purchase
 		return cc.checkTXState(stub, args)
+	} else if function == "registerBuyerKey" { // register public key of the caller for encrypted delivery
+		return cc.registerBuyerKey(stub, args)
+	} else if function == "getPurchase" { // get data value encrypted for the buyer by TxID
+		return cc.getPurchase(stub, args)
+	} else if function == "setTrustedChaincode" { // set trusted chaincode for data or tokens (admin only)
+		return cc.setTrustedChaincode(stub, args)
+	} else if function == "getTrustedChaincode" { // get trusted chaincode for data or tokens
+		return cc.getTrustedChaincode(stub, args)
+	} else if function == "registerPublisher" { // bind publisher name to identity (admin only)
+		return cc.registerPublisher(stub, args)
+	} else if function == "migrateTimeIndex" { // index data entries created before the time index (admin only)
+		return cc.migrateTimeIndex(stub, args)
 	}
 
 	return shim.Error("Received unknown function invocation")
@@ -104,16 +246,22 @@ func (cc *Chaincode) createDataEntryAd(stub shim.ChaincodeStubInterface, args []
 		return shim.Error("Expecting positiv integer or zero as creation time.")
 	}
 	publisher := args[5]
-	price, err := strconv.ParseInt(args[6], 10, 64)
-	if err != nil {
-		return shim.Error("Expecting positiv integer or zero as price.")
-	}
 	// Check if price is positive number
-	if price < 0 {
+	if strings.HasPrefix(args[6], "-") {
 		return shim.Error("Price cannot be negative number.")
 	}
+	price, err := parsePrice(args[6])
+	if err != nil {
+		return shim.Error("Expecting positiv decimal number or zero as price.")
+	}
 	accountNo := args[7]
 
+	// Verify that the caller is allowed to publish under the publisher name
+	publisherID, err := verifyPublisher(stub, publisher)
+	if err != nil {
+		return shim.Error("Publisher verification failed: " + err.Error())
+	}
+
 	// Create composite key
 	idTimeCompositeKey, err := stub.CreateCompositeKey("ID~Time", []string{dataEntryID, creationTime})
 	if err != nil {
@@ -128,10 +276,17 @@ func (cc *Chaincode) createDataEntryAd(stub shim.ChaincodeStubInterface, args []
 		return shim.Error("This data entry already exists: " + dataEntryID + "~" + creationTime)
 	}
 
+	// The first data entry of the ID marks the ID as indexed by time.
+	// IDs with data entries created before the index are marked by migrateTimeIndex
+	err = markNewIDTimeIndexed(stub, dataEntryID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// Create data entry object and marshal to JSON
 	recordType := "DATA_ENTRY_AD"
 	dataEntryAd := &DataEntryAd{DataEntry{recordType, dataEntryID, description, value,
-		unit, creationTimeUint, publisher}, price, accountNo}
+		unit, creationTimeUint, publisher, publisherID}, price, accountNo}
 	dataEntryAdJSONasBytes, err := json.Marshal(dataEntryAd)
 	if err != nil {
 		return shim.Error(err.Error())
@@ -157,6 +312,12 @@ func (cc *Chaincode) createDataEntryAd(stub shim.ChaincodeStubInterface, args []
 	valueNull := []byte{0x00}
 	stub.PutState(pubIDIndexKey, valueNull)
 
+	// Index the data by creation time for time range queries
+	err = putTimeIndex(stub, dataEntryID, creationTimeUint)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// Data entry saved and indexed
 	return shim.Success(nil)
 }
@@ -330,6 +491,168 @@ func (cc *Chaincode) getLatestDataAdByID(stub shim.ChaincodeStubInterface, args
 	return shim.Success(response.Payload)
 }
 
+// getDataAdByIDInTimeRange - read data entries with Id created within time window in chronological order
+///////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getDataAdByIDInTimeRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 3
+	//  0        1           2
+	// "ID" "fromTime" "toTime"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting data entry Id, from time and to time")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get args
+	dataEntryID := args[0]
+	fromTime, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return shim.Error("Expecting positiv integer or zero as from time.")
+	}
+	toTime, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return shim.Error("Expecting positiv integer or zero as to time.")
+	}
+	if fromTime > toTime {
+		return shim.Error("From time cannot be later than to time.")
+	}
+
+	// Data entries created before the time index are found only by scan of all entries of the ID
+	indexed, err := isTimeIndexed(stub, dataEntryID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !indexed {
+		return getDataAdByIDInTimeRangeByScan(stub, dataEntryID, fromTime, toTime)
+	}
+
+	// The ledger starts the paginated query at the bookmark, so the first page starts at the from time
+	bookmark, err := stub.CreateCompositeKey("ID~PaddedTime", []string{dataEntryID, padTime(fromTime)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Create JSON array of the entries until the to time
+	var dataAsBytes []byte
+	var entriesCount int
+	for bookmark != "" {
+		idTimeIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination("ID~PaddedTime",
+			[]string{dataEntryID}, TimeRangePageSize, bookmark)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		bookmark = metadata.Bookmark
+		for idTimeIterator.HasNext() {
+			responseRange, err := idTimeIterator.Next()
+			if err != nil {
+				idTimeIterator.Close()
+				return shim.Error(err.Error())
+			}
+
+			// get the creationTime from ID~PaddedTime composite key
+			_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+			if err != nil {
+				idTimeIterator.Close()
+				return shim.Error(err.Error())
+			}
+			creationTime, err := strconv.ParseUint(compositeKeyParts[1], 10, 64)
+			if err != nil {
+				idTimeIterator.Close()
+				return shim.Error("Retrieved composite key conversion to uint64 failed: " + err.Error())
+			}
+			if creationTime > toTime {
+				bookmark = ""
+				break
+			}
+
+			// Retrieve the data from the state
+			response := cc.getDataAdByIDAndTime(stub, []string{dataEntryID, strconv.FormatUint(creationTime, 10)})
+			if response.Status != shim.OK {
+				idTimeIterator.Close()
+				return shim.Error("Retrieval of data entry failed: " + response.Message)
+			}
+			if entriesCount > 0 {
+				dataAsBytes = append(dataAsBytes, []byte(",")...)
+			}
+			dataAsBytes = append(dataAsBytes, response.Payload...)
+			entriesCount++
+		}
+		idTimeIterator.Close()
+	}
+	dataAsBytes = append([]byte("["), dataAsBytes...)
+	dataAsBytes = append(dataAsBytes, []byte("]")...)
+
+	// It returns results as JSON array
+	return shim.Success(dataAsBytes)
+}
+
+// getDataAdByIDInTimeRangeByScan - returns data entries with Id created within time window in chronological order
+// as JSON array. It scans all data entries of the ID, so it is used only for IDs that are not indexed by time.
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getDataAdByIDInTimeRangeByScan(stub shim.ChaincodeStubInterface, dataEntryID string, fromTime uint64,
+	toTime uint64) pb.Response {
+	// Get all keys of the data entry from ID~Time index
+	idTimeIterator, err := stub.GetStateByPartialCompositeKey("ID~Time", []string{dataEntryID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer idTimeIterator.Close()
+
+	// Keep only the entries within the time window.
+	// Creation time is stored in the key as decimal string, therefore the keys are
+	// not sorted by time (e.g. "10" < "9") and entries have to be sorted afterwards.
+	type timedEntry struct {
+		creationTime uint64
+		data         []byte
+	}
+	var entries []timedEntry
+	for idTimeIterator.HasNext() {
+		responseRange, err := idTimeIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// get the dataEntryID and creationTime from ID~Time composite key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		creationTime, err := strconv.ParseUint(compositeKeyParts[1], 10, 64)
+		if err != nil {
+			return shim.Error("Retrieved composite key conversion to uint64 failed: " + err.Error())
+		}
+		if creationTime < fromTime || creationTime > toTime {
+			continue
+		}
+
+		// The data entry itself is the value of ID~Time key
+		entries = append(entries, timedEntry{creationTime, responseRange.Value})
+	}
+
+	// Sort in chronological order
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].creationTime < entries[j].creationTime })
+
+	// Create JSON array
+	var dataAsBytes []byte
+	for i, entry := range entries {
+		if i > 0 {
+			dataAsBytes = append(dataAsBytes, []byte(",")...)
+		}
+		dataAsBytes = append(dataAsBytes, entry.data...)
+	}
+	dataAsBytes = append([]byte("["), dataAsBytes...)
+	dataAsBytes = append(dataAsBytes, []byte("]")...)
+
+	// It returns results as JSON array
+	return shim.Success(dataAsBytes)
+}
+
 // getDataAdByPub - get data entry from chaincode state by publisher
 //////////////////////////////////////////////////////////////////////////////////
 func (cc *Chaincode) getDataAdByPub(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -397,14 +720,80 @@ func (cc *Chaincode) getDataAdByPub(stub shim.ChaincodeStubInterface, args []str
 	return shim.Success(dataAsBytes)
 }
 
+// getAllDataAdByIDWithPagination - read page of data entries from chaincode state based on Id
+//////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getAllDataAdByIDWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//  0        1           2
+	// "ID" "pageSize" ["bookmark"]
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting data entry Id, page size and optional bookmark")
+	}
+
+	// Input sanitization. Bookmark is empty for the first page.
+	for i := 0; i < 2; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get args
+	dataEntryID := args[0]
+	pageSize := args[1]
+	bookmark := ""
+	if len(args) == 3 {
+		bookmark = args[2]
+	}
+
+	// Retrieve the data from the state for each ID~Time row of the page
+	return getPageByPartialCompositeKey(stub, "ID~Time", []string{dataEntryID}, pageSize, bookmark,
+		func(compositeKeyParts []string) pb.Response {
+			return cc.getDataAdByIDAndTime(stub, []string{compositeKeyParts[0], compositeKeyParts[1]})
+		})
+}
+
+// getDataAdByPubWithPagination - get page of data entries from chaincode state by publisher
+////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getDataAdByPubWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//    0           1           2
+	// "Publisher" "pageSize" ["bookmark"]
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting publisher, page size and optional bookmark")
+	}
+
+	// Input sanitization. Bookmark is empty for the first page.
+	for i := 0; i < 2; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get args
+	publisher := args[0]
+	pageSize := args[1]
+	bookmark := ""
+	if len(args) == 3 {
+		bookmark = args[2]
+	}
+
+	// Retrieve the data from the state for each Publisher~DataEntryID~CreationTime row of the page
+	return getPageByPartialCompositeKey(stub, "Publisher~DataEntryID~CreationTime", []string{publisher}, pageSize, bookmark,
+		func(compositeKeyParts []string) pb.Response {
+			return cc.getDataAdByIDAndTime(stub, []string{compositeKeyParts[1], compositeKeyParts[2]})
+		})
+}
+
 // revealPaidData - invokes chaincode in different channel. Data entry
-//                   is paid, first check transaction.
+//
+//	is paid, first check transaction.
+//
 ///////////////////////////////////////////////////////////////////////////////
 func (cc *Chaincode) revealPaidData(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 	argsCount := 7
 	//      0                 1                 2              3                 4                  5               6
 	// "channelData", "chaincodeDataName", "dataEntryID", "creationTime", "channelTokens", "chaincodeTokensName", "txID",
+	// Transient fields "purchaseKey" and "oaepSeed" hold the key of the purchase and the seed of its encryption
+	// for the buyer, both generated by the publisher for each purchase
 	if len(args) != argsCount {
 		return shim.Error("Incorrect number of arguments. Expecting 7")
 	}
@@ -429,6 +818,31 @@ func (cc *Chaincode) revealPaidData(stub shim.ChaincodeStubInterface, args []str
 	chaincodeTokensName := args[5]
 	txID := args[6]
 
+	// The publisher supplies the key of the purchase and the seed of its encryption for the buyer,
+	// so endorsing peers agree on the ciphertext. The transient data is not recorded in the ledger
+	transientMap, err := stub.GetTransient()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	purchaseKey := transientMap["purchaseKey"]
+	if len(purchaseKey) != PurchaseKeySize {
+		return shim.Error("Expecting " + strconv.Itoa(PurchaseKeySize) + " bytes key in transient field purchaseKey.")
+	}
+	oaepSeed := transientMap["oaepSeed"]
+	if len(oaepSeed) != PurchaseKeySize {
+		return shim.Error("Expecting " + strconv.Itoa(PurchaseKeySize) + " bytes seed in transient field oaepSeed.")
+	}
+
+	// Only the trusted chaincodes can be asked about the data entry and the transaction
+	err = checkTrustedChaincode(stub, "data", channelData, chaincodeDataName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkTrustedChaincode(stub, "tokens", channelTokens, chaincodeTokensName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// check if the dataEntryID is present in this ledger
 	responseAd := cc.getDataAdByIDAndTime(stub, []string{dataEntryID, creationTime})
 	if responseAd.Status != shim.OK {
@@ -442,6 +856,15 @@ func (cc *Chaincode) revealPaidData(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error(err.Error())
 	}
 
+	// Only the publisher knows the key of the purchase, therefore only the publisher can reveal the data
+	creatorIDAsBytes, err := stub.GetCreator()
+	if err != nil {
+		return shim.Error("Failed to get creator ID. " + err.Error())
+	}
+	if !isSameIdentity(dataEntryAd.PublisherID, base64.StdEncoding.EncodeToString(creatorIDAsBytes)) {
+		return shim.Error("Only the publisher of the data entry ad can reveal the paid data.")
+	}
+
 	// Check if the txID is already in state used for some data entry purchase.
 	// If not then add and index it as used transaction
 	txIDResultsIterator, err := stub.GetStateByPartialCompositeKey("Tx~DataEntryID~CreationTime", []string{txID})
@@ -470,27 +893,43 @@ func (cc *Chaincode) revealPaidData(stub shim.ChaincodeStubInterface, args []str
 
 	// Invoke chaincode and get the recipient of Tx
 	fTokens := []byte("getTxDetails")
-	argsToChaincodeTokens := [][]byte{fTokens, []byte(txID)}
+	argsToChaincodeTokens := [][]byte{fTokens, []byte(txID), []byte("2")}
 	responseTxDetails := stub.InvokeChaincode(chaincodeTokensName, argsToChaincodeTokens, channelTokens)
 	if responseTxDetails.Status != shim.OK {
 		return shim.Error(responseTxDetails.Message)
 	}
 
+	// Unmarshal Tx details
+	var txDetails TxDetails
+	err = json.Unmarshal(responseTxDetails.Payload, &txDetails)
+	if err != nil {
+		return shim.Error("Unexpected response of getTxDetails: " + err.Error())
+	}
+
 	// Check if recipient of the Tx is the data entry account No.
-	txDetails := strings.Split(string(responseTxDetails.Payload), "->")
-	recipientAccID := txDetails[1]
-	tokensPaid := txDetails[2]
-	txStatus := txDetails[3]
-	if recipientAccID != dataEntryAd.AccountNo {
+	if txDetails.Recipient != dataEntryAd.AccountNo {
 		return shim.Error("This transaction does not have the same recipient account ID as required by data entry ad.")
 	}
-	if tokensPaid != strconv.FormatInt(dataEntryAd.Price, 10) {
+	if txDetails.Amount != dataEntryAd.Price {
 		return shim.Error("Price for the data and tokens sent in this Tx are not the same amount.")
 	}
-	if txStatus != "PendingTx" {
+	if txDetails.State != "PendingTx" {
 		return shim.Error("The transaction is not Pending as it has to be for data purchase.")
 	}
 
+	// The sender can refund the pending Tx after it expires, therefore expired Tx cannot pay for the data
+	expiryTime, err := time.Parse(time.RFC3339, txDetails.Expiry)
+	if err != nil {
+		return shim.Error("Unexpected expiry of the pending transaction: " + txDetails.Expiry)
+	}
+	now, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now.Seconds >= expiryTime.Unix() {
+		return shim.Error("The pending transaction expired at " + txDetails.Expiry)
+	}
+
 	// Invoke chaincode in channel where data entry with value is
 	// this prevent from indexing TxID as used if data entry is not present on another channel
 	fData := []byte("getDataByIDAndTime")
@@ -507,6 +946,11 @@ func (cc *Chaincode) revealPaidData(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error(err.Error())
 	}
 
+	// Only the publisher of the data entry can advertise it for sale
+	if !isSameIdentity(dataEntry.PublisherID, dataEntryAd.PublisherID) {
+		return shim.Error("Data entry ad was not created by the publisher of the data entry.")
+	}
+
 	/*
 		// This may work in the future if we get function that can invoke PutState into another chaincode
 			// At this stage we know that Tx recipient is correct and data entry present
@@ -519,27 +963,74 @@ func (cc *Chaincode) revealPaidData(stub shim.ChaincodeStubInterface, args []str
 			}
 	*/
 
-	// Update the value
-	dataEntryAd.Value = dataEntry.Value
-	dataEntryAdAsBytes, err := json.Marshal(dataEntryAd)
+	// The buyer is the spender who paid within allowance of the sender or the holder of the sender account
+	buyerOwnerID := txDetails.SpenderID
+	if buyerOwnerID == "" {
+		fTokens = []byte("getAccountByID")
+		argsToChaincodeTokens = [][]byte{fTokens, []byte(txDetails.Sender)}
+		responseAccount := stub.InvokeChaincode(chaincodeTokensName, argsToChaincodeTokens, channelTokens)
+		if responseAccount.Status != shim.OK {
+			return shim.Error(responseAccount.Message)
+		}
+		var account Account
+		err = json.Unmarshal(responseAccount.Payload, &account)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		buyerOwnerID = account.OwnerID
+	}
+	ownerIDAsBytes, err := base64.StdEncoding.DecodeString(buyerOwnerID)
+	if err != nil {
+		return shim.Error("Failed to decode identity of the buyer: " + err.Error())
+	}
+	buyerID, err := getIdentity(ownerIDAsBytes)
+	if err != nil {
+		return shim.Error("Failed to decode identity of the buyer: " + err.Error())
+	}
+
+	// Get the public key of the buyer
+	buyerKeyCompositeKey, err := stub.CreateCompositeKey("BuyerKey~Identity", []string{buyerID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	buyerKeyAsBytes, err := stub.GetState(buyerKeyCompositeKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if buyerKeyAsBytes == nil {
+		return shim.Error("Buyer " + buyerID + " has not registered public key.")
+	}
+	var buyerKey BuyerKey
+	err = json.Unmarshal(buyerKeyAsBytes, &buyerKey)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	// Create composite key
-	idTimeCompositeKey, err := stub.CreateCompositeKey("ID~Time", []string{dataEntryID, creationTime})
+	// Encrypt the value for the buyer. The data entry ad keeps its placeholder value.
+	encryptedKey, nonce, encryptedValue, err := encryptForBuyer(buyerKey.PublicKey, purchaseKey, oaepSeed,
+		stub.GetTxID(), []byte(dataEntry.Value))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	purchase := &Purchase{"PURCHASE", txID, dataEntryID, dataEntryAd.CreationTime, buyerID,
+		base64.StdEncoding.EncodeToString(encryptedKey), base64.StdEncoding.EncodeToString(nonce),
+		base64.StdEncoding.EncodeToString(encryptedValue)}
+	purchaseAsBytes, err := json.Marshal(purchase)
 	if err != nil {
-		return shim.Error("Error while creating composite key for ID~Time: " + err.Error())
+		return shim.Error(err.Error())
 	}
 
-	// Update the ledger
-	err = stub.PutState(idTimeCompositeKey, dataEntryAdAsBytes)
+	// Save the purchase under the TxID
+	purchaseCompositeKey, err := stub.CreateCompositeKey("Purchase~TxID", []string{txID})
+	if err != nil {
+		return shim.Error("Error while creating composite key for Purchase~TxID: " + err.Error())
+	}
+	err = stub.PutState(purchaseCompositeKey, purchaseAsBytes)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	// No need to index. DataEntryAd already indexed.
-	return shim.Success(dataEntryAdAsBytes)
+	// Return the purchase with encrypted value
+	return shim.Success(purchaseAsBytes)
 }
 
 func (cc *Chaincode) checkTXState(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -575,3 +1066,738 @@ func (cc *Chaincode) checkTXState(stub shim.ChaincodeStubInterface, args []strin
 	// Return that the TxID is unused for data purchase in this ledger
 	return shim.Success([]byte("Unused"))
 }
+
+// registerBuyerKey - registers public key of the caller. Purchased data values are encrypted with this key
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) registerBuyerKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 1
+	//      0
+	// "publicKey"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting PEM encoded RSA public key")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Check if the key can be used for encryption
+	publicKey := args[0]
+	_, err = parseRSAPublicKey(publicKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// The key belongs to the caller
+	buyerID, err := getCallerIdentity(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Save the key
+	buyerKey := &BuyerKey{"BUYERKEY", buyerID, publicKey}
+	buyerKeyAsBytes, err := json.Marshal(buyerKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	buyerKeyCompositeKey, err := stub.CreateCompositeKey("BuyerKey~Identity", []string{buyerID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(buyerKeyCompositeKey, buyerKeyAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(buyerKeyAsBytes)
+}
+
+// getPurchase - returns data value encrypted for the buyer by TxID of the payment
+///////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getPurchase(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 1
+	//    0
+	// "txID"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting TxID")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get the purchase from chaincode state
+	purchaseCompositeKey, err := stub.CreateCompositeKey("Purchase~TxID", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	purchaseAsBytes, err := stub.GetState(purchaseCompositeKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if purchaseAsBytes == nil {
+		return shim.Error("Purchase was not found.")
+	}
+
+	return shim.Success(purchaseAsBytes)
+}
+
+// setTrustedChaincode - sets channel and chaincode which is trusted for data entries or tokens
+/////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) setTrustedChaincode(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 3
+	//   0          1            2
+	// "role" "channel" "chaincodeName"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting role (data|tokens), channel and chaincode name")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Only the administrator can change the trusted chaincodes
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Save the trusted chaincode
+	err = putTrustedChaincode(stub, args[0], args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Trusted chaincode set"))
+}
+
+// getTrustedChaincode - returns channel and chaincode which is trusted for data entries or tokens
+////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getTrustedChaincode(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 1
+	//   0
+	// "role"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting role (data|tokens)")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get the trusted chaincode from chaincode state
+	counterpartKey, err := stub.CreateCompositeKey("Counterpart~Role", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	counterpartAsBytes, err := stub.GetState(counterpartKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if counterpartAsBytes == nil {
+		return shim.Error("Trusted chaincode for " + args[0] + " is not set.")
+	}
+
+	return shim.Success(counterpartAsBytes)
+}
+
+// migrateTimeIndex - indexes by time one page of data entries of the ID created before the time index.
+// It returns JSON object {"migrated":N,"bookmark":"...","hasMore":true|false}. The bookmark is the ID~Time key
+// of the first data entry of the next page encoded in base64, and it is empty for the first page. The ID is marked
+// as indexed only after its last page, so time range queries of the ID scan its data entries until the migration
+// completes. Only the administrator can migrate.
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) migrateTimeIndex(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	//  0       1           2
+	// "ID" "pageSize" ["bookmark"]
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting data entry Id to migrate, page size and optional bookmark")
+	}
+
+	// Input sanitization. Bookmark is empty for the first page.
+	for i := 0; i < 2; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get args
+	dataEntryID := args[0]
+	pageSize, err := strconv.Atoi(args[1])
+	if err != nil || pageSize < 1 || pageSize > MaxMigrationPageSize {
+		return shim.Error("Expecting page size from 1 to " + strconv.Itoa(MaxMigrationPageSize) + ".")
+	}
+	bookmark := ""
+	if len(args) == 3 {
+		bookmark = args[2]
+	}
+
+	// Decode the ID~Time key where the page starts
+	startKeyAsBytes, err := base64.StdEncoding.DecodeString(bookmark)
+	if err != nil {
+		return shim.Error("Invalid bookmark.")
+	}
+	startKey := string(startKeyAsBytes)
+	if startKey != "" {
+		objectType, compositeKeyParts, err := stub.SplitCompositeKey(startKey)
+		if err != nil || objectType != "ID~Time" || len(compositeKeyParts) != 2 || compositeKeyParts[0] != dataEntryID {
+			return shim.Error("Invalid bookmark.")
+		}
+	}
+
+	// Only the administrator can migrate the index
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Index the data entries of the page. Range queries do not accept composite keys, so the rows before
+	// the bookmark are skipped.
+	idTimeIterator, err := stub.GetStateByPartialCompositeKey("ID~Time", []string{dataEntryID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer idTimeIterator.Close()
+	var entriesCount int
+	nextKey := ""
+	for idTimeIterator.HasNext() {
+		responseRange, err := idTimeIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if responseRange.Key < startKey {
+			continue
+		}
+
+		// The first row after the page starts the next page
+		if entriesCount == pageSize {
+			nextKey = responseRange.Key
+			break
+		}
+
+		// get the creationTime from ID~Time composite key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		creationTime, err := strconv.ParseUint(compositeKeyParts[1], 10, 64)
+		if err != nil {
+			return shim.Error("Retrieved composite key conversion to uint64 failed: " + err.Error())
+		}
+		err = putTimeIndex(stub, dataEntryID, creationTime)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		entriesCount++
+	}
+
+	// Mark the ID as indexed after the last page
+	hasMore := nextKey != ""
+	if !hasMore {
+		timeIndexKey, err := stub.CreateCompositeKey("TimeIndex~ID", []string{dataEntryID})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.PutState(timeIndexKey, []byte{0x00})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// It returns number of indexed data entries and the bookmark of the next page
+	var buffer bytes.Buffer
+	buffer.WriteString("{\"migrated\":")
+	buffer.WriteString(strconv.Itoa(entriesCount))
+	buffer.WriteString(",\"bookmark\":\"")
+	if hasMore {
+		buffer.WriteString(base64.StdEncoding.EncodeToString([]byte(nextKey)))
+	}
+	buffer.WriteString("\",\"hasMore\":")
+	buffer.WriteString(strconv.FormatBool(hasMore))
+	buffer.WriteString("}")
+
+	return shim.Success(buffer.Bytes())
+}
+
+// registerPublisher - binds the publisher name to the identity allowed to publish under it.
+// Only the administrator can register or rebind publishers.
+///////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) registerPublisher(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 2
+	//      0              1
+	// "Publisher", "Identity (base64 encoded serialized identity)"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting publisher and identity")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get args
+	publisher := args[0]
+	identity := args[1]
+	identityAsBytes, err := base64.StdEncoding.DecodeString(identity)
+	if err != nil {
+		return shim.Error("Expecting base64 encoded serialized identity.")
+	}
+	_, _, err = getCreatorCertificate(identityAsBytes)
+	if err != nil {
+		return shim.Error("Expecting base64 encoded serialized identity: " + err.Error())
+	}
+
+	// Only the administrator can register publishers
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Bind the publisher name to the identity
+	publisherKey, err := stub.CreateCompositeKey("Publisher~Identity", []string{publisher})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(publisherKey, []byte(identity))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// getPageByPartialCompositeKey - returns one page of records found in the index as JSON object
+// {"records":[...],"bookmark":"...","hasMore":true|false}. The bookmark is opaque for the client.
+// It is the bookmark of the ledger query encoded in base64, so the next page starts where the previous one
+// ended, and it is empty for the first page. Paginated queries are read-only, so the transaction cannot
+// change the state.
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getPageByPartialCompositeKey(stub shim.ChaincodeStubInterface, objectType string, keys []string,
+	pageSizeStr string, bookmark string, getRecord func(compositeKeyParts []string) pb.Response) pb.Response {
+	pageSize, err := strconv.ParseInt(pageSizeStr, 10, 32)
+	if err != nil || pageSize < 1 {
+		return shim.Error("Expecting positive integer as page size.")
+	}
+
+	// Decode the bookmark of the ledger query where the page starts
+	ledgerBookmarkAsBytes, err := base64.StdEncoding.DecodeString(bookmark)
+	if err != nil {
+		return shim.Error("Invalid bookmark.")
+	}
+
+	// Get the index rows of the page
+	resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(objectType, keys,
+		int32(pageSize), string(ledgerBookmarkAsBytes))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	// buffer is a JSON object containing records of the page
+	var buffer bytes.Buffer
+	buffer.WriteString("{\"records\":[")
+	var recordsCount int64
+	for resultsIterator.HasNext() && recordsCount < pageSize {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// Get the record for the composite key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		response := getRecord(compositeKeyParts)
+		if response.Status != shim.OK {
+			return shim.Error("Retrieval of record failed: " + response.Message)
+		}
+
+		// Append the record to the array
+		if recordsCount > 0 {
+			buffer.WriteString(",")
+		}
+		buffer.Write(response.Payload)
+		recordsCount++
+	}
+
+	// The ledger returns the bookmark of the next page only if there are more rows
+	hasMore := metadata != nil && metadata.Bookmark != "" && recordsCount == pageSize
+
+	// Close the array and write the bookmark for the next page
+	buffer.WriteString("],\"bookmark\":\"")
+	if hasMore {
+		buffer.WriteString(base64.StdEncoding.EncodeToString([]byte(metadata.Bookmark)))
+	}
+	buffer.WriteString("\",\"hasMore\":")
+	buffer.WriteString(strconv.FormatBool(hasMore))
+	buffer.WriteString("}")
+
+	// Return JSON object with the page
+	return shim.Success(buffer.Bytes())
+}
+
+// getCallerIdentity - returns identity of the transaction submitter as "MSPID::CommonName"
+// It is derived from the X.509 certificate of the creator so it cannot be forged by the client.
+//////////////////////////////////////////////////////////////////////////////////////////////////
+func getCallerIdentity(stub shim.ChaincodeStubInterface) (string, error) {
+	// GetCreator returns the identity object of the chaincode invocation's submitter
+	creatorIDAsBytes, err := stub.GetCreator()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get creator ID. %s", err)
+	}
+
+	return getIdentity(creatorIDAsBytes)
+}
+
+// getIdentity - returns identity as "MSPID::CommonName" from serialized identity
+//////////////////////////////////////////////////////////////////////////////////
+func getIdentity(creatorIDAsBytes []byte) (string, error) {
+	mspID, cert, err := getCreatorCertificate(creatorIDAsBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return mspID + "::" + cert.Subject.CommonName, nil
+}
+
+// getCreatorCertificate - decodes serialized identity and returns its MSP ID and X.509 certificate
+////////////////////////////////////////////////////////////////////////////////////////////////////
+func getCreatorCertificate(creatorIDAsBytes []byte) (string, *x509.Certificate, error) {
+	sID := &msp.SerializedIdentity{}
+	err := proto.Unmarshal(creatorIDAsBytes, sID)
+	if err != nil {
+		return "", nil, fmt.Errorf("Could not deserialize a SerializedIdentity, err %s", err)
+	}
+
+	block, _ := pem.Decode(sID.IdBytes)
+	if block == nil {
+		return "", nil, fmt.Errorf("Failed to decode PEM structure")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to parse certificate %s", err)
+	}
+
+	return sID.Mspid, cert, nil
+}
+
+// verifyPublisher - checks that the publisher name is registered to the caller and returns caller identity
+// (base64 encoded serialized identity). Publisher name that is not registered yet is bound to the caller who
+// publishes under it first. The administrator can register or rebind publishers. Publishers bound
+// as "MSPID::CommonName" before are migrated to the serialized identity when they publish.
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func verifyPublisher(stub shim.ChaincodeStubInterface, publisher string) (string, error) {
+	// GetCreator returns the identity object of the chaincode invocation's submitter
+	creatorIDAsBytes, err := stub.GetCreator()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get creator ID. %s", err)
+	}
+	callerLegacyID, err := getIdentity(creatorIDAsBytes)
+	if err != nil {
+		return "", err
+	}
+	callerID := base64.StdEncoding.EncodeToString(creatorIDAsBytes)
+
+	// Get the identity the publisher name is bound to
+	publisherKey, err := stub.CreateCompositeKey("Publisher~Identity", []string{publisher})
+	if err != nil {
+		return "", err
+	}
+	publisherIDAsBytes, err := stub.GetState(publisherKey)
+	if err != nil {
+		return "", err
+	}
+	if publisherIDAsBytes == nil {
+		err = stub.PutState(publisherKey, []byte(callerID))
+		if err != nil {
+			return "", err
+		}
+		return callerID, nil
+	}
+
+	// Migrate the publisher bound as "MSPID::CommonName" to the serialized identity of the caller
+	if string(publisherIDAsBytes) == callerLegacyID {
+		err = stub.PutState(publisherKey, []byte(callerID))
+		if err != nil {
+			return "", err
+		}
+		return callerID, nil
+	}
+
+	if !isSameIdentity(callerID, string(publisherIDAsBytes)) {
+		return "", fmt.Errorf("Publisher %s is bound to another identity", publisher)
+	}
+
+	return callerID, nil
+}
+
+// isSameIdentity - checks if both identities (base64 encoded serialized identity) belong to the same holder.
+// The certificate could be renewed, so the MSP, subject and issuer of certificates are compared.
+// Identities saved as "MSPID::CommonName" before are compared by the MSP ID and common name.
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func isSameIdentity(identity string, otherIdentity string) bool {
+	if identity == otherIdentity {
+		return true
+	}
+
+	var mspIDs [2]string
+	var certs [2]*x509.Certificate
+	for i, id := range []string{identity, otherIdentity} {
+		idAsBytes, err := base64.StdEncoding.DecodeString(id)
+		if err == nil {
+			mspIDs[i], certs[i], err = getCreatorCertificate(idAsBytes)
+		}
+		if err != nil {
+			certs[i] = nil
+		}
+	}
+
+	switch {
+	case certs[0] != nil && certs[1] != nil:
+		return mspIDs[0] == mspIDs[1] && bytes.Equal(certs[0].RawSubject, certs[1].RawSubject) &&
+			bytes.Equal(certs[0].RawIssuer, certs[1].RawIssuer)
+	case certs[0] != nil:
+		return mspIDs[0]+"::"+certs[0].Subject.CommonName == otherIdentity
+	case certs[1] != nil:
+		return mspIDs[1]+"::"+certs[1].Subject.CommonName == identity
+	}
+
+	return false
+}
+
+// checkAdmin - returns error if the transaction submitter is not the administrator of the chaincode
+////////////////////////////////////////////////////////////////////////////////////////////////////
+func checkAdmin(stub shim.ChaincodeStubInterface) error {
+	// GetCreator returns the identity object of the chaincode invocation's submitter
+	creatorIDAsBytes, err := stub.GetCreator()
+	if err != nil {
+		return fmt.Errorf("Failed to get creator ID. %s", err)
+	}
+
+	adminKey, err := stub.CreateCompositeKey("Admin", []string{})
+	if err != nil {
+		return err
+	}
+	adminIDAsBytes, err := stub.GetState(adminKey)
+	if err != nil {
+		return err
+	}
+
+	// The certificate of the administrator could be renewed, so the MSP, subject and issuer are compared
+	if adminIDAsBytes == nil ||
+		!isSameIdentity(string(adminIDAsBytes), base64.StdEncoding.EncodeToString(creatorIDAsBytes)) {
+		return fmt.Errorf("Caller is not the administrator of the chaincode")
+	}
+
+	return nil
+}
+
+// putTrustedChaincode - saves channel and chaincode trusted for the role into chaincode state
+///////////////////////////////////////////////////////////////////////////////////////////////
+func putTrustedChaincode(stub shim.ChaincodeStubInterface, role string, channel string, chaincodeName string) error {
+	if role != "data" && role != "tokens" {
+		return fmt.Errorf("Expecting data or tokens as role of the chaincode")
+	}
+
+	counterpart := &Counterpart{"COUNTERPART", role, channel, chaincodeName}
+	counterpartAsBytes, err := json.Marshal(counterpart)
+	if err != nil {
+		return err
+	}
+
+	counterpartKey, err := stub.CreateCompositeKey("Counterpart~Role", []string{role})
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(counterpartKey, counterpartAsBytes)
+}
+
+// checkTrustedChaincode - returns error if the channel and chaincode are not trusted for the role
+//////////////////////////////////////////////////////////////////////////////////////////////////////
+func checkTrustedChaincode(stub shim.ChaincodeStubInterface, role string, channel string, chaincodeName string) error {
+	counterpartKey, err := stub.CreateCompositeKey("Counterpart~Role", []string{role})
+	if err != nil {
+		return err
+	}
+	counterpartAsBytes, err := stub.GetState(counterpartKey)
+	if err != nil {
+		return err
+	} else if counterpartAsBytes == nil {
+		return fmt.Errorf("Trusted chaincode for %s is not set.", role)
+	}
+
+	var counterpart Counterpart
+	err = json.Unmarshal(counterpartAsBytes, &counterpart)
+	if err != nil {
+		return err
+	}
+	if counterpart.Channel != channel || counterpart.ChaincodeName != chaincodeName {
+		return fmt.Errorf("Chaincode %s on channel %s is not trusted for %s.", chaincodeName, channel, role)
+	}
+
+	return nil
+}
+
+// parseRSAPublicKey - parses PEM encoded RSA public key
+/////////////////////////////////////////////////////////
+func parseRSAPublicKey(publicKeyPEM string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("Expecting PEM encoded RSA public key.")
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Expecting PEM encoded RSA public key.")
+	}
+	rsaPublicKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Expecting PEM encoded RSA public key.")
+	}
+	if rsaPublicKey.N.BitLen() < 2048 {
+		return nil, fmt.Errorf("Expecting RSA public key with at least 2048 bits.")
+	}
+
+	return rsaPublicKey, nil
+}
+
+// encryptForBuyer - encrypts value by the AES-256 key of the purchase in GCM mode and encrypts the key by RSA-OAEP
+// with public key of the buyer. The encryption is deterministic, so all endorsing peers produce the same ciphertext.
+// The nonce is derived from the TxID, the key of the purchase is used only once.
+// Returns encrypted key, nonce and encrypted value
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func encryptForBuyer(publicKeyPEM string, key []byte, oaepSeed []byte, txID string,
+	value []byte) ([]byte, []byte, []byte, error) {
+	publicKey, err := parseRSAPublicKey(publicKeyPEM)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	txIDHash := sha256.Sum256([]byte(txID))
+	nonce := txIDHash[:gcm.NonceSize()]
+
+	// Encrypt the key for the buyer and the value by the key
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), bytes.NewReader(oaepSeed), publicKey, key, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	encryptedValue := gcm.Seal(nil, nonce, value, nil)
+
+	return encryptedKey, nonce, encryptedValue, nil
+}
+
+// padTime - formats creation time with leading zeros, so the keys of times are sorted in chronological order
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func padTime(creationTime uint64) string {
+	return fmt.Sprintf("%020d", creationTime)
+}
+
+// putTimeIndex - saves the key of ID~PaddedTime index of the data entry
+////////////////////////////////////////////////////////////////////////////
+func putTimeIndex(stub shim.ChaincodeStubInterface, dataEntryID string, creationTime uint64) error {
+	idPaddedTimeKey, err := stub.CreateCompositeKey("ID~PaddedTime", []string{dataEntryID, padTime(creationTime)})
+	if err != nil {
+		return err
+	}
+
+	// Only the key name is needed, the data entry is read from ID~Time key
+	return stub.PutState(idPaddedTimeKey, []byte{0x00})
+}
+
+// isTimeIndexed - checks if all data entries of the ID are in ID~PaddedTime index
+////////////////////////////////////////////////////////////////////////////////////
+func isTimeIndexed(stub shim.ChaincodeStubInterface, dataEntryID string) (bool, error) {
+	timeIndexKey, err := stub.CreateCompositeKey("TimeIndex~ID", []string{dataEntryID})
+	if err != nil {
+		return false, err
+	}
+	timeIndexAsBytes, err := stub.GetState(timeIndexKey)
+	if err != nil {
+		return false, err
+	}
+
+	return timeIndexAsBytes != nil, nil
+}
+
+// markNewIDTimeIndexed - marks the ID as indexed by time if it has no data entries yet
+///////////////////////////////////////////////////////////////////////////////////////////
+func markNewIDTimeIndexed(stub shim.ChaincodeStubInterface, dataEntryID string) error {
+	indexed, err := isTimeIndexed(stub, dataEntryID)
+	if err != nil || indexed {
+		return err
+	}
+
+	// IDs with data entries created before the time index keep scanning until they are migrated
+	idTimeIterator, err := stub.GetStateByPartialCompositeKey("ID~Time", []string{dataEntryID})
+	if err != nil {
+		return err
+	}
+	defer idTimeIterator.Close()
+	if idTimeIterator.HasNext() {
+		return nil
+	}
+
+	timeIndexKey, err := stub.CreateCompositeKey("TimeIndex~ID", []string{dataEntryID})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(timeIndexKey, []byte{0x00})
+}
+
+// parsePrice - returns the price as decimal number without leading zeros and trailing zeros of the fraction,
+// which is the format of amounts returned by getTxDetails of the tokens chaincode, e.g. "0.0025" or "10"
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func parsePrice(priceStr string) (json.Number, error) {
+	intPart := priceStr
+	fracPart := ""
+	if i := strings.Index(priceStr, "."); i >= 0 {
+		intPart = priceStr[:i]
+		fracPart = priceStr[i+1:]
+		if len(fracPart) == 0 {
+			return "", fmt.Errorf("Expecting decimal number as price: %s", priceStr)
+		}
+	}
+	if len(intPart) == 0 || strings.Trim(intPart, "0123456789") != "" || strings.Trim(fracPart, "0123456789") != "" {
+		return "", fmt.Errorf("Expecting decimal number as price: %s", priceStr)
+	}
+
+	intPart = strings.TrimLeft(intPart, "0")
+	if len(intPart) == 0 {
+		intPart = "0"
+	}
+	fracPart = strings.TrimRight(fracPart, "0")
+	if len(fracPart) == 0 {
+		return json.Number(intPart), nil
+	}
+
+	return json.Number(intPart + "." + fracPart), nil
+}
@@ -1,22 +1,198 @@
 package main
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
+// testCreator is the identity of the submitter used in test invocations
+var testCreator = newTestCreator("City1MSP", "pub_user")
+
+// testCreatorID is the identity of the test creator as it is saved in data entry ads
+var testCreatorID = base64.StdEncoding.EncodeToString(testCreator)
+
+// testTransient is the transient data of test invocations with the key of the purchase supplied by the publisher
+var testTransient = map[string][]byte{"purchaseKey": []byte("0123456789abcdef0123456789abcdef"),
+	"oaepSeed": []byte("fedcba9876543210fedcba9876543210")}
+
+// newTestCreator - creates serialized identity with self-signed certificate
+func newTestCreator(mspID string, commonName string) []byte {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: commonName},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	certAsBytes, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	idBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certAsBytes})
+	creator, _ := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: idBytes})
+	return creator
+}
+
+// identityStub wraps MockStub because MockStub does not return any creator
+type identityStub struct {
+	*shim.MockStub
+	creator   []byte
+	args      [][]byte
+	transient map[string][]byte
+}
+
+func (stub *identityStub) GetCreator() ([]byte, error) {
+	return stub.creator, nil
+}
+
+func (stub *identityStub) GetTransient() (map[string][]byte, error) {
+	return stub.transient, nil
+}
+
+func (stub *identityStub) GetArgs() [][]byte {
+	return stub.args
+}
+
+func (stub *identityStub) GetStringArgs() []string {
+	strargs := make([]string, 0, len(stub.args))
+	for _, barg := range stub.args {
+		strargs = append(strargs, string(barg))
+	}
+	return strargs
+}
+
+func (stub *identityStub) GetFunctionAndParameters() (string, []string) {
+	allargs := stub.GetStringArgs()
+	if len(allargs) == 0 {
+		return "", []string{}
+	}
+	return allargs[0], allargs[1:]
+}
+
+// GetStateByPartialCompositeKeyWithPagination - MockStub does not support pagination. As in the ledger,
+// the bookmark is the key where the page starts and it is empty when there are no more keys
+func (stub *identityStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string,
+	pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	partialCompositeKey, err := stub.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	startKey := partialCompositeKey
+	if bookmark != "" {
+		startKey = bookmark
+	}
+	endKey := partialCompositeKey + string(utf8.MaxRune)
+
+	// Find the key where the next page starts
+	iterator := shim.NewMockStateRangeQueryIterator(stub.MockStub, startKey, endKey)
+	defer iterator.Close()
+	var fetchedRecordsCount int32
+	nextKey := ""
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if fetchedRecordsCount == pageSize {
+			nextKey = responseRange.Key
+			endKey = nextKey
+			break
+		}
+		fetchedRecordsCount++
+	}
+
+	metadata := &pb.QueryResponseMetadata{FetchedRecordsCount: fetchedRecordsCount, Bookmark: nextKey}
+	return shim.NewMockStateRangeQueryIterator(stub.MockStub, startKey, endKey), metadata, nil
+}
+
+// mockInvokeAs - invokes chaincode in the same way as MockInvoke but as the creator
+func mockInvokeAs(stub *shim.MockStub, creator []byte, uuid string, args [][]byte) pb.Response {
+	return mockInvokeWithTransient(stub, creator, uuid, args, nil)
+}
+
+// mockInvokeWithTransient - invokes the chaincode as the creator with the transient data of the proposal
+func mockInvokeWithTransient(stub *shim.MockStub, creator []byte, uuid string, args [][]byte,
+	transient map[string][]byte) pb.Response {
+	stub.MockTransactionStart(uuid)
+	res := new(Chaincode).Invoke(&identityStub{stub, creator, args, transient})
+	stub.MockTransactionEnd(uuid)
+	return res
+}
+
+// peerChaincode mocks chaincode on another channel. It returns the payload of the invoked function
+type peerChaincode struct {
+	payloads map[string][]byte
+}
+
+func (cc *peerChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (cc *peerChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, _ := stub.GetFunctionAndParameters()
+	payload, ok := cc.payloads[function]
+	if !ok {
+		return shim.Error("Received unknown function invocation")
+	}
+	return shim.Success(payload)
+}
+
+// newTestPublicKey - returns PEM encoded public key of the private key
+func newTestPublicKey(privateKey *rsa.PrivateKey) []byte {
+	publicKeyAsBytes, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyAsBytes})
+}
+
+// mockInitAs - initializes chaincode in the same way as MockInit but as the creator
+func mockInitAs(stub *shim.MockStub, creator []byte, uuid string, args [][]byte) pb.Response {
+	stub.MockTransactionStart(uuid)
+	res := new(Chaincode).Init(&identityStub{stub, creator, args, nil})
+	stub.MockTransactionEnd(uuid)
+	return res
+}
+
 func checkInit(t *testing.T, stub *shim.MockStub, args [][]byte) {
-	res := stub.MockInit("1", args)
+	res := mockInitAs(stub, testCreator, "1", args)
 	if res.Status != shim.OK {
 		fmt.Println("Init failed", string(res.Message))
 		t.Fail()
 	}
 }
 
+// registerTestPublisher - binds the publisher name to the creator by the administrator (test creator)
+func registerTestPublisher(t *testing.T, stub *shim.MockStub, publisher string, creator []byte) {
+	args := [][]byte{[]byte("registerPublisher"), []byte(publisher), []byte(base64.StdEncoding.EncodeToString(creator))}
+	checkInvoke(t, stub, args)
+}
+
+func checkState(t *testing.T, stub *shim.MockStub, name string, value string) {
+	bytes := stub.State[name]
+	if bytes == nil {
+		fmt.Println("State", name, "failed to get value")
+		t.Fail()
+	}
+	if string(bytes) != value {
+		fmt.Println("State value", name, "was", string(bytes), "instead required", value)
+		t.Fail()
+	}
+}
+
 func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
-	res := stub.MockInvoke("1", args)
+	res := mockInvokeWithTransient(stub, testCreator, "1", args, testTransient)
 	if res.Status != shim.OK {
 		fmt.Println("Invoke", args, "failed", string(res.Message))
 		t.Fail()
@@ -24,7 +200,7 @@ func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
 }
 
 func checkInvokeFail(t *testing.T, stub *shim.MockStub, args [][]byte) {
-	res := stub.MockInvoke("1", args)
+	res := mockInvokeWithTransient(stub, testCreator, "1", args, testTransient)
 	if res.Status == shim.OK {
 		fmt.Println("Invoke", args, "should fail but did not", string(res.Payload))
 		t.Fail()
@@ -32,7 +208,7 @@ func checkInvokeFail(t *testing.T, stub *shim.MockStub, args [][]byte) {
 }
 
 func checkInvokeResponse(t *testing.T, stub *shim.MockStub, args [][]byte, expectedPayload string) {
-	res := stub.MockInvoke("1", args)
+	res := mockInvokeWithTransient(stub, testCreator, "1", args, testTransient)
 	if res.Status != shim.OK {
 		fmt.Println("Invoke", args, "failed", string(res.Message))
 		t.Fail()
@@ -45,7 +221,7 @@ func checkInvokeResponse(t *testing.T, stub *shim.MockStub, args [][]byte, expec
 }
 
 func checkInvokeResponseFail(t *testing.T, stub *shim.MockStub, args [][]byte, expectedMessage string) {
-	res := stub.MockInvoke("1", args)
+	res := mockInvokeWithTransient(stub, testCreator, "1", args, testTransient)
 	if res.Status == shim.OK {
 		fmt.Println("Invoke", args, "should fail")
 		fmt.Println("Instead got payload:", string(res.Payload))
@@ -64,6 +240,48 @@ func Test_Init(t *testing.T) {
 
 	// Init should always success
 	checkInit(t, stub, [][]byte{[]byte("1")})
+
+	// The submitter of the instantiation should be the administrator saved as serialized identity
+	adminKey, _ := stub.CreateCompositeKey("Admin", []string{})
+	checkState(t, stub, adminKey, testCreatorID)
+
+	// It should not replace the administrator by the submitter of the upgrade
+	otherCreator := newTestCreator("City2MSP", "other_user")
+	res := mockInitAs(stub, otherCreator, "2", [][]byte{})
+	if res.Status != shim.OK {
+		fmt.Println("Init failed", string(res.Message))
+		t.Fail()
+	}
+	checkState(t, stub, adminKey, testCreatorID)
+	args := [][]byte{[]byte("setTrustedChaincode"), []byte("data"), []byte("channel1"), []byte("chaincode_data")}
+	res = mockInvokeAs(stub, otherCreator, "3", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail", string(res.Message))
+		t.Fail()
+	}
+
+	// It should accept the administrator with renewed certificate
+	renewedCreator := newTestCreator("City1MSP", "pub_user")
+	res = mockInvokeAs(stub, renewedCreator, "4", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+
+	// It should accept the administrator saved as "MSPID::CommonName" before
+	// and replace it by serialized identity when the administrator upgrades the chaincode
+	stub.MockTransactionStart("5")
+	stub.PutState(adminKey, []byte("City1MSP::pub_user"))
+	stub.MockTransactionEnd("5")
+	res = mockInitAs(stub, otherCreator, "6", [][]byte{})
+	if res.Status != shim.OK {
+		fmt.Println("Init failed", string(res.Message))
+		t.Fail()
+	}
+	checkState(t, stub, adminKey, "City1MSP::pub_user")
+	checkInvoke(t, stub, args)
+	checkInit(t, stub, [][]byte{})
+	checkState(t, stub, adminKey, testCreatorID)
 }
 
 func Test_InvokeFail(t *testing.T) {
@@ -80,6 +298,7 @@ func Test_createDataEntryAd(t *testing.T) {
 
 	// Init
 	checkInit(t, stub, [][]byte{[]byte("20")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
 	// create test data entry ad
 	args := [][]byte{[]byte("createDataEntryAd"),
 		[]byte("1"), []byte("test_data"), []byte("???"), []byte("Unit"),
@@ -90,7 +309,7 @@ func Test_createDataEntryAd(t *testing.T) {
 	args = [][]byte{[]byte("getDataAdByIDAndTime"), []byte("1"), []byte("20181212152030")}
 	expectedPayload := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"1\"" +
 		",\"Description\":\"test_data\",\"Value\":\"???\",\"Unit\":\"Unit\"," +
-		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\"," +
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
 		"\"Price\":1,\"AccountNo\":\"2\"}"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 
@@ -210,7 +429,25 @@ func Test_createDataEntryAd(t *testing.T) {
 		[]byte("2"), []byte("test_data"), []byte("???"), []byte("Unit"),
 		[]byte("20181212152030"), []byte("pub_name"), []byte("lol"), []byte("2")}
 	// it should not save to the state and it should fail
-	expectedMessage = "Expecting positiv integer or zero as price."
+	expectedMessage = "Expecting positiv decimal number or zero as price."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should create data entry ad with decimal price formatted as amount of tokens
+	args = [][]byte{[]byte("createDataEntryAd"),
+		[]byte("2"), []byte("test_data"), []byte("???"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("pub_name"), []byte("000.00250"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "")
+	args = [][]byte{[]byte("getDataAdByIDAndTime"), []byte("2"), []byte("20181212152030")}
+	expectedPayload = "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"2\"" +
+		",\"Description\":\"test_data\",\"Value\":\"???\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
+		"\"Price\":0.0025,\"AccountNo\":\"2\"}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail to createDataEntryAd if price is not decimal number
+	args = [][]byte{[]byte("createDataEntryAd"),
+		[]byte("3"), []byte("test_data"), []byte("???"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("pub_name"), []byte("1e3"), []byte("2")}
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 }
 
@@ -220,6 +457,7 @@ func Test_getDataAdByIDAndTime(t *testing.T) {
 
 	// Init
 	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
 	// create test data entry ad
 	args := [][]byte{[]byte("createDataEntryAd"),
 		[]byte("1"), []byte("test_data"), []byte("10"), []byte("Unit"),
@@ -229,7 +467,7 @@ func Test_getDataAdByIDAndTime(t *testing.T) {
 
 	expectedPayload := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"1\"" +
 		",\"Description\":\"test_data\",\"Value\":\"10\",\"Unit\":\"Unit\"," +
-		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\"," +
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
 		"\"Price\":0,\"AccountNo\":\"2\"}"
 
 	// It should get the same expected payload
@@ -282,6 +520,7 @@ func Test_getDataAdByPub(t *testing.T) {
 
 	// Init
 	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
 	// create test data entry ad
 	args := [][]byte{[]byte("createDataEntryAd"),
 		[]byte("1"), []byte("test_data"), []byte("???"), []byte("Unit"),
@@ -290,7 +529,7 @@ func Test_getDataAdByPub(t *testing.T) {
 	checkInvoke(t, stub, args)
 	expectedPayload := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"1\"" +
 		",\"Description\":\"test_data\",\"Value\":\"???\",\"Unit\":\"Unit\"," +
-		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\"," +
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
 		"\"Price\":10,\"AccountNo\":\"2\"}"
 
 	// It should get the same expected payload
@@ -305,7 +544,7 @@ func Test_getDataAdByPub(t *testing.T) {
 	checkInvoke(t, stub, args)
 	expectedPayload2 := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"2\"" +
 		",\"Description\":\"test_data\",\"Value\":\"100\",\"Unit\":\"Unit\"," +
-		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\"," +
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
 		"\"Price\":10,\"AccountNo\":\"2\"}"
 
 	// It should get both entry as JSON array
@@ -336,6 +575,7 @@ func Test_getAllDataAdByID(t *testing.T) {
 
 	// Init
 	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
 	// create test data entry ad
 	args := [][]byte{[]byte("createDataEntryAd"),
 		[]byte("1"), []byte("test_data"), []byte("???"), []byte("Unit"),
@@ -343,7 +583,7 @@ func Test_getAllDataAdByID(t *testing.T) {
 
 	expectedPayload := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"1\"" +
 		",\"Description\":\"test_data\",\"Value\":\"???\",\"Unit\":\"Unit\"," +
-		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\"," +
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
 		"\"Price\":10,\"AccountNo\":\"2\"}"
 	// it should save to the state
 	checkInvoke(t, stub, args)
@@ -353,7 +593,7 @@ func Test_getAllDataAdByID(t *testing.T) {
 
 	expectedPayload2 := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"1\"" +
 		",\"Description\":\"test_data\",\"Value\":\"???\",\"Unit\":\"Unit\"," +
-		"\"CreationTime\":20181212152031,\"Publisher\":\"pub_name\"," +
+		"\"CreationTime\":20181212152031,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
 		"\"Price\":10,\"AccountNo\":\"2\"}"
 	// it should save to the state
 	checkInvoke(t, stub, args)
@@ -380,6 +620,7 @@ func Test_getLatestDataAdByID(t *testing.T) {
 
 	// Init
 	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
 	// create test data entry ad
 	args := [][]byte{[]byte("createDataEntryAd"),
 		[]byte("1"), []byte("test_data"), []byte("???"), []byte("Unit"),
@@ -398,7 +639,7 @@ func Test_getLatestDataAdByID(t *testing.T) {
 	args = [][]byte{[]byte("getLatestDataAdByID"), []byte("1")}
 	expectedPayload := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"1\"" +
 		",\"Description\":\"test_data\",\"Value\":\"???\",\"Unit\":\"Unit\"," +
-		"\"CreationTime\":20181212152031,\"Publisher\":\"pub_name\"," +
+		"\"CreationTime\":20181212152031,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
 		"\"Price\":10,\"AccountNo\":\"2\"}"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 
@@ -498,6 +739,81 @@ func Test_revealPaidData(t *testing.T) {
 	expectedMessage = "Expecting positiv integer or zero as creation time."
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
+	// It should fail to revealPaidData when trusted chaincodes are not set
+	args = [][]byte{[]byte("revealPaidData"),
+		[]byte("channel1"), []byte("chaincode_data"), []byte("1"), []byte("20181212152030"),
+		[]byte("channel3"), []byte("chaincode_tokens"), []byte("TxID-1")}
+	expectedMessage = "Trusted chaincode for data is not set."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// Init with trusted chaincodes
+	stub = shim.NewMockStub("init_test", cc)
+	checkInit(t, stub, [][]byte{[]byte("channel1"), []byte("chaincode_data"),
+		[]byte("channel3"), []byte("chaincode_tokens")})
+
+	// It should fail to revealPaidData from chaincode that is not trusted
+	args = [][]byte{[]byte("revealPaidData"),
+		[]byte("channel1"), []byte("fake_data"), []byte("1"), []byte("20181212152030"),
+		[]byte("channel3"), []byte("chaincode_tokens"), []byte("TxID-1")}
+	expectedMessage = "Chaincode fake_data on channel channel1 is not trusted for data."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to revealPaidData with Tx from chaincode that is not trusted
+	args = [][]byte{[]byte("revealPaidData"),
+		[]byte("channel1"), []byte("chaincode_data"), []byte("1"), []byte("20181212152030"),
+		[]byte("channel4"), []byte("chaincode_tokens"), []byte("TxID-1")}
+	expectedMessage = "Chaincode chaincode_tokens on channel channel4 is not trusted for tokens."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_setTrustedChaincode(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("init_test", cc)
+
+	// It should Init with trusted chaincodes
+	checkInit(t, stub, [][]byte{[]byte("channel1"), []byte("chaincode_data"),
+		[]byte("channel3"), []byte("chaincode_tokens")})
+	args := [][]byte{[]byte("getTrustedChaincode"), []byte("data")}
+	expectedPayload := "{\"RecordType\":\"COUNTERPART\",\"Role\":\"data\",\"Channel\":\"channel1\",\"ChaincodeName\":\"chaincode_data\"}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should change trusted chaincode by the administrator
+	args = [][]byte{[]byte("setTrustedChaincode"), []byte("tokens"), []byte("channel4"), []byte("chaincode_tokens2")}
+	expectedPayload = "Trusted chaincode set"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getTrustedChaincode"), []byte("tokens")}
+	expectedPayload = "{\"RecordType\":\"COUNTERPART\",\"Role\":\"tokens\",\"Channel\":\"channel4\",\"ChaincodeName\":\"chaincode_tokens2\"}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail to change trusted chaincode by another identity
+	args = [][]byte{[]byte("setTrustedChaincode"), []byte("tokens"), []byte("channel5"), []byte("fake_tokens")}
+	res := mockInvokeAs(stub, newTestCreator("City2MSP", "buyer"), "1", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail with unknown role
+	args = [][]byte{[]byte("setTrustedChaincode"), []byte("lol"), []byte("channel5"), []byte("chaincode")}
+	expectedMessage := "Expecting data or tokens as role of the chaincode"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with empty string arg
+	args = [][]byte{[]byte("setTrustedChaincode"), []byte("data"), []byte(""), []byte("chaincode")}
+	expectedMessage = "Argument at position 2 must be a non-empty string"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with less than 3 args
+	args = [][]byte{[]byte("setTrustedChaincode"), []byte("data"), []byte("channel1")}
+	expectedMessage = "Incorrect number of arguments. Expecting role (data|tokens), channel and chaincode name"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to get trusted chaincode that is not set
+	stub = shim.NewMockStub("init_test", cc)
+	checkInit(t, stub, [][]byte{})
+	args = [][]byte{[]byte("getTrustedChaincode"), []byte("data")}
+	expectedMessage = "Trusted chaincode for data is not set."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
 }
 
 // For this function we cannot test more because of the MockStub limitations
@@ -518,3 +834,527 @@ func Test_checkTXState(t *testing.T) {
 	expectedMessage = "Argument at position 1 must be a non-empty string"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 }
+
+func Test_getDataAdByIDInTimeRange(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("init_test", cc)
+
+	// Init
+	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
+	// create test data at times 5, 10 and 30
+	for _, creationTime := range []string{"30", "5", "10"} {
+		args := [][]byte{[]byte("createDataEntryAd"),
+			[]byte("1"), []byte("test_data"), []byte("???"), []byte("Unit"),
+			[]byte(creationTime), []byte("pub_name"), []byte(creationTime), []byte("2")}
+		checkInvokeResponse(t, stub, args, "")
+	}
+	expectedPayload5 := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"1\"" +
+		",\"Description\":\"test_data\",\"Value\":\"???\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":5,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
+		"\"Price\":5,\"AccountNo\":\"2\"}"
+	expectedPayload10 := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"1\"" +
+		",\"Description\":\"test_data\",\"Value\":\"???\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":10,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
+		"\"Price\":10,\"AccountNo\":\"2\"}"
+
+	// It should return entries within the window in chronological order
+	args := [][]byte{[]byte("getDataAdByIDInTimeRange"), []byte("1"), []byte("5"), []byte("10")}
+	checkInvokeResponse(t, stub, args, "["+expectedPayload5+","+expectedPayload10+"]")
+
+	// It should return empty array if there is no entry in the window
+	args = [][]byte{[]byte("getDataAdByIDInTimeRange"), []byte("1"), []byte("11"), []byte("29")}
+	checkInvokeResponse(t, stub, args, "[]")
+
+	// It should index the entries by creation time padded with zeros
+	timeIndexKey, _ := stub.CreateCompositeKey("ID~PaddedTime", []string{"1", "00000000000000000005"})
+	checkState(t, stub, timeIndexKey, "\x00")
+
+	// It should scan the entries of ID created before the time index until the ID is migrated
+	legacyEntry := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"2\"" +
+		",\"Description\":\"test_data\",\"Value\":\"???\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":9,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
+		"\"Price\":9,\"AccountNo\":\"2\"}"
+	legacyKey, _ := stub.CreateCompositeKey("ID~Time", []string{"2", "9"})
+	stub.MockTransactionStart("2")
+	stub.PutState(legacyKey, []byte(legacyEntry))
+	stub.MockTransactionEnd("2")
+	args = [][]byte{[]byte("createDataEntryAd"),
+		[]byte("2"), []byte("test_data"), []byte("???"), []byte("Unit"),
+		[]byte("10"), []byte("pub_name"), []byte("10"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "")
+	newEntry := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"2\"" +
+		",\"Description\":\"test_data\",\"Value\":\"???\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":10,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
+		"\"Price\":10,\"AccountNo\":\"2\"}"
+	args = [][]byte{[]byte("getDataAdByIDInTimeRange"), []byte("2"), []byte("0"), []byte("100")}
+	checkInvokeResponse(t, stub, args, "["+legacyEntry+","+newEntry+"]")
+
+	// It should migrate the ID by the administrator only
+	args = [][]byte{[]byte("migrateTimeIndex"), []byte("2"), []byte("1")}
+	res := mockInvokeAs(stub, newTestCreator("City2MSP", "other_user"), "3", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail", res.Message)
+		t.Fail()
+	}
+
+	// It should migrate the ID in pages and mark it as indexed after the last page only
+	nextKey, _ := stub.CreateCompositeKey("ID~Time", []string{"2", "9"})
+	bookmark := base64.StdEncoding.EncodeToString([]byte(nextKey))
+	checkInvokeResponse(t, stub, args, "{\"migrated\":1,\"bookmark\":\""+bookmark+"\",\"hasMore\":true}")
+	markerKey, _ := stub.CreateCompositeKey("TimeIndex~ID", []string{"2"})
+	if stub.State[markerKey] != nil {
+		fmt.Println("ID 2 should not be marked as indexed before the last page")
+		t.Fail()
+	}
+	args = [][]byte{[]byte("migrateTimeIndex"), []byte("2"), []byte("1"), []byte(bookmark)}
+	checkInvokeResponse(t, stub, args, "{\"migrated\":1,\"bookmark\":\"\",\"hasMore\":false}")
+	timeIndexKey, _ = stub.CreateCompositeKey("ID~PaddedTime", []string{"2", "00000000000000000009"})
+	checkState(t, stub, timeIndexKey, "\x00")
+	checkState(t, stub, markerKey, "\x00")
+
+	// It should fail if the page size is out of bounds or the bookmark belongs to another ID
+	args = [][]byte{[]byte("migrateTimeIndex"), []byte("2"), []byte("0")}
+	checkInvokeResponseFail(t, stub, args, "Expecting page size from 1 to 500.")
+	args = [][]byte{[]byte("migrateTimeIndex"), []byte("1"), []byte("1"), []byte(bookmark)}
+	checkInvokeResponseFail(t, stub, args, "Invalid bookmark.")
+	args = [][]byte{[]byte("getDataAdByIDInTimeRange"), []byte("2"), []byte("0"), []byte("100")}
+	checkInvokeResponse(t, stub, args, "["+legacyEntry+","+newEntry+"]")
+	args = [][]byte{[]byte("getDataAdByIDInTimeRange"), []byte("2"), []byte("10"), []byte("10")}
+	checkInvokeResponse(t, stub, args, "["+newEntry+"]")
+
+	// It should fail if from time is later than to time
+	args = [][]byte{[]byte("getDataAdByIDInTimeRange"), []byte("1"), []byte("10"), []byte("5")}
+	expectedMessage := "From time cannot be later than to time."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail if time is not uint
+	args = [][]byte{[]byte("getDataAdByIDInTimeRange"), []byte("1"), []byte("-5"), []byte("10")}
+	expectedMessage = "Expecting positiv integer or zero as from time."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+	args = [][]byte{[]byte("getDataAdByIDInTimeRange"), []byte("1"), []byte("5"), []byte("lol")}
+	expectedMessage = "Expecting positiv integer or zero as to time."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with empty arg
+	args = [][]byte{[]byte("getDataAdByIDInTimeRange"), []byte("1"), []byte(""), []byte("10")}
+	expectedMessage = "Argument at position 2 must be a non-empty string"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with less than 3 args
+	args = [][]byte{[]byte("getDataAdByIDInTimeRange"), []byte("1"), []byte("5")}
+	expectedMessage = "Incorrect number of arguments. Expecting data entry Id, from time and to time"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_getAllDataAdByIDWithPagination(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("init_test", cc)
+
+	// Init
+	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
+	// create three test data entries
+	for _, creationTime := range []string{"1", "2", "3"} {
+		args := [][]byte{[]byte("createDataEntryAd"),
+			[]byte("1"), []byte("test_data"), []byte("???"), []byte("Unit"),
+			[]byte(creationTime), []byte("pub_name"), []byte("1"), []byte("2")}
+		checkInvokeResponse(t, stub, args, "")
+	}
+	expectedPayload3 := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"1\"" +
+		",\"Description\":\"test_data\",\"Value\":\"???\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":3,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
+		"\"Price\":1,\"AccountNo\":\"2\"}"
+
+	// It should return the first page with two entries and bookmark
+	args := [][]byte{[]byte("getAllDataAdByIDWithPagination"), []byte("1"), []byte("2")}
+	res := mockInvokeAs(stub, nil, "1", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.FailNow()
+	}
+	var page struct {
+		Records  []json.RawMessage `json:"records"`
+		Bookmark string            `json:"bookmark"`
+		HasMore  bool              `json:"hasMore"`
+	}
+	err := json.Unmarshal(res.Payload, &page)
+	if err != nil || len(page.Records) != 2 || !page.HasMore || page.Bookmark == "" {
+		fmt.Println("Unexpected first page:", string(res.Payload))
+		t.FailNow()
+	}
+
+	// It should return the last entry on the second page
+	args = [][]byte{[]byte("getAllDataAdByIDWithPagination"), []byte("1"), []byte("2"), []byte(page.Bookmark)}
+	expectedPayload := "{\"records\":[" + expectedPayload3 + "],\"bookmark\":\"\",\"hasMore\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should return empty page for unknown data entry
+	args = [][]byte{[]byte("getAllDataAdByIDWithPagination"), []byte("2"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "{\"records\":[],\"bookmark\":\"\",\"hasMore\":false}")
+
+	// It should fail with invalid page size
+	args = [][]byte{[]byte("getAllDataAdByIDWithPagination"), []byte("1"), []byte("0")}
+	expectedMessage := "Expecting positive integer as page size."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with invalid bookmark
+	args = [][]byte{[]byte("getAllDataAdByIDWithPagination"), []byte("1"), []byte("2"), []byte("%%%")}
+	expectedMessage = "Invalid bookmark."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with less than 2 args
+	args = [][]byte{[]byte("getAllDataAdByIDWithPagination"), []byte("1")}
+	expectedMessage = "Incorrect number of arguments. Expecting data entry Id, page size and optional bookmark"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_getDataAdByPubWithPagination(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("init_test", cc)
+
+	// Init
+	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
+	// create test data of two different entries
+	for _, dataEntryID := range []string{"1", "2"} {
+		args := [][]byte{[]byte("createDataEntryAd"),
+			[]byte(dataEntryID), []byte("test_data"), []byte("???"), []byte("Unit"),
+			[]byte("20181212152030"), []byte("pub_name"), []byte("1"), []byte("2")}
+		checkInvokeResponse(t, stub, args, "")
+	}
+	expectedPayload := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"1\"" +
+		",\"Description\":\"test_data\",\"Value\":\"???\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
+		"\"Price\":1,\"AccountNo\":\"2\"}"
+	expectedPayload2 := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"2\"" +
+		",\"Description\":\"test_data\",\"Value\":\"???\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
+		"\"Price\":1,\"AccountNo\":\"2\"}"
+
+	// It should return all entries if they fit to the page
+	args := [][]byte{[]byte("getDataAdByPubWithPagination"), []byte("pub_name"), []byte("10"), []byte("")}
+	checkInvokeResponse(t, stub, args,
+		"{\"records\":["+expectedPayload+","+expectedPayload2+"],\"bookmark\":\"\",\"hasMore\":false}")
+
+	// It should fail with empty arg
+	args = [][]byte{[]byte("getDataAdByPubWithPagination"), []byte(""), []byte("10")}
+	expectedMessage := "Argument at position 1 must be a non-empty string"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with more than 3 args
+	args = [][]byte{[]byte("getDataAdByPubWithPagination"), []byte("pub_name"), []byte("10"), []byte(""), []byte("")}
+	expectedMessage = "Incorrect number of arguments. Expecting publisher, page size and optional bookmark"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_createDataEntryAdPublisherIdentity(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("init_test", cc)
+
+	// Init
+	checkInit(t, stub, [][]byte{[]byte("1")})
+
+	// It should bind publisher name that is not registered to the identity publishing under it first
+	args := [][]byte{[]byte("createDataEntryAd"),
+		[]byte("11"), []byte("test_data"), []byte("???"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("first_pub"), []byte("1"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "")
+	firstPublisherKey, _ := stub.CreateCompositeKey("Publisher~Identity", []string{"first_pub"})
+	checkState(t, stub, firstPublisherKey, testCreatorID)
+
+	// It should not create data under publisher name bound to the first identity by another identity
+	otherCreator := newTestCreator("City2MSP", "other_user")
+	args = [][]byte{[]byte("createDataEntryAd"),
+		[]byte("12"), []byte("test_data"), []byte("???"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("first_pub"), []byte("1"), []byte("2")}
+	res := mockInvokeAs(stub, otherCreator, "12", args)
+	expectedMessage := "Publisher verification failed: Publisher first_pub is bound to another identity"
+	if res.Status == shim.OK || res.Message != expectedMessage {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, res.Message)
+		t.Fail()
+	}
+
+	// It should not register publisher by other identity than the administrator
+	args = [][]byte{[]byte("registerPublisher"), []byte("pub_name"), []byte(base64.StdEncoding.EncodeToString(otherCreator))}
+	res = mockInvokeAs(stub, otherCreator, "1", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, res.Message)
+		t.Fail()
+	}
+
+	// It should not register publisher with identity that is not serialized identity
+	args = [][]byte{[]byte("registerPublisher"), []byte("pub_name"), []byte("City1MSP::pub_user")}
+	expectedMessage = "Expecting base64 encoded serialized identity."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should create data under publisher name registered to the test creator
+	registerTestPublisher(t, stub, "pub_name", testCreator)
+	args = [][]byte{[]byte("createDataEntryAd"),
+		[]byte("1"), []byte("test_data"), []byte("???"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("pub_name"), []byte("1"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "")
+	publisherKey, _ := stub.CreateCompositeKey("Publisher~Identity", []string{"pub_name"})
+	checkState(t, stub, publisherKey, testCreatorID)
+
+	// It should not create data under publisher name of another identity
+	args = [][]byte{[]byte("createDataEntryAd"),
+		[]byte("2"), []byte("test_data"), []byte("???"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("pub_name"), []byte("1"), []byte("2")}
+	res = mockInvokeAs(stub, otherCreator, "2", args)
+	expectedMessage = "Publisher verification failed: Publisher pub_name is bound to another identity"
+	if res.Status == shim.OK || res.Message != expectedMessage {
+		fmt.Println("Expected message:", expectedMessage)
+		fmt.Println("Instead got this:", res.Message)
+		t.Fail()
+	}
+
+	// It should create data under publisher name rebound to another identity by the administrator
+	registerTestPublisher(t, stub, "pub_name", otherCreator)
+	res = mockInvokeAs(stub, otherCreator, "3", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+
+	// It should accept renewed certificate of the registered identity
+	args = [][]byte{[]byte("createDataEntryAd"),
+		[]byte("3"), []byte("test_data"), []byte("???"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("pub_name"), []byte("1"), []byte("2")}
+	res = mockInvokeAs(stub, newTestCreator("City2MSP", "other_user"), "4", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+
+	// It should migrate publisher bound as MSPID::CommonName to the serialized identity
+	legacyKey, _ := stub.CreateCompositeKey("Publisher~Identity", []string{"legacy_pub"})
+	stub.MockTransactionStart("5")
+	stub.PutState(legacyKey, []byte("City1MSP::pub_user"))
+	stub.MockTransactionEnd("5")
+	args = [][]byte{[]byte("createDataEntryAd"),
+		[]byte("4"), []byte("test_data"), []byte("???"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("legacy_pub"), []byte("1"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "")
+	checkState(t, stub, legacyKey, testCreatorID)
+
+	// It should not create data without creator certificate
+	args = [][]byte{[]byte("createDataEntryAd"),
+		[]byte("5"), []byte("test_data"), []byte("???"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("pub_name"), []byte("1"), []byte("2")}
+	res = mockInvokeAs(stub, nil, "6", args)
+	if res.Status == shim.OK {
+		fmt.Println("Invoke", args, "should fail")
+		t.Fail()
+	}
+}
+
+func Test_registerBuyerKey(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("init_test", cc)
+
+	// Init
+	checkInit(t, stub, [][]byte{[]byte("1")})
+
+	// It should register public key of the caller
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	publicKey := newTestPublicKey(privateKey)
+	args := [][]byte{[]byte("registerBuyerKey"), publicKey}
+	buyerKey, _ := json.Marshal(&BuyerKey{"BUYERKEY", "City1MSP::pub_user", string(publicKey)})
+	checkInvokeResponse(t, stub, args, string(buyerKey))
+
+	// It should fail with key that is not PEM encoded
+	args = [][]byte{[]byte("registerBuyerKey"), []byte("lol")}
+	expectedMessage := "Expecting PEM encoded RSA public key."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with key that is not RSA
+	ecdsaKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecdsaPublicKey, _ := x509.MarshalPKIXPublicKey(&ecdsaKey.PublicKey)
+	args = [][]byte{[]byte("registerBuyerKey"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: ecdsaPublicKey})}
+	expectedMessage = "Expecting PEM encoded RSA public key."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with short key
+	shortKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	args = [][]byte{[]byte("registerBuyerKey"), newTestPublicKey(shortKey)}
+	expectedMessage = "Expecting RSA public key with at least 2048 bits."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with empty string arg
+	args = [][]byte{[]byte("registerBuyerKey"), []byte("")}
+	expectedMessage = "Argument at position 1 must be a non-empty string"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_revealPaidDataEncrypted(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("init_test", cc)
+	buyer := newTestCreator("City2MSP", "buyer")
+
+	// Mock the data and tokens chaincodes
+	dataEntry, _ := json.Marshal(&DataEntry{"DATA_ENTRY", "1", "test_data", "42", "Unit", 20181212152030,
+		"pub_name", "City1MSP::pub_user"})
+	txDetails, _ := json.Marshal(&TxDetails{"TxID-1", "2", "1", "10", "PendingTx", "2018-12-12T15:20:30Z",
+		time.Now().Add(time.Hour).UTC().Format(time.RFC3339), ""})
+	account, _ := json.Marshal(&Account{"2", base64.StdEncoding.EncodeToString(buyer)})
+	data := &peerChaincode{map[string][]byte{"getDataByIDAndTime": dataEntry}}
+	stub.MockPeerChaincode("chaincode_data/channel1", shim.NewMockStub("chaincode_data", data))
+	tokens := &peerChaincode{map[string][]byte{"getTxDetails": txDetails, "getAccountByID": account}}
+	stub.MockPeerChaincode("chaincode_tokens/channel3", shim.NewMockStub("chaincode_tokens", tokens))
+
+	// Init with trusted chaincodes and create data entry ad
+	checkInit(t, stub, [][]byte{[]byte("channel1"), []byte("chaincode_data"),
+		[]byte("channel3"), []byte("chaincode_tokens")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
+	args := [][]byte{[]byte("createDataEntryAd"),
+		[]byte("1"), []byte("test_data"), []byte("???"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("pub_name"), []byte("10"), []byte("1")}
+	checkInvoke(t, stub, args)
+
+	// register public key of the buyer
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	res := mockInvokeAs(stub, buyer, "1", [][]byte{[]byte("registerBuyerKey"), newTestPublicKey(privateKey)})
+	if res.Status != shim.OK {
+		fmt.Println("Invoke registerBuyerKey failed", string(res.Message))
+		t.FailNow()
+	}
+
+	// It should fail to reveal data without the key of the purchase
+	args = [][]byte{[]byte("revealPaidData"),
+		[]byte("channel1"), []byte("chaincode_data"), []byte("1"), []byte("20181212152030"),
+		[]byte("channel3"), []byte("chaincode_tokens"), []byte("TxID-1")}
+	for _, invalid := range []struct {
+		transient map[string][]byte
+		message   string
+	}{
+		{nil, "Expecting 32 bytes key in transient field purchaseKey."},
+		{map[string][]byte{"purchaseKey": []byte("short"), "oaepSeed": testTransient["oaepSeed"]},
+			"Expecting 32 bytes key in transient field purchaseKey."},
+		{map[string][]byte{"purchaseKey": testTransient["purchaseKey"]},
+			"Expecting 32 bytes seed in transient field oaepSeed."},
+	} {
+		res = mockInvokeWithTransient(stub, testCreator, "1", args, invalid.transient)
+		if res.Status == shim.OK || res.Message != invalid.message {
+			fmt.Println("Invoke", args, "should fail", string(res.Message))
+			t.Fail()
+		}
+	}
+
+	// It should fail to reveal data by other identity than the publisher, even by the buyer
+	for _, caller := range [][]byte{buyer, newTestCreator("City2MSP", "other_user")} {
+		res = mockInvokeWithTransient(stub, caller, "1", args, testTransient)
+		if res.Status == shim.OK || res.Message != "Only the publisher of the data entry ad can reveal the paid data." {
+			fmt.Println("Invoke", args, "should fail", string(res.Message))
+			t.Fail()
+		}
+	}
+
+	// It should reveal data encrypted for the buyer
+	res = mockInvokeWithTransient(stub, testCreator, "1", args, testTransient)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.FailNow()
+	}
+	var purchase Purchase
+	err := json.Unmarshal(res.Payload, &purchase)
+	if err != nil || purchase.TxID != "TxID-1" || purchase.DataEntryID != "1" || purchase.BuyerID != "City2MSP::buyer" {
+		fmt.Println("Unexpected purchase:", string(res.Payload))
+		t.FailNow()
+	}
+
+	// It should be possible to decrypt the value by the private key of the buyer
+	encryptedKey, _ := base64.StdEncoding.DecodeString(purchase.EncryptedKey)
+	nonce, _ := base64.StdEncoding.DecodeString(purchase.Nonce)
+	encryptedValue, _ := base64.StdEncoding.DecodeString(purchase.EncryptedValue)
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, encryptedKey, nil)
+	if err != nil || !bytes.Equal(key, testTransient["purchaseKey"]) {
+		fmt.Println("Failed to decrypt the key of the purchase:", err)
+		t.FailNow()
+	}
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	value, err := gcm.Open(nil, nonce, encryptedValue, nil)
+	if err != nil || string(value) != "42" {
+		fmt.Println("Failed to decrypt the value:", err, string(value))
+		t.Fail()
+	}
+
+	// It should encrypt the value equally on every endorsing peer
+	otherKey, otherNonce, otherValue, err := encryptForBuyer(string(newTestPublicKey(privateKey)),
+		testTransient["purchaseKey"], testTransient["oaepSeed"], "1", []byte("42"))
+	if err != nil || !bytes.Equal(otherKey, encryptedKey) || !bytes.Equal(otherNonce, nonce) ||
+		!bytes.Equal(otherValue, encryptedValue) {
+		fmt.Println("Unexpected encryption of the purchase", err)
+		t.Fail()
+	}
+
+	// It should return the purchase by TxID
+	args = [][]byte{[]byte("getPurchase"), []byte("TxID-1")}
+	checkInvokeResponse(t, stub, args, string(res.Payload))
+
+	// It should keep the placeholder value in the data entry ad
+	args = [][]byte{[]byte("getDataAdByIDAndTime"), []byte("1"), []byte("20181212152030")}
+	expectedPayload := "{\"RecordType\":\"DATA_ENTRY_AD\",\"DataEntryID\":\"1\"" +
+		",\"Description\":\"test_data\",\"Value\":\"???\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"," +
+		"\"Price\":10,\"AccountNo\":\"1\"}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail to reveal data with the same Tx twice
+	args = [][]byte{[]byte("revealPaidData"),
+		[]byte("channel1"), []byte("chaincode_data"), []byte("1"), []byte("20181212152030"),
+		[]byte("channel3"), []byte("chaincode_tokens"), []byte("TxID-1")}
+	expectedMessage := "Transaction was already used for data entry ID: 1 CreationTime:20181212152030"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to reveal data when the buyer has not registered public key
+	account, _ = json.Marshal(&Account{"3", base64.StdEncoding.EncodeToString(newTestCreator("City2MSP", "other_buyer"))})
+	tokens.payloads["getAccountByID"] = account
+	args = [][]byte{[]byte("revealPaidData"),
+		[]byte("channel1"), []byte("chaincode_data"), []byte("1"), []byte("20181212152030"),
+		[]byte("channel3"), []byte("chaincode_tokens"), []byte("TxID-2")}
+	expectedMessage = "Buyer City2MSP::other_buyer has not registered public key."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should reveal data encrypted for the spender who paid within allowance of the sender
+	spenderTxDetails, _ := json.Marshal(&TxDetails{"TxID-4", "3", "1", "10", "PendingTx", "2018-12-12T15:20:30Z",
+		time.Now().Add(time.Hour).UTC().Format(time.RFC3339), base64.StdEncoding.EncodeToString(buyer)})
+	tokens.payloads["getTxDetails"] = spenderTxDetails
+	args = [][]byte{[]byte("revealPaidData"),
+		[]byte("channel1"), []byte("chaincode_data"), []byte("1"), []byte("20181212152030"),
+		[]byte("channel3"), []byte("chaincode_tokens"), []byte("TxID-4")}
+	res = mockInvokeWithTransient(stub, testCreator, "2", args, testTransient)
+	err = json.Unmarshal(res.Payload, &purchase)
+	if res.Status != shim.OK || err != nil || purchase.TxID != "TxID-4" || purchase.BuyerID != "City2MSP::buyer" {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+
+	// It should fail to reveal data with the pending Tx that expired and can be refunded
+	expiredTxDetails, _ := json.Marshal(&TxDetails{"TxID-3", "2", "1", "10", "PendingTx", "2018-12-12T15:20:30Z",
+		"2018-12-12T15:21:30Z", ""})
+	tokens.payloads["getTxDetails"] = expiredTxDetails
+	args = [][]byte{[]byte("revealPaidData"),
+		[]byte("channel1"), []byte("chaincode_data"), []byte("1"), []byte("20181212152030"),
+		[]byte("channel3"), []byte("chaincode_tokens"), []byte("TxID-3")}
+	expectedMessage = "The pending transaction expired at 2018-12-12T15:21:30Z"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to reveal data entry of another publisher
+	otherTxDetails, _ := json.Marshal(&TxDetails{"TxID-5", "2", "1", "10", "PendingTx", "2018-12-12T15:20:30Z",
+		time.Now().Add(time.Hour).UTC().Format(time.RFC3339), ""})
+	tokens.payloads["getTxDetails"] = otherTxDetails
+	data.payloads["getDataByIDAndTime"], _ = json.Marshal(&DataEntry{"DATA_ENTRY", "1", "test_data", "42", "Unit",
+		20181212152030, "pub_name", base64.StdEncoding.EncodeToString(newTestCreator("City2MSP", "pub_user"))})
+	args = [][]byte{[]byte("revealPaidData"),
+		[]byte("channel1"), []byte("chaincode_data"), []byte("1"), []byte("20181212152030"),
+		[]byte("channel3"), []byte("chaincode_tokens"), []byte("TxID-5")}
+	expectedMessage = "Data entry ad was not created by the publisher of the data entry."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to get purchase that does not exist
+	args = [][]byte{[]byte("getPurchase"), []byte("TxID-2")}
+	expectedMessage = "Purchase was not found."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sort"
 	"strconv"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
@@ -23,8 +31,29 @@ type DataEntry struct {
 	Unit         string // optional units for the data value
 	CreationTime uint64 // Time when the data was created. It can differ from the blockchain entry time
 	Publisher    string // publisher of the data
+	PublisherID  string // verified identity of the publisher (base64 encoded serialized identity)
 }
 
+// BatchItemResult represents result of a single data entry in createDataBatch
+type BatchItemResult struct {
+	Index        int    // position of the data entry in the batch
+	DataEntryID  string // ID of the data entry
+	CreationTime uint64 // creation time of the data entry
+	Status       int32  // shim.OK if the data entry was saved
+	Message      string // error message if the data entry was rejected
+}
+
+// MaxBatchSize - limits the number of data entries that can be created in one createDataBatch transaction.
+// This keeps the transaction within the size limits of the ordering service.
+const MaxBatchSize = 500
+
+// TimeRangePageSize - number of keys of ID~PaddedTime index read by one query of getDataByIDInTimeRange
+const TimeRangePageSize = 100
+
+// MaxMigrationPageSize - limits the number of data entries indexed by one migrateTimeIndex transaction.
+// This keeps the transaction within the size limits of the ordering service.
+const MaxMigrationPageSize = 500
+
 // Main
 ////////
 func main() {
@@ -39,6 +68,29 @@ func main() {
 // Init initializes chaincode
 //////////////////////////////
 func (cc *Chaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	// GetCreator returns the identity object of the chaincode instantiation's submitter
+	creatorID, err := stub.GetCreator()
+	if err != nil {
+		return shim.Error("Failed to get identity of the administrator: " + err.Error())
+	}
+
+	// The submitter of the instantiation becomes the administrator of the chaincode.
+	// The administrator is not replaced by the submitter of the upgrade
+	adminKey, err := stub.CreateCompositeKey("Admin", []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	adminAsBytes, err := stub.GetState(adminKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if adminAsBytes == nil {
+		err = stub.PutState(adminKey, []byte(base64.StdEncoding.EncodeToString(creatorID)))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
 	return shim.Success(nil)
 }
 
@@ -50,14 +102,26 @@ func (cc *Chaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	// Handle functions
 	if function == "createData" { //create a new data entry
 		return cc.createData(stub, args)
+	} else if function == "createDataBatch" { //create multiple data entries in one transaction
+		return cc.createDataBatch(stub, args)
 	} else if function == "getDataByIDAndTime" { //read specific data by DataEntryID
 		return cc.getDataByIDAndTime(stub, args)
 	} else if function == "getAllDataByID" { //read all data by DataEntryID
 		return cc.getAllDataByID(stub, args)
+	} else if function == "getAllDataByIDWithPagination" { //read page of data by DataEntryID
+		return cc.getAllDataByIDWithPagination(stub, args)
 	} else if function == "getLatestDataByID" { //read latest data by DataEntryID
 		return cc.getLatestDataByID(stub, args)
+	} else if function == "getDataByIDInTimeRange" { //read data by DataEntryID created within time window
+		return cc.getDataByIDInTimeRange(stub, args)
 	} else if function == "getDataByPub" { //find data created by publisher using rich get
 		return cc.getDataByPub(stub, args)
+	} else if function == "getDataByPubWithPagination" { //read page of data created by publisher
+		return cc.getDataByPubWithPagination(stub, args)
+	} else if function == "registerPublisher" { //bind publisher name to identity by the administrator
+		return cc.registerPublisher(stub, args)
+	} else if function == "migrateTimeIndex" { //index data entries created before the time index by the administrator
+		return cc.migrateTimeIndex(stub, args)
 	}
 
 	return shim.Error("Received unknown function invocation")
@@ -92,6 +156,12 @@ func (cc *Chaincode) createData(stub shim.ChaincodeStubInterface, args []string)
 	}
 	publisher := args[5]
 
+	// Verify that the caller is allowed to publish under the publisher name
+	publisherID, err := verifyPublisher(stub, publisher)
+	if err != nil {
+		return shim.Error("Publisher verification failed: " + err.Error())
+	}
+
 	// Create composite key
 	idTimeCompositeKey, err := stub.CreateCompositeKey("ID~Time", []string{dataEntryID, creationTime})
 	if err != nil {
@@ -106,13 +176,20 @@ func (cc *Chaincode) createData(stub shim.ChaincodeStubInterface, args []string)
 		return shim.Error("This data entry already exists: " + dataEntryID + "~" + creationTime)
 	}
 
+	// The first data entry of the ID marks the ID as indexed by time.
+	// IDs with data entries created before the index are marked by migrateTimeIndex
+	err = markNewIDTimeIndexed(stub, dataEntryID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// Create data entry object and marshal to JSON
 	recordType := "DATA_ENTRY"
 	creationTimeUint, err := strconv.ParseUint(creationTime, 10, 64)
 	if err != nil {
 		return shim.Error("Error while parse Uint: " + err.Error())
 	}
-	dataEntry := &DataEntry{recordType, dataEntryID, description, value, unit, creationTimeUint, publisher}
+	dataEntry := &DataEntry{recordType, dataEntryID, description, value, unit, creationTimeUint, publisher, publisherID}
 	dataEntryJSONasBytes, err := json.Marshal(dataEntry)
 	if err != nil {
 		return shim.Error("Error while Marshal dataEntry: " + err.Error())
@@ -138,10 +215,92 @@ func (cc *Chaincode) createData(stub shim.ChaincodeStubInterface, args []string)
 	valueNull := []byte{0x00}
 	stub.PutState(pubIDIndexKey, valueNull)
 
+	// Index the data by creation time for time range queries
+	err = putTimeIndex(stub, dataEntryID, creationTimeUint)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
 	// Data entry saved and indexed. Return nil
 	return shim.Success(nil)
 }
 
+// createDataBatch - create multiple data entries in one transaction. In atomic mode the whole
+// batch is rejected if any data entry is invalid. In partial mode valid data entries are saved
+// and the result of each data entry is returned.
+/////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) createDataBatch(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 2
+	//          0                   1
+	// "[DataEntry, ...]" "atomic|partial"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting JSON array of data entries and mode")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get args
+	var dataEntries []DataEntry
+	err = json.Unmarshal([]byte(args[0]), &dataEntries)
+	if err != nil {
+		return shim.Error("Expecting JSON array of data entries: " + err.Error())
+	}
+	if len(dataEntries) == 0 {
+		return shim.Error("Batch must contain at least one data entry.")
+	}
+	if len(dataEntries) > MaxBatchSize {
+		return shim.Error("Batch exceeded max number of data entries: " + strconv.Itoa(MaxBatchSize))
+	}
+	mode := args[1]
+	if mode != "atomic" && mode != "partial" {
+		return shim.Error("Expecting atomic or partial as mode.")
+	}
+
+	// Create each data entry with the same rules as createData.
+	// State written in this transaction is not readable before commit,
+	// therefore duplicates within the batch have to be tracked here.
+	createdKeys := make(map[string]bool)
+	results := make([]BatchItemResult, len(dataEntries))
+	for i, dataEntry := range dataEntries {
+		creationTime := strconv.FormatUint(dataEntry.CreationTime, 10)
+		results[i] = BatchItemResult{i, dataEntry.DataEntryID, dataEntry.CreationTime, shim.OK, ""}
+
+		var response pb.Response
+		if createdKeys[dataEntry.DataEntryID+"~"+creationTime] {
+			response = shim.Error("This data entry already exists: " + dataEntry.DataEntryID + "~" + creationTime)
+		} else {
+			response = cc.createData(stub, []string{dataEntry.DataEntryID, dataEntry.Description,
+				dataEntry.Value, dataEntry.Unit, creationTime, dataEntry.Publisher})
+		}
+
+		// Reject whole batch in atomic mode
+		if response.Status != shim.OK {
+			if mode == "atomic" {
+				return shim.Error("Data entry at index " + strconv.Itoa(i) + " rejected: " + response.Message)
+			}
+			results[i].Status = response.Status
+			results[i].Message = response.Message
+			continue
+		}
+		createdKeys[dataEntry.DataEntryID+"~"+creationTime] = true
+	}
+
+	// Marshal results of all data entries
+	resultsAsBytes, err := json.Marshal(results)
+	if err != nil {
+		return shim.Error("Error while Marshal results: " + err.Error())
+	}
+
+	// It returns results as JSON array
+	return shim.Success(resultsAsBytes)
+}
+
 // getDataByIDAndTime - read data entry from chaincode state based on Id and time creation
 ////////////////////////////////////////////////////////////////////////////////////////////
 func (cc *Chaincode) getDataByIDAndTime(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -311,6 +470,168 @@ func (cc *Chaincode) getLatestDataByID(stub shim.ChaincodeStubInterface, args []
 	return shim.Success(response.Payload)
 }
 
+// getDataByIDInTimeRange - read data entries with Id created within time window in chronological order
+/////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getDataByIDInTimeRange(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 3
+	//  0        1           2
+	// "ID" "fromTime" "toTime"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting data entry Id, from time and to time")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get args
+	dataEntryID := args[0]
+	fromTime, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return shim.Error("Expecting positiv integer or zero as from time.")
+	}
+	toTime, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return shim.Error("Expecting positiv integer or zero as to time.")
+	}
+	if fromTime > toTime {
+		return shim.Error("From time cannot be later than to time.")
+	}
+
+	// Data entries created before the time index are found only by scan of all entries of the ID
+	indexed, err := isTimeIndexed(stub, dataEntryID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !indexed {
+		return getDataByIDInTimeRangeByScan(stub, dataEntryID, fromTime, toTime)
+	}
+
+	// The ledger starts the paginated query at the bookmark, so the first page starts at the from time
+	bookmark, err := stub.CreateCompositeKey("ID~PaddedTime", []string{dataEntryID, padTime(fromTime)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Create JSON array of the entries until the to time
+	var dataAsBytes []byte
+	var entriesCount int
+	for bookmark != "" {
+		idTimeIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination("ID~PaddedTime",
+			[]string{dataEntryID}, TimeRangePageSize, bookmark)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		bookmark = metadata.Bookmark
+		for idTimeIterator.HasNext() {
+			responseRange, err := idTimeIterator.Next()
+			if err != nil {
+				idTimeIterator.Close()
+				return shim.Error(err.Error())
+			}
+
+			// get the creationTime from ID~PaddedTime composite key
+			_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+			if err != nil {
+				idTimeIterator.Close()
+				return shim.Error(err.Error())
+			}
+			creationTime, err := strconv.ParseUint(compositeKeyParts[1], 10, 64)
+			if err != nil {
+				idTimeIterator.Close()
+				return shim.Error("Retrieved composite key conversion to uint64 failed: " + err.Error())
+			}
+			if creationTime > toTime {
+				bookmark = ""
+				break
+			}
+
+			// Retrieve the data from the state
+			response := cc.getDataByIDAndTime(stub, []string{dataEntryID, strconv.FormatUint(creationTime, 10)})
+			if response.Status != shim.OK {
+				idTimeIterator.Close()
+				return shim.Error("Retrieval of data entry failed: " + response.Message)
+			}
+			if entriesCount > 0 {
+				dataAsBytes = append(dataAsBytes, []byte(",")...)
+			}
+			dataAsBytes = append(dataAsBytes, response.Payload...)
+			entriesCount++
+		}
+		idTimeIterator.Close()
+	}
+	dataAsBytes = append([]byte("["), dataAsBytes...)
+	dataAsBytes = append(dataAsBytes, []byte("]")...)
+
+	// It returns results as JSON array
+	return shim.Success(dataAsBytes)
+}
+
+// getDataByIDInTimeRangeByScan - returns data entries with Id created within time window in chronological order
+// as JSON array. It scans all data entries of the ID, so it is used only for IDs that are not indexed by time.
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getDataByIDInTimeRangeByScan(stub shim.ChaincodeStubInterface, dataEntryID string, fromTime uint64,
+	toTime uint64) pb.Response {
+	// Get all keys of the data entry from ID~Time index
+	idTimeIterator, err := stub.GetStateByPartialCompositeKey("ID~Time", []string{dataEntryID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer idTimeIterator.Close()
+
+	// Keep only the entries within the time window.
+	// Creation time is stored in the key as decimal string, therefore the keys are
+	// not sorted by time (e.g. "10" < "9") and entries have to be sorted afterwards.
+	type timedEntry struct {
+		creationTime uint64
+		data         []byte
+	}
+	var entries []timedEntry
+	for idTimeIterator.HasNext() {
+		responseRange, err := idTimeIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// get the dataEntryID and creationTime from ID~Time composite key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		creationTime, err := strconv.ParseUint(compositeKeyParts[1], 10, 64)
+		if err != nil {
+			return shim.Error("Retrieved composite key conversion to uint64 failed: " + err.Error())
+		}
+		if creationTime < fromTime || creationTime > toTime {
+			continue
+		}
+
+		// The data entry itself is the value of ID~Time key
+		entries = append(entries, timedEntry{creationTime, responseRange.Value})
+	}
+
+	// Sort in chronological order
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].creationTime < entries[j].creationTime })
+
+	// Create JSON array
+	var dataAsBytes []byte
+	for i, entry := range entries {
+		if i > 0 {
+			dataAsBytes = append(dataAsBytes, []byte(",")...)
+		}
+		dataAsBytes = append(dataAsBytes, entry.data...)
+	}
+	dataAsBytes = append([]byte("["), dataAsBytes...)
+	dataAsBytes = append(dataAsBytes, []byte("]")...)
+
+	// It returns results as JSON array
+	return shim.Success(dataAsBytes)
+}
+
 // getDataByPub - get data entry from chaincode state by publisher
 //////////////////////////////////////////////////////////////////////////////////
 func (cc *Chaincode) getDataByPub(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -377,3 +698,508 @@ func (cc *Chaincode) getDataByPub(stub shim.ChaincodeStubInterface, args []strin
 	// It returns results as JSON array
 	return shim.Success(dataAsBytes)
 }
+
+// getAllDataByIDWithPagination - read page of data entries from chaincode state based on Id
+////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getAllDataByIDWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//  0        1           2
+	// "ID" "pageSize" ["bookmark"]
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting data entry Id, page size and optional bookmark")
+	}
+
+	// Input sanitization. Bookmark is empty for the first page.
+	for i := 0; i < 2; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get args
+	dataEntryID := args[0]
+	pageSize := args[1]
+	bookmark := ""
+	if len(args) == 3 {
+		bookmark = args[2]
+	}
+
+	// Retrieve the data from the state for each ID~Time row of the page
+	return getPageByPartialCompositeKey(stub, "ID~Time", []string{dataEntryID}, pageSize, bookmark,
+		func(compositeKeyParts []string) pb.Response {
+			return cc.getDataByIDAndTime(stub, []string{compositeKeyParts[0], compositeKeyParts[1]})
+		})
+}
+
+// getDataByPubWithPagination - get page of data entries from chaincode state by publisher
+//////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getDataByPubWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//    0           1           2
+	// "Publisher" "pageSize" ["bookmark"]
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting publisher, page size and optional bookmark")
+	}
+
+	// Input sanitization. Bookmark is empty for the first page.
+	for i := 0; i < 2; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get args
+	publisher := args[0]
+	pageSize := args[1]
+	bookmark := ""
+	if len(args) == 3 {
+		bookmark = args[2]
+	}
+
+	// Retrieve the data from the state for each Publisher~DataEntryID~CreationTime row of the page
+	return getPageByPartialCompositeKey(stub, "Publisher~DataEntryID~CreationTime", []string{publisher}, pageSize, bookmark,
+		func(compositeKeyParts []string) pb.Response {
+			return cc.getDataByIDAndTime(stub, []string{compositeKeyParts[1], compositeKeyParts[2]})
+		})
+}
+
+// migrateTimeIndex - indexes by time one page of data entries of the ID created before the time index.
+// It returns JSON object {"migrated":N,"bookmark":"...","hasMore":true|false}. The bookmark is the ID~Time key
+// of the first data entry of the next page encoded in base64, and it is empty for the first page. The ID is marked
+// as indexed only after its last page, so time range queries of the ID scan its data entries until the migration
+// completes. Only the administrator can migrate.
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) migrateTimeIndex(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	//  0       1           2
+	// "ID" "pageSize" ["bookmark"]
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting data entry Id to migrate, page size and optional bookmark")
+	}
+
+	// Input sanitization. Bookmark is empty for the first page.
+	for i := 0; i < 2; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get args
+	dataEntryID := args[0]
+	pageSize, err := strconv.Atoi(args[1])
+	if err != nil || pageSize < 1 || pageSize > MaxMigrationPageSize {
+		return shim.Error("Expecting page size from 1 to " + strconv.Itoa(MaxMigrationPageSize) + ".")
+	}
+	bookmark := ""
+	if len(args) == 3 {
+		bookmark = args[2]
+	}
+
+	// Decode the ID~Time key where the page starts
+	startKeyAsBytes, err := base64.StdEncoding.DecodeString(bookmark)
+	if err != nil {
+		return shim.Error("Invalid bookmark.")
+	}
+	startKey := string(startKeyAsBytes)
+	if startKey != "" {
+		objectType, compositeKeyParts, err := stub.SplitCompositeKey(startKey)
+		if err != nil || objectType != "ID~Time" || len(compositeKeyParts) != 2 || compositeKeyParts[0] != dataEntryID {
+			return shim.Error("Invalid bookmark.")
+		}
+	}
+
+	// Only the administrator can migrate the index
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Index the data entries of the page. Range queries do not accept composite keys, so the rows before
+	// the bookmark are skipped.
+	idTimeIterator, err := stub.GetStateByPartialCompositeKey("ID~Time", []string{dataEntryID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer idTimeIterator.Close()
+	var entriesCount int
+	nextKey := ""
+	for idTimeIterator.HasNext() {
+		responseRange, err := idTimeIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if responseRange.Key < startKey {
+			continue
+		}
+
+		// The first row after the page starts the next page
+		if entriesCount == pageSize {
+			nextKey = responseRange.Key
+			break
+		}
+
+		// get the creationTime from ID~Time composite key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		creationTime, err := strconv.ParseUint(compositeKeyParts[1], 10, 64)
+		if err != nil {
+			return shim.Error("Retrieved composite key conversion to uint64 failed: " + err.Error())
+		}
+		err = putTimeIndex(stub, dataEntryID, creationTime)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		entriesCount++
+	}
+
+	// Mark the ID as indexed after the last page
+	hasMore := nextKey != ""
+	if !hasMore {
+		timeIndexKey, err := stub.CreateCompositeKey("TimeIndex~ID", []string{dataEntryID})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.PutState(timeIndexKey, []byte{0x00})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// It returns number of indexed data entries and the bookmark of the next page
+	var buffer bytes.Buffer
+	buffer.WriteString("{\"migrated\":")
+	buffer.WriteString(strconv.Itoa(entriesCount))
+	buffer.WriteString(",\"bookmark\":\"")
+	if hasMore {
+		buffer.WriteString(base64.StdEncoding.EncodeToString([]byte(nextKey)))
+	}
+	buffer.WriteString("\",\"hasMore\":")
+	buffer.WriteString(strconv.FormatBool(hasMore))
+	buffer.WriteString("}")
+
+	return shim.Success(buffer.Bytes())
+}
+
+// registerPublisher - binds the publisher name to the identity allowed to publish under it.
+// Only the administrator can register or rebind publishers.
+///////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) registerPublisher(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 2
+	//      0              1
+	// "Publisher", "Identity (base64 encoded serialized identity)"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting publisher and identity")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get args
+	publisher := args[0]
+	identity := args[1]
+	identityAsBytes, err := base64.StdEncoding.DecodeString(identity)
+	if err != nil {
+		return shim.Error("Expecting base64 encoded serialized identity.")
+	}
+	_, _, err = getCreatorCertificate(identityAsBytes)
+	if err != nil {
+		return shim.Error("Expecting base64 encoded serialized identity: " + err.Error())
+	}
+
+	// Only the administrator can register publishers
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Bind the publisher name to the identity
+	publisherKey, err := stub.CreateCompositeKey("Publisher~Identity", []string{publisher})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(publisherKey, []byte(identity))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// getPageByPartialCompositeKey - returns one page of records found in the index as JSON object
+// {"records":[...],"bookmark":"...","hasMore":true|false}. The bookmark is opaque for the client.
+// It is the bookmark of the ledger query encoded in base64, so the next page starts where the previous one
+// ended, and it is empty for the first page. Paginated queries are read-only, so the transaction cannot
+// change the state.
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getPageByPartialCompositeKey(stub shim.ChaincodeStubInterface, objectType string, keys []string,
+	pageSizeStr string, bookmark string, getRecord func(compositeKeyParts []string) pb.Response) pb.Response {
+	pageSize, err := strconv.ParseInt(pageSizeStr, 10, 32)
+	if err != nil || pageSize < 1 {
+		return shim.Error("Expecting positive integer as page size.")
+	}
+
+	// Decode the bookmark of the ledger query where the page starts
+	ledgerBookmarkAsBytes, err := base64.StdEncoding.DecodeString(bookmark)
+	if err != nil {
+		return shim.Error("Invalid bookmark.")
+	}
+
+	// Get the index rows of the page
+	resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(objectType, keys,
+		int32(pageSize), string(ledgerBookmarkAsBytes))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	// buffer is a JSON object containing records of the page
+	var buffer bytes.Buffer
+	buffer.WriteString("{\"records\":[")
+	var recordsCount int64
+	for resultsIterator.HasNext() && recordsCount < pageSize {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// Get the record for the composite key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		response := getRecord(compositeKeyParts)
+		if response.Status != shim.OK {
+			return shim.Error("Retrieval of record failed: " + response.Message)
+		}
+
+		// Append the record to the array
+		if recordsCount > 0 {
+			buffer.WriteString(",")
+		}
+		buffer.Write(response.Payload)
+		recordsCount++
+	}
+
+	// The ledger returns the bookmark of the next page only if there are more rows
+	hasMore := metadata != nil && metadata.Bookmark != "" && recordsCount == pageSize
+
+	// Close the array and write the bookmark for the next page
+	buffer.WriteString("],\"bookmark\":\"")
+	if hasMore {
+		buffer.WriteString(base64.StdEncoding.EncodeToString([]byte(metadata.Bookmark)))
+	}
+	buffer.WriteString("\",\"hasMore\":")
+	buffer.WriteString(strconv.FormatBool(hasMore))
+	buffer.WriteString("}")
+
+	// Return JSON object with the page
+	return shim.Success(buffer.Bytes())
+}
+
+// getIdentity - returns identity as "MSPID::CommonName" from serialized identity
+//////////////////////////////////////////////////////////////////////////////////
+func getIdentity(creatorIDAsBytes []byte) (string, error) {
+	mspID, cert, err := getCreatorCertificate(creatorIDAsBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return mspID + "::" + cert.Subject.CommonName, nil
+}
+
+// getCreatorCertificate - decodes serialized identity and returns its MSP ID and X.509 certificate
+////////////////////////////////////////////////////////////////////////////////////////////////////
+func getCreatorCertificate(creatorIDAsBytes []byte) (string, *x509.Certificate, error) {
+	sID := &msp.SerializedIdentity{}
+	err := proto.Unmarshal(creatorIDAsBytes, sID)
+	if err != nil {
+		return "", nil, fmt.Errorf("Could not deserialize a SerializedIdentity, err %s", err)
+	}
+
+	block, _ := pem.Decode(sID.IdBytes)
+	if block == nil {
+		return "", nil, fmt.Errorf("Failed to decode PEM structure")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to parse certificate %s", err)
+	}
+
+	return sID.Mspid, cert, nil
+}
+
+// verifyPublisher - checks that the publisher name is registered to the caller and returns caller identity
+// (base64 encoded serialized identity). Publisher name that is not registered yet is bound to the caller who
+// publishes under it first. The administrator can register or rebind publishers. Publishers bound
+// as "MSPID::CommonName" before are migrated to the serialized identity when they publish.
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func verifyPublisher(stub shim.ChaincodeStubInterface, publisher string) (string, error) {
+	// GetCreator returns the identity object of the chaincode invocation's submitter
+	creatorIDAsBytes, err := stub.GetCreator()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get creator ID. %s", err)
+	}
+	callerLegacyID, err := getIdentity(creatorIDAsBytes)
+	if err != nil {
+		return "", err
+	}
+	callerID := base64.StdEncoding.EncodeToString(creatorIDAsBytes)
+
+	// Get the identity the publisher name is bound to
+	publisherKey, err := stub.CreateCompositeKey("Publisher~Identity", []string{publisher})
+	if err != nil {
+		return "", err
+	}
+	publisherIDAsBytes, err := stub.GetState(publisherKey)
+	if err != nil {
+		return "", err
+	}
+	if publisherIDAsBytes == nil {
+		err = stub.PutState(publisherKey, []byte(callerID))
+		if err != nil {
+			return "", err
+		}
+		return callerID, nil
+	}
+
+	// Migrate the publisher bound as "MSPID::CommonName" to the serialized identity of the caller
+	if string(publisherIDAsBytes) == callerLegacyID {
+		err = stub.PutState(publisherKey, []byte(callerID))
+		if err != nil {
+			return "", err
+		}
+		return callerID, nil
+	}
+
+	isPublisher, err := isCreator(stub, string(publisherIDAsBytes))
+	if err != nil {
+		return "", err
+	}
+	if !isPublisher {
+		return "", fmt.Errorf("Publisher %s is bound to another identity", publisher)
+	}
+
+	return callerID, nil
+}
+
+// checkAdmin - returns error if the transaction submitter is not the administrator of the chaincode
+////////////////////////////////////////////////////////////////////////////////////////////////////
+func checkAdmin(stub shim.ChaincodeStubInterface) error {
+	adminKey, err := stub.CreateCompositeKey("Admin", []string{})
+	if err != nil {
+		return err
+	}
+	adminIDAsBytes, err := stub.GetState(adminKey)
+	if err != nil {
+		return err
+	} else if adminIDAsBytes == nil {
+		return fmt.Errorf("Caller is not the administrator of the chaincode")
+	}
+
+	isAdmin, err := isCreator(stub, string(adminIDAsBytes))
+	if err != nil {
+		return err
+	}
+	if !isAdmin {
+		return fmt.Errorf("Caller is not the administrator of the chaincode")
+	}
+
+	return nil
+}
+
+// isCreator - checks if the transaction submitter has the identity (base64 encoded serialized identity)
+// The certificate could be renewed, so the MSP, subject and issuer of certificates are compared as well.
+///////////////////////////////////////////////////////////////////////////////////////////////////////////
+func isCreator(stub shim.ChaincodeStubInterface, identity string) (bool, error) {
+	// GetCreator returns the identity object of the chaincode invocation's submitter
+	creatorIDAsBytes, err := stub.GetCreator()
+	if err != nil {
+		return false, fmt.Errorf("Failed to get creator ID. %s", err)
+	}
+
+	// Compare the serialized identities first
+	if base64.StdEncoding.EncodeToString(creatorIDAsBytes) == identity {
+		return true, nil
+	}
+
+	// Compare the MSP, subject and issuer of certificates
+	callerMSPID, callerCert, err := getCreatorCertificate(creatorIDAsBytes)
+	if err != nil {
+		return false, err
+	}
+	identityAsBytes, err := base64.StdEncoding.DecodeString(identity)
+	if err != nil {
+		return false, nil
+	}
+	identityMSPID, identityCert, err := getCreatorCertificate(identityAsBytes)
+	if err != nil {
+		return false, nil
+	}
+
+	return callerMSPID == identityMSPID && bytes.Equal(callerCert.RawSubject, identityCert.RawSubject) &&
+		bytes.Equal(callerCert.RawIssuer, identityCert.RawIssuer), nil
+}
+
+// padTime - formats creation time with leading zeros, so the keys of times are sorted in chronological order
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func padTime(creationTime uint64) string {
+	return fmt.Sprintf("%020d", creationTime)
+}
+
+// putTimeIndex - saves the key of ID~PaddedTime index of the data entry
+////////////////////////////////////////////////////////////////////////////
+func putTimeIndex(stub shim.ChaincodeStubInterface, dataEntryID string, creationTime uint64) error {
+	idPaddedTimeKey, err := stub.CreateCompositeKey("ID~PaddedTime", []string{dataEntryID, padTime(creationTime)})
+	if err != nil {
+		return err
+	}
+
+	// Only the key name is needed, the data entry is read from ID~Time key
+	return stub.PutState(idPaddedTimeKey, []byte{0x00})
+}
+
+// isTimeIndexed - checks if all data entries of the ID are in ID~PaddedTime index
+////////////////////////////////////////////////////////////////////////////////////
+func isTimeIndexed(stub shim.ChaincodeStubInterface, dataEntryID string) (bool, error) {
+	timeIndexKey, err := stub.CreateCompositeKey("TimeIndex~ID", []string{dataEntryID})
+	if err != nil {
+		return false, err
+	}
+	timeIndexAsBytes, err := stub.GetState(timeIndexKey)
+	if err != nil {
+		return false, err
+	}
+
+	return timeIndexAsBytes != nil, nil
+}
+
+// markNewIDTimeIndexed - marks the ID as indexed by time if it has no data entries yet
+///////////////////////////////////////////////////////////////////////////////////////////
+func markNewIDTimeIndexed(stub shim.ChaincodeStubInterface, dataEntryID string) error {
+	indexed, err := isTimeIndexed(stub, dataEntryID)
+	if err != nil || indexed {
+		return err
+	}
+
+	// IDs with data entries created before the time index keep scanning until they are migrated
+	idTimeIterator, err := stub.GetStateByPartialCompositeKey("ID~Time", []string{dataEntryID})
+	if err != nil {
+		return err
+	}
+	defer idTimeIterator.Close()
+	if idTimeIterator.HasNext() {
+		return nil
+	}
+
+	timeIndexKey, err := stub.CreateCompositeKey("TimeIndex~ID", []string{dataEntryID})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(timeIndexKey, []byte{0x00})
+}
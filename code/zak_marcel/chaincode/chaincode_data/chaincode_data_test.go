@@ -1,12 +1,118 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
+// testCreator is the identity of the submitter used in test invocations
+var testCreator = newTestCreator("City1MSP", "pub_user")
+
+// testCreatorID is the identity of the test creator as it is saved in data entries
+var testCreatorID = base64.StdEncoding.EncodeToString(testCreator)
+
+// newTestCreator - creates serialized identity with self-signed certificate
+func newTestCreator(mspID string, commonName string) []byte {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: commonName},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	certAsBytes, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	idBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certAsBytes})
+	creator, _ := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: idBytes})
+	return creator
+}
+
+// identityStub wraps MockStub because MockStub does not return any creator
+type identityStub struct {
+	*shim.MockStub
+	creator []byte
+	args    [][]byte
+}
+
+func (stub *identityStub) GetCreator() ([]byte, error) {
+	return stub.creator, nil
+}
+
+func (stub *identityStub) GetArgs() [][]byte {
+	return stub.args
+}
+
+func (stub *identityStub) GetStringArgs() []string {
+	strargs := make([]string, 0, len(stub.args))
+	for _, barg := range stub.args {
+		strargs = append(strargs, string(barg))
+	}
+	return strargs
+}
+
+func (stub *identityStub) GetFunctionAndParameters() (string, []string) {
+	allargs := stub.GetStringArgs()
+	if len(allargs) == 0 {
+		return "", []string{}
+	}
+	return allargs[0], allargs[1:]
+}
+
+// GetStateByPartialCompositeKeyWithPagination - MockStub does not support pagination. As in the ledger,
+// the bookmark is the key where the page starts and it is empty when there are no more keys
+func (stub *identityStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string,
+	pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	partialCompositeKey, err := stub.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	startKey := partialCompositeKey
+	if bookmark != "" {
+		startKey = bookmark
+	}
+	endKey := partialCompositeKey + string(utf8.MaxRune)
+
+	// Find the key where the next page starts
+	iterator := shim.NewMockStateRangeQueryIterator(stub.MockStub, startKey, endKey)
+	defer iterator.Close()
+	var fetchedRecordsCount int32
+	nextKey := ""
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if fetchedRecordsCount == pageSize {
+			nextKey = responseRange.Key
+			endKey = nextKey
+			break
+		}
+		fetchedRecordsCount++
+	}
+
+	metadata := &pb.QueryResponseMetadata{FetchedRecordsCount: fetchedRecordsCount, Bookmark: nextKey}
+	return shim.NewMockStateRangeQueryIterator(stub.MockStub, startKey, endKey), metadata, nil
+}
+
+// mockInvokeAs - invokes chaincode in the same way as MockInvoke but as the creator
+func mockInvokeAs(stub *shim.MockStub, creator []byte, uuid string, args [][]byte) pb.Response {
+	stub.MockTransactionStart(uuid)
+	res := new(Chaincode).Invoke(&identityStub{stub, creator, args})
+	stub.MockTransactionEnd(uuid)
+	return res
+}
+
 func checkInit(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	res := stub.MockInit("1", args)
 	if res.Status != shim.OK {
@@ -15,6 +121,17 @@ func checkInit(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	}
 }
 
+// registerTestPublisher - binds the publisher name to the creator by the administrator.
+// MockInit does not set any creator, so the administrator is the empty identity
+func registerTestPublisher(t *testing.T, stub *shim.MockStub, publisher string, creator []byte) {
+	args := [][]byte{[]byte("registerPublisher"), []byte(publisher), []byte(base64.StdEncoding.EncodeToString(creator))}
+	res := mockInvokeAs(stub, nil, "1", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+}
+
 func checkInitFail(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	res := stub.MockInit("1", args)
 	if res.Status == shim.OK {
@@ -23,8 +140,20 @@ func checkInitFail(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	}
 }
 
+func checkState(t *testing.T, stub *shim.MockStub, name string, value string) {
+	bytes := stub.State[name]
+	if bytes == nil {
+		fmt.Println("State", name, "failed to get value")
+		t.Fail()
+	}
+	if string(bytes) != value {
+		fmt.Println("State value", name, "was", string(bytes), "instead required", value)
+		t.Fail()
+	}
+}
+
 func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
-	res := stub.MockInvoke("1", args)
+	res := mockInvokeAs(stub, testCreator, "1", args)
 	if res.Status != shim.OK {
 		fmt.Println("Invoke", args, "failed", string(res.Message))
 		t.Fail()
@@ -32,7 +161,7 @@ func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
 }
 
 func checkInvokeFail(t *testing.T, stub *shim.MockStub, args [][]byte) {
-	res := stub.MockInvoke("1", args)
+	res := mockInvokeAs(stub, testCreator, "1", args)
 	if res.Status == shim.OK {
 		fmt.Println("Invoke", args, "should fail but did not", string(res.Payload))
 		t.Fail()
@@ -40,7 +169,7 @@ func checkInvokeFail(t *testing.T, stub *shim.MockStub, args [][]byte) {
 }
 
 func checkInvokeResponse(t *testing.T, stub *shim.MockStub, args [][]byte, expectedPayload string) {
-	res := stub.MockInvoke("1", args)
+	res := mockInvokeAs(stub, testCreator, "1", args)
 	if res.Status != shim.OK {
 		fmt.Println("Invoke", args, "failed", string(res.Message))
 		t.Fail()
@@ -53,7 +182,7 @@ func checkInvokeResponse(t *testing.T, stub *shim.MockStub, args [][]byte, expec
 }
 
 func checkInvokeResponseFail(t *testing.T, stub *shim.MockStub, args [][]byte, expectedMessage string) {
-	res := stub.MockInvoke("1", args)
+	res := mockInvokeAs(stub, testCreator, "1", args)
 	if res.Status == shim.OK {
 		fmt.Println("Invoke", args, "should fail")
 		fmt.Println("Instead got payload:", string(res.Payload))
@@ -87,6 +216,7 @@ func Test_createData(t *testing.T) {
 
 	// Init
 	checkInit(t, stub, [][]byte{[]byte("20")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
 	// create test data
 	args := [][]byte{[]byte("createData"),
 		[]byte("1"), []byte("test_data"), []byte("10"), []byte("Unit"),
@@ -97,7 +227,7 @@ func Test_createData(t *testing.T) {
 	args = [][]byte{[]byte("getDataByIDAndTime"), []byte("1"), []byte("20181212152030")}
 	expectedPayload := "{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"1\"" +
 		",\"Description\":\"test_data\",\"Value\":\"10\",\"Unit\":\"Unit\"," +
-		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\"}"
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 
 	// create test data that has the same ID and creationTime Shoult fail
@@ -186,6 +316,7 @@ func Test_getDataByIDAndTime(t *testing.T) {
 
 	// Init
 	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
 	// create test data
 	args := [][]byte{[]byte("createData"),
 		[]byte("1"), []byte("test_data"), []byte("10"), []byte("Unit"),
@@ -195,7 +326,7 @@ func Test_getDataByIDAndTime(t *testing.T) {
 
 	expectedPayload := "{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"1\"" +
 		",\"Description\":\"test_data\",\"Value\":\"10\",\"Unit\":\"Unit\"," +
-		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\"}"
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}"
 
 	// It should get the same expected payload
 	args = [][]byte{[]byte("getDataByIDAndTime"), []byte("1"), []byte("20181212152030")}
@@ -228,6 +359,7 @@ func Test_getAllDataByID(t *testing.T) {
 
 	// Init
 	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
 	// create test data
 	args := [][]byte{[]byte("createData"),
 		[]byte("1"), []byte("test_data"), []byte("10"), []byte("Unit"),
@@ -236,7 +368,7 @@ func Test_getAllDataByID(t *testing.T) {
 	checkInvokeResponse(t, stub, args, "")
 	expectedPayload := "{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"1\"" +
 		",\"Description\":\"test_data\",\"Value\":\"10\",\"Unit\":\"Unit\"," +
-		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\"}"
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}"
 
 	// It should get the same expected payload
 	args = [][]byte{[]byte("getAllDataByID"), []byte("1")}
@@ -250,7 +382,7 @@ func Test_getAllDataByID(t *testing.T) {
 	checkInvoke(t, stub, args)
 	expectedPayload2 := "{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"1\"" +
 		",\"Description\":\"test_data\",\"Value\":\"100\",\"Unit\":\"Unit\"," +
-		"\"CreationTime\":20181212152031,\"Publisher\":\"pub_name\"}"
+		"\"CreationTime\":20181212152031,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}"
 
 	// It should get both entry as JSON array
 	args = [][]byte{[]byte("getAllDataByID"), []byte("1")}
@@ -280,6 +412,7 @@ func Test_getLatestDataByID(t *testing.T) {
 
 	// Init
 	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
 	// create test data
 	args := [][]byte{[]byte("createData"),
 		[]byte("1"), []byte("test_data"), []byte("10"), []byte("Unit"),
@@ -295,7 +428,7 @@ func Test_getLatestDataByID(t *testing.T) {
 	checkInvoke(t, stub, args)
 	expectedPayload := "{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"1\"" +
 		",\"Description\":\"test_data\",\"Value\":\"100\",\"Unit\":\"Unit\"," +
-		"\"CreationTime\":20181212152031,\"Publisher\":\"pub_name\"}"
+		"\"CreationTime\":20181212152031,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}"
 
 	// It should get both entry as JSON array
 	args = [][]byte{[]byte("getLatestDataByID"), []byte("1")}
@@ -318,6 +451,7 @@ func Test_getDataByPub(t *testing.T) {
 
 	// Init
 	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
 	// create test data
 	args := [][]byte{[]byte("createData"),
 		[]byte("1"), []byte("test_data"), []byte("10"), []byte("Unit"),
@@ -326,7 +460,7 @@ func Test_getDataByPub(t *testing.T) {
 	checkInvokeResponse(t, stub, args, "")
 	expectedPayload := "{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"1\"" +
 		",\"Description\":\"test_data\",\"Value\":\"10\",\"Unit\":\"Unit\"," +
-		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\"}"
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}"
 
 	// It should get the same expected payload
 	args = [][]byte{[]byte("getDataByPub"), []byte("pub_name")}
@@ -340,7 +474,7 @@ func Test_getDataByPub(t *testing.T) {
 	checkInvoke(t, stub, args)
 	expectedPayload2 := "{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"2\"" +
 		",\"Description\":\"test_data\",\"Value\":\"100\",\"Unit\":\"Unit\"," +
-		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\"}"
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}"
 
 	// It should get both entry as JSON array
 	args = [][]byte{[]byte("getDataByPub"), []byte("pub_name")}
@@ -363,3 +497,391 @@ func Test_getDataByPub(t *testing.T) {
 	expectedPayload = "Incorrect number of arguments. Expecting publisher to get"
 	checkInvokeResponseFail(t, stub, args, expectedPayload)
 }
+
+func Test_getDataByIDInTimeRange(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("init_test", cc)
+
+	// Init
+	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
+	// create test data at times 5, 10 and 30
+	for _, creationTime := range []string{"30", "5", "10"} {
+		args := [][]byte{[]byte("createData"),
+			[]byte("1"), []byte("test_data"), []byte(creationTime), []byte("Unit"),
+			[]byte(creationTime), []byte("pub_name")}
+		checkInvokeResponse(t, stub, args, "")
+	}
+	expectedPayload5 := "{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"1\"" +
+		",\"Description\":\"test_data\",\"Value\":\"5\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":5,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}"
+	expectedPayload10 := "{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"1\"" +
+		",\"Description\":\"test_data\",\"Value\":\"10\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":10,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}"
+
+	// It should return entries within the window in chronological order
+	args := [][]byte{[]byte("getDataByIDInTimeRange"), []byte("1"), []byte("5"), []byte("10")}
+	checkInvokeResponse(t, stub, args, "["+expectedPayload5+","+expectedPayload10+"]")
+
+	// It should return empty array if there is no entry in the window
+	args = [][]byte{[]byte("getDataByIDInTimeRange"), []byte("1"), []byte("11"), []byte("29")}
+	checkInvokeResponse(t, stub, args, "[]")
+
+	// It should index the entries by creation time padded with zeros
+	timeIndexKey, _ := stub.CreateCompositeKey("ID~PaddedTime", []string{"1", "00000000000000000005"})
+	checkState(t, stub, timeIndexKey, "\x00")
+
+	// It should scan the entries of ID created before the time index until the ID is migrated
+	legacyEntry := "{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"2\"" +
+		",\"Description\":\"test_data\",\"Value\":\"9\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":9,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}"
+	legacyKey, _ := stub.CreateCompositeKey("ID~Time", []string{"2", "9"})
+	stub.MockTransactionStart("2")
+	stub.PutState(legacyKey, []byte(legacyEntry))
+	stub.MockTransactionEnd("2")
+	args = [][]byte{[]byte("createData"),
+		[]byte("2"), []byte("test_data"), []byte("10"), []byte("Unit"),
+		[]byte("10"), []byte("pub_name")}
+	checkInvokeResponse(t, stub, args, "")
+	expectedPayload := "[" + legacyEntry + ",{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"2\"" +
+		",\"Description\":\"test_data\",\"Value\":\"10\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":10,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}]"
+	args = [][]byte{[]byte("getDataByIDInTimeRange"), []byte("2"), []byte("0"), []byte("100")}
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should migrate the ID by the administrator only
+	args = [][]byte{[]byte("migrateTimeIndex"), []byte("2"), []byte("1")}
+	expectedMessage := "Caller is not the administrator of the chaincode"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should migrate the ID in pages and mark it as indexed after the last page only
+	nextKey, _ := stub.CreateCompositeKey("ID~Time", []string{"2", "9"})
+	bookmark := base64.StdEncoding.EncodeToString([]byte(nextKey))
+	res := mockInvokeAs(stub, nil, "3", args)
+	if res.Status != shim.OK || string(res.Payload) != "{\"migrated\":1,\"bookmark\":\""+bookmark+"\",\"hasMore\":true}" {
+		fmt.Println("Invoke", args, "failed", res.Message, string(res.Payload))
+		t.Fail()
+	}
+	markerKey, _ := stub.CreateCompositeKey("TimeIndex~ID", []string{"2"})
+	if stub.State[markerKey] != nil {
+		fmt.Println("ID 2 should not be marked as indexed before the last page")
+		t.Fail()
+	}
+	args = [][]byte{[]byte("migrateTimeIndex"), []byte("2"), []byte("1"), []byte(bookmark)}
+	res = mockInvokeAs(stub, nil, "3", args)
+	if res.Status != shim.OK || string(res.Payload) != "{\"migrated\":1,\"bookmark\":\"\",\"hasMore\":false}" {
+		fmt.Println("Invoke", args, "failed", res.Message, string(res.Payload))
+		t.Fail()
+	}
+	timeIndexKey, _ = stub.CreateCompositeKey("ID~PaddedTime", []string{"2", "00000000000000000009"})
+	checkState(t, stub, timeIndexKey, "\x00")
+	checkState(t, stub, markerKey, "\x00")
+
+	// It should fail if the page size is out of bounds or the bookmark belongs to another ID
+	args = [][]byte{[]byte("migrateTimeIndex"), []byte("2"), []byte("501")}
+	res = mockInvokeAs(stub, nil, "3", args)
+	if res.Status == shim.OK || res.Message != "Expecting page size from 1 to 500." {
+		fmt.Println("Invoke", args, "should fail", res.Message)
+		t.Fail()
+	}
+	args = [][]byte{[]byte("migrateTimeIndex"), []byte("1"), []byte("1"), []byte(bookmark)}
+	res = mockInvokeAs(stub, nil, "3", args)
+	if res.Status == shim.OK || res.Message != "Invalid bookmark." {
+		fmt.Println("Invoke", args, "should fail", res.Message)
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getDataByIDInTimeRange"), []byte("2"), []byte("0"), []byte("100")}
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getDataByIDInTimeRange"), []byte("2"), []byte("10"), []byte("10")}
+	checkInvokeResponse(t, stub, args, "["+expectedPayload[len(legacyEntry)+2:])
+
+	// It should fail if from time is later than to time
+	args = [][]byte{[]byte("getDataByIDInTimeRange"), []byte("1"), []byte("10"), []byte("5")}
+	expectedMessage = "From time cannot be later than to time."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail if time is not uint
+	args = [][]byte{[]byte("getDataByIDInTimeRange"), []byte("1"), []byte("-5"), []byte("10")}
+	expectedMessage = "Expecting positiv integer or zero as from time."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+	args = [][]byte{[]byte("getDataByIDInTimeRange"), []byte("1"), []byte("5"), []byte("lol")}
+	expectedMessage = "Expecting positiv integer or zero as to time."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with empty arg
+	args = [][]byte{[]byte("getDataByIDInTimeRange"), []byte("1"), []byte(""), []byte("10")}
+	expectedMessage = "Argument at position 2 must be a non-empty string"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with less than 3 args
+	args = [][]byte{[]byte("getDataByIDInTimeRange"), []byte("1"), []byte("5")}
+	expectedMessage = "Incorrect number of arguments. Expecting data entry Id, from time and to time"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_getAllDataByIDWithPagination(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("init_test", cc)
+
+	// Init
+	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
+	// create three test data entries
+	for _, creationTime := range []string{"1", "2", "3"} {
+		args := [][]byte{[]byte("createData"),
+			[]byte("1"), []byte("test_data"), []byte(creationTime), []byte("Unit"),
+			[]byte(creationTime), []byte("pub_name")}
+		checkInvokeResponse(t, stub, args, "")
+	}
+	expectedPayload3 := "{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"1\"" +
+		",\"Description\":\"test_data\",\"Value\":\"3\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":3,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}"
+
+	// It should return the first page with two entries and bookmark
+	args := [][]byte{[]byte("getAllDataByIDWithPagination"), []byte("1"), []byte("2")}
+	res := mockInvokeAs(stub, nil, "1", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.FailNow()
+	}
+	var page struct {
+		Records  []json.RawMessage `json:"records"`
+		Bookmark string            `json:"bookmark"`
+		HasMore  bool              `json:"hasMore"`
+	}
+	err := json.Unmarshal(res.Payload, &page)
+	if err != nil || len(page.Records) != 2 || !page.HasMore || page.Bookmark == "" {
+		fmt.Println("Unexpected first page:", string(res.Payload))
+		t.FailNow()
+	}
+
+	// It should return the last entry on the second page
+	args = [][]byte{[]byte("getAllDataByIDWithPagination"), []byte("1"), []byte("2"), []byte(page.Bookmark)}
+	expectedPayload := "{\"records\":[" + expectedPayload3 + "],\"bookmark\":\"\",\"hasMore\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should return empty page for unknown data entry
+	args = [][]byte{[]byte("getAllDataByIDWithPagination"), []byte("2"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "{\"records\":[],\"bookmark\":\"\",\"hasMore\":false}")
+
+	// It should fail with invalid page size
+	args = [][]byte{[]byte("getAllDataByIDWithPagination"), []byte("1"), []byte("0")}
+	expectedMessage := "Expecting positive integer as page size."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with invalid bookmark
+	args = [][]byte{[]byte("getAllDataByIDWithPagination"), []byte("1"), []byte("2"), []byte("%%%")}
+	expectedMessage = "Invalid bookmark."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with less than 2 args
+	args = [][]byte{[]byte("getAllDataByIDWithPagination"), []byte("1")}
+	expectedMessage = "Incorrect number of arguments. Expecting data entry Id, page size and optional bookmark"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_getDataByPubWithPagination(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("init_test", cc)
+
+	// Init
+	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
+	// create test data of two different entries
+	for _, dataEntryID := range []string{"1", "2"} {
+		args := [][]byte{[]byte("createData"),
+			[]byte(dataEntryID), []byte("test_data"), []byte("10"), []byte("Unit"),
+			[]byte("20181212152030"), []byte("pub_name")}
+		checkInvokeResponse(t, stub, args, "")
+	}
+	expectedPayload := "{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"1\"" +
+		",\"Description\":\"test_data\",\"Value\":\"10\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}"
+	expectedPayload2 := "{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"2\"" +
+		",\"Description\":\"test_data\",\"Value\":\"10\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":20181212152030,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}"
+
+	// It should return all entries if they fit to the page
+	args := [][]byte{[]byte("getDataByPubWithPagination"), []byte("pub_name"), []byte("10"), []byte("")}
+	checkInvokeResponse(t, stub, args,
+		"{\"records\":["+expectedPayload+","+expectedPayload2+"],\"bookmark\":\"\",\"hasMore\":false}")
+
+	// It should fail with empty arg
+	args = [][]byte{[]byte("getDataByPubWithPagination"), []byte(""), []byte("10")}
+	expectedMessage := "Argument at position 1 must be a non-empty string"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with more than 3 args
+	args = [][]byte{[]byte("getDataByPubWithPagination"), []byte("pub_name"), []byte("10"), []byte(""), []byte("")}
+	expectedMessage = "Incorrect number of arguments. Expecting publisher, page size and optional bookmark"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_createDataBatch(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("init_test", cc)
+
+	// Init
+	checkInit(t, stub, [][]byte{[]byte("1")})
+	registerTestPublisher(t, stub, "pub_name", testCreator)
+
+	// It should create all data entries of the batch
+	batch := "[{\"DataEntryID\":\"1\",\"Description\":\"test_data\",\"Value\":\"10\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":1,\"Publisher\":\"pub_name\"}," +
+		"{\"DataEntryID\":\"1\",\"Description\":\"test_data\",\"Value\":\"20\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":2,\"Publisher\":\"pub_name\"}]"
+	args := [][]byte{[]byte("createDataBatch"), []byte(batch), []byte("atomic")}
+	expectedPayload := "[{\"Index\":0,\"DataEntryID\":\"1\",\"CreationTime\":1,\"Status\":200,\"Message\":\"\"}," +
+		"{\"Index\":1,\"DataEntryID\":\"1\",\"CreationTime\":2,\"Status\":200,\"Message\":\"\"}]"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// Both records and publisher index should be in the state
+	args = [][]byte{[]byte("getDataByIDAndTime"), []byte("1"), []byte("2")}
+	expectedPayload = "{\"RecordType\":\"DATA_ENTRY\",\"DataEntryID\":\"1\"" +
+		",\"Description\":\"test_data\",\"Value\":\"20\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":2,\"Publisher\":\"pub_name\",\"PublisherID\":\"" + testCreatorID + "\"}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	pubIDIndexKey, _ := stub.CreateCompositeKey("Publisher~DataEntryID~CreationTime", []string{"pub_name", "1", "2"})
+	checkState(t, stub, pubIDIndexKey, "\x00")
+
+	// It should reject the whole batch in atomic mode if one data entry is invalid
+	batch = "[{\"DataEntryID\":\"2\",\"Description\":\"test_data\",\"Value\":\"10\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":1,\"Publisher\":\"pub_name\"}," +
+		"{\"DataEntryID\":\"2\",\"Description\":\"\",\"Value\":\"20\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":2,\"Publisher\":\"pub_name\"}]"
+	args = [][]byte{[]byte("createDataBatch"), []byte(batch), []byte("atomic")}
+	expectedMessage := "Data entry at index 1 rejected: Argument at position 2 must be a non-empty string"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should report result of each data entry in partial mode
+	batch = "[{\"DataEntryID\":\"3\",\"Description\":\"test_data\",\"Value\":\"10\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":1,\"Publisher\":\"pub_name\"}," +
+		"{\"DataEntryID\":\"3\",\"Description\":\"test_data\",\"Value\":\"20\",\"Unit\":\"Unit\"," +
+		"\"CreationTime\":1,\"Publisher\":\"pub_name\"}]"
+	args = [][]byte{[]byte("createDataBatch"), []byte(batch), []byte("partial")}
+	expectedPayload = "[{\"Index\":0,\"DataEntryID\":\"3\",\"CreationTime\":1,\"Status\":200,\"Message\":\"\"}," +
+		"{\"Index\":1,\"DataEntryID\":\"3\",\"CreationTime\":1,\"Status\":500," +
+		"\"Message\":\"This data entry already exists: 3~1\"}]"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail with unknown mode
+	args = [][]byte{[]byte("createDataBatch"), []byte(batch), []byte("lol")}
+	expectedMessage = "Expecting atomic or partial as mode."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with empty batch
+	args = [][]byte{[]byte("createDataBatch"), []byte("[]"), []byte("atomic")}
+	expectedMessage = "Batch must contain at least one data entry."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail if the batch is not JSON array
+	args = [][]byte{[]byte("createDataBatch"), []byte("lol"), []byte("atomic")}
+	checkInvokeFail(t, stub, args)
+
+	// It should fail with less than 2 args
+	args = [][]byte{[]byte("createDataBatch"), []byte(batch)}
+	expectedMessage = "Incorrect number of arguments. Expecting JSON array of data entries and mode"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_createDataPublisherIdentity(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("init_test", cc)
+
+	// Init
+	checkInit(t, stub, [][]byte{[]byte("1")})
+
+	// It should bind publisher name that is not registered to the identity publishing under it first
+	args := [][]byte{[]byte("createData"),
+		[]byte("11"), []byte("test_data"), []byte("10"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("first_pub")}
+	checkInvokeResponse(t, stub, args, "")
+	firstPublisherKey, _ := stub.CreateCompositeKey("Publisher~Identity", []string{"first_pub"})
+	checkState(t, stub, firstPublisherKey, testCreatorID)
+
+	// It should not create data under publisher name bound to the first identity by another identity
+	otherCreator := newTestCreator("City2MSP", "other_user")
+	args = [][]byte{[]byte("createData"),
+		[]byte("12"), []byte("test_data"), []byte("10"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("first_pub")}
+	res := mockInvokeAs(stub, otherCreator, "12", args)
+	expectedMessage := "Publisher verification failed: Publisher first_pub is bound to another identity"
+	if res.Status == shim.OK || res.Message != expectedMessage {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, res.Message)
+		t.Fail()
+	}
+
+	// It should not register publisher by other identity than the administrator
+	args = [][]byte{[]byte("registerPublisher"), []byte("pub_name"), []byte(testCreatorID)}
+	expectedMessage = "Caller is not the administrator of the chaincode"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should not register publisher with identity that is not serialized identity
+	args = [][]byte{[]byte("registerPublisher"), []byte("pub_name"), []byte("City1MSP::pub_user")}
+	res = mockInvokeAs(stub, nil, "1", args)
+	if res.Status == shim.OK || res.Message != "Expecting base64 encoded serialized identity." {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, res.Message)
+		t.Fail()
+	}
+
+	// It should create data under publisher name registered to the test creator
+	registerTestPublisher(t, stub, "pub_name", testCreator)
+	args = [][]byte{[]byte("createData"),
+		[]byte("1"), []byte("test_data"), []byte("10"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("pub_name")}
+	checkInvokeResponse(t, stub, args, "")
+	publisherKey, _ := stub.CreateCompositeKey("Publisher~Identity", []string{"pub_name"})
+	checkState(t, stub, publisherKey, testCreatorID)
+
+	// It should not create data under publisher name of another identity
+	args = [][]byte{[]byte("createData"),
+		[]byte("2"), []byte("test_data"), []byte("10"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("pub_name")}
+	res = mockInvokeAs(stub, otherCreator, "2", args)
+	expectedMessage = "Publisher verification failed: Publisher pub_name is bound to another identity"
+	if res.Status == shim.OK || res.Message != expectedMessage {
+		fmt.Println("Expected message:", expectedMessage)
+		fmt.Println("Instead got this:", res.Message)
+		t.Fail()
+	}
+
+	// It should create data under publisher name rebound to another identity by the administrator
+	registerTestPublisher(t, stub, "pub_name", otherCreator)
+	res = mockInvokeAs(stub, otherCreator, "3", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+
+	// It should accept renewed certificate of the registered identity
+	renewedCreator := newTestCreator("City2MSP", "other_user")
+	args = [][]byte{[]byte("createData"),
+		[]byte("3"), []byte("test_data"), []byte("10"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("pub_name")}
+	res = mockInvokeAs(stub, renewedCreator, "4", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+
+	// It should migrate publisher bound as MSPID::CommonName to the serialized identity
+	legacyKey, _ := stub.CreateCompositeKey("Publisher~Identity", []string{"legacy_pub"})
+	stub.MockTransactionStart("5")
+	stub.PutState(legacyKey, []byte("City1MSP::pub_user"))
+	stub.MockTransactionEnd("5")
+	args = [][]byte{[]byte("createData"),
+		[]byte("4"), []byte("test_data"), []byte("10"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("legacy_pub")}
+	checkInvokeResponse(t, stub, args, "")
+	checkState(t, stub, legacyKey, testCreatorID)
+
+	// It should not create data without creator certificate
+	args = [][]byte{[]byte("createData"),
+		[]byte("5"), []byte("test_data"), []byte("10"), []byte("Unit"),
+		[]byte("20181212152030"), []byte("pub_name")}
+	res = mockInvokeAs(stub, nil, "6", args)
+	if res.Status == shim.OK {
+		fmt.Println("Invoke", args, "should fail")
+		t.Fail()
+	}
+}
@@ -2,16 +2,22 @@ package main
 
 import (
 	"bytes"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math"
+	"math/big"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
-	//"crypto/x509"
-	//"encoding/pem"
+	"unicode/utf8"
 
-	//"github.com/golang/protobuf/proto"
-	//"github.com/hyperledger/fabric/protos/msp"
+	"github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
 	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
@@ -23,18 +29,277 @@ type Chaincode struct {
 
 // Account represents account of a member
 type Account struct {
+	RecordType string   // RecordType is used to distinguish the various types of objects in state database
+	AccountID  string   // unique id of the account
+	Name       string   // name of the account (holder)
+	OwnerID    string   // Cryptographic account holder identity (base64 encoded serialized identity)
+	Tokens     int64    // amount of tokens (money)
+	Status     string   // status of the account (active|frozen|closed)
+	Owners     []string `json:",omitempty"` // identities of owners of multi-signature account (base64 encoded)
+	Threshold  int      `json:",omitempty"` // number of owners that have to approve transfer from multi-signature account
+	FrozenBy   string   `json:",omitempty"` // who froze the account (settlement|admin), settlement activates only its own
+}
+
+// TransferProposal represents transfer from multi-signature account waiting for approvals of its owners
+type TransferProposal struct {
+	RecordType    string   // RecordType is used to distinguish the various types of objects in state database
+	ProposalID    string   // TxID of the transaction that proposed the transfer
+	FromAccountID string   // account ID of the multi-signature account
+	ToAccountID   string   // account ID of the recipient
+	Amount        int64    // amount of tokens in the smallest units
+	TokenType     string   // symbol of the token type
+	DataPurchase  bool     // true if the transfer is payment for data purchase
+	Approvals     []string // identities of owners that approved the transfer (base64 encoded)
+	Expiry        string   // time after which the proposal cannot be approved (RFC 3339)
+	State         string   // state of the proposal (Proposed|Executed|Cancelled)
+	ExecutedTxID  string   // TxID of the transaction that executed the transfer
+	Action        string   `json:",omitempty"` // delete if the owners approve deletion of the account instead of transfer
+}
+
+// Allowance represents amount of tokens that holder of spender account can send from owner account
+type Allowance struct {
+	RecordType string // RecordType is used to distinguish the various types of objects in state database
+	Owner      string // account ID of the owner of the tokens
+	Spender    string // account ID of the spender
+	Tokens     int64  // amount of tokens that can be sent
+}
+
+// BatchItem represents single recipient of the batch transfer
+type BatchItem struct {
+	To     string      // account ID of the recipient
+	Amount json.Number // amount of transfered tokens as decimal number of the default token type
+}
+
+// BatchTransfer represents transfer of tokens from one account to more recipients in a single transaction
+type BatchTransfer struct {
+	TxID   string      // ID of the transaction
+	Sender string      // account ID of the sender
+	Amount json.Number // amount of tokens taken from the sender as decimal number of the default token type
+	Fee    json.Number // fee paid by the sender to the treasury account for all recipients
+	Items  []BatchItem // recipients and their amounts of tokens
+}
+
+// ExchangeRate represents exchange rate of a token pair published by the administrator. Amount of tokens
+// of the target token type is amount of the source token type * Numerator / Denominator
+type ExchangeRate struct {
+	RecordType        string // RecordType is used to distinguish the various types of objects in state database
+	FromType          string // symbol of the source token type
+	ToType            string // symbol of the target token type
+	Numerator         int64  // numerator of the rate
+	Denominator       int64  // denominator of the rate
+	TreasuryAccountID string // account that provides liquidity of the pair
+	TxID              string // ID of the transaction that published the rate
+	Timestamp         string // time of the transaction that published the rate (RFC 3339)
+}
+
+// TokenSwap represents conversion of tokens of an account against the treasury account
+type TokenSwap struct {
+	TxID              string      // ID of the transaction
+	AccountID         string      // account that swapped the tokens
+	TreasuryAccountID string      // account that provided liquidity
+	FromType          string      // symbol of the source token type
+	FromAmount        json.Number // amount of tokens taken from the account as decimal number of the source token type
+	ToType            string      // symbol of the target token type
+	ToAmount          json.Number // amount of tokens given to the account as decimal number of the target token type
+}
+
+// AccountSettlement represents balances and status of an account checked by settleFastTransfers
+type AccountSettlement struct {
+	AccountID string                 // unique id of the account
+	Tokens    map[string]json.Number // amount of tokens by token type as decimal number of the token type
+	Status    string                 // status of the account (active|frozen|closed)
+}
+
+// TransferFee represents fee of a kind of transfer paid by the sender to the treasury account
+type TransferFee struct {
+	Flat        int64 // flat fee in the smallest units of the default token type
+	BasisPoints int64 // fee in hundredths of percent of the amount of transferred tokens
+}
+
+// FeeSchedule represents fees of all kinds of transfers and the account that receives them
+type FeeSchedule struct {
+	Fast              TransferFee // fee of sendTokensFast
+	Safe              TransferFee // fee of sendTokensSafe
+	DataPurchase      TransferFee // fee of payment for data purchase sent by sendTokensFast or sendTokensSafe
+	TreasuryAccountID string      // account ID of the treasury that receives the fees
+}
+
+// PrunePolicy represents when pruneDueAccounts compacts deltas of an account into its checkpoint
+type PrunePolicy struct {
+	MaxDeltas int64 // highest number of deltas of an account that is not compacted
+	MinAge    int64 // number of seconds after which a delta can be compacted
+}
+
+// PruneSummary represents accounts of a page checked by pruneDueAccounts
+type PruneSummary struct {
+	Accounts       int64  // number of checked accounts
+	PrunedAccounts int64  // number of accounts over the threshold that were compacted
+	PrunedDeltas   int64  // number of deltas added to checkpoints
+	Bookmark       string // bookmark of the next page
+	HasMore        bool   // true if there are more accounts to check
+}
+
+// RollForwardSummary represents accounts of a page checked by rollForwardReceivers
+type RollForwardSummary struct {
+	Accounts       int64  // number of checked accounts
+	RolledAccounts int64  // number of accounts that received the checkpoint deltas and were rolled forward
+	RolledDeltas   int64  // number of deltas added to checkpoints
+	Bookmark       string // bookmark of the next page
+	HasMore        bool   // true if there are more accounts to check
+}
+
+// TxDetails represents participants, amount and state of transaction
+type TxDetails struct {
+	TxID      string      // ID of the transaction
+	Sender    string      // account ID of the sender
+	Recipient string      // account ID of the recipient
+	Amount    json.Number // amount of transfered tokens as decimal number of the token type
+	Fee       json.Number // fee paid by the sender to the treasury account
+	TokenType string      // symbol of the token type
+	State     string      // state of the transaction (ValidTx|PendingTx|RefundedTx)
+	Timestamp string      // time of the transaction (RFC 3339)
+	Expiry    string      // time after which the pending Tx can be refunded and cannot be used for data purchase (RFC 3339)
+	SpenderID string      // identity (base64 serialized) of the holder who sent the tokens within allowance of the sender
+}
+
+// AccountTx represents single transaction from the point of view of an account
+type AccountTx struct {
+	TxID         string      // ID of the transaction
+	Direction    string      // direction of the tokens (in|out)
+	Amount       json.Number // amount of transfered tokens as decimal number of the token type
+	TokenType    string      // symbol of the token type
+	Counterparty string      // account ID of the other participant
+	State        string      // state of the transaction (ValidTx|PendingTx|OrphanTx)
+	Timestamp    string      // time of the transaction (RFC 3339)
+}
+
+// Checkpoint represents tokens of an account from all transactions that were rolled forward.
+// The balance of the account is the checkpoint plus deltas in the index of account entries of the token type
+// recorded since the checkpoint
+type Checkpoint struct {
 	RecordType string // RecordType is used to distinguish the various types of objects in state database
 	AccountID  string // unique id of the account
-	Name       string // name of the account (holder)
-	OwnerID    string // Cryptographic account holder identity
+	TokenType  string // symbol of the token type
 	Tokens     int64  // amount of tokens (money)
+	TxID       string // ID of the transaction that rolled the checkpoint forward
+	Timestamp  string // time of the transaction that rolled the checkpoint forward (RFC 3339)
+}
+
+// TokenType represents a registered type of tokens (currency). Amounts of tokens are in the smallest units
+type TokenType struct {
+	RecordType string // RecordType is used to distinguish the various types of objects in state database
+	Symbol     string // unique symbol of the token type
+	Decimals   int    // number of decimal places of the smallest unit
+	Issuer     string // identity of the issuer who can mint and burn the tokens
+}
+
+// Counterpart - represents trusted chaincode on another channel which can be invoked by this chaincode
+type Counterpart struct {
+	RecordType    string // RecordType is used to distinguish the various types of objects in state database
+	Role          string // role of the chaincode (ad)
+	Channel       string // channel where the chaincode is instantiated
+	ChaincodeName string // name of the chaincode
+}
+
+// AccountBalance represents sum of all transactions of an account
+type AccountBalance struct {
+	AccountID string // unique id of the account
+	Tokens    int64  // amount of tokens (money)
+}
+
+// AccountBalances represents balances of all token types of an account
+type AccountBalances struct {
+	AccountID string           // unique id of the account
+	Tokens    map[string]int64 // amount of tokens by token type
+}
+
+// BalanceSnapshot represents snapshot of balances of all accounts
+type BalanceSnapshot struct {
+	RecordType  string           // RecordType is used to distinguish the various types of objects in state database
+	SnapshotID  string           // unique id of the snapshot
+	Timestamp   string           // time of the first batch of the snapshot, balances are recorded as of this time (RFC 3339)
+	Accounts    int64            // number of accounts in the snapshot
+	TotalTokens map[string]int64 // sum of balances of all accounts in the snapshot by token type
+	Complete    bool             // true if balances of all accounts were recorded
+}
+
+// OrphanRow represents an index entry without its counterpart in the other index
+type OrphanRow struct {
+	Index  string   // name of the composite key index
+	Key    []string // attributes of the composite key
+	Reason string   // which entry is missing
+}
+
+// AuditReport represents result of the ledger consistency audit
+type AuditReport struct {
+	TotalSupply      int64            // sum of all account balances and pending amounts
+	RecordedSupply   int64            // amount of tokens in circulation recorded by Init, mintTokens and burnTokens
+	PendingAmount    int64            // amount of tokens in pending transactions
+	PendingTxCount   int              // number of pending transactions
+	NegativeBalances []AccountBalance // accounts with negative sum of transactions
+	OrphanRows       []OrphanRow      // index entries without counterpart in the other index
+	Passed           bool             // true if no inconsistency was found
+}
+
+// RepairChange represents a change of chaincode state planned or done by repairIndexes
+type RepairChange struct {
+	Action string   // add|delete|update
+	Index  string   // name of the composite key index or Account
+	Key    []string // attributes of the composite key or account ID
+	Reason string   // why the change is needed
 }
 
-// LimitTokens - limits the highest number of tokens that can be transfered
+// RepairResult represents changes of a single account or Tx entry checked by repairIndexes
+type RepairResult struct {
+	Key     []string       // attributes of the checked composite key
+	Changes []RepairChange // changes of the chaincode state
+}
+
+// DefaultTokenType - symbol of the token type of all tokens created before token types were introduced.
+// Composite keys of the default token type have no token type attribute, so the existing entries keep working
+var DefaultTokenType = "TOK"
+
+// DefaultDecimals - number of decimal places of the default token type. Amounts are kept as integers
+// in the smallest units, e.g. "0.0025" is 25 units with 4 decimals.
+// It can be changed by the administrator with setTokenDecimals while there are no tokens in circulation
+var DefaultDecimals = 0
+
+// PendingTxExpiry - default number of seconds after which the sender can refund
+// the pending transaction for data purchase that was not used to reveal the data.
+// It can be changed by the administrator with setPendingTxExpiry
+var PendingTxExpiry int64 = 86400
+
+// TransferProposalExpiry - default number of seconds after which the transfer proposal of multi-signature
+// account cannot be approved anymore.
+// It can be changed by the administrator with setTransferProposalExpiry
+var TransferProposalExpiry int64 = 86400
+
+// CheckpointDeltas - default number of deltas of an account after which the checkpoint of the account
+// is rolled forward by the next transfer with check of sender's tokens. Accounts that only receive tokens
+// are rolled forward by pruneDueAccounts. Zero disables the roll forward.
+// It can be changed by the administrator with setCheckpointDeltas
+var CheckpointDeltas int64 = 100
+
+// PruneMaxDeltas and PruneMinAge - default prune policy used by pruneDueAccounts. Accounts with more deltas
+// than PruneMaxDeltas are compacted, but only deltas older than PruneMinAge seconds are added to the checkpoint.
+// It can be changed by the administrator with setPrunePolicy
+var PruneMaxDeltas int64 = 100
+var PruneMinAge int64 = 3600
+
+// LimitTokens - default limit of the highest number of tokens that can be transfered
 // from account without immediate verification of available tokens.
-// This provides high throughput required for IoT data an many transactions per sec
+// This provides high throughput required for IoT data an many transactions per sec.
+// It can be changed in Init or by the administrator with setFastTransferLimit for all or single account
 var LimitTokens int64 = 1
 
+// MaxRepairKeys - limits the number of index entries that can be repaired in one repairIndexes transaction.
+// This keeps the transaction within the size limits of the ordering service.
+const MaxRepairKeys = 100
+
+// MaxRepairAccountEntries - limits the number of account entries read by the repair of one account.
+// Accounts with more entries are pruned by pruneAccountTx before the repair.
+const MaxRepairAccountEntries = 1000
+
 // Main function
 /////////////////
 func main() {
@@ -54,11 +319,12 @@ func (cc *Chaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	argsCount := 1
 	// Set number of init accounts to create
 	noOfAccounts := 1
-	//           1
-	// "Initial amount of tokens"
+	//           0                     1               2                   3                    4
+	// "Initial amount of tokens" ["channelAd" "chaincodeAdName"] ["Fast transfer limit"] ["Treasury account ID"]
+	// Optional arguments followed by another one can be empty strings, so each of them can be passed alone
 
 	args := stub.GetStringArgs()
-	if len(args) != argsCount {
+	if len(args) < argsCount || len(args) > argsCount+4 {
 		return shim.Error(`Incorect number of arguments.
 			Expectiong number of accounts and tokens to create`)
 	}
@@ -68,10 +334,35 @@ func (cc *Chaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
 		}
 	}
+	if len(args) >= argsCount+2 && (len(args[1]) <= 0) != (len(args[2]) <= 0) {
+		return shim.Error("Expecting both channel and name of the ad chaincode or none of them.")
+	}
+	if len(args) > argsCount && len(args[len(args)-1]) <= 0 {
+		return shim.Error("Argument at position " + strconv.Itoa(len(args)) + " must be a non-empty string")
+	}
 
-	tokens, err := strconv.ParseInt(args[0], 10, 64)
+	// Amounts are in decimals of the default token type. Decimals set before the upgrade are kept
+	registeredTokenType, err := getTokenTypeValue(stub, DefaultTokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokens, err := parseAmount(args[0], registeredTokenType.Decimals)
 	if err != nil || tokens < 0 {
-		return shim.Error("Expecting positiv integer or zero as number of tokens to init.")
+		return shim.Error("Expecting positiv amount or zero as number of tokens to init.")
+	}
+
+	// Fast transfer limit is the last optional argument or it is followed by the treasury account
+	limitTokensStr := ""
+	limitIndex := len(args) - 1
+	if len(args) == argsCount+4 {
+		limitIndex = 3
+	}
+	if (len(args) == argsCount+1 || len(args) >= argsCount+3) && len(args[limitIndex]) > 0 {
+		limitTokens, err := parseAmount(args[limitIndex], registeredTokenType.Decimals)
+		if err != nil || limitTokens < 0 {
+			return shim.Error("Expecting positiv amount or zero as fast transfer limit.")
+		}
+		limitTokensStr = strconv.FormatInt(limitTokens, 10)
 	}
 
 	// GetCreator returns the identity object of the chaincode invocation's submitter
@@ -80,10 +371,21 @@ func (cc *Chaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		return shim.Error("Failed to get creator ID." + err.Error())
 	}
 
+	// The init account exists if the chaincode is upgraded. Tokens are created only at the instantiation
+	initAccountAsBytes, err := stub.GetState("1")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	upgrade := initAccountAsBytes != nil
+	if upgrade {
+		noOfAccounts = 0
+	}
+
 	// Create account objects in array
 	accounts := make([]*Account, noOfAccounts)
 	for i := 0; i < noOfAccounts; i++ {
-		accounts[i] = &Account{"ACCOUNT", strconv.Itoa(i + 1), "Init_Account", string(creatorID), tokens}
+		accounts[i] = &Account{"ACCOUNT", strconv.Itoa(i + 1), "Init_Account", base64.StdEncoding.EncodeToString(creatorID), tokens, "active",
+			nil, 0, ""}
 	}
 
 	// marshal each account object and save to the blockchain
@@ -103,17 +405,13 @@ func (cc *Chaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	// An 'index' is a normal key/value entry in state.
 	// The key is a composite key, with the elements that you want to range get on listed first.
 	txID := stub.GetTxID()
+	txTimestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 	for i := 0; i < noOfAccounts; i++ {
 		// Maintain index "Account~op~Tok~TxID"
-		txRecipientIDCompositeKey, err := stub.CreateCompositeKey("Account~op~Tok~TxID",
-			[]string{strconv.Itoa(i + 1), "+", strconv.FormatInt(tokens, 10), txID})
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-
-		// Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
-		value := []byte{0x00}
-		stub.PutState(txRecipientIDCompositeKey, value)
+		err = putAccountEntry(stub, strconv.Itoa(i+1), "+", strconv.FormatInt(tokens, 10), txID, DefaultTokenType)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
@@ -124,7 +422,8 @@ func (cc *Chaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-		stub.PutState(txParticipantsTokCompositeKey, value)
+		// The value of the Tx entry is the time of the transaction
+		err = stub.PutState(txParticipantsTokCompositeKey, txTimestamp)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
@@ -135,7 +434,111 @@ func (cc *Chaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-		stub.PutState(nameIDIndexKey, value)
+
+		// Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
+		value := []byte{0x00}
+		err = stub.PutState(nameIDIndexKey, value)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// Track the amount of tokens in circulation. Ledgers of older versions do not track it,
+	// so it is computed from the token indexes at their upgrade
+	totalSupplyKey, err := stub.CreateCompositeKey("TotalSupply", tokenTypeKeys([]string{}, DefaultTokenType))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	totalSupplyAsBytes, err := stub.GetState(totalSupplyKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if totalSupplyAsBytes == nil {
+		totalSupply := tokens * int64(noOfAccounts)
+		if upgrade {
+			totalSupply, err = computeTotalSupply(stub, DefaultTokenType)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		err = putTotalSupply(stub, DefaultTokenType, totalSupply)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// Register the default token type issued by the administrator. Decimals and issuer set before the upgrade are kept
+	tokenTypeKey, err := stub.CreateCompositeKey("TokenType~Symbol", []string{DefaultTokenType})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokenTypeAsBytes, err := stub.GetState(tokenTypeKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if tokenTypeAsBytes == nil {
+		tokenTypeAsBytes, err = json.Marshal(&TokenType{"TOKENTYPE", DefaultTokenType, DefaultDecimals, base64.StdEncoding.EncodeToString(creatorID)})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.PutState(tokenTypeKey, tokenTypeAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// The submitter of the instantiation becomes the administrator of the chaincode.
+	// The administrator is not replaced by the submitter of the upgrade
+	adminKey, err := stub.CreateCompositeKey("Admin", []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	adminAsBytes, err := stub.GetState(adminKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if adminAsBytes == nil {
+		err = stub.PutState(adminKey, []byte(base64.StdEncoding.EncodeToString(creatorID)))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// Trusted chaincode of data entry ads is optional. It can be set later by the administrator
+	if len(args) >= argsCount+2 && len(args[1]) > 0 {
+		err = putTrustedChaincode(stub, "ad", args[1], args[2])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// Fast transfer limit is optional. LimitTokens is used if it is not set
+	if limitTokensStr != "" {
+		err = putConfig(stub, "LimitTokens", limitTokensStr)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// Fees are credited to the first account if the treasury account is not set. The treasury account
+	// set before the upgrade is kept, it can be changed only by setFeeTreasury
+	if len(args) == argsCount+4 {
+		treasuryAccountID, err := getConfigString(stub, "FeeTreasury", "")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if treasuryAccountID == "" {
+			treasuryAccountAsBytes, err := stub.GetState(args[4])
+			if err != nil {
+				return shim.Error(err.Error())
+			} else if treasuryAccountAsBytes == nil {
+				return shim.Error("Account does not exist: " + args[4])
+			}
+			err = putConfig(stub, "FeeTreasury", args[4])
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
 	}
 
 	// Return the TxID
@@ -150,28 +553,122 @@ func (cc *Chaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	// Handle different functions
 	if function == "createAccount" { //create a new account
 		return cc.createAccount(stub, args)
+	} else if function == "createMultiSigAccount" { // create a new account owned by more identities with M-of-N threshold
+		return cc.createMultiSigAccount(stub, args)
 	} else if function == "deleteAccountByID" { // delete an account by account Id
 		return cc.deleteAccountByID(stub, args)
 	} else if function == "getAccountByID" { // get an account by its Id
 		return cc.getAccountByID(stub, args)
 	} else if function == "getAccountByName" { // find an account base on name of account holder
 		return cc.getAccountByName(stub, args)
+	} else if function == "getAccountByNameWithPagination" { // get page of accounts base on name of account holder
+		return cc.getAccountByNameWithPagination(stub, args)
 	} else if function == "sendTokensFast" { // transfer tokens from one account to another without check
 		return cc.sendTokensFast(stub, args)
 	} else if function == "sendTokensSafe" { // transfer tokens from one account to another with check
 		return cc.sendTokensSafe(stub, args)
+	} else if function == "approveTransfer" { // approve transfer proposal of multi-signature account (owner only)
+		return cc.approveTransfer(stub, args)
+	} else if function == "cancelTransfer" { // cancel transfer proposal of multi-signature account (owner only)
+		return cc.cancelTransfer(stub, args)
+	} else if function == "getTransferProposal" { // get transfer proposal of multi-signature account with approvals
+		return cc.getTransferProposal(stub, args)
+	} else if function == "sendTokensBatch" { // transfer tokens from one account to more accounts with check
+		return cc.sendTokensBatch(stub, args)
+	} else if function == "approve" { // allow holder of another account to send tokens from the account
+		return cc.approve(stub, args)
+	} else if function == "getAllowance" { // get amount of tokens that spender can send from the account
+		return cc.getAllowance(stub, args)
+	} else if function == "sendTokensFrom" { // transfer tokens from account of another holder within allowance
+		return cc.sendTokensFrom(stub, args)
+	} else if function == "setExchangeRate" { // publish exchange rate of token pair (admin only)
+		return cc.setExchangeRate(stub, args)
+	} else if function == "getExchangeRate" { // get current exchange rate of token pair
+		return cc.getExchangeRate(stub, args)
+	} else if function == "getExchangeRateHistory" { // get all published exchange rates of token pair with pagination
+		return cc.getExchangeRateHistory(stub, args)
+	} else if function == "swapTokens" { // convert tokens of account to another token type against treasury account
+		return cc.swapTokens(stub, args)
 	} else if function == "updateAccountTokens" { // update state of account (value of tokens)
 		return cc.updateAccountTokens(stub, args)
 	} else if function == "getAccountTokens" { // get the current value of tokens on account
 		return cc.getAccountTokens(stub, args)
 	} else if function == "getAccountHistoryByID" { // get history for an account by its Id
 		return cc.getAccountHistoryByID(stub, args)
-	} else if function == "getTxDetails" { // get transaction details (sender->recipient->tokens->[Pending|Valid])
+	} else if function == "getAccountTransactions" { // get page of transactions of an account
+		return cc.getAccountTransactions(stub, args)
+	} else if function == "getTxDetails" { // get transaction details (sender, recipient, tokens, [Pending|Valid], time)
 		return cc.getTxDetails(stub, args)
 	} else if function == "changePendingTx" { // change tx pending to tx valid so recipient can use the tokens
 		return cc.changePendingTx(stub, args)
 	} else if function == "pruneAccountTx" { // change tx pending to tx valid so recipient can use the tokens
 		return cc.pruneAccountTx(stub, args)
+	} else if function == "registerTokenType" { // register new token type issued by the caller
+		return cc.registerTokenType(stub, args)
+	} else if function == "getTokenType" { // get symbol, decimals and issuer of the token type
+		return cc.getTokenType(stub, args)
+	} else if function == "setTokenDecimals" { // change decimals of the token type without tokens in circulation
+		return cc.setTokenDecimals(stub, args)
+	} else if function == "mintTokens" { // create new tokens on account (issuer of the token type only)
+		return cc.mintTokens(stub, args)
+	} else if function == "burnTokens" { // take tokens out of circulation (issuer of the token type only)
+		return cc.burnTokens(stub, args)
+	} else if function == "getTotalSupply" { // get the amount of tokens in circulation
+		return cc.getTotalSupply(stub, args)
+	} else if function == "createBalanceSnapshot" { // record balances of a batch of accounts into a snapshot (admin only)
+		return cc.createBalanceSnapshot(stub, args)
+	} else if function == "getBalanceSnapshot" { // get time and totals of a snapshot
+		return cc.getBalanceSnapshot(stub, args)
+	} else if function == "getBalanceAt" { // get balance of an account recorded in a snapshot
+		return cc.getBalanceAt(stub, args)
+	} else if function == "auditLedger" { // check consistency of token indexes and total supply
+		return cc.auditLedger(stub, args)
+	} else if function == "recomputeTotalSupply" { // set total supply to the sum of balances and pending amounts (admin only)
+		return cc.recomputeTotalSupply(stub, args)
+	} else if function == "repairIndexes" { // fix inconsistency of token indexes found by audit (admin only)
+		return cc.repairIndexes(stub, args)
+	} else if function == "refundPendingTx" { // return tokens of expired pending tx to the sender
+		return cc.refundPendingTx(stub, args)
+	} else if function == "setPendingTxExpiry" { // set seconds after which pending tx expires (admin only)
+		return cc.setPendingTxExpiry(stub, args)
+	} else if function == "getPendingTxExpiry" { // get seconds after which pending tx expires
+		return cc.getPendingTxExpiry(stub, args)
+	} else if function == "setTransferProposalExpiry" { // set seconds after which transfer proposal expires (admin only)
+		return cc.setTransferProposalExpiry(stub, args)
+	} else if function == "getTransferProposalExpiry" { // get seconds after which transfer proposal expires
+		return cc.getTransferProposalExpiry(stub, args)
+	} else if function == "settleFastTransfers" { // freeze accounts with negative amount of tokens (admin only)
+		return cc.settleFastTransfers(stub, args)
+	} else if function == "setAccountStatus" { // set status of the account (active|frozen|closed) (admin only)
+		return cc.setAccountStatus(stub, args)
+	} else if function == "setCheckpointDeltas" { // set number of deltas after which checkpoint rolls forward (admin only)
+		return cc.setCheckpointDeltas(stub, args)
+	} else if function == "getCheckpointDeltas" { // get number of deltas after which checkpoint rolls forward
+		return cc.getCheckpointDeltas(stub, args)
+	} else if function == "setPrunePolicy" { // set max number of deltas and min age of compacted deltas (admin only)
+		return cc.setPrunePolicy(stub, args)
+	} else if function == "getPrunePolicy" { // get max number of deltas and min age of compacted deltas
+		return cc.getPrunePolicy(stub, args)
+	} else if function == "pruneDueAccounts" { // compact deltas of accounts over the prune policy (admin only)
+		return cc.pruneDueAccounts(stub, args)
+	} else if function == "rollForwardReceivers" { // roll forward checkpoints of accounts that received checkpoint deltas (admin only)
+		return cc.rollForwardReceivers(stub, args)
+	} else if function == "setFastTransferLimit" { // set limit of fast transfer for all or single account (admin only)
+		return cc.setFastTransferLimit(stub, args)
+	} else if function == "deleteFastTransferLimit" { // remove limit of fast transfer of single account (admin only)
+		return cc.deleteFastTransferLimit(stub, args)
+	} else if function == "getFastTransferLimit" { // get limit of fast transfer for all or single account
+		return cc.getFastTransferLimit(stub, args)
+	} else if function == "setTransferFee" { // set flat and percentage fee of the kind of transfer (admin only)
+		return cc.setTransferFee(stub, args)
+	} else if function == "setFeeTreasury" { // set the account that receives the fees (admin only)
+		return cc.setFeeTreasury(stub, args)
+	} else if function == "getFeeSchedule" { // get fees of all kinds of transfers and the treasury account
+		return cc.getFeeSchedule(stub, args)
+	} else if function == "setTrustedChaincode" { // set trusted chaincode of data entry ads (admin only)
+		return cc.setTrustedChaincode(stub, args)
+	} else if function == "getTrustedChaincode" { // get trusted chaincode of data entry ads
+		return cc.getTrustedChaincode(stub, args)
 	}
 
 	return shim.Error("Received unknown function invocation")
@@ -199,6 +696,11 @@ func (cc *Chaincode) createAccount(stub shim.ChaincodeStubInterface, args []stri
 	accountID := args[0]
 	name := args[1]
 
+	// Names of system participants in Tx entries cannot be used as account IDs
+	if isSystemParticipant(accountID) {
+		return shim.Error("Account ID is reserved: " + accountID)
+	}
+
 	// Check if an account already exists
 	accountAsBytes, err := stub.GetState(accountID)
 	if err != nil {
@@ -215,7 +717,7 @@ func (cc *Chaincode) createAccount(stub shim.ChaincodeStubInterface, args []stri
 
 	// Create Account object and marshal to JSON
 	recordType := "ACCOUNT"
-	accountEntry := &Account{recordType, accountID, name, string(creatorID), 0}
+	accountEntry := &Account{recordType, accountID, name, base64.StdEncoding.EncodeToString(creatorID), 0, "active", nil, 0, ""}
 	accountEntryJSONasBytes, err := json.Marshal(accountEntry)
 	if err != nil {
 		return shim.Error(err.Error())
@@ -239,13 +741,112 @@ func (cc *Chaincode) createAccount(stub shim.ChaincodeStubInterface, args []stri
 	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the data.
 	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
 	value := []byte{0x00}
-	stub.PutState(nameIDIndexKey, value)
+	err = stub.PutState(nameIDIndexKey, value)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Account saved and indexed. Return success
+	return shim.Success([]byte("Account created"))
+}
+
+// createMultiSigAccount - create a new account owned by more identities and store into chaincode state.
+// Transfer from the account has to be approved by the threshold number of owners
+//////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) createMultiSigAccount(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 4
+	//      0         1         2                  3
+	// "AccountID", "Name", "Threshold", "["ownerID",...]"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting account Id, name, threshold and JSON array of owners")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	accountID := args[0]
+	name := args[1]
+	if isSystemParticipant(accountID) {
+		return shim.Error("Account ID is reserved: " + accountID)
+	}
+	var owners []string
+	err = json.Unmarshal([]byte(args[3]), &owners)
+	if err != nil || len(owners) == 0 {
+		return shim.Error("Expecting JSON array of owner identities.")
+	}
+	listedOwners := make(map[string]bool)
+	for _, owner := range owners {
+		if listedOwners[owner] {
+			return shim.Error("Owner is listed more than once.")
+		}
+		listedOwners[owner] = true
+
+		// Owner is base64 encoded serialized identity in the same way as the holder of the account
+		ownerAsBytes, err := base64.StdEncoding.DecodeString(owner)
+		if err != nil {
+			return shim.Error("Expecting base64 encoded serialized identity of each owner.")
+		}
+		_, _, err = getCreatorCertificate(ownerAsBytes)
+		if err != nil {
+			return shim.Error("Expecting base64 encoded serialized identity of each owner.")
+		}
+	}
+	threshold, err := strconv.Atoi(args[2])
+	if err != nil || threshold < 1 || threshold > len(owners) {
+		return shim.Error("Expecting integer from 1 to number of owners as threshold.")
+	}
+
+	// Check if an account already exists
+	accountAsBytes, err := stub.GetState(accountID)
+	if err != nil {
+		return shim.Error("Failed to get account: " + err.Error())
+	} else if accountAsBytes != nil {
+		return shim.Error("This account already exists: " + accountID)
+	}
+
+	// GetCreator returns the identity object of the chaincode invocation's submitter
+	creatorID, err := stub.GetCreator()
+	if err != nil {
+		return shim.Error("Failed to get creator ID." + err.Error())
+	}
+
+	// Create Account object and marshal to JSON
+	accountEntry := &Account{"ACCOUNT", accountID, name, base64.StdEncoding.EncodeToString(creatorID), 0, "active",
+		owners, threshold, ""}
+	accountEntryJSONasBytes, err := json.Marshal(accountEntry)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Save account entry to state
+	err = stub.PutState(accountID, accountEntryJSONasBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	//  Index the account to enable name-based range queries
+	nameIDIndexKey, err := stub.CreateCompositeKey("Name~AccountID", []string{accountEntry.Name, accountEntry.AccountID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	value := []byte{0x00}
+	err = stub.PutState(nameIDIndexKey, value)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
 	// Account saved and indexed. Return success
 	return shim.Success([]byte("Account created"))
 }
 
-// deleteAccountByID - deletes the account if number of tokens is 0
+// deleteAccountByID - deletes the account if number of tokens is 0. Deletion of multi-signature account
+// is proposal that is executed when the threshold number of owners approved it
 ///////////////////////////////////////////////////////////////////////////////////////////////////////
 func (cc *Chaincode) deleteAccountByID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
@@ -274,114 +875,202 @@ func (cc *Chaincode) deleteAccountByID(stub shim.ChaincodeStubInterface, args []
 		return shim.Error(err.Error())
 	}
 
-	// Check if the account have any tokens
-	responseTokens := cc.getAccountTokens(stub, []string{accountID})
-	if responseTokens.Status != shim.OK {
-		return shim.Error(responseTokens.Message)
+	// Only the account holder can delete the account
+	err = checkAccountOwner(stub, &account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Deletion of multi-signature account becomes proposal approved by the caller
+	if account.Threshold > 0 {
+		txID := stub.GetTxID()
+		proposal := &TransferProposal{"TRANSFERPROPOSAL", txID, accountID, "", 0, "", false, []string{}, "",
+			"Proposed", "", "delete"}
+		err = proposeTransfer(stub, &account, proposal)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// Return the ID of the proposal
+		return shim.Success([]byte(txID))
 	}
 
-	// convert Payload to int64
-	remainingTokensStr := string(responseTokens.Payload)
-	remainingTokens, err := strconv.ParseInt(remainingTokensStr, 10, 64)
+	err = deleteAccount(stub, &account)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	if remainingTokens != 0 {
-		return shim.Error("Account cannot be deleted. Amount of tokens is not 0.")
-	}
 
-	// Prune all Tx
-	responsePruneTx := cc.pruneAccountTx(stub, []string{accountID})
-	if responsePruneTx.Status != shim.OK {
-		return shim.Error(responsePruneTx.Message)
+	// Return Success
+	return shim.Success([]byte("Account deleted"))
+}
+
+// deleteAccount - deletes the account with its checkpoints, allowances, limits and Tx entries
+// if the account has no tokens of any token type and no pending transactions
+//////////////////////////////////////////////////////////////////////////////////////////////////
+func deleteAccount(stub shim.ChaincodeStubInterface, account *Account) error {
+	accountID := account.AccountID
+
+	// The open snapshot has to record the balances of the account
+	openSnapshot, err := getOpenSnapshot(stub)
+	if err != nil {
+		return err
+	} else if openSnapshot != nil {
+		return fmt.Errorf("Account cannot be deleted until snapshot %s is complete.", openSnapshot.SnapshotID)
 	}
 
-	// Update Account state before delete
-	responseAccUpdate := cc.updateAccountTokens(stub, []string{accountID})
-	if responseAccUpdate.Status != shim.OK {
-		return shim.Error(responseAccUpdate.Message)
+	// Check if the account have any tokens of any token type
+	tokenTypes, err := getAccountTokenTypes(stub, accountID)
+	if err != nil {
+		return err
+	}
+	for _, tokenType := range tokenTypes {
+		remainingTokens, _, err := getAccountBalance(stub, accountID, tokenType)
+		if err != nil {
+			return err
+		}
+		if remainingTokens != 0 {
+			return fmt.Errorf("Account cannot be deleted. Amount of tokens is not 0.")
+		}
 	}
 
 	// Delete the account state
 	err = stub.DelState(accountID)
 	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
+		return fmt.Errorf("Failed to delete state:%s", err)
 	}
 
 	// Maintain the index Name~AccountID
 	indexName := "Name~AccountID"
 	nameIDIndexKey, err := stub.CreateCompositeKey(indexName, []string{account.Name, account.AccountID})
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
 
 	//  Delete index entry to state.
 	err = stub.DelState(nameIDIndexKey)
 	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
-	}
-
-	// Maintain the index "Account~op~Tok~TxID"
-	// Get the single account transactions for the account ID
-	accountTxIterator, err := stub.GetStateByPartialCompositeKey("Account~op~Tok~TxID",
-		[]string{accountID})
-	if err != nil {
-		return shim.Error(err.Error())
+		return fmt.Errorf("Failed to delete state:%s", err)
 	}
-	defer accountTxIterator.Close()
 
-	// If it is created account without any Tx then do not have to delete aby Tx in index
-	if accountTxIterator.HasNext() {
-		// Get the row
-		responseAccTxRange, err := accountTxIterator.Next()
+	// Delete checkpoints of all token types of the account
+	for _, tokenType := range tokenTypes {
+		checkpointKey, err := stub.CreateCompositeKey("Checkpoint~AccountID", tokenTypeKeys([]string{accountID}, tokenType))
 		if err != nil {
-			return shim.Error(err.Error())
+			return err
 		}
-
-		// Get separate parts of composite key
-		_, compositeKey, err := stub.SplitCompositeKey(responseAccTxRange.Key)
-		lastTxToDel := compositeKey[3]
+		err = stub.DelState(checkpointKey)
 		if err != nil {
-			return shim.Error(err.Error())
+			return fmt.Errorf("Failed to delete state:%s", err)
 		}
+	}
 
-		//  Delete index entry in the ledger.
-		err = stub.DelState(responseAccTxRange.Key)
+	// Delete allowances to spend tokens from the account
+	allowanceIterator, err := stub.GetStateByPartialCompositeKey("Allowance~Owner~Spender", []string{accountID})
+	if err != nil {
+		return err
+	}
+	defer allowanceIterator.Close()
+	for allowanceIterator.HasNext() {
+		responseRange, err := allowanceIterator.Next()
 		if err != nil {
-			return shim.Error(err.Error())
+			return err
 		}
-
-		// Maintain the index "TxID~Sender~Recipient~Tok"
-		txParticipantsTokIterator, err := stub.GetStateByPartialCompositeKey("TxID~Sender~Recipient~Tok",
-			[]string{lastTxToDel})
+		err = stub.DelState(responseRange.Key)
 		if err != nil {
-			return shim.Error(err.Error())
+			return fmt.Errorf("Failed to delete state:%s", err)
 		}
-		defer txParticipantsTokIterator.Close()
+	}
 
-		// Check if the TxID is in the TxID~Sender~Recipient~Tok index
-		if !txParticipantsTokIterator.HasNext() {
-			return shim.Error("DeleteAccount: There was an entry in one index but no entry in the second index")
+	// Delete the fast transfer limits of all token types of the account
+	accountLimitIterator, err := stub.GetStateByPartialCompositeKey("LimitTokens~AccountID", []string{accountID})
+	if err != nil {
+		return err
+	}
+	defer accountLimitIterator.Close()
+	for accountLimitIterator.HasNext() {
+		responseRange, err := accountLimitIterator.Next()
+		if err != nil {
+			return err
 		}
-
-		// Get the row
-		responseTxParticipantsRange, err := txParticipantsTokIterator.Next()
+		err = stub.DelState(responseRange.Key)
 		if err != nil {
-			return shim.Error(err.Error())
+			return fmt.Errorf("Failed to delete state:%s", err)
 		}
+	}
 
-		// // Delete the Tx entry in "TxID~Sender~Recipient~Tok"
-		err = stub.DelState(responseTxParticipantsRange.Key)
+	// Maintain the indexes of account entries of all token types of the account
+	for _, tokenType := range tokenTypes {
+		err = deleteAccountEntries(stub, accountID, tokenType)
 		if err != nil {
-			return shim.Error(err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteAccountEntries - removes the account entries of the token type of the deleted account and the Tx entries
+// that the other participants do not need anymore. Account with pending transactions cannot be deleted
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func deleteAccountEntries(stub shim.ChaincodeStubInterface, accountID string, tokenType string) error {
+	// Get all account transactions of the token type for the account ID
+	accountTxIterator, err := getAccountEntries(stub, accountID, tokenType)
+	if err != nil {
+		return err
+	}
+	defer accountTxIterator.Close()
+
+	// If it is created account without any Tx then do not have to delete any Tx in index
+	for accountTxIterator.HasNext() {
+		// Get the row
+		responseAccTxRange, err := accountTxIterator.Next()
+		if err != nil {
+			return err
+		}
+
+		// Get separate parts of composite key
+		compositeKeyParts, err := splitAccountEntryKey(stub, responseAccTxRange.Key)
+		if err != nil {
+			return err
+		}
+		operation := compositeKeyParts[1]
+		tokensStr := compositeKeyParts[2]
+		txID := compositeKeyParts[3]
+
+		// Find the Tx entry in the index "TxID~Sender~Recipient~Tok"
+		txEntryKey, counterpart, err := getTxEntry(stub, "TxID~Sender~Recipient~Tok", accountID, operation, tokensStr,
+			txID, tokenType)
+		if err != nil {
+			return err
 		}
-		if !txParticipantsTokIterator.HasNext() {
-			return shim.Error("DeleteAccount: Two Transactions with the same ID? Impossible!")
+		if txEntryKey == "" {
+			// The tokens of pending Tx are still on the way to the recipient
+			pendingTxEntryKey, _, err := getTxEntry(stub, "PendingTxID~Sender~Recipient~Tok", accountID, operation,
+				tokensStr, txID, tokenType)
+			if err != nil {
+				return err
+			}
+			if pendingTxEntryKey != "" {
+				return fmt.Errorf("Account cannot be deleted. There are pending transactions.")
+			}
+		}
+
+		//  Delete index entry in the ledger.
+		err = deleteAccountEntry(stub, accountID, operation, tokensStr, txID, tokenType)
+		if err != nil {
+			return err
+		}
+
+		// Maintain the index "TxID~Sender~Recipient~Tok"
+		if txEntryKey != "" {
+			err = deleteTxEntryIfUnused(stub, txEntryKey, accountID, counterpart, operation, tokensStr, txID, tokenType)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
-	// Return Success
-	return shim.Success([]byte("Account deleted"))
+	return nil
 }
 
 // getAccountByID - read account entry from chaincode state based on its Id
@@ -483,19 +1172,50 @@ func (cc *Chaincode) getAccountByName(stub shim.ChaincodeStubInterface, args []s
 	return shim.Success(accountsAsBytes)
 }
 
+// getAccountByNameWithPagination - get page of accounts from chaincode state by name
+//////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getAccountByNameWithPagination(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//   0          1           2
+	// "name" "pageSize" ["bookmark"]
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting name of account holder, page size and optional bookmark")
+	}
+
+	// Input sanitization. Bookmark is empty for the first page.
+	for i := 0; i < 2; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	name := args[0]
+	pageSize := args[1]
+	bookmark := ""
+	if len(args) == 3 {
+		bookmark = args[2]
+	}
+
+	// Get the account from state for each Name~AccountID row of the page
+	return getPageByPartialCompositeKey(stub, "Name~AccountID", []string{name}, pageSize, bookmark,
+		func(compositeKeyParts []string) pb.Response {
+			return cc.getAccountByID(stub, []string{compositeKeyParts[1]})
+		})
+}
+
 // sendTokensFast - transfer tokens from one account to another without check of sender's tokens
 ////////////////////////////////////////////////////////////////////////////////////////////////
 func (cc *Chaincode) sendTokensFast(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 	argsCount := 4
-	//       0              1            2          3
-	// "fromAccountId" "toAccountId" "Amount" "dataPurchase"
-	if len(args) != argsCount {
-		return shim.Error("Incorrect number of arguments. Expecting FromAccountId, ToAccountId, Amount, dataPurchase")
+	//       0              1            2          3              4
+	// "fromAccountId" "toAccountId" "Amount" "dataPurchase" ["tokenType"]
+	if len(args) != argsCount && len(args) != argsCount+1 {
+		return shim.Error("Incorrect number of arguments. Expecting FromAccountId, ToAccountId, Amount, dataPurchase and optional token type")
 	}
 
 	// Input sanitization
-	for i := 0; i < argsCount; i++ {
+	for i := 0; i < len(args); i++ {
 		if len(args[i]) <= 0 {
 			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
 		}
@@ -509,13 +1229,27 @@ func (cc *Chaincode) sendTokensFast(stub shim.ChaincodeStubInterface, args []str
 	if fromAccountID == toAccountID {
 		return shim.Error("From account and to account cannot be the same.")
 	}
-	tokensToSend, err := strconv.ParseInt(args[2], 10, 64)
+
+	// Tokens of the default token type are sent if the token type is not set
+	tokenType := DefaultTokenType
+	if len(args) > argsCount {
+		tokenType = args[4]
+	}
+	registeredTokenType, err := getTokenTypeValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokensToSend, err := parseAmount(args[2], registeredTokenType.Decimals)
 	if err != nil || tokensToSend < 1 {
-		return shim.Error("Expecting positive integer as number of tokens to transfer.")
+		return shim.Error("Expecting positive amount of tokens to transfer.")
 	}
 
 	// Check if the amount of tokens does not exceed limit for fast transfer
-	if tokensToSend > LimitTokens {
+	limitTokens, err := getFastTransferLimitValue(stub, fromAccountID, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if tokensToSend > limitTokens {
 		return shim.Error("Exceeded max number of tokens for fast transaction. Use safe token transfer instead.")
 	}
 
@@ -525,88 +1259,58 @@ func (cc *Chaincode) sendTokensFast(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error("Expecting boolean value. If this transfer is for data purchase or not.")
 	}
 
-	/* TODO account holder verification
-
-		// GetCreator returns the identity object of the chaincode invocation's submitter
-		creatorIDAsBytes, err := stub.GetCreator()
-		if err != nil {
-			return shim.Error("Failed to get creator ID." + err.Error())
-		}
-
-		sID := &msp.SerializedIdentity{}
-	    err = proto.Unmarshal(creatorIDAsBytes, sID)
-	    if err != nil {
-	        return shim.Error(fmt.Sprintf("Could not deserialize a SerializedIdentity, err %s", err))
-	    }
+	// Data entry ads have prices in the default token type
+	if dataPurchase && tokenType != DefaultTokenType {
+		return shim.Error("Data purchase can be paid only in " + DefaultTokenType + " tokens.")
+	}
 
-	    block, _ := pem.Decode(sID.IdBytes)
-	    if block == nil {
-	        return shim.Error(fmt.Sprintf("Failed to decode PEM structure"))
-		}
+	// Get the sender's account
+	fromAccountAsBytes, err := stub.GetState(fromAccountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if fromAccountAsBytes == nil {
+		return shim.Error("Account does not exist: " + fromAccountID)
+	}
+	var account Account
+	err = json.Unmarshal(fromAccountAsBytes, &account)
+	if err != nil {
+		return shim.Error("Some error: " + err.Error())
+	}
 
-	    cert, err := x509.ParseCertificate(block.Bytes)
-	    if err != nil {
-	        return shim.Error(fmt.Sprintf("Unable to parse certificate %s", err))
-	    }
+	// Only the account holder can send tokens from the account
+	err = checkAccountOwner(stub, &account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkSingleSignature(&account, "Use sendTokensSafe to propose the transfer.")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-		// Get the account
-		fromAccountAsBytes, err := stub.GetState(fromAccountID)
-		if err != nil {
-			return shim.Error(err.Error())
-		} else if fromAccountAsBytes == nil {
-			return shim.Error(err.Error())
-		}
-		var account Account
-		err = json.Unmarshal(fromAccountAsBytes, &account)
-		if err != nil {
-			return shim.Error("Some error: " + err.Error())
-		}
-	*/
+	// Frozen or closed account cannot send tokens
+	err = checkAccountActive(&account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	// Index txID and sender accounts ID
-	// this is required for quick lookup and transaction aggregation.
-	txID := stub.GetTxID()
-	var SenderIDOpTokCompositeKey, recipientIDOpTokCompositeKey, txParticipantsTokCompositeKey string
+	// The fee is paid on top of the transferred tokens
+	feeKind := "fast"
 	if dataPurchase {
-		SenderIDOpTokCompositeKey, err = stub.CreateCompositeKey("Account~op~Tok~TxID",
-			[]string{fromAccountID, "-", strconv.FormatInt(tokensToSend, 10), txID})
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		txParticipantsTokCompositeKey, err = stub.CreateCompositeKey("PendingTxID~Sender~Recipient~Tok",
-			[]string{txID, fromAccountID, toAccountID, strconv.FormatInt(tokensToSend, 10)})
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-	} else {
-		SenderIDOpTokCompositeKey, err = stub.CreateCompositeKey("Account~op~Tok~TxID",
-			[]string{fromAccountID, "-", strconv.FormatInt(tokensToSend, 10), txID})
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		recipientIDOpTokCompositeKey, err = stub.CreateCompositeKey("Account~op~Tok~TxID",
-			[]string{toAccountID, "+", strconv.FormatInt(tokensToSend, 10), txID})
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		txParticipantsTokCompositeKey, err = stub.CreateCompositeKey("TxID~Sender~Recipient~Tok",
-			[]string{txID, fromAccountID, toAccountID, strconv.FormatInt(tokensToSend, 10)})
-		if err != nil {
-			return shim.Error(err.Error())
-		}
+		feeKind = "dataPurchase"
 	}
-	// Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the data.
-	// Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
-	value := []byte{0x00}
-	stub.PutState(SenderIDOpTokCompositeKey, value)
+	fee, treasuryAccountID, err := getTransferFee(stub, feeKind, fromAccountID, tokensToSend, tokenType)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	stub.PutState(recipientIDOpTokCompositeKey, value)
+
+	// Index txID and sender accounts ID
+	// this is required for quick lookup and transaction aggregation.
+	txID := stub.GetTxID()
+	err = putTransfer(stub, fromAccountID, toAccountID, tokensToSend, dataPurchase, tokenType)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	stub.PutState(txParticipantsTokCompositeKey, value)
+	err = putFee(stub, fromAccountID, treasuryAccountID, fee)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
@@ -621,14 +1325,14 @@ func (cc *Chaincode) sendTokensFast(stub shim.ChaincodeStubInterface, args []str
 func (cc *Chaincode) sendTokensSafe(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 	argsCount := 4
-	//       0              1            2          3
-	// "fromAccountId" "toAccountId" "Amount" "dataPurchase"
-	if len(args) != argsCount {
-		return shim.Error("Incorrect number of arguments. Expecting FromAccountId, ToAccountId, Amount, dataPurchase")
+	//       0              1            2          3              4
+	// "fromAccountId" "toAccountId" "Amount" "dataPurchase" ["tokenType"]
+	if len(args) != argsCount && len(args) != argsCount+1 {
+		return shim.Error("Incorrect number of arguments. Expecting FromAccountId, ToAccountId, Amount, dataPurchase and optional token type")
 	}
 
 	// Input sanitization
-	for i := 0; i < argsCount; i++ {
+	for i := 0; i < len(args); i++ {
 		if len(args[i]) <= 0 {
 			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
 		}
@@ -642,9 +1346,19 @@ func (cc *Chaincode) sendTokensSafe(stub shim.ChaincodeStubInterface, args []str
 	if fromAccountID == toAccountID {
 		return shim.Error("From account and to account cannot be the same.")
 	}
-	tokensToSend, err := strconv.ParseInt(args[2], 10, 64)
+
+	// Tokens of the default token type are sent if the token type is not set
+	tokenType := DefaultTokenType
+	if len(args) > argsCount {
+		tokenType = args[4]
+	}
+	registeredTokenType, err := getTokenTypeValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokensToSend, err := parseAmount(args[2], registeredTokenType.Decimals)
 	if err != nil || tokensToSend < 1 {
-		return shim.Error("Expecting positive integer as number of tokens to transfer.")
+		return shim.Error("Expecting positive amount of tokens to transfer.")
 	}
 
 	// Is it payment for data purchase
@@ -653,26 +1367,17 @@ func (cc *Chaincode) sendTokensSafe(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error("Expecting boolean value. If this transfer is for data purchase or not.")
 	}
 
-	/* TODO account holder verification
-	// GetCreator returns the identity object of the chaincode invocation's submitter
-	creatorID, err := stub.GetCreator()
-	if err != nil {
-		return shim.Error("Failed to get creator ID." + err.Error())
+	// Data entry ads have prices in the default token type
+	if dataPurchase && tokenType != DefaultTokenType {
+		return shim.Error("Data purchase can be paid only in " + DefaultTokenType + " tokens.")
 	}
-	*/
 
-	// If account retrieval from state does not fail then accounts exist.
+	// If account retrieval from state does not fail then account exists.
 	fromAccountAsBytes, err := stub.GetState(fromAccountID)
 	if err != nil {
 		return shim.Error(err.Error())
 	} else if fromAccountAsBytes == nil {
-		return shim.Error(err.Error())
-	}
-	toAccountAsBytes, err := stub.GetState(toAccountID)
-	if err != nil {
-		return shim.Error(err.Error())
-	} else if toAccountAsBytes == nil {
-		return shim.Error(err.Error())
+		return shim.Error("Account does not exist: " + fromAccountID)
 	}
 	// Unmarshal the account object
 	var account Account
@@ -681,124 +1386,110 @@ func (cc *Chaincode) sendTokensSafe(stub shim.ChaincodeStubInterface, args []str
 		return shim.Error("Some error: " + err.Error())
 	}
 
-	/* TODO account holder verification
-
-		// GetCreator returns the identity object of the chaincode invocation's submitter
-		creatorIDAsBytes, err := stub.GetCreator()
-		if err != nil {
-			return shim.Error("Failed to get creator ID." + err.Error())
-		}
-
-		sID := &msp.SerializedIdentity{}
-	    err = proto.Unmarshal(creatorIDAsBytes, sID)
-	    if err != nil {
-	        return shim.Error(fmt.Sprintf("Could not deserialize a SerializedIdentity, err %s", err))
-	    }
-
-	    block, _ := pem.Decode(sID.IdBytes)
-	    if block == nil {
-	        return shim.Error(fmt.Sprintf("Failed to decode PEM structure"))
-		}
-
-	    cert, err := x509.ParseCertificate(block.Bytes)
-	    if err != nil {
-	        return shim.Error(fmt.Sprintf("Unable to parse certificate %s", err))
-	    }
-
-		// Get the account
-		fromAccountAsBytes, err := stub.GetState(fromAccountID)
+	// Transfer from multi-signature account becomes proposal approved by the caller
+	txID := stub.GetTxID()
+	if account.Threshold > 0 {
+		proposal := &TransferProposal{"TRANSFERPROPOSAL", txID, fromAccountID, toAccountID, tokensToSend, tokenType,
+			dataPurchase, []string{}, "", "Proposed", "", ""}
+		err = proposeTransfer(stub, &account, proposal)
 		if err != nil {
 			return shim.Error(err.Error())
-		} else if fromAccountAsBytes == nil {
-			return shim.Error(err.Error())
-		}
-		var account Account
-		err = json.Unmarshal(fromAccountAsBytes, &account)
-		if err != nil {
-			return shim.Error("Some error: " + err.Error())
 		}
-	*/
 
-	// Get the latest state of tokens for sender's account
-	argsTok := []string{fromAccountID}
-	fromAccTokResponse := cc.getAccountTokens(stub, argsTok)
-	if fromAccTokResponse.Status != shim.OK {
-		return shim.Error("Retrieval of account tokens failed: " + fromAccTokResponse.Message)
+		// Return the ID of the proposal
+		return shim.Success([]byte(txID))
 	}
 
-	// Extract the values from Payload
-	fromAccTokStr := string(fromAccTokResponse.Payload)
-	fromAccTok, err := strconv.ParseInt(fromAccTokStr, 10, 64)
+	// Only the account holder can send tokens from the account
+	err = checkAccountOwner(stub, &account)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	// Check if sender has enough tokens
-	if fromAccTok < tokensToSend {
-		return shim.Error("Not enough tokens on the sender's account")
-	}
 	// Index txID and sender accounts ID
 	// this is required for quick lookup and transaction aggregation.
-	txID := stub.GetTxID()
-	var SenderIDOpTokCompositeKey, recipientIDOpTokCompositeKey, txParticipantsTokCompositeKey string
-	if dataPurchase {
-		SenderIDOpTokCompositeKey, err = stub.CreateCompositeKey("Account~op~Tok~TxID",
-			[]string{fromAccountID, "-", strconv.FormatInt(tokensToSend, 10), txID})
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		txParticipantsTokCompositeKey, err = stub.CreateCompositeKey("PendingTxID~Sender~Recipient~Tok",
-			[]string{txID, fromAccountID, toAccountID, strconv.FormatInt(tokensToSend, 10)})
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-	} else {
-		SenderIDOpTokCompositeKey, err = stub.CreateCompositeKey("Account~op~Tok~TxID",
-			[]string{fromAccountID, "-", strconv.FormatInt(tokensToSend, 10), txID})
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		recipientIDOpTokCompositeKey, err = stub.CreateCompositeKey("Account~op~Tok~TxID",
-			[]string{toAccountID, "+", strconv.FormatInt(tokensToSend, 10), txID})
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		txParticipantsTokCompositeKey, err = stub.CreateCompositeKey("TxID~Sender~Recipient~Tok",
-			[]string{txID, fromAccountID, toAccountID, strconv.FormatInt(tokensToSend, 10)})
-		if err != nil {
-			return shim.Error(err.Error())
-		}
+	err = putSafeTransfer(stub, &account, toAccountID, tokensToSend, dataPurchase, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	// Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the data.
-	// Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
-	value := []byte{0x00}
-	stub.PutState(SenderIDOpTokCompositeKey, value)
+	// Tx entry saved and indexed
+	return shim.Success([]byte(txID))
+}
+
+// putSafeTransfer - saves the transfer of tokens with the fee if the sender has enough tokens.
+// Frozen or closed account cannot send tokens and closed account cannot receive them
+///////////////////////////////////////////////////////////////////////////////////////////////////
+func putSafeTransfer(stub shim.ChaincodeStubInterface, account *Account, toAccountID string, tokensToSend int64,
+	dataPurchase bool, tokenType string) error {
+	err := checkAccountActive(account)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
-	stub.PutState(recipientIDOpTokCompositeKey, value)
+	toAccountAsBytes, err := stub.GetState(toAccountID)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
+	} else if toAccountAsBytes == nil {
+		return fmt.Errorf("Account does not exist: %s", toAccountID)
 	}
-	stub.PutState(txParticipantsTokCompositeKey, value)
+	var toAccount Account
+	err = json.Unmarshal(toAccountAsBytes, &toAccount)
 	if err != nil {
-		return shim.Error(err.Error())
+		return fmt.Errorf("Some error: %s", err)
+	}
+	if toAccount.Status == "closed" {
+		return fmt.Errorf("Account %s is closed.", toAccountID)
 	}
 
-	// Tx entry saved and indexed
-	return shim.Success([]byte(txID))
+	// Get the latest state of tokens for sender's account
+	fromAccTok, deltas, err := getAccountBalance(stub, account.AccountID, tokenType)
+	if err != nil {
+		return fmt.Errorf("Retrieval of account tokens failed: %s", err)
+	}
+
+	// The fee is paid on top of the transferred tokens
+	feeKind := "safe"
+	if dataPurchase {
+		feeKind = "dataPurchase"
+	}
+	fee, treasuryAccountID, err := getTransferFee(stub, feeKind, account.AccountID, tokensToSend, tokenType)
+	if err != nil {
+		return err
+	}
+	tokensToPay, err := addTokens(tokensToSend, fee)
+	if err != nil {
+		return err
+	}
+
+	// Check if sender has enough tokens
+	if fromAccTok < tokensToPay {
+		return fmt.Errorf("Not enough tokens on the sender's account")
+	}
+
+	// Roll the checkpoint forward before the new debit is saved
+	err = rollForwardCheckpointIfDue(stub, account.AccountID, tokenType, deltas)
+	if err != nil {
+		return err
+	}
+
+	err = putTransfer(stub, account.AccountID, toAccountID, tokensToSend, dataPurchase, tokenType)
+	if err != nil {
+		return err
+	}
+
+	return putFee(stub, account.AccountID, treasuryAccountID, fee)
 }
 
-// updateAccountTokens - updates the account entry in state with the latest values of tokens
-////////////////////////////////////////////////////////////////////////////////////////////
-func (cc *Chaincode) updateAccountTokens(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// approveTransfer - approves the transfer proposal of multi-signature account by the owner who is the caller.
+// The transfer is executed in the same transaction when the threshold number of owners approved it
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) approveTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 	argsCount := 1
-	//       0
-	// "accountID"
+	//      0
+	// "proposalID"
 	if len(args) != argsCount {
-		return shim.Error("Incorrect number of arguments. Expecting account ID")
+		return shim.Error("Incorrect number of arguments. Expecting proposal ID")
 	}
 
 	// Input sanitization
@@ -808,64 +1499,39 @@ func (cc *Chaincode) updateAccountTokens(stub shim.ChaincodeStubInterface, args
 		}
 	}
 
-	// Extract args
-	accountID := args[0]
-
-	// Get the account entry from chaincode state
-	accountAsBytes, err := stub.GetState(accountID)
+	proposal, account, err := getOpenTransferProposal(stub, args[0])
 	if err != nil {
 		return shim.Error(err.Error())
-	} else if accountAsBytes == nil {
-		return shim.Error(err.Error())
 	}
-	var account Account
-	err = json.Unmarshal(accountAsBytes, &account)
+	expired, err := isTransferProposalExpired(stub, proposal)
 	if err != nil {
-		return shim.Error("Some error: " + err.Error())
+		return shim.Error(err.Error())
 	}
-
-	// Get the latest state of tokens for sender's account
-	argsTok := []string{accountID}
-	accTokResponse := cc.getAccountTokens(stub, argsTok)
-	if accTokResponse.Status != shim.OK {
-		return shim.Error("Retrieval of account tokens failed: " + accTokResponse.Message)
+	if expired {
+		return shim.Error("Transfer proposal expired at " + proposal.Expiry)
 	}
 
-	// Extract values from Payload
-	accTokStr := string(accTokResponse.Payload)
-	accTok, err := strconv.ParseInt(accTokStr, 10, 64)
+	err = approveTransferProposal(stub, account, proposal)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-
-	// update values of tokens
-	account.Tokens = accTok
-
-	// Marshal object
-	accountAsBytesNew, err := json.Marshal(&account)
-	if err != nil {
-		return shim.Error("Some error: " + err.Error())
-	}
-
-	// Write state back to the ledger
-	err = stub.PutState(accountID, accountAsBytesNew)
+	proposalAsBytes, err := json.Marshal(proposal)
 	if err != nil {
-		return shim.Error("Some error: " + err.Error())
+		return shim.Error(err.Error())
 	}
 
-	// return JSON object Account with updated token values
-	return shim.Success(accountAsBytesNew)
+	return shim.Success(proposalAsBytes)
 }
 
-// getAccountTokens - returns current state of tokens in a specific account
-////////////////////////////////////////////////////////////////////////////
-func (cc *Chaincode) getAccountTokens(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// cancelTransfer - cancels the transfer proposal of multi-signature account. Any owner can cancel it
+/////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) cancelTransfer(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 	argsCount := 1
-	//    0
-	// "accountID"
+	//      0
+	// "proposalID"
 	if len(args) != argsCount {
-		return shim.Error("Incorrect number of arguments. Expecting account ID")
+		return shim.Error("Incorrect number of arguments. Expecting proposal ID")
 	}
 
 	// Input sanitization
@@ -875,67 +1541,33 @@ func (cc *Chaincode) getAccountTokens(stub shim.ChaincodeStubInterface, args []s
 		}
 	}
 
-	// Get args
-	accountID := args[0]
+	proposal, account, err := getOpenTransferProposal(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	_, err = getMultiSigOwner(stub, account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	// Get all account transactions for the account ID
-	accountTxIterator, err := stub.GetStateByPartialCompositeKey("Account~op~Tok~TxID", []string{accountID})
+	proposal.State = "Cancelled"
+	err = putTransferProposal(stub, proposal)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer accountTxIterator.Close()
 
-	// Iterate through result set and compute final amount of tokens
-	var finalTok int64
-	for accountTxIterator.HasNext() {
-		// Get the next row
-		responseRange, err := accountTxIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-
-		// Split the composite key into its component parts
-		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-
-		// Retrieve the amount of tokens and operation
-		operation := compositeKeyParts[1]
-		tokensStr := compositeKeyParts[2]
-
-		// Convert the tokensStr string and perform the operation
-		tokens, err := strconv.ParseInt(tokensStr, 10, 64)
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-
-		// calculate the delta
-		switch operation {
-		case "+":
-			finalTok += tokens
-		case "-":
-			finalTok -= tokens
-		default:
-			return shim.Error(fmt.Sprintf("Unrecognized operation %s", operation))
-		}
-	}
-
-	// format int64 to string
-	res := strconv.FormatInt(finalTok, 10)
-
-	// Return result
-	return shim.Success([]byte(res))
+	return shim.Success([]byte("Transfer proposal cancelled"))
 }
 
-// getAccountHistoryByID - get the whole history of specific account number even if it was deleted from state.
-/////////////////////////////////////////////////////////////////////////////////////////////////////////////
-func (cc *Chaincode) getAccountHistoryByID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// getTransferProposal - returns the transfer proposal of multi-signature account with its approvals.
+// The state of the proposal that was not approved in time is Expired
+/////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getTransferProposal(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	argsCount := 1
-	//    0
-	// "accountID"
+	//      0
+	// "proposalID"
 	if len(args) != argsCount {
-		return shim.Error("Incorrect number of arguments. Expecting AccountID")
+		return shim.Error("Incorrect number of arguments. Expecting proposal ID")
 	}
 
 	// Input sanitization
@@ -945,83 +1577,37 @@ func (cc *Chaincode) getAccountHistoryByID(stub shim.ChaincodeStubInterface, arg
 		}
 	}
 
-	// Extract args
-	accountID := args[0]
-
-	// Get history for the account ID
-	resultsIterator, err := stub.GetHistoryForKey(accountID)
+	proposal, err := getTransferProposalValue(stub, args[0])
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer resultsIterator.Close()
-
-	// buffer is a JSON array containing historic values for the account
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-
-	// for each entry write to buffer
-	for resultsIterator.HasNext() {
-		response, err := resultsIterator.Next()
+	if proposal.State == "Proposed" {
+		expired, err := isTransferProposalExpired(stub, proposal)
 		if err != nil {
 			return shim.Error(err.Error())
 		}
-
-		// This create structure of the output
-		// Write transaction ID
-		buffer.WriteString("{\"TxId\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(response.TxId)
-		buffer.WriteString("\"")
-
-		// Write Value
-		buffer.WriteString(", \"Value\":")
-
-		// if it was a delete operation on given key, then we set the
-		// value to null. Else, we will write the response.Value
-		// as-is (as the Value itself a JSON)
-		if response.IsDelete {
-			buffer.WriteString("null")
-		} else {
-			buffer.WriteString(string(response.Value))
-		}
-
-		// Write Timestamp of the transaction
-		buffer.WriteString(", \"Timestamp\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String())
-		buffer.WriteString("\"")
-
-		// Write if it was delete transaction
-		buffer.WriteString(", \"IsDelete\":")
-		buffer.WriteString("\"")
-		buffer.WriteString(strconv.FormatBool(response.IsDelete))
-		buffer.WriteString("\"")
-
-		// Close the single entry
-		buffer.WriteString("}")
-
-		// Add a comma in front of an array member
-		if resultsIterator.HasNext() {
-			buffer.WriteString(",")
+		if expired {
+			proposal.State = "Expired"
 		}
 	}
+	proposalAsBytes, err := json.Marshal(proposal)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	// Close JSON array
-	buffer.WriteString("]")
-
-	// Return JSON array of history transactions for the account ID
-	return shim.Success(buffer.Bytes())
+	return shim.Success(proposalAsBytes)
 }
 
-// getTxDetails - returns participants' account IDs of transaction and amount
-//////////////////////////////////////////////////////////////////////////////////////////////////////////
-func (cc *Chaincode) getTxDetails(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// sendTokensBatch - transfer tokens from one account to more accounts with single check of sender's tokens.
+// The sender's account gets one debit of all tokens and each recipient gets its credit
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) sendTokensBatch(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
-	argsCount := 1
-	//    0
-	// "txID"
+	argsCount := 3
+	//       0                       1                           2
+	// "fromAccountId" "[{"To":"id","Amount":"1.5"},...]" "dataPurchase"
 	if len(args) != argsCount {
-		return shim.Error("Incorrect number of arguments. Expecting TxID")
+		return shim.Error("Incorrect number of arguments. Expecting FromAccountId, JSON array of recipients and amounts, dataPurchase")
 	}
 
 	// Input sanitization
@@ -1032,76 +1618,183 @@ func (cc *Chaincode) getTxDetails(stub shim.ChaincodeStubInterface, args []strin
 	}
 
 	// Extract args
-	txID := args[0]
+	fromAccountID := args[0]
+	defaultTokenType, err := getTokenTypeValue(stub, DefaultTokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var items []BatchItem
+	err = json.Unmarshal([]byte(args[1]), &items)
+	if err != nil || len(items) == 0 {
+		return shim.Error("Expecting non-empty JSON array of recipients and amounts.")
+	}
 
-	// Get the state from TxID~Sender~Recipient~Tok index
-	txIDResultsIterator, err := stub.GetStateByPartialCompositeKey("TxID~Sender~Recipient~Tok",
-		[]string{txID})
+	// Is it payment for data purchase
+	dataPurchase, err := strconv.ParseBool(args[2])
+	if err != nil {
+		return shim.Error("Expecting boolean value. If this transfer is for data purchase or not.")
+	}
+	if dataPurchase && len(items) != 1 {
+		return shim.Error("Data purchase can be paid only to a single recipient.")
+	}
+
+	// Get the sender's account
+	fromAccountAsBytes, err := stub.GetState(fromAccountID)
 	if err != nil {
 		return shim.Error(err.Error())
+	} else if fromAccountAsBytes == nil {
+		return shim.Error("Account does not exist: " + fromAccountID)
+	}
+	var account Account
+	err = json.Unmarshal(fromAccountAsBytes, &account)
+	if err != nil {
+		return shim.Error("Some error: " + err.Error())
 	}
-	defer txIDResultsIterator.Close()
 
-	// Initialise txState as validTx
-	txState := "ValidTx"
+	// Only the account holder can send tokens from the account
+	err = checkAccountOwner(stub, &account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkSingleSignature(&account, "Use sendTokensSafe to propose each transfer.")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-	// If there is not such TxID then check the PendingTxID~Sender~Recipient~Tok index
-	if !txIDResultsIterator.HasNext() {
-		txIDResultsIterator, err = stub.GetStateByPartialCompositeKey("PendingTxID~Sender~Recipient~Tok",
-			[]string{txID})
+	// Frozen or closed account cannot send tokens
+	err = checkAccountActive(&account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Check the recipients and sum the tokens
+	var tokensToSend int64
+	itemTokens := make([]int64, len(items))
+	recipients := make(map[string]bool)
+	for i, item := range items {
+		if item.To == "" {
+			return shim.Error("Expecting account ID of each recipient.")
+		}
+		if item.To == fromAccountID {
+			return shim.Error("From account and to account cannot be the same.")
+		}
+		if recipients[item.To] {
+			return shim.Error("Recipient " + item.To + " is listed more than once.")
+		}
+		recipients[item.To] = true
+		itemTokens[i], err = parseAmount(item.Amount.String(), defaultTokenType.Decimals)
+		if err != nil || itemTokens[i] < 1 {
+			return shim.Error("Expecting positive amount of tokens to transfer.")
+		}
+		if tokensToSend > math.MaxInt64-itemTokens[i] {
+			return shim.Error("Total amount of tokens would overflow.")
+		}
+		tokensToSend += itemTokens[i]
+		items[i].Amount = json.Number(formatAmount(itemTokens[i], defaultTokenType.Decimals))
+
+		// Recipient has to exist and cannot be closed
+		toAccountAsBytes, err := stub.GetState(item.To)
 		if err != nil {
 			return shim.Error(err.Error())
+		} else if toAccountAsBytes == nil {
+			return shim.Error("Account does not exist: " + item.To)
 		}
+		var toAccount Account
+		err = json.Unmarshal(toAccountAsBytes, &toAccount)
+		if err != nil {
+			return shim.Error("Some error: " + err.Error())
+		}
+		if toAccount.Status == "closed" {
+			return shim.Error("Account " + item.To + " is closed.")
+		}
+	}
 
-		// There is not such transaction in both indices
-		if !txIDResultsIterator.HasNext() {
-			return shim.Error("Transaction was not found.")
+	// The fee of safe transfer is paid on top of the transferred tokens for each recipient
+	feeKind := "safe"
+	if dataPurchase {
+		feeKind = "dataPurchase"
+	}
+	var fee int64
+	var treasuryAccountID string
+	for _, tokens := range itemTokens {
+		itemFee, itemTreasuryAccountID, err := getTransferFee(stub, feeKind, fromAccountID, tokens, DefaultTokenType)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		fee, err = addTokens(fee, itemFee)
+		if err != nil {
+			return shim.Error(err.Error())
 		}
+		treasuryAccountID = itemTreasuryAccountID
+	}
+	tokensToPay, err := addTokens(tokensToSend, fee)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
 
-		// Change the txState to pendingTx
-		txState = "PendingTx"
+	// Get the latest state of tokens for sender's account only once
+	fromAccTok, deltas, err := getAccountBalance(stub, fromAccountID, DefaultTokenType)
+	if err != nil {
+		return shim.Error("Retrieval of account tokens failed: " + err.Error())
 	}
 
-	// Get the response range
-	responseRange, err := txIDResultsIterator.Next()
+	// Check if sender has enough tokens
+	if fromAccTok < tokensToPay {
+		return shim.Error("Not enough tokens on the sender's account")
+	}
+
+	// Roll the checkpoint forward before the new debit is saved
+	err = rollForwardCheckpointIfDue(stub, fromAccountID, DefaultTokenType, deltas)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	// Get the values from composite key
-	_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+	txID := stub.GetTxID()
+	if dataPurchase {
+		// Pending Tx of data purchase is the same as of sendTokensSafe
+		err = putTransfer(stub, fromAccountID, items[0].To, tokensToSend, dataPurchase, DefaultTokenType)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	} else {
+		// The sender's debit and recipients' credits are connected by Batch in "TxID~Sender~Recipient~Tok"
+		err = putSystemTransfer(stub, fromAccountID, "-", "Batch", tokensToSend, DefaultTokenType)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		for i, item := range items {
+			err = putSystemTransfer(stub, item.To, "+", "Batch", itemTokens[i], DefaultTokenType)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+	err = putFee(stub, fromAccountID, treasuryAccountID, fee)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	// Construct participants as string
-	participantsAccountsID := compositeKeyParts[1] + "->" + compositeKeyParts[2]
-	tokens := compositeKeyParts[3]
-	if txIDResultsIterator.HasNext() {
-		return shim.Error("Two TxID are same? Impossible!")
+	// Return the TxID with line items
+	batchAsBytes, err := json.Marshal(&BatchTransfer{txID, fromAccountID,
+		json.Number(formatAmount(tokensToSend, defaultTokenType.Decimals)),
+		json.Number(formatAmount(fee, defaultTokenType.Decimals)), items})
+	if err != nil {
+		return shim.Error(err.Error())
 	}
 
-	// Construct the response string
-	var response []byte
-	response = append(response, []byte(participantsAccountsID)...)
-	response = append(response, []byte("->")...)
-	response = append(response, []byte(tokens)...)
-	response = append(response, []byte("->")...)
-	response = append(response, []byte(txState)...)
-
-	// Return byte array with Tx details
-	return shim.Success(response)
+	return shim.Success(batchAsBytes)
 }
 
-// changePendingTx - change pending tokens to normal tokens
-////////////////////////////////////////////////////////////////////////////////////////////////////
-func (cc *Chaincode) changePendingTx(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+// approve - allows the holder of spender account to send tokens from the owner account.
+// The new allowance replaces the previous one. Zero removes the allowance
+//////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) approve(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 	argsCount := 3
-	//      0              1           2
-	// "channelAd" "chaincodeAdName" "txID"
+	//       0              1           2
+	// "ownerAccountID" "spenderAccountID" "Amount"
 	if len(args) != argsCount {
-		return shim.Error("Incorrect number of arguments. Expecting 3")
+		return shim.Error("Incorrect number of arguments. Expecting owner account ID, spender account ID and amount")
 	}
 
 	// Input sanitization
@@ -1112,212 +1805,5444 @@ func (cc *Chaincode) changePendingTx(stub shim.ChaincodeStubInterface, args []st
 	}
 
 	// Extract args
-	channelAd := args[0]
-	chaincodeAdName := args[1]
-	txID := args[2]
-
-	// Get the TxID from another chaincode
-	pendingTxIDResultsIterator, err := stub.GetStateByPartialCompositeKey("PendingTxID~Sender~Recipient~Tok",
-		[]string{txID})
+	ownerAccountID := args[0]
+	spenderAccountID := args[1]
+	if ownerAccountID == spenderAccountID {
+		return shim.Error("Owner account and spender account cannot be the same.")
+	}
+	defaultTokenType, err := getTokenTypeValue(stub, DefaultTokenType)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-	defer pendingTxIDResultsIterator.Close()
-
-	// If not Tx found then it was already moved as valid Tx
-	if !pendingTxIDResultsIterator.HasNext() {
-		return shim.Error("Transaction was already used or does not exist.")
+	tokensToApprove, err := parseAmount(args[2], defaultTokenType.Decimals)
+	if err != nil || tokensToApprove < 0 {
+		return shim.Error("Expecting positiv amount or zero as number of tokens to approve.")
 	}
 
-	// Extract values
-	responseRange, err := pendingTxIDResultsIterator.Next()
+	// Get the owner account
+	ownerAccountAsBytes, err := stub.GetState(ownerAccountID)
 	if err != nil {
 		return shim.Error(err.Error())
+	} else if ownerAccountAsBytes == nil {
+		return shim.Error("Account does not exist: " + ownerAccountID)
 	}
-
-	// Get the separate values
-	_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+	var ownerAccount Account
+	err = json.Unmarshal(ownerAccountAsBytes, &ownerAccount)
 	if err != nil {
-		return shim.Error(err.Error())
-	}
-
-	// Check if there is another Tx with the same ID
-	if pendingTxIDResultsIterator.HasNext() {
-		return shim.Error("changePendingTx: Two TxID are same? Impossible!")
+		return shim.Error("Some error: " + err.Error())
 	}
 
-	// check if the Tx was already used for data purchase
-	fDataAd := []byte("checkTXState")
-	argsToChaincodeAd := [][]byte{fDataAd, []byte(txID)}
-	responseTXCheck := stub.InvokeChaincode(chaincodeAdName, argsToChaincodeAd, channelAd)
-	if responseTXCheck.Status != shim.OK {
-		return shim.Error("changePendingTx: Error while invoking another chaincode: " + responseTXCheck.Message)
-	}
-	if string(responseTXCheck.Payload) != "Used" {
-		return shim.Error("This TxID was not used for data purchase yet.")
+	// Only the account holder can approve spending from the account
+	err = checkAccountOwner(stub, &ownerAccount)
+	if err != nil {
+		return shim.Error(err.Error())
 	}
-
-	// create composite key to reindex
-	txCompositeIndexKey, err := stub.CreateCompositeKey("TxID~Sender~Recipient~Tok",
-		[]string{txID, compositeKeyParts[1], compositeKeyParts[2], compositeKeyParts[3]})
+	err = checkSingleSignature(&ownerAccount, "It cannot approve allowances.")
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	// Maintain index of pending Tx
-	err = stub.DelState(responseRange.Key)
+	// Check if the spender account exists
+	spenderAccountAsBytes, err := stub.GetState(spenderAccountID)
 	if err != nil {
 		return shim.Error(err.Error())
+	} else if spenderAccountAsBytes == nil {
+		return shim.Error("Account does not exist: " + spenderAccountID)
 	}
 
-	// Add Tx to index "TxID~Sender~Recipient~Tok"
-	// Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
-	value := []byte{0x00}
-	err = stub.PutState(txCompositeIndexKey, value)
+	// Save or remove the allowance
+	allowanceKey, err := stub.CreateCompositeKey("Allowance~Owner~Spender", []string{ownerAccountID, spenderAccountID})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-
-	// Create the new composite key for the index  Account~op~Tok~TxID
-	recipientIDOpTokCompositeKey, err := stub.CreateCompositeKey("Account~op~Tok~TxID",
-		[]string{compositeKeyParts[2], "+", compositeKeyParts[3], txID})
+	if tokensToApprove == 0 {
+		err = stub.DelState(allowanceKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success([]byte("Allowance removed"))
+	}
+	allowanceAsBytes, err := json.Marshal(&Allowance{"ALLOWANCE", ownerAccountID, spenderAccountID, tokensToApprove})
 	if err != nil {
 		return shim.Error(err.Error())
 	}
-
-	// Save to the state
-	err = stub.PutState(recipientIDOpTokCompositeKey, value)
+	err = stub.PutState(allowanceKey, allowanceAsBytes)
 	if err != nil {
 		return shim.Error(err.Error())
 	}
 
-	// Tx changed and indexed in both indexes
-	// Return tx ID
-	return shim.Success([]byte(txID))
+	return shim.Success([]byte("Allowance set"))
 }
 
-func (cc *Chaincode) pruneAccountTx(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var err error
-	argsCount := 1
-	//    0
-	// "accountID"
+// getAllowance - returns amount of tokens that the holder of spender account can send from the owner account
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getAllowance(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	argsCount := 2
+	//       0                 1
+	// "ownerAccountID" "spenderAccountID"
 	if len(args) != argsCount {
-		return shim.Error("Incorrect number of arguments. Expecting account ID")
+		return shim.Error("Incorrect number of arguments. Expecting owner account ID and spender account ID")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	allowanceKey, err := stub.CreateCompositeKey("Allowance~Owner~Spender", []string{args[0], args[1]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	allowanceAsBytes, err := stub.GetState(allowanceKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if allowanceAsBytes == nil {
+		return shim.Success([]byte("0"))
+	}
+	var allowance Allowance
+	err = json.Unmarshal(allowanceAsBytes, &allowance)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defaultTokenType, err := getTokenTypeValue(stub, DefaultTokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// format amount in the smallest units as decimal number of the token type
+	return shim.Success([]byte(formatAmount(allowance.Tokens, defaultTokenType.Decimals)))
+}
+
+// sendTokensFrom - transfer tokens from the owner account within the allowance of the caller's account.
+// The transfer is indexed in the same way as sendTokensSafe, so it can be used for data purchase
+//////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) sendTokensFrom(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 4
+	//       0               1            2          3
+	// "ownerAccountID" "toAccountId" "Amount" "dataPurchase"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting OwnerAccountId, ToAccountId, Amount, dataPurchase")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	ownerAccountID := args[0]
+	toAccountID := args[1]
+
+	// Check if sender and recipient args are the same
+	if ownerAccountID == toAccountID {
+		return shim.Error("From account and to account cannot be the same.")
+	}
+	defaultTokenType, err := getTokenTypeValue(stub, DefaultTokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokensToSend, err := parseAmount(args[2], defaultTokenType.Decimals)
+	if err != nil || tokensToSend < 1 {
+		return shim.Error("Expecting positive amount of tokens to transfer.")
+	}
+
+	// Is it payment for data purchase
+	dataPurchase, err := strconv.ParseBool(args[3])
+	if err != nil {
+		return shim.Error("Expecting boolean value. If this transfer is for data purchase or not.")
+	}
+
+	// Get both accounts
+	ownerAccountAsBytes, err := stub.GetState(ownerAccountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if ownerAccountAsBytes == nil {
+		return shim.Error("Account does not exist: " + ownerAccountID)
+	}
+	toAccountAsBytes, err := stub.GetState(toAccountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if toAccountAsBytes == nil {
+		return shim.Error("Account does not exist: " + toAccountID)
+	}
+	var ownerAccount Account
+	err = json.Unmarshal(ownerAccountAsBytes, &ownerAccount)
+	if err != nil {
+		return shim.Error("Some error: " + err.Error())
+	}
+	var toAccount Account
+	err = json.Unmarshal(toAccountAsBytes, &toAccount)
+	if err != nil {
+		return shim.Error("Some error: " + err.Error())
+	}
+
+	// Frozen or closed account cannot send tokens and closed account cannot receive them
+	err = checkAccountActive(&ownerAccount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if toAccount.Status == "closed" {
+		return shim.Error("Account " + toAccountID + " is closed.")
+	}
+
+	// The owner pays the fee on top of the transferred tokens and the fee is spent from the allowance as well
+	feeKind := "safe"
+	if dataPurchase {
+		feeKind = "dataPurchase"
+	}
+	fee, treasuryAccountID, err := getTransferFee(stub, feeKind, ownerAccountID, tokensToSend, DefaultTokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokensToPay, err := addTokens(tokensToSend, fee)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Find the allowance of the account held by the caller
+	allowanceIterator, err := stub.GetStateByPartialCompositeKey("Allowance~Owner~Spender", []string{ownerAccountID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer allowanceIterator.Close()
+	var allowance Allowance
+	var allowanceKey string
+	for allowanceIterator.HasNext() {
+		responseRange, err := allowanceIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var spenderAllowance Allowance
+		err = json.Unmarshal(responseRange.Value, &spenderAllowance)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// The holder of the spender account can use the allowance
+		spenderAccountAsBytes, err := stub.GetState(spenderAllowance.Spender)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if spenderAccountAsBytes == nil {
+			continue
+		}
+		var spenderAccount Account
+		err = json.Unmarshal(spenderAccountAsBytes, &spenderAccount)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if checkAccountOwner(stub, &spenderAccount) != nil || checkSingleSignature(&spenderAccount, "It cannot spend allowance.") != nil ||
+			checkAccountActive(&spenderAccount) != nil {
+			continue
+		}
+		if spenderAllowance.Tokens >= tokensToPay {
+			allowance = spenderAllowance
+			allowanceKey = responseRange.Key
+			break
+		}
+	}
+	if allowanceKey == "" {
+		return shim.Error("Not enough allowance to send tokens from account " + ownerAccountID)
+	}
+
+	// Get the latest state of tokens for owner's account
+	ownerAccTok, deltas, err := getAccountBalance(stub, ownerAccountID, DefaultTokenType)
+	if err != nil {
+		return shim.Error("Retrieval of account tokens failed: " + err.Error())
+	}
+
+	// Check if owner has enough tokens
+	if ownerAccTok < tokensToPay {
+		return shim.Error("Not enough tokens on the sender's account")
+	}
+
+	// Roll the checkpoint forward before the new debit is saved
+	err = rollForwardCheckpointIfDue(stub, ownerAccountID, DefaultTokenType, deltas)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Reduce the allowance
+	allowance.Tokens -= tokensToPay
+	if allowance.Tokens == 0 {
+		err = stub.DelState(allowanceKey)
+	} else {
+		var allowanceAsBytes []byte
+		allowanceAsBytes, err = json.Marshal(&allowance)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.PutState(allowanceKey, allowanceAsBytes)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Index the transfer in the same way as transfers of the owner
+	txID := stub.GetTxID()
+	err = putTransfer(stub, ownerAccountID, toAccountID, tokensToSend, dataPurchase, DefaultTokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// The spender is the buyer of the data, not the holder of the owner account
+	if dataPurchase {
+		spenderID, err := stub.GetCreator()
+		if err != nil {
+			return shim.Error("Failed to get creator ID." + err.Error())
+		}
+		spenderKey, err := stub.CreateCompositeKey("Spender~TxID", []string{txID})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.PutState(spenderKey, []byte(base64.StdEncoding.EncodeToString(spenderID)))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	err = putFee(stub, ownerAccountID, treasuryAccountID, fee)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Tx entry saved and indexed
+	return shim.Success([]byte(txID))
+}
+
+// setExchangeRate - publishes exchange rate of the token pair and the treasury account that provides liquidity.
+// Previous rates of the pair stay in the rate history
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) setExchangeRate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 5
+	//      0          1          2             3                4
+	// "fromType" "toType" "numerator" "denominator" "treasuryAccountID"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting fromType, toType, numerator, denominator, treasuryAccountID")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	fromType := args[0]
+	toType := args[1]
+	if fromType == toType {
+		return shim.Error("Token types of the pair cannot be the same.")
+	}
+	numerator, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || numerator < 1 {
+		return shim.Error("Expecting positive integer as numerator of the rate.")
+	}
+	denominator, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil || denominator < 1 {
+		return shim.Error("Expecting positive integer as denominator of the rate.")
+	}
+	treasuryAccountID := args[4]
+
+	// Only the administrator can publish exchange rates
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Check if the token types and the treasury account exist
+	for _, tokenType := range []string{fromType, toType} {
+		_, err = getTokenTypeValue(stub, tokenType)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	treasuryAccountAsBytes, err := stub.GetState(treasuryAccountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if treasuryAccountAsBytes == nil {
+		return shim.Error("Account does not exist: " + treasuryAccountID)
+	}
+	var treasuryAccount Account
+	err = json.Unmarshal(treasuryAccountAsBytes, &treasuryAccount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Swaps send tokens from the treasury account without approval of its holder,
+	// therefore only the account held by the administrator can be the treasury account
+	err = checkAccountOwner(stub, &treasuryAccount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkSingleSignature(&treasuryAccount, "It cannot be the treasury account of swaps.")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	txTimestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txID := stub.GetTxID()
+	rate := &ExchangeRate{"EXCHANGERATE", fromType, toType, numerator, denominator, treasuryAccountID, txID, string(txTimestamp)}
+	rateAsBytes, err := json.Marshal(rate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Save the current rate and add it to the rate history ordered by time
+	rateKey, err := stub.CreateCompositeKey("ExchangeRate~From~To", []string{fromType, toType})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(rateKey, rateAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rateHistoryKey, err := stub.CreateCompositeKey("ExchangeRateHistory~From~To~Timestamp~TxID",
+		[]string{fromType, toType, string(txTimestamp), txID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(rateHistoryKey, rateAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Exchange rate set"))
+}
+
+// getExchangeRate - returns the current exchange rate of the token pair
+//////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getExchangeRate(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	argsCount := 2
+	//      0         1
+	// "fromType" "toType"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting fromType and toType")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	rate, err := getExchangeRateValue(stub, args[0], args[1])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	rateAsBytes, err := json.Marshal(rate)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(rateAsBytes)
+}
+
+// getExchangeRateHistory - returns all published exchange rates of the token pair from the oldest one
+////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getExchangeRateHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//      0         1          2            3
+	// "fromType" "toType" "pageSize" ["bookmark"]
+	if len(args) < 3 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting fromType, toType, page size and optional bookmark")
+	}
+
+	// Input sanitization. Bookmark is empty for the first page.
+	for i := 0; i < 3; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	fromType := args[0]
+	toType := args[1]
+	pageSize := args[2]
+	bookmark := ""
+	if len(args) == 4 {
+		bookmark = args[3]
+	}
+
+	// The rate is saved as the value of the history entry
+	return getPageByPartialCompositeKey(stub, "ExchangeRateHistory~From~To~Timestamp~TxID", []string{fromType, toType},
+		pageSize, bookmark, func(compositeKeyParts []string) pb.Response {
+			rateHistoryKey, err := stub.CreateCompositeKey("ExchangeRateHistory~From~To~Timestamp~TxID", compositeKeyParts)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			rateAsBytes, err := stub.GetState(rateHistoryKey)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			return shim.Success(rateAsBytes)
+		})
+}
+
+// swapTokens - converts tokens of the account to another token type by the current exchange rate.
+// The account sends tokens of the source type to the treasury account and the treasury account sends
+// tokens of the target type back in the same Tx, so either both transfers are saved or none of them
+//////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) swapTokens(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 4
+	//      0           1         2        3
+	// "accountID" "fromType" "toType" "Amount"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting accountID, fromType, toType, Amount")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	accountID := args[0]
+	fromType := args[1]
+	toType := args[2]
+	registeredFromType, err := getTokenTypeValue(stub, fromType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokensToSwap, err := parseAmount(args[3], registeredFromType.Decimals)
+	if err != nil || tokensToSwap < 1 {
+		return shim.Error("Expecting positive amount of tokens to swap.")
+	}
+
+	// Get the current rate of the pair
+	rate, err := getExchangeRateValue(stub, fromType, toType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if rate.TreasuryAccountID == accountID {
+		return shim.Error("Treasury account cannot swap tokens with itself.")
+	}
+
+	// Amount of the target token type is rounded down
+	toAmount := new(big.Int).Mul(big.NewInt(tokensToSwap), big.NewInt(rate.Numerator))
+	toAmount.Quo(toAmount, big.NewInt(rate.Denominator))
+	if !toAmount.IsInt64() {
+		return shim.Error("Amount of swapped tokens would overflow.")
+	}
+	tokensToReceive := toAmount.Int64()
+	if tokensToReceive < 1 {
+		return shim.Error("Amount of tokens is too small to be swapped.")
+	}
+
+	// Get both accounts
+	accountAsBytes, err := stub.GetState(accountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if accountAsBytes == nil {
+		return shim.Error("Account does not exist: " + accountID)
+	}
+	var account Account
+	err = json.Unmarshal(accountAsBytes, &account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	treasuryAccountAsBytes, err := stub.GetState(rate.TreasuryAccountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if treasuryAccountAsBytes == nil {
+		return shim.Error("Account does not exist: " + rate.TreasuryAccountID)
+	}
+	var treasuryAccount Account
+	err = json.Unmarshal(treasuryAccountAsBytes, &treasuryAccount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Only the account holder can swap tokens of the account
+	err = checkAccountOwner(stub, &account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkSingleSignature(&account, "Its tokens cannot be swapped.")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Frozen or closed accounts cannot send tokens
+	err = checkAccountActive(&account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkAccountActive(&treasuryAccount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Check if the account has enough tokens and the treasury account has enough liquidity
+	accTok, accDeltas, err := getAccountBalance(stub, accountID, fromType)
+	if err != nil {
+		return shim.Error("Retrieval of account tokens failed: " + err.Error())
+	}
+	if accTok < tokensToSwap {
+		return shim.Error("Not enough tokens on the sender's account")
+	}
+	treasuryTok, treasuryDeltas, err := getAccountBalance(stub, rate.TreasuryAccountID, toType)
+	if err != nil {
+		return shim.Error("Retrieval of account tokens failed: " + err.Error())
+	}
+	if treasuryTok < tokensToReceive {
+		return shim.Error("Not enough tokens on the treasury account " + rate.TreasuryAccountID)
+	}
+
+	// Roll the checkpoints forward before the new debits are saved
+	err = rollForwardCheckpointIfDue(stub, accountID, fromType, accDeltas)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = rollForwardCheckpointIfDue(stub, rate.TreasuryAccountID, toType, treasuryDeltas)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Both transfers share the TxID and differ in token type
+	txID := stub.GetTxID()
+	err = putTransfer(stub, accountID, rate.TreasuryAccountID, tokensToSwap, false, fromType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putTransfer(stub, rate.TreasuryAccountID, accountID, tokensToReceive, false, toType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Amounts in the smallest units are formatted as decimal numbers of their token types
+	registeredToType, err := getTokenTypeValue(stub, toType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	swapAsBytes, err := json.Marshal(&TokenSwap{txID, accountID, rate.TreasuryAccountID,
+		fromType, json.Number(formatAmount(tokensToSwap, registeredFromType.Decimals)),
+		toType, json.Number(formatAmount(tokensToReceive, registeredToType.Decimals))})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(swapAsBytes)
+}
+
+// updateAccountTokens - updates the account entry in state with the latest values of tokens
+////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) updateAccountTokens(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 1
+	//       0
+	// "accountID"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting account ID")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	accountID := args[0]
+
+	// Get the account entry from chaincode state
+	accountAsBytes, err := stub.GetState(accountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if accountAsBytes == nil {
+		return shim.Error(err.Error())
+	}
+	var account Account
+	err = json.Unmarshal(accountAsBytes, &account)
+	if err != nil {
+		return shim.Error("Some error: " + err.Error())
+	}
+
+	// Only the account holder can update the account
+	err = checkAccountOwner(stub, &account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Get the latest state of tokens for sender's account
+	accTok, _, err := getAccountBalance(stub, accountID, DefaultTokenType)
+	if err != nil {
+		return shim.Error("Retrieval of account tokens failed: " + err.Error())
+	}
+
+	// update values of tokens
+	account.Tokens = accTok
+
+	// Marshal object
+	accountAsBytesNew, err := json.Marshal(&account)
+	if err != nil {
+		return shim.Error("Some error: " + err.Error())
+	}
+
+	// Write state back to the ledger
+	err = stub.PutState(accountID, accountAsBytesNew)
+	if err != nil {
+		return shim.Error("Some error: " + err.Error())
+	}
+
+	// return JSON object Account with updated token values
+	return shim.Success(accountAsBytesNew)
+}
+
+// getAccountTokens - returns current state of tokens of the token type in a specific account
+/////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getAccountTokens(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 1
+	//    0             1
+	// "accountID" ["tokenType"]
+	if len(args) != argsCount && len(args) != argsCount+1 {
+		return shim.Error("Incorrect number of arguments. Expecting account ID and optional token type")
+	}
+
+	// Input sanitization
+	for i := 0; i < len(args); i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get args
+	accountID := args[0]
+	tokenType := DefaultTokenType
+	if len(args) > argsCount {
+		tokenType = args[1]
+	}
+	registeredTokenType, err := getTokenTypeValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// The checkpoint of the account plus all deltas recorded since the checkpoint
+	finalTok, _, err := getAccountBalance(stub, accountID, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// format amount in the smallest units as decimal number of the token type
+	res := formatAmount(finalTok, registeredTokenType.Decimals)
+
+	// Return result
+	return shim.Success([]byte(res))
+}
+
+// getAccountHistoryByID - get the whole history of specific account number even if it was deleted from state.
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getAccountHistoryByID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	argsCount := 1
+	//    0
+	// "accountID"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting AccountID")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	accountID := args[0]
+
+	// Get history for the account ID
+	resultsIterator, err := stub.GetHistoryForKey(accountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	// buffer is a JSON array containing historic values for the account
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	// for each entry write to buffer
+	for resultsIterator.HasNext() {
+		response, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// This create structure of the output
+		// Write transaction ID
+		buffer.WriteString("{\"TxId\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(response.TxId)
+		buffer.WriteString("\"")
+
+		// Write Value
+		buffer.WriteString(", \"Value\":")
+
+		// if it was a delete operation on given key, then we set the
+		// value to null. Else, we will write the response.Value
+		// as-is (as the Value itself a JSON)
+		if response.IsDelete {
+			buffer.WriteString("null")
+		} else {
+			buffer.WriteString(string(response.Value))
+		}
+
+		// Write Timestamp of the transaction
+		buffer.WriteString(", \"Timestamp\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(time.Unix(response.Timestamp.Seconds, int64(response.Timestamp.Nanos)).String())
+		buffer.WriteString("\"")
+
+		// Write if it was delete transaction
+		buffer.WriteString(", \"IsDelete\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(strconv.FormatBool(response.IsDelete))
+		buffer.WriteString("\"")
+
+		// Close the single entry
+		buffer.WriteString("}")
+
+		// Add a comma in front of an array member
+		if resultsIterator.HasNext() {
+			buffer.WriteString(",")
+		}
+	}
+
+	// Close JSON array
+	buffer.WriteString("]")
+
+	// Return JSON array of history transactions for the account ID
+	return shim.Success(buffer.Bytes())
+}
+
+// getAccountTransactions - returns page of transactions of the account with direction, amount,
+// counterparty, state and time. Transactions are ordered as in the index "Account~op~Tok~TxID"
+// and followed by transactions of other token types as in the index "Account~Type~op~Tok~TxID"
+/////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getAccountTransactions(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//       0          1           2
+	// "accountID" "pageSize" ["bookmark"]
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting account ID, page size and optional bookmark")
+	}
+
+	// Input sanitization. Bookmark is empty for the first page.
+	for i := 0; i < 2; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	accountID := args[0]
+	pageSize := args[1]
+	bookmark := ""
+	if len(args) == 3 {
+		bookmark = args[2]
+	}
+
+	// Transactions of the default token type are followed by transactions of other token types.
+	// The bookmark tells in which index the page starts
+	objectType := "Account~op~Tok~TxID"
+	ledgerBookmarkAsBytes, err := base64.StdEncoding.DecodeString(bookmark)
+	if err != nil {
+		return shim.Error("Invalid bookmark.")
+	}
+	if len(ledgerBookmarkAsBytes) > 0 {
+		objectType, _, err = stub.SplitCompositeKey(string(ledgerBookmarkAsBytes))
+		if err != nil || (objectType != "Account~op~Tok~TxID" && objectType != "Account~Type~op~Tok~TxID") {
+			return shim.Error("Invalid bookmark.")
+		}
+	}
+
+	// Get the Tx details for each account entry of the page
+	response := getPageByPartialCompositeKey(stub, objectType, []string{accountID}, pageSize, bookmark,
+		func(compositeKeyParts []string) pb.Response {
+			if objectType == "Account~Type~op~Tok~TxID" {
+				compositeKeyParts = []string{compositeKeyParts[0], compositeKeyParts[2], compositeKeyParts[3],
+					compositeKeyParts[4], compositeKeyParts[1]}
+			}
+			return getAccountTx(stub, compositeKeyParts)
+		})
+	if response.Status != shim.OK || objectType != "Account~op~Tok~TxID" {
+		return response
+	}
+
+	// Continue with the entries of other token types after the last page of the default token type
+	var page struct {
+		Records  []json.RawMessage `json:"records"`
+		Bookmark string            `json:"bookmark"`
+		HasMore  bool              `json:"hasMore"`
+	}
+	err = json.Unmarshal(response.Payload, &page)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if page.HasMore {
+		return response
+	}
+	typeIterator, err := stub.GetStateByPartialCompositeKey("Account~Type~op~Tok~TxID", []string{accountID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer typeIterator.Close()
+	if !typeIterator.HasNext() {
+		return response
+	}
+	typeStartKey, err := stub.CreateCompositeKey("Account~Type~op~Tok~TxID", []string{accountID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	page.Bookmark = base64.StdEncoding.EncodeToString([]byte(typeStartKey))
+	page.HasMore = true
+	pageAsBytes, err := json.Marshal(&page)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(pageAsBytes)
+}
+
+// getTxDetails - returns participants' account IDs of transaction, amount and state of transaction as the legacy
+// string sender->recipient->tokens->[ValidTx|PendingTx|RefundedTx]. Version 2 returns JSON object with time and fee
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getTxDetails(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 1
+	//    0         1
+	// "txID" ["version"]
+	if len(args) != argsCount && len(args) != argsCount+1 {
+		return shim.Error("Incorrect number of arguments. Expecting TxID")
+	}
+
+	// Input sanitization
+	for i := 0; i < len(args); i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	txID := args[0]
+	version := "1"
+	if len(args) > argsCount {
+		version = args[1]
+	}
+	if version != "1" && version != "2" {
+		return shim.Error("Expecting 1 or 2 as version of the response.")
+	}
+
+	// Get the state from TxID~Sender~Recipient~Tok index
+	txIDResultsIterator, err := stub.GetStateByPartialCompositeKey("TxID~Sender~Recipient~Tok",
+		[]string{txID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer txIDResultsIterator.Close()
+
+	// Initialise txState as validTx
+	txState := "ValidTx"
+
+	// If there is not such TxID then check the PendingTxID~Sender~Recipient~Tok index
+	if !txIDResultsIterator.HasNext() {
+		txIDResultsIterator, err = stub.GetStateByPartialCompositeKey("PendingTxID~Sender~Recipient~Tok",
+			[]string{txID})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer txIDResultsIterator.Close()
+
+		// Change the txState to pendingTx
+		txState = "PendingTx"
+	}
+
+	// If there is not such TxID then check the RefundedTxID~Sender~Recipient~Tok index
+	if !txIDResultsIterator.HasNext() {
+		txIDResultsIterator, err = stub.GetStateByPartialCompositeKey("RefundedTxID~Sender~Recipient~Tok",
+			[]string{txID})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer txIDResultsIterator.Close()
+
+		// There is not such transaction in all indices
+		if !txIDResultsIterator.HasNext() {
+			return shim.Error("Transaction was not found.")
+		}
+
+		// Change the txState to refundedTx
+		txState = "RefundedTx"
+	}
+
+	// Get the response range
+	responseRange, err := txIDResultsIterator.Next()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Get the values from composite key
+	_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Tx with more recipients (batch) has single entry with the sender's account
+	for txIDResultsIterator.HasNext() {
+		nextResponseRange, err := txIDResultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, nextCompositeKeyParts, err := stub.SplitCompositeKey(nextResponseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if isSystemParticipant(nextCompositeKeyParts[1]) {
+			continue
+		}
+		if !isSystemParticipant(compositeKeyParts[1]) {
+			// Swap of tokens has an entry for each token type, the entry of the first one is returned
+			if tokenTypeOfKey(nextCompositeKeyParts, 4) != tokenTypeOfKey(compositeKeyParts, 4) {
+				continue
+			}
+			return shim.Error("Two TxID are same? Impossible!")
+		}
+		responseRange = nextResponseRange
+		compositeKeyParts = nextCompositeKeyParts
+	}
+
+	// Amount is formatted as decimal number of the token type
+	tokenType, err := getTokenTypeValue(stub, tokenTypeOfKey(compositeKeyParts, 4))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amount, err := strconv.ParseInt(compositeKeyParts[3], 10, 64)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	amountStr := formatAmount(amount, tokenType.Decimals)
+
+	// The fee is saved as a separate transfer to the treasury account
+	var fee int64
+	feeResultsIterator, err := stub.GetStateByPartialCompositeKey("TxID~Sender~Recipient~Tok",
+		[]string{feeTxID(txID)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer feeResultsIterator.Close()
+	if feeResultsIterator.HasNext() {
+		feeResponseRange, err := feeResultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		_, feeCompositeKeyParts, err := stub.SplitCompositeKey(feeResponseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		fee, err = strconv.ParseInt(feeCompositeKeyParts[3], 10, 64)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// Construct the legacy response string
+	if version == "1" {
+		var response []byte
+		response = append(response, []byte(compositeKeyParts[1]+"->"+compositeKeyParts[2])...)
+		response = append(response, []byte("->")...)
+		response = append(response, []byte(amountStr)...)
+		response = append(response, []byte("->")...)
+		response = append(response, []byte(txState)...)
+
+		// Return byte array with Tx details
+		return shim.Success(response)
+	}
+
+	// Construct the response object
+	// Tx entries created before the time was recorded contain only null character
+	timestamp := ""
+	if len(responseRange.Value) > 1 {
+		timestamp = string(responseRange.Value)
+	}
+	expiry := ""
+	if txState == "PendingTx" {
+		expiryTime, err := getPendingTxExpiryTime(stub, responseRange.Value)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		expiry = expiryTime.UTC().Format(time.RFC3339)
+	}
+	spenderKey, err := stub.CreateCompositeKey("Spender~TxID", []string{txID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	spenderID, err := stub.GetState(spenderKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txDetails := &TxDetails{txID, compositeKeyParts[1], compositeKeyParts[2], json.Number(amountStr),
+		json.Number(formatAmount(fee, tokenType.Decimals)), tokenType.Symbol,
+		txState, timestamp, expiry, string(spenderID)}
+	txDetailsAsBytes, err := json.Marshal(txDetails)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Return JSON object with Tx details
+	return shim.Success(txDetailsAsBytes)
+}
+
+// changePendingTx - change pending tokens to normal tokens
+////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) changePendingTx(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 3
+	//      0              1           2
+	// "channelAd" "chaincodeAdName" "txID"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	channelAd := args[0]
+	chaincodeAdName := args[1]
+	txID := args[2]
+
+	// Only the trusted chaincode can confirm that the Tx was used for data purchase
+	err = checkTrustedChaincode(stub, "ad", channelAd, chaincodeAdName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Get the TxID from another chaincode
+	pendingTxIDResultsIterator, err := stub.GetStateByPartialCompositeKey("PendingTxID~Sender~Recipient~Tok",
+		[]string{txID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer pendingTxIDResultsIterator.Close()
+
+	// If not Tx found then it was already moved as valid Tx
+	if !pendingTxIDResultsIterator.HasNext() {
+		return shim.Error("Transaction was already used or does not exist.")
+	}
+
+	// Extract values
+	responseRange, err := pendingTxIDResultsIterator.Next()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Get the separate values
+	_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Check if there is another Tx with the same ID
+	if pendingTxIDResultsIterator.HasNext() {
+		return shim.Error("changePendingTx: Two TxID are same? Impossible!")
+	}
+
+	// check if the Tx was already used for data purchase
+	fDataAd := []byte("checkTXState")
+	argsToChaincodeAd := [][]byte{fDataAd, []byte(txID)}
+	responseTXCheck := stub.InvokeChaincode(chaincodeAdName, argsToChaincodeAd, channelAd)
+	if responseTXCheck.Status != shim.OK {
+		return shim.Error("changePendingTx: Error while invoking another chaincode: " + responseTXCheck.Message)
+	}
+	if string(responseTXCheck.Payload) != "Used" {
+		return shim.Error("This TxID was not used for data purchase yet.")
+	}
+
+	// The recipient gets tokens of the Tx sent before
+	err = recordOpenSnapshotBalances(stub, compositeKeyParts[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// create composite key to reindex
+	tokenType := tokenTypeOfKey(compositeKeyParts, 4)
+	txCompositeIndexKey, err := stub.CreateCompositeKey("TxID~Sender~Recipient~Tok",
+		tokenTypeKeys([]string{txID, compositeKeyParts[1], compositeKeyParts[2], compositeKeyParts[3]}, tokenType))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Maintain index of pending Tx
+	err = stub.DelState(responseRange.Key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Add Tx to index "TxID~Sender~Recipient~Tok" and keep the time of the transaction
+	err = stub.PutState(txCompositeIndexKey, responseRange.Value)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Save the recipient's entry into the index of account entries
+	err = putAccountEntry(stub, compositeKeyParts[2], "+", compositeKeyParts[3], txID, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Tx changed and indexed in both indexes
+	// Return tx ID
+	return shim.Success([]byte(txID))
+}
+
+func (cc *Chaincode) pruneAccountTx(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 1
+	//    0             1
+	// "accountID" ["tokenType"]
+	if len(args) != argsCount && len(args) != argsCount+1 {
+		return shim.Error("Incorrect number of arguments. Expecting account ID and optional token type")
+	}
+
+	// Input sanitization
+	for i := 0; i < len(args); i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	accountID := args[0]
+	tokenType := DefaultTokenType
+	if len(args) > argsCount {
+		tokenType = args[1]
+	}
+	_, err = getTokenTypeValue(stub, tokenType)
+	if err != nil {
+		return shim.Error("pruneAccountTx: " + err.Error())
+	}
+
+	// Get the account entry from chaincode state
+	accountAsBytes, err := stub.GetState(accountID)
+	if err != nil {
+		return shim.Error("pruneAccountTx: " + err.Error())
+	} else if accountAsBytes == nil {
+		return shim.Error("pruneAccountTx: Account does not exist: " + accountID)
+	}
+	var account Account
+	err = json.Unmarshal(accountAsBytes, &account)
+	if err != nil {
+		return shim.Error("pruneAccountTx: " + err.Error())
+	}
+
+	// Only the account holder can prune the account transactions
+	err = checkAccountOwner(stub, &account)
+	if err != nil {
+		return shim.Error("pruneAccountTx: " + err.Error())
+	}
+	err = recordOpenSnapshotBalances(stub, accountID)
+	if err != nil {
+		return shim.Error("pruneAccountTx: " + err.Error())
+	}
+
+	// Get all account transactions of the token type for the account ID
+	accountTxIterator, err := getAccountEntries(stub, accountID, tokenType)
+	if err != nil {
+		return shim.Error("pruneAccountTx: " + err.Error())
+	}
+	defer accountTxIterator.Close()
+
+	// Iterate through result set and compute final amount of tokens
+	var finalTok int64
+	for accountTxIterator.HasNext() {
+		// Get the next row
+		responseRange, err := accountTxIterator.Next()
+		if err != nil {
+			return shim.Error("pruneAccountTx: " + err.Error())
+		}
+
+		// Split the composite key into its component parts
+		compositeKeyParts, err := splitAccountEntryKey(stub, responseRange.Key)
+		if err != nil {
+			return shim.Error("pruneAccountTx: " + err.Error())
+		}
+
+		// Retrieve the amount of tokens and operation
+		operation := compositeKeyParts[1]
+		tokensStr := compositeKeyParts[2]
+		txID := compositeKeyParts[3]
+
+		// Convert the tokensStr string and perform the operation
+		tokens, err := strconv.ParseInt(tokensStr, 10, 64)
+		if err != nil {
+			return shim.Error("pruneAccountTx: " + err.Error())
+		}
+
+		// check if the TxID is in "TxID~Sender~Recipient~Tok" index. If not then it is not valid Tx yet
+		// It can be pending Tx
+		txEntryKey, counterpart, err := getTxEntry(stub, "TxID~Sender~Recipient~Tok", accountID, operation, tokensStr,
+			txID, tokenType)
+		if err != nil {
+			return shim.Error("pruneAccountTx: " + err.Error())
+		}
+		if txEntryKey == "" {
+			continue
+		}
+
+		// calculate the delta
+		switch operation {
+		case "+":
+			finalTok, err = addTokens(finalTok, tokens)
+		case "-":
+			finalTok, err = addTokens(finalTok, -tokens)
+		default:
+			return shim.Error(fmt.Sprintf("Unrecognized operation %s", operation))
+		}
+		if err != nil {
+			return shim.Error("pruneAccountTx: " + err.Error())
+		}
+
+		// Maintain the index of account entries
+		err = deleteAccountEntry(stub, accountID, operation, tokensStr, txID, tokenType)
+		if err != nil {
+			return shim.Error("pruneAccountTx: " + err.Error())
+		}
+
+		// Maintain index of "TxID~Sender~Recipient~Tok"
+		// The Tx entry is kept while the other participant still needs it
+		err = deleteTxEntryIfUnused(stub, txEntryKey, accountID, counterpart, operation, tokensStr, txID, tokenType)
+		if err != nil {
+			return shim.Error("pruneAccountTx: " + err.Error())
+		}
+	}
+
+	newTxID := stub.GetTxID()
+	// Create the new composite key for the new entry
+	recipientIDOpTokCompositeKey, err := createAccountEntryKey(stub, accountID, "+", strconv.FormatInt(finalTok, 10),
+		newTxID, tokenType)
+	if err != nil {
+		return shim.Error("pruneAccountTx: " + err.Error())
+	}
+
+	// Create the new composite key for the new entry
+	txParticipantsTokCompositeKey, err := stub.CreateCompositeKey("TxID~Sender~Recipient~Tok",
+		tokenTypeKeys([]string{newTxID, "pruneTx", accountID, strconv.FormatInt(finalTok, 10)}, tokenType))
+	if err != nil {
+		return shim.Error("pruneAccountTx: " + err.Error())
+	}
+
+	// Update the index with single Tx that agregates all that were deleted
+	// Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
+	value := []byte{0x00}
+	err = stub.PutState(recipientIDOpTokCompositeKey, value)
+	if err != nil {
+		return shim.Error("pruneAccountTx: " + err.Error())
+	}
+	txTimestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return shim.Error("pruneAccountTx: " + err.Error())
+	}
+	err = stub.PutState(txParticipantsTokCompositeKey, txTimestamp)
+	if err != nil {
+		return shim.Error("pruneAccountTx: " + err.Error())
+	}
+
+	// Index updated
+	// Return new Tx ID
+	return shim.Success([]byte(newTxID))
+}
+
+// registerTokenType - registers new token type (currency). The caller becomes the issuer of the token type
+// and only the issuer can mint and burn its tokens
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) registerTokenType(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 2
+	//     0         1
+	// "symbol" "decimals"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting symbol and decimals")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	symbol := args[0]
+	decimals, err := strconv.Atoi(args[1])
+	if err != nil || decimals < 0 || decimals > 18 {
+		return shim.Error("Expecting integer from 0 to 18 as number of decimals.")
+	}
+
+	// Check if the token type already exists
+	tokenTypeKey, err := stub.CreateCompositeKey("TokenType~Symbol", []string{symbol})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokenTypeAsBytes, err := stub.GetState(tokenTypeKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if tokenTypeAsBytes != nil || symbol == DefaultTokenType {
+		return shim.Error("Token type already exists: " + symbol)
+	}
+
+	// GetCreator returns the identity object of the chaincode invocation's submitter
+	creatorID, err := stub.GetCreator()
+	if err != nil {
+		return shim.Error("Failed to get creator ID." + err.Error())
+	}
+
+	tokenTypeAsBytes, err = json.Marshal(&TokenType{"TOKENTYPE", symbol, decimals, base64.StdEncoding.EncodeToString(creatorID)})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(tokenTypeKey, tokenTypeAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Token type registered"))
+}
+
+// getTokenType - returns symbol, decimals and issuer of the token type
+////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getTokenType(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	argsCount := 1
+	//     0
+	// "symbol"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting symbol")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	tokenType, err := getTokenTypeValue(stub, args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokenTypeAsBytes, err := json.Marshal(tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(tokenTypeAsBytes)
+}
+
+// setTokenDecimals - changes the number of decimal places of the token type (issuer of the token type only).
+// Amounts are kept in the smallest units, so the decimals can be changed only while there are no tokens in circulation
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) setTokenDecimals(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 2
+	//     0         1
+	// "symbol" "decimals"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting symbol and decimals")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	symbol := args[0]
+	decimals, err := strconv.Atoi(args[1])
+	if err != nil || decimals < 0 || decimals > 18 {
+		return shim.Error("Expecting integer from 0 to 18 as number of decimals.")
+	}
+
+	// Only the issuer of the token type can change the decimals
+	tokenType, err := getTokenTypeValue(stub, symbol)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkTokenIssuer(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Existing amounts would change their value
+	totalSupply, err := getTotalSupplyValue(stub, symbol)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if totalSupply != 0 {
+		return shim.Error("Decimals cannot be changed while there are tokens of type " + symbol + " in circulation.")
+	}
+
+	tokenType.Decimals = decimals
+	tokenTypeKey, err := stub.CreateCompositeKey("TokenType~Symbol", []string{symbol})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokenTypeAsBytes, err := json.Marshal(tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(tokenTypeKey, tokenTypeAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Token decimals set"))
+}
+
+// mintTokens - creates new tokens of the token type on the account and increases total supply
+//////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) mintTokens(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 2
+	//      0          1          2
+	// "accountID" "Amount" ["tokenType"]
+	if len(args) != argsCount && len(args) != argsCount+1 {
+		return shim.Error("Incorrect number of arguments. Expecting account ID, amount and optional token type")
+	}
+
+	// Input sanitization
+	for i := 0; i < len(args); i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	accountID := args[0]
+	tokenType := DefaultTokenType
+	if len(args) > argsCount {
+		tokenType = args[2]
+	}
+
+	// Only the issuer of the token type can create tokens
+	registeredTokenType, err := getTokenTypeValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokensToMint, err := parseAmount(args[1], registeredTokenType.Decimals)
+	if err != nil || tokensToMint < 1 {
+		return shim.Error("Expecting positive amount of tokens to mint.")
+	}
+	err = checkTokenIssuer(stub, registeredTokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Check if the account exists
+	accountAsBytes, err := stub.GetState(accountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if accountAsBytes == nil {
+		return shim.Error("Account does not exist: " + accountID)
+	}
+
+	// Increase total supply
+	totalSupply, err := getTotalSupplyValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if totalSupply > math.MaxInt64-tokensToMint {
+		return shim.Error("Total supply of tokens would overflow.")
+	}
+	err = putTotalSupply(stub, tokenType, totalSupply+tokensToMint)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Record the operation in the same way as transfers
+	txID := stub.GetTxID()
+	err = putSystemTransfer(stub, accountID, "+", "Mint", tokensToMint, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Tx entry saved and indexed
+	return shim.Success([]byte(txID))
+}
+
+// burnTokens - takes tokens out of circulation from the account and decreases total supply
+////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) burnTokens(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 2
+	//      0          1          2
+	// "accountID" "Amount" ["tokenType"]
+	if len(args) != argsCount && len(args) != argsCount+1 {
+		return shim.Error("Incorrect number of arguments. Expecting account ID, amount and optional token type")
+	}
+
+	// Input sanitization
+	for i := 0; i < len(args); i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	accountID := args[0]
+	tokenType := DefaultTokenType
+	if len(args) > argsCount {
+		tokenType = args[2]
+	}
+
+	// Only the issuer of the token type can take tokens out of circulation
+	registeredTokenType, err := getTokenTypeValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokensToBurn, err := parseAmount(args[1], registeredTokenType.Decimals)
+	if err != nil || tokensToBurn < 1 {
+		return shim.Error("Expecting positive amount of tokens to burn.")
+	}
+	err = checkTokenIssuer(stub, registeredTokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Get the account
+	accountAsBytes, err := stub.GetState(accountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if accountAsBytes == nil {
+		return shim.Error("Account does not exist: " + accountID)
+	}
+	var account Account
+	err = json.Unmarshal(accountAsBytes, &account)
+	if err != nil {
+		return shim.Error("Some error: " + err.Error())
+	}
+
+	// Tokens can be burned only from the account held by the issuer
+	err = checkAccountOwner(stub, &account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = checkSingleSignature(&account, "Its tokens cannot be burned.")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Check if the account has enough tokens
+	accTok, _, err := getAccountBalance(stub, accountID, tokenType)
+	if err != nil {
+		return shim.Error("Retrieval of account tokens failed: " + err.Error())
+	}
+	if accTok < tokensToBurn {
+		return shim.Error("Not enough tokens on the account")
+	}
+
+	// Decrease total supply
+	totalSupply, err := getTotalSupplyValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if totalSupply < tokensToBurn {
+		return shim.Error("Not enough tokens in circulation. Total supply has to be recomputed by recomputeTotalSupply.")
+	}
+	err = putTotalSupply(stub, tokenType, totalSupply-tokensToBurn)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Record the operation in the same way as transfers
+	txID := stub.GetTxID()
+	err = putSystemTransfer(stub, accountID, "-", "Burn", tokensToBurn, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Tx entry saved and indexed
+	return shim.Success([]byte(txID))
+}
+
+// getTotalSupply - returns the amount of tokens of the token type in circulation
+///////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getTotalSupply(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//      0
+	// ["tokenType"]
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting optional token type")
+	}
+	tokenType := DefaultTokenType
+	if len(args) == 1 {
+		tokenType = args[0]
+	}
+	registeredTokenType, err := getTokenTypeValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	totalSupply, err := getTotalSupplyValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(formatAmount(totalSupply, registeredTokenType.Decimals)))
+}
+
+// createBalanceSnapshot - records balances of all token types of a page of accounts into the snapshot. The first page
+// creates the snapshot and the last page completes it, after that the snapshot cannot be changed. Every page records
+// balances as of the time of the first page, so transfers between pages are not counted. Balances are computed
+// in the same way as getAccountTokens, so tokens of pending Tx are taken from the sender but not given to the recipient
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) createBalanceSnapshot(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	//       0            1           2
+	// "snapshotID" "pageSize" ["bookmark"]
+	if len(args) < 2 || len(args) > 3 {
+		return shim.Error("Incorrect number of arguments. Expecting snapshot ID, page size and optional bookmark")
+	}
+
+	// Input sanitization. Bookmark is empty for the first page.
+	for i := 0; i < 2; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	snapshotID := args[0]
+	pageSize := args[1]
+	bookmark := ""
+	if len(args) == 3 {
+		bookmark = args[2]
+	}
+
+	// Only the administrator can create snapshots
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// The first page creates the snapshot, next pages continue it
+	snapshotKey, err := stub.CreateCompositeKey("Snapshot~ID", []string{snapshotID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	snapshotAsBytes, err := stub.GetState(snapshotKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	var snapshot BalanceSnapshot
+	if bookmark == "" {
+		if snapshotAsBytes != nil {
+			return shim.Error("Snapshot already exists: " + snapshotID)
+		}
+
+		// Deltas changed while the snapshot is open are recorded into the open snapshot, so only one can be open
+		openSnapshot, err := getOpenSnapshot(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if openSnapshot != nil {
+			return shim.Error("Snapshot is not complete yet: " + openSnapshot.SnapshotID)
+		}
+		txTimestamp, err := getTxTimestamp(stub)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		snapshot = BalanceSnapshot{"SNAPSHOT", snapshotID, string(txTimestamp), 0, map[string]int64{}, false}
+		err = putConfig(stub, "OpenSnapshot", snapshotID)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	} else {
+		if snapshotAsBytes == nil {
+			return shim.Error("Snapshot does not exist: " + snapshotID)
+		}
+		err = json.Unmarshal(snapshotAsBytes, &snapshot)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if snapshot.Complete {
+			return shim.Error("Snapshot is complete and cannot be changed: " + snapshotID)
+		}
+	}
+
+	// Record the balances of each account of the page. Balances of accounts recorded before their deltas
+	// were changed are kept
+	response := getPageOfAccounts(stub, pageSize, bookmark,
+		func(accountID string) pb.Response {
+			balances, err := putSnapshotBalances(stub, &snapshot, accountID)
+			if err != nil {
+				return shim.Error("Retrieval of account tokens failed: " + err.Error())
+			}
+			snapshot.Accounts++
+			for tokenType, tokens := range balances.Tokens {
+				snapshot.TotalTokens[tokenType], err = addTokens(snapshot.TotalTokens[tokenType], tokens)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+			}
+
+			balancesAsBytes, err := json.Marshal(balances)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			return shim.Success(balancesAsBytes)
+		})
+	if response.Status != shim.OK {
+		return response
+	}
+
+	// The snapshot is complete when there are no more accounts
+	var page struct {
+		HasMore bool `json:"hasMore"`
+	}
+	err = json.Unmarshal(response.Payload, &page)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	snapshot.Complete = !page.HasMore
+	if snapshot.Complete {
+		err = putConfig(stub, "OpenSnapshot", "")
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+	snapshotAsBytes, err = json.Marshal(&snapshot)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(snapshotKey, snapshotAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return response
+}
+
+// getBalanceSnapshot - returns time, number of accounts and sum of balances of the snapshot
+/////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getBalanceSnapshot(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	argsCount := 1
+	//      0
+	// "snapshotID"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting snapshot ID")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	snapshotKey, err := stub.CreateCompositeKey("Snapshot~ID", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	snapshotAsBytes, err := stub.GetState(snapshotKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if snapshotAsBytes == nil {
+		return shim.Error("Snapshot does not exist: " + args[0])
+	}
+
+	return shim.Success(snapshotAsBytes)
+}
+
+// getBalanceAt - returns the balance of the token type of the account recorded in the complete snapshot
+//////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getBalanceAt(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	argsCount := 2
+	//      0            1             2
+	// "accountID" "snapshotID" ["tokenType"]
+	if len(args) != argsCount && len(args) != argsCount+1 {
+		return shim.Error("Incorrect number of arguments. Expecting account ID, snapshot ID and optional token type")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	accountID := args[0]
+	snapshotID := args[1]
+	tokenType := DefaultTokenType
+	if len(args) > argsCount {
+		tokenType = args[2]
+	}
+	registeredTokenType, err := getTokenTypeValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Balances of incomplete snapshot would not be consistent
+	snapshotResponse := cc.getBalanceSnapshot(stub, []string{snapshotID})
+	if snapshotResponse.Status != shim.OK {
+		return snapshotResponse
+	}
+	var snapshot BalanceSnapshot
+	err = json.Unmarshal(snapshotResponse.Payload, &snapshot)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if !snapshot.Complete {
+		return shim.Error("Snapshot is not complete yet: " + snapshotID)
+	}
+
+	balances, err := getSnapshotBalances(stub, snapshotID, accountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if balances == nil {
+		return shim.Error("Account " + accountID + " is not in snapshot " + snapshotID)
+	}
+
+	// format amount in the smallest units as decimal number of the token type. Token types the account
+	// did not have at the time of the snapshot have zero balance
+	return shim.Success([]byte(formatAmount(balances.Tokens[tokenType], registeredTokenType.Decimals)))
+}
+
+// auditLedger - walks both token indexes and reports total supply, pending amounts,
+// negative balances and rows that appear only in one index for the token type
+///////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) auditLedger(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//      0
+	// ["tokenType"]
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting optional token type")
+	}
+	tokenType := DefaultTokenType
+	if len(args) == 1 {
+		tokenType = args[0]
+	}
+	_, err := getTokenTypeValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Load the index of account entries and compute balances
+	accountRows, err := getAccountEntryRows(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	balances := make(map[string]int64)
+	accountIDs := []string{}
+	accountRowKeys := make(map[string]bool)
+	for _, parts := range accountRows {
+		tokens, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if _, ok := balances[parts[0]]; !ok {
+			accountIDs = append(accountIDs, parts[0])
+		}
+		switch parts[1] {
+		case "+":
+			balances[parts[0]], err = addTokens(balances[parts[0]], tokens)
+		case "-":
+			balances[parts[0]], err = addTokens(balances[parts[0]], -tokens)
+		default:
+			return shim.Error(fmt.Sprintf("Unrecognized operation %s", parts[1]))
+		}
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		accountRowKeys[strings.Join(parts[:4], "~")] = true
+	}
+
+	// Deltas are removed from the index when they are rolled forward into the checkpoint or pruned,
+	// so the account entry can be missing only for Tx before the last compaction of the account
+	compactedUntil := make(map[string]string)
+
+	// Add checkpoints of the accounts
+	checkpointIterator, err := stub.GetStateByPartialCompositeKey("Checkpoint~AccountID", []string{})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer checkpointIterator.Close()
+	for checkpointIterator.HasNext() {
+		responseRange, err := checkpointIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		var checkpoint Checkpoint
+		err = json.Unmarshal(responseRange.Value, &checkpoint)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if checkpoint.TokenType != tokenType {
+			continue
+		}
+		if _, ok := balances[checkpoint.AccountID]; !ok {
+			accountIDs = append(accountIDs, checkpoint.AccountID)
+		}
+		balances[checkpoint.AccountID], err = addTokens(balances[checkpoint.AccountID], checkpoint.Tokens)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		compactedUntil[checkpoint.AccountID] = checkpoint.Timestamp
+	}
+
+	// Load "TxID~Sender~Recipient~Tok" and "PendingTxID~Sender~Recipient~Tok" indexes
+	txRows, err := getIndexRows(stub, "TxID~Sender~Recipient~Tok", 4, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	pendingTxRows, err := getIndexRows(stub, "PendingTxID~Sender~Recipient~Tok", 4, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	txRowKeys := make(map[string]bool)
+	for _, parts := range txRows {
+		txRowKeys[strings.Join([]string{parts[0], parts[1], "-", parts[3]}, "~")] = true
+		txRowKeys[strings.Join([]string{parts[0], parts[2], "+", parts[3]}, "~")] = true
+
+		// Times are in the same RFC 3339 format, so they can be compared as strings
+		if parts[1] == "pruneTx" {
+			txTimestamp, err := getTxEntryTimestamp(stub, "TxID~Sender~Recipient~Tok", parts, tokenType)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if txTimestamp > compactedUntil[parts[2]] {
+				compactedUntil[parts[2]] = txTimestamp
+			}
+		}
+	}
+	pendingTxRowKeys := make(map[string]bool)
+	for _, parts := range pendingTxRows {
+		pendingTxRowKeys[strings.Join([]string{parts[0], parts[1], "-", parts[3]}, "~")] = true
+	}
+
+	var report AuditReport
+	report.NegativeBalances = []AccountBalance{}
+	report.OrphanRows = []OrphanRow{}
+
+	// Every account row must belong to valid or pending Tx
+	for _, parts := range accountRows {
+		txRowKey := strings.Join([]string{parts[3], parts[0], parts[1], parts[2]}, "~")
+		if !txRowKeys[txRowKey] && !pendingTxRowKeys[txRowKey] {
+			report.OrphanRows = append(report.OrphanRows, OrphanRow{accountEntryIndex(tokenType),
+				accountEntryKeys(parts[0], parts[1], parts[2], parts[3], tokenType), "Missing Tx entry"})
+		}
+	}
+
+	// Every valid Tx must be referred by both of its participants. System participants have no account entries.
+	// The entry of the participant is missing if it was compacted before or the account was deleted
+	for _, parts := range txRows {
+		for _, participant := range [][]string{{parts[1], "-", "Missing sender entry"}, {parts[2], "+", "Missing recipient entry"}} {
+			rowKey := strings.Join([]string{participant[0], participant[1], parts[3], parts[0]}, "~")
+			if isSystemParticipant(participant[0]) || accountRowKeys[rowKey] {
+				continue
+			}
+			if compacted, ok := compactedUntil[participant[0]]; ok {
+				txTimestamp, err := getTxEntryTimestamp(stub, "TxID~Sender~Recipient~Tok", parts, tokenType)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				if txTimestamp <= compacted {
+					continue
+				}
+			}
+			accountAsBytes, err := stub.GetState(participant[0])
+			if err != nil {
+				return shim.Error(err.Error())
+			} else if accountAsBytes == nil {
+				continue
+			}
+			report.OrphanRows = append(report.OrphanRows, OrphanRow{"TxID~Sender~Recipient~Tok", parts, participant[2]})
+			break
+		}
+	}
+
+	// Tokens of the pending Tx were taken from the sender but not given to the recipient yet
+	for _, parts := range pendingTxRows {
+		tokens, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		senderRowKey := strings.Join([]string{parts[1], "-", parts[3], parts[0]}, "~")
+		if !accountRowKeys[senderRowKey] {
+			report.OrphanRows = append(report.OrphanRows, OrphanRow{"PendingTxID~Sender~Recipient~Tok", parts, "Missing sender entry"})
+			continue
+		}
+		report.PendingAmount, err = addTokens(report.PendingAmount, tokens)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		report.PendingTxCount++
+	}
+
+	// Sum the balances
+	var sumOfBalances int64
+	for _, accountID := range accountIDs {
+		sumOfBalances, err = addTokens(sumOfBalances, balances[accountID])
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if balances[accountID] < 0 {
+			report.NegativeBalances = append(report.NegativeBalances, AccountBalance{accountID, balances[accountID]})
+		}
+	}
+	report.TotalSupply, err = addTokens(sumOfBalances, report.PendingAmount)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Compare with the amount of tokens in circulation
+	report.RecordedSupply, err = getTotalSupplyValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	report.Passed = report.TotalSupply == report.RecordedSupply && len(report.NegativeBalances) == 0 &&
+		len(report.OrphanRows) == 0
+
+	reportAsBytes, err := json.Marshal(report)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(reportAsBytes)
+}
+
+// recomputeTotalSupply - sets the amount of tokens of the token type in circulation to the sum of all
+// account balances and pending amounts. It migrates ledgers that did not track the total supply
+/////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) recomputeTotalSupply(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//      0
+	// ["tokenType"]
+	if len(args) > 1 {
+		return shim.Error("Incorrect number of arguments. Expecting optional token type")
+	}
+	tokenType := DefaultTokenType
+	if len(args) == 1 {
+		tokenType = args[0]
+	}
+	registeredTokenType, err := getTokenTypeValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Only the administrator can change the total supply
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	totalSupply, err := computeTotalSupply(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putTotalSupply(stub, tokenType, totalSupply)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(formatAmount(totalSupply, registeredTokenType.Decimals)))
+}
+
+// repairIndexes - fixes a batch of accounts or Tx entries so they are consistent in both token indexes.
+// Scope "txs" rebuilds missing account entries of the participants of Tx entries, "pendingTxs" rebuilds missing
+// account entries of pending Tx senders and "accounts" removes account entries without Tx entry and recomputes
+// the tokens of the account, so it runs after the other scopes. The dry-run returns a page of the planned changes
+// without any change of state. Paginated queries are read-only, so the repair takes the keys of the index entries
+// reported by the dry-run as JSON array and returns JSON array of the applied changes. Both the page and the keys
+// are limited to MaxRepairKeys index entries.
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) repairIndexes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	//     0        1                   2                     3
+	// "dryRun" "scope" "pageSize"|"[[key, ...], ...]" ["bookmark"]
+	if len(args) < 3 || len(args) > 4 {
+		return shim.Error("Incorrect number of arguments. Expecting dry-run flag, scope, page size and optional bookmark")
+	}
+
+	// Input sanitization. Bookmark is empty for the first page.
+	for i := 0; i < 3; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	dryRun, err := strconv.ParseBool(args[0])
+	if err != nil {
+		return shim.Error("Expecting true or false as dry-run flag.")
+	}
+	scope := args[1]
+	var objectType string
+	var repairEntry func(stub shim.ChaincodeStubInterface, compositeKeyParts []string, dryRun bool) pb.Response
+	switch scope {
+	case "accounts":
+		objectType = "Name~AccountID"
+		repairEntry = repairAccountEntries
+	case "txs":
+		objectType = "TxID~Sender~Recipient~Tok"
+		repairEntry = repairTxEntry
+	case "pendingTxs":
+		objectType = "PendingTxID~Sender~Recipient~Tok"
+		repairEntry = repairPendingTxEntry
+	default:
+		return shim.Error("Expecting accounts, txs or pendingTxs as scope.")
+	}
+
+	// Only the administrator can repair the indexes
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Each page is a bounded batch of the planned changes
+	if dryRun {
+		pageSize, err := strconv.Atoi(args[2])
+		if err == nil && pageSize > MaxRepairKeys {
+			return shim.Error("Page exceeded max number of index entries: " + strconv.Itoa(MaxRepairKeys))
+		}
+		bookmark := ""
+		if len(args) == 4 {
+			bookmark = args[3]
+		}
+		return getPageByPartialCompositeKey(stub, objectType, []string{}, args[2], bookmark,
+			func(compositeKeyParts []string) pb.Response {
+				return repairEntry(stub, compositeKeyParts, true)
+			})
+	}
+
+	// Repair the index entries reported by the dry-run
+	if len(args) != 3 {
+		return shim.Error("Incorrect number of arguments. Expecting dry-run flag, scope and keys of the index entries")
+	}
+	var keys [][]string
+	err = json.Unmarshal([]byte(args[2]), &keys)
+	if err != nil {
+		return shim.Error("Expecting JSON array of keys of the index entries: " + err.Error())
+	}
+	if len(keys) > MaxRepairKeys {
+		return shim.Error("Batch exceeded max number of index entries: " + strconv.Itoa(MaxRepairKeys))
+	}
+
+	// buffer is a JSON array containing results of the repaired index entries
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	for i, compositeKeyParts := range keys {
+		// Only the existing index entries can be repaired
+		compositeKey, err := stub.CreateCompositeKey(objectType, compositeKeyParts)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		entryAsBytes, err := stub.GetState(compositeKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if entryAsBytes == nil {
+			return shim.Error("Index entry does not exist: " + strings.Join(compositeKeyParts, "~"))
+		}
+
+		response := repairEntry(stub, compositeKeyParts, false)
+		if response.Status != shim.OK {
+			return shim.Error("Repair of index entry failed: " + response.Message)
+		}
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		buffer.Write(response.Payload)
+	}
+	buffer.WriteString("]")
+
+	return shim.Success(buffer.Bytes())
+}
+
+// refundPendingTx - returns tokens of expired pending transaction that was not used for data purchase
+/////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) refundPendingTx(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 3
+	//      0              1           2
+	// "channelAd" "chaincodeAdName" "txID"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting 3")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	channelAd := args[0]
+	chaincodeAdName := args[1]
+	txID := args[2]
+
+	// Only the trusted chaincode can confirm that the Tx was not used for data purchase
+	err = checkTrustedChaincode(stub, "ad", channelAd, chaincodeAdName)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Get the pending Tx
+	pendingTxIDResultsIterator, err := stub.GetStateByPartialCompositeKey("PendingTxID~Sender~Recipient~Tok",
+		[]string{txID})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer pendingTxIDResultsIterator.Close()
+
+	// If not Tx found then it was already moved as valid Tx or refunded
+	if !pendingTxIDResultsIterator.HasNext() {
+		return shim.Error("Transaction was already used or does not exist.")
+	}
+
+	// Extract values
+	responseRange, err := pendingTxIDResultsIterator.Next()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Get the separate values
+	_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	fromAccountID := compositeKeyParts[1]
+
+	// Get the sender's account
+	fromAccountAsBytes, err := stub.GetState(fromAccountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if fromAccountAsBytes == nil {
+		return shim.Error("Account does not exist: " + fromAccountID)
+	}
+	var account Account
+	err = json.Unmarshal(fromAccountAsBytes, &account)
+	if err != nil {
+		return shim.Error("Some error: " + err.Error())
+	}
+
+	// Only the sender can refund the tokens
+	err = checkAccountOwner(stub, &account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// The pending Tx can be used for data purchase only until it expires, so the refund does not rely
+	// only on the answer of the ad chaincode, which is not validated on commit of this Tx
+	expiryTime, err := getPendingTxExpiryTime(stub, responseRange.Value)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	now, err := stub.GetTxTimestamp()
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if now.Seconds < expiryTime.Unix() {
+		return shim.Error("Pending transaction expires at " + expiryTime.UTC().Format(time.RFC3339))
+	}
+
+	// check if the Tx was not used for data purchase before it expired
+	fDataAd := []byte("checkTXState")
+	argsToChaincodeAd := [][]byte{fDataAd, []byte(txID)}
+	responseTXCheck := stub.InvokeChaincode(chaincodeAdName, argsToChaincodeAd, channelAd)
+	if responseTXCheck.Status != shim.OK {
+		return shim.Error("refundPendingTx: Error while invoking another chaincode: " + responseTXCheck.Message)
+	}
+	if string(responseTXCheck.Payload) != "Unused" {
+		return shim.Error("This TxID was already used for data purchase.")
+	}
+
+	// The debit of the sender is removed
+	err = recordOpenSnapshotBalances(stub, fromAccountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Move the Tx from the index of pending Tx to the index of refunded Tx
+	err = stub.DelState(responseRange.Key)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	tokenType := tokenTypeOfKey(compositeKeyParts, 4)
+	refundedTxCompositeKey, err := stub.CreateCompositeKey("RefundedTxID~Sender~Recipient~Tok",
+		tokenTypeKeys([]string{txID, compositeKeyParts[1], compositeKeyParts[2], compositeKeyParts[3]}, tokenType))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(refundedTxCompositeKey, responseRange.Value)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Remove the debit of the sender's account
+	err = deleteAccountEntry(stub, fromAccountID, "-", compositeKeyParts[3], txID, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Return the refunded TxID
+	return shim.Success([]byte(txID))
+}
+
+// setPendingTxExpiry - sets number of seconds after which the pending Tx can be refunded
+//////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) setPendingTxExpiry(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 1
+	//      0
+	// "seconds"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting number of seconds")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	expiry, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || expiry < 0 {
+		return shim.Error("Expecting positiv integer or zero as number of seconds.")
+	}
+
+	// Only the administrator can change the expiry
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Save the expiry
+	err = putConfig(stub, "PendingTxExpiry", strconv.FormatInt(expiry, 10))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Pending Tx expiry set"))
+}
+
+// getPendingTxExpiry - returns number of seconds after which the pending Tx can be refunded
+/////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getPendingTxExpiry(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	expiry, err := getConfigInt(stub, "PendingTxExpiry", PendingTxExpiry)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(strconv.FormatInt(expiry, 10)))
+}
+
+// setTransferProposalExpiry - sets number of seconds after which the transfer proposal cannot be approved
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) setTransferProposalExpiry(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 1
+	//      0
+	// "seconds"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting number of seconds")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	expiry, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || expiry <= 0 {
+		return shim.Error("Expecting positive integer as number of seconds.")
+	}
+
+	// Only the administrator can change the expiry
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Save the expiry
+	err = putConfig(stub, "TransferProposalExpiry", strconv.FormatInt(expiry, 10))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Transfer proposal expiry set"))
+}
+
+// getTransferProposalExpiry - returns number of seconds after which the transfer proposal cannot be approved
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getTransferProposalExpiry(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	expiry, err := getConfigInt(stub, "TransferProposalExpiry", TransferProposalExpiry)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(strconv.FormatInt(expiry, 10)))
+}
+
+// settleFastTransfers - freezes accounts that went below zero tokens by fast transfers
+// and activates accounts it froze whose debt was covered. Accounts are processed in pages
+/////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) settleFastTransfers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	//     0            1
+	// "pageSize" ["bookmark"]
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting page size and optional bookmark")
+	}
+
+	// Input sanitization. Bookmark is empty for the first page.
+	if len(args[0]) <= 0 {
+		return shim.Error("Argument at position 1 must be a non-empty string")
+	}
+
+	// Extract args
+	pageSize := args[0]
+	bookmark := ""
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+
+	// Only the administrator can freeze the accounts
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return getPageOfAccounts(stub, pageSize, bookmark,
+		func(accountID string) pb.Response {
+			return cc.settleAccount(stub, accountID)
+		})
+}
+
+// settleAccount - freezes the account with negative amount of tokens or activates the frozen account with covered debt
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) settleAccount(stub shim.ChaincodeStubInterface, accountID string) pb.Response {
+	// Get the account entry from chaincode state
+	accountAsBytes, err := stub.GetState(accountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if accountAsBytes == nil {
+		return shim.Error("Account does not exist: " + accountID)
+	}
+	var account Account
+	err = json.Unmarshal(accountAsBytes, &account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Get the latest state of tokens of all token types. Fast transfers of any token type can go below zero
+	balances, err := getAccountBalances(stub, accountID)
+	if err != nil {
+		return shim.Error("Retrieval of account tokens failed: " + err.Error())
+	}
+	inDebt := false
+	settlement := AccountSettlement{accountID, map[string]json.Number{}, ""}
+	for tokenType, tokens := range balances {
+		if tokens < 0 {
+			inDebt = true
+		}
+		registeredTokenType, err := getTokenTypeValue(stub, tokenType)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		settlement.Tokens[tokenType] = json.Number(formatAmount(tokens, registeredTokenType.Decimals))
+	}
+
+	// Closed accounts are not changed. Accounts created before statuses are active.
+	// Accounts frozen by the administrator stay frozen until the administrator activates them
+	status := account.Status
+	if status == "" {
+		status = "active"
+	}
+	newStatus := status
+	frozenBy := account.FrozenBy
+	if status == "active" && inDebt {
+		newStatus = "frozen"
+		frozenBy = "settlement"
+	} else if status == "frozen" && account.FrozenBy == "settlement" && !inDebt {
+		newStatus = "active"
+		frozenBy = ""
+	}
+
+	// Save the account only if the status changed
+	if newStatus != status {
+		account.Status = newStatus
+		account.FrozenBy = frozenBy
+		account.Tokens = balances[DefaultTokenType]
+		accountAsBytes, err = json.Marshal(&account)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		err = stub.PutState(accountID, accountAsBytes)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	settlement.Status = newStatus
+	settlementAsBytes, err := json.Marshal(settlement)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(settlementAsBytes)
+}
+
+// setAccountStatus - sets status of the account. Frozen account can be activated only if its debt is covered
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) setAccountStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 2
+	//      0          1
+	// "accountID" "status"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting account ID and status (active|frozen|closed)")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	accountID := args[0]
+	status := args[1]
+	if status != "active" && status != "frozen" && status != "closed" {
+		return shim.Error("Expecting active, frozen or closed as status of the account.")
+	}
+
+	// Only the administrator can change the status
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Get the account entry from chaincode state
+	accountAsBytes, err := stub.GetState(accountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if accountAsBytes == nil {
+		return shim.Error("Account does not exist: " + accountID)
+	}
+	var account Account
+	err = json.Unmarshal(accountAsBytes, &account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// The debt of every token type has to be covered before the account is active again
+	if status == "active" {
+		balances, err := getAccountBalances(stub, accountID)
+		if err != nil {
+			return shim.Error("Retrieval of account tokens failed: " + err.Error())
+		}
+		for _, tokens := range balances {
+			if tokens < 0 {
+				return shim.Error("Account " + accountID + " cannot be activated until its debt is covered.")
+			}
+		}
+	}
+
+	// Write state back to the ledger. The account frozen by the administrator is not activated by settlement
+	account.Status = status
+	account.FrozenBy = ""
+	if status == "frozen" {
+		account.FrozenBy = "admin"
+	}
+	accountAsBytes, err = json.Marshal(&account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(accountID, accountAsBytes)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Account status set"))
+}
+
+// setCheckpointDeltas - sets number of deltas of an account after which the checkpoint is rolled forward
+////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) setCheckpointDeltas(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 1
+	//      0
+	// "deltas"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting number of deltas")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	deltas, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || deltas < 0 {
+		return shim.Error("Expecting positiv integer or zero as number of deltas.")
+	}
+
+	// Only the administrator can change the number of deltas
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = putConfig(stub, "CheckpointDeltas", strconv.FormatInt(deltas, 10))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Checkpoint deltas set"))
+}
+
+// getCheckpointDeltas - returns number of deltas of an account after which the checkpoint is rolled forward
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getCheckpointDeltas(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	deltas, err := getConfigInt(stub, "CheckpointDeltas", CheckpointDeltas)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(strconv.FormatInt(deltas, 10)))
+}
+
+// setPrunePolicy - sets the highest number of deltas of an account and the minimum age of compacted deltas
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) setPrunePolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 2
+	//      0          1
+	// "maxDeltas" "minAge"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting max number of deltas and min age in seconds")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	maxDeltas, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || maxDeltas <= 0 {
+		return shim.Error("Expecting positive integer as max number of deltas.")
+	}
+	minAge, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || minAge < 0 {
+		return shim.Error("Expecting positiv integer or zero as min age in seconds.")
+	}
+
+	// Only the administrator can change the prune policy
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = putConfig(stub, "PruneMaxDeltas", strconv.FormatInt(maxDeltas, 10))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putConfig(stub, "PruneMinAge", strconv.FormatInt(minAge, 10))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Prune policy set"))
+}
+
+// getPrunePolicy - returns the highest number of deltas of an account and the minimum age of compacted deltas
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getPrunePolicy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	policy, err := getPrunePolicyValue(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	policyAsBytes, err := json.Marshal(policy)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(policyAsBytes)
+}
+
+// getPrunePolicyValue - returns the prune policy from chaincode state or the default policy
+/////////////////////////////////////////////////////////////////////////////////////////////
+func getPrunePolicyValue(stub shim.ChaincodeStubInterface) (*PrunePolicy, error) {
+	maxDeltas, err := getConfigInt(stub, "PruneMaxDeltas", PruneMaxDeltas)
+	if err != nil {
+		return nil, err
+	}
+	minAge, err := getConfigInt(stub, "PruneMinAge", PruneMinAge)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PrunePolicy{maxDeltas, minAge}, nil
+}
+
+// pruneDueAccounts - compacts deltas of a page of accounts that have more deltas than the prune policy allows.
+// Checkpoints of accounts that reached the checkpoint deltas are rolled forward regardless of the age of deltas.
+// The page size bounds the work done in single Tx, the bookmark of the summary continues with the next page
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) pruneDueAccounts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	//     0            1
+	// "pageSize" ["bookmark"]
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting page size and optional bookmark")
+	}
+
+	// Input sanitization. Bookmark is empty for the first page.
+	if len(args[0]) <= 0 {
+		return shim.Error("Argument at position 1 must be a non-empty string")
+	}
+
+	// Extract args
+	pageSize := args[0]
+	bookmark := ""
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+
+	// Only the administrator can prune all accounts
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	policy, err := getPrunePolicyValue(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	checkpointDeltas, err := getConfigInt(stub, "CheckpointDeltas", CheckpointDeltas)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var summary PruneSummary
+	response := getPageOfAccounts(stub, pageSize, bookmark,
+		func(accountID string) pb.Response {
+			tokenTypes, err := getAccountTokenTypes(stub, accountID)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			summary.Accounts++
+
+			// Each token type of the account has its own checkpoint
+			var accountPrunedDeltas int64
+			for _, tokenType := range tokenTypes {
+				_, deltas, err := getAccountBalance(stub, accountID, tokenType)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				minAge := policy.MinAge
+				if checkpointDeltas > 0 && deltas >= checkpointDeltas {
+					minAge = 0
+				} else if deltas <= policy.MaxDeltas {
+					continue
+				}
+				prunedDeltas, err := rollForwardCheckpoint(stub, accountID, tokenType, minAge)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				accountPrunedDeltas += prunedDeltas
+			}
+			if accountPrunedDeltas > 0 {
+				summary.PrunedAccounts++
+				summary.PrunedDeltas += accountPrunedDeltas
+			}
+			return shim.Success([]byte(strconv.Quote(accountID)))
+		})
+	if response.Status != shim.OK {
+		return response
+	}
+
+	// Continue with the bookmark of the page
+	var page struct {
+		Bookmark string `json:"bookmark"`
+		HasMore  bool   `json:"hasMore"`
+	}
+	err = json.Unmarshal(response.Payload, &page)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	summary.Bookmark = page.Bookmark
+	summary.HasMore = page.HasMore
+	summaryAsBytes, err := json.Marshal(&summary)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(summaryAsBytes)
+}
+
+// rollForwardReceivers - rolls forward checkpoints of a page of accounts that received at least the checkpoint
+// deltas of a token type. Senders roll their checkpoints forward by their own transfers, recipients are only
+// credited by the transfers of others, so their credits are counted in "Received~Account~Type~Tok~TxID"
+// and checked by this batch, e.g. from cron. The bookmark of the summary continues with the next page
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) rollForwardReceivers(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	//     0            1
+	// "pageSize" ["bookmark"]
+	if len(args) < 1 || len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting page size and optional bookmark")
+	}
+
+	// Input sanitization. Bookmark is empty for the first page.
+	if len(args[0]) <= 0 {
+		return shim.Error("Argument at position 1 must be a non-empty string")
+	}
+
+	// Extract args
+	pageSize := args[0]
+	bookmark := ""
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+
+	// Only the administrator can roll forward all accounts
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	checkpointDeltas, err := getConfigInt(stub, "CheckpointDeltas", CheckpointDeltas)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var summary RollForwardSummary
+	response := getPageOfAccounts(stub, pageSize, bookmark,
+		func(accountID string) pb.Response {
+			summary.Accounts++
+			if checkpointDeltas == 0 {
+				return shim.Success([]byte(strconv.Quote(accountID)))
+			}
+
+			// Count the credits of each token type of the account
+			receivedIterator, err := stub.GetStateByPartialCompositeKey("Received~Account~Type~Tok~TxID",
+				[]string{accountID})
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			defer receivedIterator.Close()
+			tokenTypes := []string{}
+			received := make(map[string]int64)
+			for receivedIterator.HasNext() {
+				responseRange, err := receivedIterator.Next()
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				tokenType := compositeKeyParts[1]
+				if _, ok := received[tokenType]; !ok {
+					tokenTypes = append(tokenTypes, tokenType)
+				}
+				received[tokenType]++
+			}
+
+			// Each token type of the account has its own checkpoint
+			var accountRolledDeltas int64
+			for _, tokenType := range tokenTypes {
+				if received[tokenType] < checkpointDeltas {
+					continue
+				}
+				rolledDeltas, err := rollForwardCheckpoint(stub, accountID, tokenType, 0)
+				if err != nil {
+					return shim.Error(err.Error())
+				}
+				accountRolledDeltas += rolledDeltas
+			}
+			if accountRolledDeltas > 0 {
+				summary.RolledAccounts++
+				summary.RolledDeltas += accountRolledDeltas
+			}
+			return shim.Success([]byte(strconv.Quote(accountID)))
+		})
+	if response.Status != shim.OK {
+		return response
+	}
+
+	// Continue with the bookmark of the page
+	var page struct {
+		Bookmark string `json:"bookmark"`
+		HasMore  bool   `json:"hasMore"`
+	}
+	err = json.Unmarshal(response.Payload, &page)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	summary.Bookmark = page.Bookmark
+	summary.HasMore = page.HasMore
+	summaryAsBytes, err := json.Marshal(&summary)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(summaryAsBytes)
+}
+
+// setFastTransferLimit - sets the highest number of tokens of the token type that can be sent by sendTokensFast.
+// The limit of single account overrides the limit of all accounts
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) setFastTransferLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 1
+	//    0          1            2
+	// "limit" ["accountID"] ["tokenType"]
+	// Account ID followed by the token type can be empty string to set the limit of all accounts
+	if len(args) < argsCount || len(args) > argsCount+2 {
+		return shim.Error("Incorrect number of arguments. Expecting limit, optional account ID and optional token type")
+	}
+
+	// Input sanitization
+	for i := 0; i < len(args); i++ {
+		if len(args[i]) <= 0 && i != 1 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+	if len(args) == argsCount+1 && len(args[1]) <= 0 {
+		return shim.Error("Argument at position 2 must be a non-empty string")
+	}
+
+	// Extract args
+	accountID := ""
+	if len(args) > argsCount {
+		accountID = args[1]
+	}
+	tokenType := DefaultTokenType
+	if len(args) > argsCount+1 {
+		tokenType = args[2]
+	}
+	registeredTokenType, err := getTokenTypeValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	limitTokens, err := parseAmount(args[0], registeredTokenType.Decimals)
+	if err != nil || limitTokens < 0 {
+		return shim.Error("Expecting positiv amount or zero as fast transfer limit.")
+	}
+
+	// Only the administrator can change the limit
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Save the limit of all accounts
+	if accountID == "" {
+		err = putConfig(stub, tokenTypeConfigName("LimitTokens", tokenType), strconv.FormatInt(limitTokens, 10))
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		return shim.Success([]byte("Fast transfer limit set"))
+	}
+
+	// Check if the account exists
+	accountAsBytes, err := stub.GetState(accountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if accountAsBytes == nil {
+		return shim.Error("Account does not exist: " + accountID)
+	}
+
+	// Save the limit of the account
+	accountLimitKey, err := stub.CreateCompositeKey("LimitTokens~AccountID", tokenTypeKeys([]string{accountID}, tokenType))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.PutState(accountLimitKey, []byte(strconv.FormatInt(limitTokens, 10)))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Fast transfer limit set"))
+}
+
+// deleteFastTransferLimit - removes the limit of the token type of the account so the limit of all accounts applies again
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) deleteFastTransferLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 1
+	//      0             1
+	// "accountID" ["tokenType"]
+	if len(args) != argsCount && len(args) != argsCount+1 {
+		return shim.Error("Incorrect number of arguments. Expecting account ID and optional token type")
+	}
+
+	// Input sanitization
+	for i := 0; i < len(args); i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Only the administrator can change the limit
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	tokenType := DefaultTokenType
+	if len(args) > argsCount {
+		tokenType = args[1]
+	}
+	accountLimitKey, err := stub.CreateCompositeKey("LimitTokens~AccountID", tokenTypeKeys([]string{args[0]}, tokenType))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = stub.DelState(accountLimitKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Fast transfer limit deleted"))
+}
+
+// getFastTransferLimit - returns the limit of fast transfer of the token type of the account or of all accounts
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getFastTransferLimit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	//      0             1
+	// ["accountID"] ["tokenType"]
+	// Account ID followed by the token type can be empty string to get the limit of all accounts
+	if len(args) > 2 {
+		return shim.Error("Incorrect number of arguments. Expecting optional account ID and optional token type")
+	}
+
+	tokenType := DefaultTokenType
+	if len(args) == 2 {
+		tokenType = args[1]
+	}
+	registeredTokenType, err := getTokenTypeValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	var limitTokens int64
+	if len(args) > 0 && len(args[0]) > 0 {
+		limitTokens, err = getFastTransferLimitValue(stub, args[0], tokenType)
+	} else {
+		limitTokens, err = getConfigInt(stub, tokenTypeConfigName("LimitTokens", tokenType), LimitTokens)
+	}
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte(formatAmount(limitTokens, registeredTokenType.Decimals)))
+}
+
+// setTransferFee - sets the flat fee and the percentage fee of the kind of transfer (fast|safe|dataPurchase).
+// The fee is paid by the sender on top of the transferred tokens and credited to the treasury account
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) setTransferFee(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 3
+	//   0      1        2
+	// "kind" "flat" "percent"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting kind of transfer, flat fee and percentage fee")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Extract args
+	kind := args[0]
+	if kind != "fast" && kind != "safe" && kind != "dataPurchase" {
+		return shim.Error("Expecting fast, safe or dataPurchase as kind of transfer.")
+	}
+	defaultTokenType, err := getTokenTypeValue(stub, DefaultTokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	flat, err := parseAmount(args[1], defaultTokenType.Decimals)
+	if err != nil || flat < 0 {
+		return shim.Error("Expecting positiv amount or zero as flat fee.")
+	}
+	// Percentage with two decimals is in hundredths of percent
+	basisPoints, err := parseAmount(args[2], 2)
+	if err != nil || basisPoints < 0 || basisPoints > 10000 {
+		return shim.Error("Expecting percentage from 0 to 100 with at most 2 decimals as fee.")
+	}
+
+	// Only the administrator can change the fees
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	err = putConfig(stub, kind+"FeeFlat", strconv.FormatInt(flat, 10))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	err = putConfig(stub, kind+"FeeBasisPoints", strconv.FormatInt(basisPoints, 10))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Transfer fee set"))
+}
+
+// setFeeTreasury - sets the account that receives fees of all kinds of transfers
+//////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) setFeeTreasury(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 1
+	//          0
+	// "treasuryAccountID"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting treasury account ID")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Only the administrator can change the treasury account
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Check if the treasury account exists
+	treasuryAccountAsBytes, err := stub.GetState(args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if treasuryAccountAsBytes == nil {
+		return shim.Error("Account does not exist: " + args[0])
+	}
+
+	err = putConfig(stub, "FeeTreasury", args[0])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Fee treasury set"))
+}
+
+// getFeeSchedule - returns fees of all kinds of transfers and the treasury account that receives them
+/////////////////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getFeeSchedule(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 0 {
+		return shim.Error("Incorrect number of arguments. Expecting 0")
+	}
+
+	var schedule FeeSchedule
+	for kind, transferFee := range map[string]*TransferFee{"fast": &schedule.Fast, "safe": &schedule.Safe,
+		"dataPurchase": &schedule.DataPurchase} {
+		value, err := getTransferFeeValue(stub, kind)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		*transferFee = *value
+	}
+	treasuryAccountID, err := getConfigString(stub, "FeeTreasury", "1")
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	schedule.TreasuryAccountID = treasuryAccountID
+
+	scheduleAsBytes, err := json.Marshal(&schedule)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(scheduleAsBytes)
+}
+
+// setTrustedChaincode - sets channel and chaincode which is trusted for data entry ads
+////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) setTrustedChaincode(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 3
+	//   0          1            2
+	// "role" "channel" "chaincodeName"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting role (ad), channel and chaincode name")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Only the administrator can change the trusted chaincodes
+	err = checkAdmin(stub)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Save the trusted chaincode
+	err = putTrustedChaincode(stub, args[0], args[1], args[2])
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success([]byte("Trusted chaincode set"))
+}
+
+// getTrustedChaincode - returns channel and chaincode which is trusted for data entry ads
+///////////////////////////////////////////////////////////////////////////////////////////////
+func (cc *Chaincode) getTrustedChaincode(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var err error
+	argsCount := 1
+	//   0
+	// "role"
+	if len(args) != argsCount {
+		return shim.Error("Incorrect number of arguments. Expecting role (ad)")
+	}
+
+	// Input sanitization
+	for i := 0; i < argsCount; i++ {
+		if len(args[i]) <= 0 {
+			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+		}
+	}
+
+	// Get the trusted chaincode from chaincode state
+	counterpartKey, err := stub.CreateCompositeKey("Counterpart~Role", []string{args[0]})
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	counterpartAsBytes, err := stub.GetState(counterpartKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if counterpartAsBytes == nil {
+		return shim.Error("Trusted chaincode for " + args[0] + " is not set.")
+	}
+
+	return shim.Success(counterpartAsBytes)
+}
+
+// getPageByPartialCompositeKey - returns one page of records found in the index as JSON object
+// {"records":[...],"bookmark":"...","hasMore":true|false}. The bookmark is opaque for the client.
+// It is the bookmark of the ledger query encoded in base64, so the next page starts where the previous one
+// ended, and it is empty for the first page. Paginated queries are read-only, so the transaction cannot
+// change the state.
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getPageByPartialCompositeKey(stub shim.ChaincodeStubInterface, objectType string, keys []string,
+	pageSizeStr string, bookmark string, getRecord func(compositeKeyParts []string) pb.Response) pb.Response {
+	pageSize, err := strconv.ParseInt(pageSizeStr, 10, 32)
+	if err != nil || pageSize < 1 {
+		return shim.Error("Expecting positive integer as page size.")
+	}
+
+	// Decode the bookmark of the ledger query where the page starts
+	ledgerBookmarkAsBytes, err := base64.StdEncoding.DecodeString(bookmark)
+	if err != nil {
+		return shim.Error("Invalid bookmark.")
+	}
+
+	// Get the index rows of the page
+	resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(objectType, keys,
+		int32(pageSize), string(ledgerBookmarkAsBytes))
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	defer resultsIterator.Close()
+
+	// buffer is a JSON object containing records of the page
+	var buffer bytes.Buffer
+	buffer.WriteString("{\"records\":[")
+	var recordsCount int64
+	for resultsIterator.HasNext() && recordsCount < pageSize {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// Get the record for the composite key
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		response := getRecord(compositeKeyParts)
+		if response.Status != shim.OK {
+			return shim.Error("Retrieval of record failed: " + response.Message)
+		}
+
+		// Append the record to the array
+		if recordsCount > 0 {
+			buffer.WriteString(",")
+		}
+		buffer.Write(response.Payload)
+		recordsCount++
+	}
+
+	// The ledger returns the bookmark of the next page only if there are more rows
+	hasMore := metadata != nil && metadata.Bookmark != "" && recordsCount == pageSize
+
+	// Close the array and write the bookmark for the next page
+	buffer.WriteString("],\"bookmark\":\"")
+	if hasMore {
+		buffer.WriteString(base64.StdEncoding.EncodeToString([]byte(metadata.Bookmark)))
+	}
+	buffer.WriteString("\",\"hasMore\":")
+	buffer.WriteString(strconv.FormatBool(hasMore))
+	buffer.WriteString("}")
+
+	// Return JSON object with the page
+	return shim.Success(buffer.Bytes())
+}
+
+// getPageOfAccounts - returns one page of records of accounts in the same format as getPageByPartialCompositeKey.
+// Paginated queries are read-only, so the batches that change the state read the accounts by range of their keys.
+// The range starts at the bookmark, which is the ID of the first account of the next page encoded in base64.
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getPageOfAccounts(stub shim.ChaincodeStubInterface, pageSizeStr string, bookmark string,
+	getRecord func(accountID string) pb.Response) pb.Response {
+	pageSize, err := strconv.ParseInt(pageSizeStr, 10, 32)
+	if err != nil || pageSize < 1 {
+		return shim.Error("Expecting positive integer as page size.")
+	}
+
+	// Decode the bookmark to the first account ID of the page
+	startKeyAsBytes, err := base64.StdEncoding.DecodeString(bookmark)
+	if err != nil {
+		return shim.Error("Invalid bookmark.")
+	}
+
+	// Accounts are the only simple keys. Composite keys start with null character, so they are out of the range
+	startKey := string(startKeyAsBytes)
+	if startKey == "" {
+		startKey = "\x01"
+	}
+	resultsIterator, err := stub.GetStateByRange(startKey, string(utf8.MaxRune))
+	if err != nil {
+		return shim.Error("Invalid bookmark.")
+	}
+	defer resultsIterator.Close()
+
+	// buffer is a JSON object containing records of the page
+	var buffer bytes.Buffer
+	buffer.WriteString("{\"records\":[")
+	var recordsCount int64
+	for resultsIterator.HasNext() && recordsCount < pageSize {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+
+		// Get the record for the account
+		response := getRecord(responseRange.Key)
+		if response.Status != shim.OK {
+			return shim.Error("Retrieval of record failed: " + response.Message)
+		}
+
+		// Append the record to the array
+		if recordsCount > 0 {
+			buffer.WriteString(",")
+		}
+		buffer.Write(response.Payload)
+		recordsCount++
+	}
+
+	// The next page starts at the next account
+	nextKey := ""
+	if resultsIterator.HasNext() {
+		responseRange, err := resultsIterator.Next()
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		nextKey = responseRange.Key
+	}
+
+	// Close the array and write the bookmark for the next page
+	buffer.WriteString("],\"bookmark\":\"")
+	buffer.WriteString(base64.StdEncoding.EncodeToString([]byte(nextKey)))
+	buffer.WriteString("\",\"hasMore\":")
+	buffer.WriteString(strconv.FormatBool(nextKey != ""))
+	buffer.WriteString("}")
+
+	// Return JSON object with the page
+	return shim.Success(buffer.Bytes())
+}
+
+// getCreatorCertificate - decodes serialized identity and returns its MSP ID and X.509 certificate
+////////////////////////////////////////////////////////////////////////////////////////////////////
+func getCreatorCertificate(creatorIDAsBytes []byte) (string, *x509.Certificate, error) {
+	sID := &msp.SerializedIdentity{}
+	err := proto.Unmarshal(creatorIDAsBytes, sID)
+	if err != nil {
+		return "", nil, fmt.Errorf("Could not deserialize a SerializedIdentity, err %s", err)
+	}
+
+	block, _ := pem.Decode(sID.IdBytes)
+	if block == nil {
+		return "", nil, fmt.Errorf("Failed to decode PEM structure")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to parse certificate %s", err)
+	}
+
+	return sID.Mspid, cert, nil
+}
+
+// checkAccountOwner - returns error if the transaction submitter is not the account holder
+////////////////////////////////////////////////////////////////////////////////////////////
+func checkAccountOwner(stub shim.ChaincodeStubInterface, account *Account) error {
+	if account.Threshold > 0 {
+		_, err := getMultiSigOwner(stub, account)
+		return err
+	}
+
+	isOwner, err := isCreator(stub, account.OwnerID)
+	if err != nil {
+		return err
+	}
+	if !isOwner {
+		return fmt.Errorf("Caller is not the holder of account %s", account.AccountID)
+	}
+
+	return nil
+}
+
+// checkSingleSignature - returns error if the account is multi-signature account. Tokens can be sent
+// from multi-signature account only by transfer proposal approved by its owners. The reason tells the caller
+// what multi-signature account cannot do or what to use instead
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func checkSingleSignature(account *Account, reason string) error {
+	if account.Threshold > 0 {
+		return fmt.Errorf("Account %s is multi-signature account. %s", account.AccountID, reason)
+	}
+
+	return nil
+}
+
+// getMultiSigOwner - returns the identity of the owner of multi-signature account who is the caller
+//////////////////////////////////////////////////////////////////////////////////////////////////////
+func getMultiSigOwner(stub shim.ChaincodeStubInterface, account *Account) (string, error) {
+	for _, owner := range account.Owners {
+		isOwner, err := isCreator(stub, owner)
+		if err != nil {
+			return "", err
+		}
+		if isOwner {
+			return owner, nil
+		}
+	}
+
+	return "", fmt.Errorf("Caller is not an owner of multi-signature account %s", account.AccountID)
+}
+
+// checkAdmin - returns error if the transaction submitter is not the administrator of the chaincode
+////////////////////////////////////////////////////////////////////////////////////////////////////
+func checkAdmin(stub shim.ChaincodeStubInterface) error {
+	adminKey, err := stub.CreateCompositeKey("Admin", []string{})
+	if err != nil {
+		return err
+	}
+	adminIDAsBytes, err := stub.GetState(adminKey)
+	if err != nil {
+		return err
+	} else if adminIDAsBytes == nil {
+		return fmt.Errorf("Caller is not the administrator of the chaincode")
+	}
+
+	isAdmin, err := isCreator(stub, string(adminIDAsBytes))
+	if err != nil {
+		return err
+	}
+	if !isAdmin {
+		return fmt.Errorf("Caller is not the administrator of the chaincode")
+	}
+
+	return nil
+}
+
+// isCreator - checks if the transaction submitter has the identity (base64 encoded serialized identity).
+// Accounts created before the identity was encoded keep the serialized identity as raw string in JSON
+/////////////////////////////////////////////////////////////////////////////////////////////////////////
+func isCreator(stub shim.ChaincodeStubInterface, identity string) (bool, error) {
+	// GetCreator returns the identity object of the chaincode invocation's submitter
+	creatorIDAsBytes, err := stub.GetCreator()
+	if err != nil {
+		return false, fmt.Errorf("Failed to get creator ID. %s", err)
+	}
+
+	// Compare the serialized identities first
+	if base64.StdEncoding.EncodeToString(creatorIDAsBytes) == identity {
+		return true, nil
+	}
+
+	// JSON encoding replaced invalid UTF-8 bytes of the raw string, so the caller is encoded in the same way
+	legacyIDAsBytes, err := json.Marshal(string(creatorIDAsBytes))
+	if err != nil {
+		return false, err
+	}
+	var legacyID string
+	err = json.Unmarshal(legacyIDAsBytes, &legacyID)
+	if err != nil {
+		return false, err
+	}
+	if legacyID == identity {
+		return true, nil
+	}
+
+	// The certificate could be renewed. Compare the MSP, subject and issuer of certificates
+	callerMSPID, callerCert, err := getCreatorCertificate(creatorIDAsBytes)
+	if err != nil {
+		return false, err
+	}
+	identityAsBytes, err := base64.StdEncoding.DecodeString(identity)
+	if err != nil {
+		return false, nil
+	}
+	identityMSPID, identityCert, err := getCreatorCertificate(identityAsBytes)
+	if err != nil {
+		return false, nil
+	}
+
+	return callerMSPID == identityMSPID && bytes.Equal(callerCert.RawSubject, identityCert.RawSubject) &&
+		bytes.Equal(callerCert.RawIssuer, identityCert.RawIssuer), nil
+}
+
+// putTrustedChaincode - saves channel and chaincode trusted for the role into chaincode state
+///////////////////////////////////////////////////////////////////////////////////////////////
+func putTrustedChaincode(stub shim.ChaincodeStubInterface, role string, channel string, chaincodeName string) error {
+	if role != "ad" {
+		return fmt.Errorf("Expecting ad as role of the chaincode")
+	}
+
+	counterpart := &Counterpart{"COUNTERPART", role, channel, chaincodeName}
+	counterpartAsBytes, err := json.Marshal(counterpart)
+	if err != nil {
+		return err
+	}
+
+	counterpartKey, err := stub.CreateCompositeKey("Counterpart~Role", []string{role})
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(counterpartKey, counterpartAsBytes)
+}
+
+// checkTrustedChaincode - returns error if the channel and chaincode are not trusted for the role
+//////////////////////////////////////////////////////////////////////////////////////////////////////
+func checkTrustedChaincode(stub shim.ChaincodeStubInterface, role string, channel string, chaincodeName string) error {
+	counterpartKey, err := stub.CreateCompositeKey("Counterpart~Role", []string{role})
+	if err != nil {
+		return err
+	}
+	counterpartAsBytes, err := stub.GetState(counterpartKey)
+	if err != nil {
+		return err
+	} else if counterpartAsBytes == nil {
+		return fmt.Errorf("Trusted chaincode for %s is not set.", role)
+	}
+
+	var counterpart Counterpart
+	err = json.Unmarshal(counterpartAsBytes, &counterpart)
+	if err != nil {
+		return err
+	}
+	if counterpart.Channel != channel || counterpart.ChaincodeName != chaincodeName {
+		return fmt.Errorf("Chaincode %s on channel %s is not trusted for %s.", chaincodeName, channel, role)
+	}
+
+	return nil
+}
+
+// getTxTimestamp - returns time of the transaction in RFC 3339 format
+//////////////////////////////////////////////////////////////////////
+func getTxTimestamp(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC().Format(time.RFC3339)), nil
+}
+
+// getPendingTxExpiryTime - returns the time after which the pending Tx can be refunded and cannot be used
+// for data purchase. Tx entries created before the time was recorded contain only null character
+// and they are considered as expired
+//////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getPendingTxExpiryTime(stub shim.ChaincodeStubInterface, txEntryValue []byte) (time.Time, error) {
+	if len(txEntryValue) <= 1 {
+		return time.Unix(0, 0), nil
+	}
+	expiry, err := getConfigInt(stub, "PendingTxExpiry", PendingTxExpiry)
+	if err != nil {
+		return time.Time{}, err
+	}
+	txTime, err := time.Parse(time.RFC3339, string(txEntryValue))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return txTime.Add(time.Duration(expiry) * time.Second), nil
+}
+
+// putConfig - saves configuration value into chaincode state
+///////////////////////////////////////////////////////////////
+func putConfig(stub shim.ChaincodeStubInterface, name string, value string) error {
+	configKey, err := stub.CreateCompositeKey("Config~Name", []string{name})
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(configKey, []byte(value))
+}
+
+// getConfigInt - returns integer configuration value from chaincode state or the default value if it is not set
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getConfigInt(stub shim.ChaincodeStubInterface, name string, defaultValue int64) (int64, error) {
+	configKey, err := stub.CreateCompositeKey("Config~Name", []string{name})
+	if err != nil {
+		return 0, err
+	}
+	valueAsBytes, err := stub.GetState(configKey)
+	if err != nil {
+		return 0, err
+	} else if valueAsBytes == nil {
+		return defaultValue, nil
+	}
+
+	return strconv.ParseInt(string(valueAsBytes), 10, 64)
+}
+
+// getConfigString - returns configuration value from chaincode state or the default value if it is not set
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getConfigString(stub shim.ChaincodeStubInterface, name string, defaultValue string) (string, error) {
+	configKey, err := stub.CreateCompositeKey("Config~Name", []string{name})
+	if err != nil {
+		return "", err
+	}
+	valueAsBytes, err := stub.GetState(configKey)
+	if err != nil {
+		return "", err
+	} else if valueAsBytes == nil {
+		return defaultValue, nil
+	}
+
+	return string(valueAsBytes), nil
+}
+
+// putTotalSupply - saves the amount of tokens of the token type in circulation into chaincode state
+///////////////////////////////////////////////////////////////////////////////////
+func putTotalSupply(stub shim.ChaincodeStubInterface, tokenType string, totalSupply int64) error {
+	totalSupplyKey, err := stub.CreateCompositeKey("TotalSupply", tokenTypeKeys([]string{}, tokenType))
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(totalSupplyKey, []byte(strconv.FormatInt(totalSupply, 10)))
+}
+
+// getTotalSupplyValue - returns the amount of tokens of the token type in circulation from chaincode state
+//////////////////////////////////////////////////////////////////////////////////////////
+func getTotalSupplyValue(stub shim.ChaincodeStubInterface, tokenType string) (int64, error) {
+	totalSupplyKey, err := stub.CreateCompositeKey("TotalSupply", tokenTypeKeys([]string{}, tokenType))
+	if err != nil {
+		return 0, err
+	}
+	totalSupplyAsBytes, err := stub.GetState(totalSupplyKey)
+	if err != nil {
+		return 0, err
+	} else if totalSupplyAsBytes == nil {
+		return 0, nil
+	}
+
+	return strconv.ParseInt(string(totalSupplyAsBytes), 10, 64)
+}
+
+// computeTotalSupply - returns the sum of checkpoints, account entries and pending amounts of the token type.
+// Pending Tx without the account entry of the sender are not counted, as in auditLedger
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func computeTotalSupply(stub shim.ChaincodeStubInterface, tokenType string) (int64, error) {
+	var totalSupply int64
+
+	checkpointIterator, err := stub.GetStateByPartialCompositeKey("Checkpoint~AccountID", []string{})
+	if err != nil {
+		return 0, err
+	}
+	defer checkpointIterator.Close()
+	for checkpointIterator.HasNext() {
+		responseRange, err := checkpointIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		var checkpoint Checkpoint
+		err = json.Unmarshal(responseRange.Value, &checkpoint)
+		if err != nil {
+			return 0, err
+		}
+		if checkpoint.TokenType != tokenType {
+			continue
+		}
+		totalSupply, err = addTokens(totalSupply, checkpoint.Tokens)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	accountRows, err := getAccountEntryRows(stub, tokenType)
+	if err != nil {
+		return 0, err
+	}
+	accountRowKeys := make(map[string]bool)
+	for _, parts := range accountRows {
+		tokens, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		switch parts[1] {
+		case "+":
+			totalSupply, err = addTokens(totalSupply, tokens)
+		case "-":
+			totalSupply, err = addTokens(totalSupply, -tokens)
+		default:
+			return 0, fmt.Errorf("Unrecognized operation %s", parts[1])
+		}
+		if err != nil {
+			return 0, err
+		}
+		accountRowKeys[strings.Join(parts[:4], "~")] = true
+	}
+
+	pendingTxRows, err := getIndexRows(stub, "PendingTxID~Sender~Recipient~Tok", 4, tokenType)
+	if err != nil {
+		return 0, err
+	}
+	for _, parts := range pendingTxRows {
+		if !accountRowKeys[strings.Join([]string{parts[1], "-", parts[3], parts[0]}, "~")] {
+			continue
+		}
+		tokens, err := strconv.ParseInt(parts[3], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		totalSupply, err = addTokens(totalSupply, tokens)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return totalSupply, nil
+}
+
+// getIndexRows - returns attributes of all composite keys of the token type in the index. Composite keys
+// of the index have n attributes without the token type
+///////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getIndexRows(stub shim.ChaincodeStubInterface, indexName string, n int, tokenType string) ([][]string, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	rows := [][]string{}
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		if tokenTypeOfKey(compositeKeyParts, n) != tokenType {
+			continue
+		}
+		rows = append(rows, compositeKeyParts)
+	}
+
+	return rows, nil
+}
+
+// getTxEntryTimestamp - returns the time of the Tx entry with the attributes. Tx entries created
+// before the time was recorded contain only null character, their time is empty string
+////////////////////////////////////////////////////////////////////////////////////////////////////
+func getTxEntryTimestamp(stub shim.ChaincodeStubInterface, indexName string, parts []string, tokenType string) (string, error) {
+	txEntryKey, err := stub.CreateCompositeKey(indexName, tokenTypeKeys(parts[:4], tokenType))
+	if err != nil {
+		return "", err
+	}
+	txEntryAsBytes, err := stub.GetState(txEntryKey)
+	if err != nil {
+		return "", err
+	}
+	if len(txEntryAsBytes) <= 1 {
+		return "", nil
+	}
+
+	return string(txEntryAsBytes), nil
+}
+
+// getTxEntry - returns the key of the Tx entry that belongs to the account entry and the other participant of the Tx.
+// The key is empty string if the Tx entry does not exist
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getTxEntry(stub shim.ChaincodeStubInterface, indexName string, accountID string, operation string,
+	tokensStr string, txID string, tokenType string) (string, string, error) {
+	// More Tx entries can share the same TxID (e.g. Init of more accounts)
+	txIterator, err := stub.GetStateByPartialCompositeKey(indexName, []string{txID})
+	if err != nil {
+		return "", "", err
+	}
+	defer txIterator.Close()
+
+	for txIterator.HasNext() {
+		responseRange, err := txIterator.Next()
+		if err != nil {
+			return "", "", err
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		if err != nil {
+			return "", "", err
+		}
+		sender := compositeKeyParts[1]
+		recipient := compositeKeyParts[2]
+		if compositeKeyParts[3] != tokensStr || tokenTypeOfKey(compositeKeyParts, 4) != tokenType {
+			continue
+		}
+		if operation == "+" && recipient == accountID {
+			return responseRange.Key, sender, nil
+		}
+		if operation == "-" && sender == accountID {
+			return responseRange.Key, recipient, nil
+		}
+	}
+
+	return "", "", nil
+}
+
+// deleteTxEntryIfUnused - deletes the Tx entry unless the other participant still has its account entry of the Tx
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func deleteTxEntryIfUnused(stub shim.ChaincodeStubInterface, txEntryKey string, accountID string, counterpart string,
+	operation string, tokensStr string, txID string, tokenType string) error {
+	if counterpart != accountID && !isSystemParticipant(counterpart) {
+		counterpartOperation := "+"
+		if operation == "+" {
+			counterpartOperation = "-"
+		}
+		counterpartKey, err := createAccountEntryKey(stub, counterpart, counterpartOperation, tokensStr, txID, tokenType)
+		if err != nil {
+			return err
+		}
+		counterpartAsBytes, err := stub.GetState(counterpartKey)
+		if err != nil {
+			return err
+		}
+		if counterpartAsBytes != nil {
+			return nil
+		}
+	}
+
+	return stub.DelState(txEntryKey)
+}
+
+// isSystemParticipant - returns true if the participant of the Tx is not an account
+/////////////////////////////////////////////////////////////////////////////////////
+func isSystemParticipant(participant string) bool {
+	switch participant {
+	case "Init", "Mint", "Burn", "pruneTx", "Batch":
+		return true
+	}
+	return false
+}
+
+// repairAccountEntries - removes account entries without Tx entry and recomputes tokens of the account
+////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func repairAccountEntries(stub shim.ChaincodeStubInterface, nameIDParts []string, dryRun bool) pb.Response {
+	accountID := nameIDParts[1]
+	result := RepairResult{Key: nameIDParts, Changes: []RepairChange{}}
+
+	// Get the account entry from chaincode state
+	accountAsBytes, err := stub.GetState(accountID)
+	if err != nil {
+		return shim.Error(err.Error())
+	} else if accountAsBytes == nil {
+		result.Changes = append(result.Changes, RepairChange{"delete", "Name~AccountID", nameIDParts, "Account does not exist"})
+		if !dryRun {
+			nameIDIndexKey, err := stub.CreateCompositeKey("Name~AccountID", nameIDParts)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			err = stub.DelState(nameIDIndexKey)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+		return marshalRepairResult(result)
+	}
+	var account Account
+	err = json.Unmarshal(accountAsBytes, &account)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Tokens of the default token type are computed from the checkpoint and deltas since the checkpoint
+	checkpoint, err := getCheckpoint(stub, accountID, DefaultTokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	finalTok := checkpoint.Tokens
+	var entriesCount int64
+	for _, objectType := range []string{"Account~op~Tok~TxID", "Account~Type~op~Tok~TxID"} {
+		deltaTok, indexEntriesCount, err := repairAccountEntriesOfIndex(stub, objectType, accountID,
+			MaxRepairAccountEntries-entriesCount, dryRun, &result)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		entriesCount += indexEntriesCount
+		finalTok, err = addTokens(finalTok, deltaTok)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	// Recompute the tokens of the account
+	if account.Tokens != finalTok {
+		result.Changes = append(result.Changes, RepairChange{"update", "Account", []string{accountID},
+			fmt.Sprintf("Cached tokens %d, computed %d", account.Tokens, finalTok)})
+		if !dryRun {
+			account.Tokens = finalTok
+			accountAsBytes, err = json.Marshal(&account)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			err = stub.PutState(accountID, accountAsBytes)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+
+	return marshalRepairResult(result)
+}
+
+// repairAccountEntriesOfIndex - removes orphan account entries of the account from the index of account entries
+// and returns the sum of deltas of the default token type that belong to valid or pending Tx and the number
+// of the read account entries. It fails if the account has more than maxEntries entries in the index
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func repairAccountEntriesOfIndex(stub shim.ChaincodeStubInterface, objectType string, accountID string,
+	maxEntries int64, dryRun bool, result *RepairResult) (int64, int64, error) {
+	// Get all account transactions for the account ID
+	accountTxIterator, err := stub.GetStateByPartialCompositeKey(objectType, []string{accountID})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer accountTxIterator.Close()
+
+	var deltaTok int64
+	var entriesCount int64
+	for accountTxIterator.HasNext() {
+		responseRange, err := accountTxIterator.Next()
+		if err != nil {
+			return 0, 0, err
+		}
+		entriesCount++
+		if entriesCount > maxEntries {
+			return 0, 0, fmt.Errorf("Account %s has more than %d account entries. Prune the account before the repair",
+				accountID, MaxRepairAccountEntries)
+		}
+		compositeKeyParts, err := splitAccountEntryKey(stub, responseRange.Key)
+		if err != nil {
+			return 0, 0, err
+		}
+		operation := compositeKeyParts[1]
+		tokensStr := compositeKeyParts[2]
+		txID := compositeKeyParts[3]
+		tokenType := tokenTypeOfKey(compositeKeyParts, 4)
+
+		// The account entry has to belong to valid or pending Tx
+		txEntryKey, _, err := getTxEntry(stub, "TxID~Sender~Recipient~Tok", accountID, operation, tokensStr, txID,
+			tokenType)
+		if err != nil {
+			return 0, 0, err
+		}
+		if txEntryKey == "" {
+			txEntryKey, _, err = getTxEntry(stub, "PendingTxID~Sender~Recipient~Tok", accountID, operation,
+				tokensStr, txID, tokenType)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		// The Tx entry is the record of the transfer. The orphan account entry cannot be matched
+		// with any Tx, so it is removed and its tokens are not counted
+		if txEntryKey == "" {
+			result.Changes = append(result.Changes, RepairChange{"delete", objectType,
+				accountEntryKeys(accountID, operation, tokensStr, txID, tokenType), "Missing Tx entry"})
+			if !dryRun {
+				err = deleteAccountEntry(stub, accountID, operation, tokensStr, txID, tokenType)
+				if err != nil {
+					return 0, 0, err
+				}
+			}
+			continue
+		}
+
+		// calculate the delta
+		if tokenType != DefaultTokenType {
+			continue
+		}
+		tokens, err := strconv.ParseInt(tokensStr, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		switch operation {
+		case "+":
+			deltaTok, err = addTokens(deltaTok, tokens)
+		case "-":
+			deltaTok, err = addTokens(deltaTok, -tokens)
+		default:
+			return 0, 0, fmt.Errorf("Unrecognized operation %s", operation)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return deltaTok, entriesCount, nil
+}
+
+// repairTxEntry - rebuilds missing account entries of the participants of the Tx entry. Entries of system
+// participants, deleted accounts and Tx before the last compaction of the account are not expected
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func repairTxEntry(stub shim.ChaincodeStubInterface, txEntryParts []string, dryRun bool) pb.Response {
+	result := RepairResult{Key: txEntryParts, Changes: []RepairChange{}}
+	txID := txEntryParts[0]
+	sender := txEntryParts[1]
+	recipient := txEntryParts[2]
+	tokensStr := txEntryParts[3]
+	tokenType := tokenTypeOfKey(txEntryParts, 4)
+
+	txTimestamp, err := getTxEntryTimestamp(stub, "TxID~Sender~Recipient~Tok", txEntryParts, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	// Check the account entries of both participants
+	for _, participant := range [][]string{{sender, "-", "Missing sender entry"}, {recipient, "+", "Missing recipient entry"}} {
+		if isSystemParticipant(participant[0]) {
+			continue
+		}
+		accountEntryParts := accountEntryKeys(participant[0], participant[1], tokensStr, txID, tokenType)
+		accountEntryKey, err := stub.CreateCompositeKey(accountEntryIndex(tokenType), accountEntryParts)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		accountEntryAsBytes, err := stub.GetState(accountEntryKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if accountEntryAsBytes != nil {
+			continue
+		}
+
+		// Account entries are removed with the account
+		accountAsBytes, err := stub.GetState(participant[0])
+		if err != nil {
+			return shim.Error(err.Error())
+		} else if accountAsBytes == nil {
+			continue
+		}
+
+		// Times are in the same RFC 3339 format, so they can be compared as strings.
+		// Tx without time cannot be placed after the compaction
+		compactedUntil, err := getCompactedUntil(stub, participant[0], tokenType)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if compactedUntil != "" && txTimestamp <= compactedUntil {
+			continue
+		}
+
+		result.Changes = append(result.Changes, RepairChange{"add", accountEntryIndex(tokenType), accountEntryParts,
+			participant[2]})
+		if !dryRun {
+			err = stub.PutState(accountEntryKey, []byte{0x00})
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+		}
+	}
+
+	return marshalRepairResult(result)
+}
+
+// getCompactedUntil - returns the time of the last compaction of the account entries of the token type.
+// The time is empty if the entries were never rolled forward into the checkpoint or pruned
+////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getCompactedUntil(stub shim.ChaincodeStubInterface, accountID string, tokenType string) (string, error) {
+	checkpoint, err := getCheckpoint(stub, accountID, tokenType)
+	if err != nil {
+		return "", err
+	}
+	compactedUntil := checkpoint.Timestamp
+
+	// The pruned entries are replaced by a single entry received from pruneTx
+	creditKeys := []string{accountID, "+"}
+	if tokenType != DefaultTokenType {
+		creditKeys = []string{accountID, tokenType, "+"}
+	}
+	accountTxIterator, err := stub.GetStateByPartialCompositeKey(accountEntryIndex(tokenType), creditKeys)
+	if err != nil {
+		return "", err
+	}
+	defer accountTxIterator.Close()
+	for accountTxIterator.HasNext() {
+		responseRange, err := accountTxIterator.Next()
+		if err != nil {
+			return "", err
+		}
+		compositeKeyParts, err := splitAccountEntryKey(stub, responseRange.Key)
+		if err != nil {
+			return "", err
+		}
+		txEntryKey, counterpart, err := getTxEntry(stub, "TxID~Sender~Recipient~Tok", accountID, "+",
+			compositeKeyParts[2], compositeKeyParts[3], tokenType)
+		if err != nil {
+			return "", err
+		}
+		if txEntryKey == "" || counterpart != "pruneTx" {
+			continue
+		}
+		pruneTimestamp, err := getTxEntryTimestamp(stub, "TxID~Sender~Recipient~Tok",
+			[]string{compositeKeyParts[3], "pruneTx", accountID, compositeKeyParts[2]}, tokenType)
+		if err != nil {
+			return "", err
+		}
+		if pruneTimestamp > compactedUntil {
+			compactedUntil = pruneTimestamp
+		}
+	}
+
+	return compactedUntil, nil
+}
+
+// repairPendingTxEntry - rebuilds the missing account entry of the sender of the pending Tx
+///////////////////////////////////////////////////////////////////////////////////////////////
+func repairPendingTxEntry(stub shim.ChaincodeStubInterface, pendingTxEntryParts []string, dryRun bool) pb.Response {
+	result := RepairResult{Key: pendingTxEntryParts, Changes: []RepairChange{}}
+	tokenType := tokenTypeOfKey(pendingTxEntryParts, 4)
+	senderEntryParts := accountEntryKeys(pendingTxEntryParts[1], "-", pendingTxEntryParts[3], pendingTxEntryParts[0],
+		tokenType)
+
+	// Tokens of the pending Tx have to be taken from the sender
+	senderIDOpTokCompositeKey, err := stub.CreateCompositeKey(accountEntryIndex(tokenType), senderEntryParts)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	senderEntryAsBytes, err := stub.GetState(senderIDOpTokCompositeKey)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	if senderEntryAsBytes != nil {
+		return marshalRepairResult(result)
+	}
+
+	result.Changes = append(result.Changes, RepairChange{"add", accountEntryIndex(tokenType), senderEntryParts,
+		"Missing sender entry"})
+	if !dryRun {
+		err = stub.PutState(senderIDOpTokCompositeKey, []byte{0x00})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	return marshalRepairResult(result)
+}
+
+// marshalRepairResult - returns the repair result as JSON
+///////////////////////////////////////////////////////////
+func marshalRepairResult(result RepairResult) pb.Response {
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(resultAsBytes)
+}
+
+// getFastTransferLimitValue - returns the limit of fast transfer of the token type for the account.
+// The limit of the account has precedence over the limit of all accounts
+//////////////////////////////////////////////////////////////////////////////////////////////////////
+func getFastTransferLimitValue(stub shim.ChaincodeStubInterface, accountID string, tokenType string) (int64, error) {
+	accountLimitKey, err := stub.CreateCompositeKey("LimitTokens~AccountID", tokenTypeKeys([]string{accountID}, tokenType))
+	if err != nil {
+		return 0, err
+	}
+	accountLimitAsBytes, err := stub.GetState(accountLimitKey)
+	if err != nil {
+		return 0, err
+	} else if accountLimitAsBytes != nil {
+		return strconv.ParseInt(string(accountLimitAsBytes), 10, 64)
+	}
+
+	return getConfigInt(stub, tokenTypeConfigName("LimitTokens", tokenType), LimitTokens)
+}
+
+// checkAccountActive - returns error if the account is frozen or closed.
+// Accounts created before the status was introduced are active
+/////////////////////////////////////////////////////////////////////////
+func checkAccountActive(account *Account) error {
+	switch account.Status {
+	case "frozen":
+		if account.FrozenBy == "admin" {
+			return fmt.Errorf("Account %s is frozen by the administrator.", account.AccountID)
+		}
+		return fmt.Errorf("Account %s is frozen until its debt is covered.", account.AccountID)
+	case "closed":
+		return fmt.Errorf("Account %s is closed.", account.AccountID)
+	}
+	return nil
+}
+
+// putTransfer - saves the transfer of tokens between two accounts into both indexes. Tokens of data purchase
+// are pending until the pending Tx is changed to valid, therefore only the sender's entry is saved for them
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func putTransfer(stub shim.ChaincodeStubInterface, fromAccountID string, toAccountID string, tokensToSend int64,
+	dataPurchase bool, tokenType string) error {
+	return putTransferTx(stub, stub.GetTxID(), fromAccountID, toAccountID, tokensToSend, dataPurchase, tokenType)
+}
+
+// putTransferTx - saves the transfer of tokens under the TxID into both indexes in the same way as putTransfer
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func putTransferTx(stub shim.ChaincodeStubInterface, txID string, fromAccountID string, toAccountID string,
+	tokensToSend int64, dataPurchase bool, tokenType string) error {
+	tokensStr := strconv.FormatInt(tokensToSend, 10)
+	err := putAccountEntry(stub, fromAccountID, "-", tokensStr, txID, tokenType)
+	if err != nil {
+		return err
+	}
+
+	// The recipient gets the tokens of data purchase when the pending Tx is changed to valid
+	if dataPurchase {
+		return putTxEntry(stub, "PendingTxID~Sender~Recipient~Tok", txID, fromAccountID, toAccountID, tokensStr, tokenType)
+	}
+	err = putAccountEntry(stub, toAccountID, "+", tokensStr, txID, tokenType)
+	if err != nil {
+		return err
+	}
+
+	return putTxEntry(stub, "TxID~Sender~Recipient~Tok", txID, fromAccountID, toAccountID, tokensStr, tokenType)
+}
+
+// putSystemTransfer - saves the movement of tokens between the account and a system participant
+// (Mint, Burn, Batch) which is not an account. Only the account gets the entry in the index of account entries,
+// the operation ("+" or "-") tells on which side of the Tx entry the account is
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func putSystemTransfer(stub shim.ChaincodeStubInterface, accountID string, operation string, systemParticipant string,
+	tokens int64, tokenType string) error {
+	txID := stub.GetTxID()
+	tokensStr := strconv.FormatInt(tokens, 10)
+	err := putAccountEntry(stub, accountID, operation, tokensStr, txID, tokenType)
+	if err != nil {
+		return err
+	}
+
+	if operation == "+" {
+		return putTxEntry(stub, "TxID~Sender~Recipient~Tok", txID, systemParticipant, accountID, tokensStr, tokenType)
+	}
+	return putTxEntry(stub, "TxID~Sender~Recipient~Tok", txID, accountID, systemParticipant, tokensStr, tokenType)
+}
+
+// putAccountEntry - saves the delta of the account into the index of account entries of the token type.
+// Credits are counted in "Received~Account~Type~Tok~TxID" as well, so receiving accounts can be rolled
+// forward by rollForwardReceivers without reading the entries of their senders
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func putAccountEntry(stub shim.ChaincodeStubInterface, accountID string, operation string, tokensStr string,
+	txID string, tokenType string) error {
+	accountIDOpTokCompositeKey, err := createAccountEntryKey(stub, accountID, operation, tokensStr, txID, tokenType)
+	if err != nil {
+		return err
+	}
+
+	// Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
+	err = stub.PutState(accountIDOpTokCompositeKey, []byte{0x00})
+	if err != nil || operation != "+" {
+		return err
+	}
+
+	// Every credit has its own row, so concurrent transfers to the same account do not conflict
+	receivedCompositeKey, err := stub.CreateCompositeKey("Received~Account~Type~Tok~TxID",
+		[]string{accountID, tokenType, tokensStr, txID})
+	if err != nil {
+		return err
+	}
+	return stub.PutState(receivedCompositeKey, []byte{0x00})
+}
+
+// deleteAccountEntry - removes the delta of the account from the index of account entries of the token type
+// and the credit from "Received~Account~Type~Tok~TxID"
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func deleteAccountEntry(stub shim.ChaincodeStubInterface, accountID string, operation string, tokensStr string,
+	txID string, tokenType string) error {
+	accountIDOpTokCompositeKey, err := createAccountEntryKey(stub, accountID, operation, tokensStr, txID, tokenType)
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(accountIDOpTokCompositeKey)
+	if err != nil || operation != "+" {
+		return err
+	}
+
+	receivedCompositeKey, err := stub.CreateCompositeKey("Received~Account~Type~Tok~TxID",
+		[]string{accountID, tokenType, tokensStr, txID})
+	if err != nil {
+		return err
+	}
+	return stub.DelState(receivedCompositeKey)
+}
+
+// accountEntryIndex - returns the index of account entries of the token type. Entries of the default token type
+// stay in "Account~op~Tok~TxID" as before token types were introduced. Entries of other token types are keyed
+// by the token type ahead of the operation, so the deltas of one token type are read without the others
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func accountEntryIndex(tokenType string) string {
+	if tokenType == DefaultTokenType {
+		return "Account~op~Tok~TxID"
+	}
+
+	return "Account~Type~op~Tok~TxID"
+}
+
+// accountEntryKeys - returns attributes of the account entry in the order of the index of the token type
+///////////////////////////////////////////////////////////////////////////////////////////////////////////
+func accountEntryKeys(accountID string, operation string, tokensStr string, txID string, tokenType string) []string {
+	if tokenType == DefaultTokenType {
+		return []string{accountID, operation, tokensStr, txID}
+	}
+
+	return []string{accountID, tokenType, operation, tokensStr, txID}
+}
+
+// createAccountEntryKey - returns the composite key of the account entry in the index of the token type
+/////////////////////////////////////////////////////////////////////////////////////////////////////////
+func createAccountEntryKey(stub shim.ChaincodeStubInterface, accountID string, operation string, tokensStr string,
+	txID string, tokenType string) (string, error) {
+	return stub.CreateCompositeKey(accountEntryIndex(tokenType),
+		accountEntryKeys(accountID, operation, tokensStr, txID, tokenType))
+}
+
+// getAccountEntries - returns the iterator over the account entries of the token type of the account
+///////////////////////////////////////////////////////////////////////////////////////////////////////
+func getAccountEntries(stub shim.ChaincodeStubInterface, accountID string,
+	tokenType string) (shim.StateQueryIteratorInterface, error) {
+	if tokenType == DefaultTokenType {
+		return stub.GetStateByPartialCompositeKey("Account~op~Tok~TxID", []string{accountID})
+	}
+
+	return stub.GetStateByPartialCompositeKey("Account~Type~op~Tok~TxID", []string{accountID, tokenType})
+}
+
+// splitAccountEntryKey - returns attributes of the account entry in the order of "Account~op~Tok~TxID",
+// i.e. account ID, operation, tokens and TxID followed by the token type unless it is the default token type
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func splitAccountEntryKey(stub shim.ChaincodeStubInterface, compositeKey string) ([]string, error) {
+	objectType, compositeKeyParts, err := stub.SplitCompositeKey(compositeKey)
+	if err != nil {
+		return nil, err
+	}
+	if objectType != "Account~Type~op~Tok~TxID" {
+		return compositeKeyParts, nil
+	}
+	if len(compositeKeyParts) != 5 {
+		return nil, fmt.Errorf("Invalid account entry %s", strings.Join(compositeKeyParts, "~"))
+	}
+
+	return []string{compositeKeyParts[0], compositeKeyParts[2], compositeKeyParts[3], compositeKeyParts[4],
+		compositeKeyParts[1]}, nil
+}
+
+// getAccountEntryRows - returns attributes of all account entries of the token type in the order
+// returned by splitAccountEntryKey
+////////////////////////////////////////////////////////////////////////////////////////////////////
+func getAccountEntryRows(stub shim.ChaincodeStubInterface, tokenType string) ([][]string, error) {
+	iterator, err := stub.GetStateByPartialCompositeKey(accountEntryIndex(tokenType), []string{})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	rows := [][]string{}
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		compositeKeyParts, err := splitAccountEntryKey(stub, responseRange.Key)
+		if err != nil {
+			return nil, err
+		}
+		if tokenTypeOfKey(compositeKeyParts, 4) != tokenType {
+			continue
+		}
+		rows = append(rows, compositeKeyParts)
+	}
+
+	return rows, nil
+}
+
+// putTxEntry - saves the Tx entry into the index. The value of the Tx entry is the time of the transaction
+////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func putTxEntry(stub shim.ChaincodeStubInterface, indexName string, txID string, sender string, recipient string,
+	tokensStr string, tokenType string) error {
+	txParticipantsTokCompositeKey, err := stub.CreateCompositeKey(indexName,
+		tokenTypeKeys([]string{txID, sender, recipient, tokensStr}, tokenType))
+	if err != nil {
+		return err
+	}
+	txTimestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(txParticipantsTokCompositeKey, txTimestamp)
+}
+
+// feeTxID - returns the TxID of the fee of the transaction. The fee is saved as a separate transfer,
+// so its entries never collide with the entries of the transfer itself
+///////////////////////////////////////////////////////////////////////////////////////////////////////
+func feeTxID(txID string) string {
+	return txID + ".fee"
+}
+
+// putFee - saves the fee paid by the sender as a delta credited to the treasury account
+///////////////////////////////////////////////////////////////////////////////////////////
+func putFee(stub shim.ChaincodeStubInterface, fromAccountID string, treasuryAccountID string, fee int64) error {
+	if fee == 0 {
+		return nil
+	}
+
+	return putTransferTx(stub, feeTxID(stub.GetTxID()), fromAccountID, treasuryAccountID, fee, false, DefaultTokenType)
+}
+
+// getTransferFee - returns the fee of the kind of transfer (fast|safe|dataPurchase) and the treasury account.
+// Fees are paid only in the default token type and the treasury account pays no fees
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getTransferFee(stub shim.ChaincodeStubInterface, kind string, fromAccountID string, tokensToSend int64,
+	tokenType string) (int64, string, error) {
+	treasuryAccountID, err := getConfigString(stub, "FeeTreasury", "1")
+	if err != nil {
+		return 0, "", err
+	}
+	if tokenType != DefaultTokenType || fromAccountID == treasuryAccountID {
+		return 0, treasuryAccountID, nil
+	}
+
+	transferFee, err := getTransferFeeValue(stub, kind)
+	if err != nil {
+		return 0, "", err
+	}
+
+	// Percentage of the amount is rounded down
+	fee := new(big.Int).Mul(big.NewInt(tokensToSend), big.NewInt(transferFee.BasisPoints))
+	fee.Quo(fee, big.NewInt(10000))
+	fee.Add(fee, big.NewInt(transferFee.Flat))
+	if !fee.IsInt64() {
+		return 0, "", fmt.Errorf("Fee of the transfer would overflow.")
+	}
+
+	return fee.Int64(), treasuryAccountID, nil
+}
+
+// getTransferFeeValue - returns the fee of the kind of transfer from chaincode state. Transfers are without fee by default
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getTransferFeeValue(stub shim.ChaincodeStubInterface, kind string) (*TransferFee, error) {
+	flat, err := getConfigInt(stub, kind+"FeeFlat", 0)
+	if err != nil {
+		return nil, err
+	}
+	basisPoints, err := getConfigInt(stub, kind+"FeeBasisPoints", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TransferFee{flat, basisPoints}, nil
+}
+
+// getAccountTx - returns the transaction of the account entry with attributes returned by splitAccountEntryKey
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getAccountTx(stub shim.ChaincodeStubInterface, compositeKeyParts []string) pb.Response {
+	accountID := compositeKeyParts[0]
+	operation := compositeKeyParts[1]
+	tokensStr := compositeKeyParts[2]
+	txID := compositeKeyParts[3]
+	tokenType := tokenTypeOfKey(compositeKeyParts, 4)
+
+	amount, err := strconv.ParseInt(tokensStr, 10, 64)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	registeredTokenType, err := getTokenTypeValue(stub, tokenType)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+	accountTx := AccountTx{TxID: txID, Direction: "in", Amount: json.Number(formatAmount(amount, registeredTokenType.Decimals)),
+		TokenType: tokenType, State: "OrphanTx"}
+	if operation == "-" {
+		accountTx.Direction = "out"
+	}
+
+	// Find the Tx entry in valid or pending transactions
+	for _, index := range [][]string{{"TxID~Sender~Recipient~Tok", "ValidTx"}, {"PendingTxID~Sender~Recipient~Tok", "PendingTx"}} {
+		txEntryKey, counterparty, err := getTxEntry(stub, index[0], accountID, operation, tokensStr, txID, tokenType)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if txEntryKey == "" {
+			continue
+		}
+		accountTx.Counterparty = counterparty
+		accountTx.State = index[1]
+
+		// Tx entries created before the time was recorded contain only null character
+		txEntryAsBytes, err := stub.GetState(txEntryKey)
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		if len(txEntryAsBytes) > 1 {
+			accountTx.Timestamp = string(txEntryAsBytes)
+		}
+		break
+	}
+
+	// The sender of the batch transfer is in the entry of the sender's debit
+	if accountTx.Counterparty == "Batch" && operation == "+" {
+		txIterator, err := stub.GetStateByPartialCompositeKey("TxID~Sender~Recipient~Tok", []string{txID})
+		if err != nil {
+			return shim.Error(err.Error())
+		}
+		defer txIterator.Close()
+		for txIterator.HasNext() {
+			responseRange, err := txIterator.Next()
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			_, txEntryParts, err := stub.SplitCompositeKey(responseRange.Key)
+			if err != nil {
+				return shim.Error(err.Error())
+			}
+			if txEntryParts[2] == "Batch" {
+				accountTx.Counterparty = txEntryParts[1]
+				break
+			}
+		}
+	}
+
+	accountTxAsBytes, err := json.Marshal(accountTx)
+	if err != nil {
+		return shim.Error(err.Error())
+	}
+
+	return shim.Success(accountTxAsBytes)
+}
+
+// getCheckpoint - returns the checkpoint of the token type of the account. Account without checkpoint starts
+// from zero tokens
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getCheckpoint(stub shim.ChaincodeStubInterface, accountID string, tokenType string) (*Checkpoint, error) {
+	checkpoint := &Checkpoint{RecordType: "CHECKPOINT", AccountID: accountID, TokenType: tokenType}
+	checkpointKey, err := stub.CreateCompositeKey("Checkpoint~AccountID", tokenTypeKeys([]string{accountID}, tokenType))
+	if err != nil {
+		return nil, err
+	}
+	checkpointAsBytes, err := stub.GetState(checkpointKey)
+	if err != nil {
+		return nil, err
+	} else if checkpointAsBytes == nil {
+		return checkpoint, nil
+	}
+	err = json.Unmarshal(checkpointAsBytes, checkpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	return checkpoint, nil
+}
+
+// getAccountBalance - returns tokens of the token type of the account and number of deltas recorded since the checkpoint
+// that can be rolled forward. Deltas of pending Tx and deltas without Tx entry are counted in tokens only
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getAccountBalance(stub shim.ChaincodeStubInterface, accountID string, tokenType string) (int64, int64, error) {
+	checkpoint, err := getCheckpoint(stub, accountID, tokenType)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Get account transactions of the token type since the checkpoint
+	accountTxIterator, err := getAccountEntries(stub, accountID, tokenType)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer accountTxIterator.Close()
+
+	// Iterate through result set and compute final amount of tokens
+	finalTok := checkpoint.Tokens
+	var deltas int64
+	for accountTxIterator.HasNext() {
+		// Get the next row
+		responseRange, err := accountTxIterator.Next()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		// Split the composite key into its component parts
+		compositeKeyParts, err := splitAccountEntryKey(stub, responseRange.Key)
+		if err != nil {
+			return 0, 0, err
+		}
+		operation := compositeKeyParts[1]
+		tokensStr := compositeKeyParts[2]
+		txID := compositeKeyParts[3]
+
+		// Convert the amount of tokens and perform the operation
+		tokens, err := strconv.ParseInt(tokensStr, 10, 64)
+		if err != nil {
+			return 0, 0, err
+		}
+		switch operation {
+		case "+":
+			finalTok, err = addTokens(finalTok, tokens)
+		case "-":
+			finalTok, err = addTokens(finalTok, -tokens)
+		default:
+			return 0, 0, fmt.Errorf("Unrecognized operation %s", operation)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		// Only deltas of valid Tx can be rolled forward into the checkpoint
+		txEntryKey, _, err := getTxEntry(stub, "TxID~Sender~Recipient~Tok", accountID, operation, tokensStr, txID,
+			tokenType)
+		if err != nil {
+			return 0, 0, err
+		}
+		if txEntryKey != "" {
+			deltas++
+		}
+	}
+
+	return finalTok, deltas, nil
+}
+
+// getAccountBalanceAt - returns tokens of the token type of the account as of the time. Deltas of Tx after
+// the time are not counted. Tx entries created before timestamps were recorded are older than any time
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getAccountBalanceAt(stub shim.ChaincodeStubInterface, accountID string, tokenType string, asOf string) (int64, error) {
+	checkpoint, err := getCheckpoint(stub, accountID, tokenType)
+	if err != nil {
+		return 0, err
+	}
+
+	accountTxIterator, err := getAccountEntries(stub, accountID, tokenType)
+	if err != nil {
+		return 0, err
+	}
+	defer accountTxIterator.Close()
+
+	finalTok := checkpoint.Tokens
+	for accountTxIterator.HasNext() {
+		responseRange, err := accountTxIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		compositeKeyParts, err := splitAccountEntryKey(stub, responseRange.Key)
+		if err != nil {
+			return 0, err
+		}
+		operation := compositeKeyParts[1]
+		tokensStr := compositeKeyParts[2]
+		txID := compositeKeyParts[3]
+
+		// The time of the delta is the time of its valid or pending Tx
+		txEntryKey, _, err := getTxEntry(stub, "TxID~Sender~Recipient~Tok", accountID, operation, tokensStr, txID,
+			tokenType)
+		if err != nil {
+			return 0, err
+		}
+		if txEntryKey == "" {
+			txEntryKey, _, err = getTxEntry(stub, "PendingTxID~Sender~Recipient~Tok", accountID, operation,
+				tokensStr, txID, tokenType)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if txEntryKey != "" {
+			txTimestamp, err := stub.GetState(txEntryKey)
+			if err != nil {
+				return 0, err
+			}
+			if len(txTimestamp) > 1 && string(txTimestamp) > asOf {
+				continue
+			}
+		}
+
+		tokens, err := strconv.ParseInt(tokensStr, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		switch operation {
+		case "+":
+			finalTok, err = addTokens(finalTok, tokens)
+		case "-":
+			finalTok, err = addTokens(finalTok, -tokens)
+		default:
+			return 0, fmt.Errorf("Unrecognized operation %s", operation)
+		}
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	// Input sanitization
-	for i := 0; i < argsCount; i++ {
-		if len(args[i]) <= 0 {
-			return shim.Error("Argument at position " + strconv.Itoa(i+1) + " must be a non-empty string")
+	return finalTok, nil
+}
+
+// getOpenSnapshot - returns the snapshot that is not complete yet or nil if all snapshots are complete
+////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getOpenSnapshot(stub shim.ChaincodeStubInterface) (*BalanceSnapshot, error) {
+	snapshotID, err := getConfigString(stub, "OpenSnapshot", "")
+	if err != nil || snapshotID == "" {
+		return nil, err
+	}
+	snapshotKey, err := stub.CreateCompositeKey("Snapshot~ID", []string{snapshotID})
+	if err != nil {
+		return nil, err
+	}
+	snapshotAsBytes, err := stub.GetState(snapshotKey)
+	if err != nil {
+		return nil, err
+	} else if snapshotAsBytes == nil {
+		return nil, fmt.Errorf("Snapshot does not exist: %s", snapshotID)
+	}
+	snapshot := &BalanceSnapshot{}
+	err = json.Unmarshal(snapshotAsBytes, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+// getSnapshotBalances - returns balances of the account recorded in the snapshot or nil if they were not recorded
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getSnapshotBalances(stub shim.ChaincodeStubInterface, snapshotID string, accountID string) (*AccountBalances, error) {
+	balanceKey, err := stub.CreateCompositeKey("SnapshotBalance~ID~AccountID", []string{snapshotID, accountID})
+	if err != nil {
+		return nil, err
+	}
+	balancesAsBytes, err := stub.GetState(balanceKey)
+	if err != nil || balancesAsBytes == nil {
+		return nil, err
+	}
+	balances := &AccountBalances{}
+	err = json.Unmarshal(balancesAsBytes, balances)
+	if err != nil {
+		return nil, err
+	}
+
+	return balances, nil
+}
+
+// putSnapshotBalances - records balances of all token types of the account as of the time of the snapshot.
+// Balances recorded before are not changed
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func putSnapshotBalances(stub shim.ChaincodeStubInterface, snapshot *BalanceSnapshot, accountID string) (*AccountBalances, error) {
+	balances, err := getSnapshotBalances(stub, snapshot.SnapshotID, accountID)
+	if err != nil || balances != nil {
+		return balances, err
+	}
+
+	// Every account has a balance of the default token type
+	tokenTypes, err := getAccountTokenTypes(stub, accountID)
+	if err != nil {
+		return nil, err
+	}
+	balances = &AccountBalances{accountID, map[string]int64{DefaultTokenType: 0}}
+	for _, tokenType := range tokenTypes {
+		balances.Tokens[tokenType], err = getAccountBalanceAt(stub, accountID, tokenType, snapshot.Timestamp)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	// Extract args
-	accountID := args[0]
+	balancesAsBytes, err := json.Marshal(balances)
+	if err != nil {
+		return nil, err
+	}
+	balanceKey, err := stub.CreateCompositeKey("SnapshotBalance~ID~AccountID", []string{snapshot.SnapshotID, accountID})
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(balanceKey, balancesAsBytes)
+	if err != nil {
+		return nil, err
+	}
 
-	// Get all account transactions for the account ID
-	accountTxIterator, err := stub.GetStateByPartialCompositeKey("Account~op~Tok~TxID", []string{accountID})
+	return balances, nil
+}
+
+// recordOpenSnapshotBalances - records balances of the account into the open snapshot before its past deltas
+// are compacted or changed, because the snapshot could not compute them as of its time anymore
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func recordOpenSnapshotBalances(stub shim.ChaincodeStubInterface, accountID string) error {
+	snapshot, err := getOpenSnapshot(stub)
+	if err != nil || snapshot == nil {
+		return err
+	}
+	_, err = putSnapshotBalances(stub, snapshot, accountID)
+	return err
+}
+
+// rollForwardCheckpointIfDue - rolls the checkpoint of the token type of the account forward if the number of deltas reached the limit
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func rollForwardCheckpointIfDue(stub shim.ChaincodeStubInterface, accountID string, tokenType string, deltas int64) error {
+	checkpointDeltas, err := getConfigInt(stub, "CheckpointDeltas", CheckpointDeltas)
 	if err != nil {
-		return shim.Error("pruneAccountTx: " + err.Error())
+		return err
+	}
+	if checkpointDeltas == 0 || deltas < checkpointDeltas {
+		return nil
+	}
+
+	_, err = rollForwardCheckpoint(stub, accountID, tokenType, 0)
+	return err
+}
+
+// rollForwardCheckpoint - adds deltas of valid transactions of the token type to the checkpoint and removes them
+// from the index. Deltas of pending transactions stay in the index until the transactions are valid.
+// Deltas younger than minAge seconds are kept as well. Recipients only add new deltas, so they never
+// conflict with the checkpoint. Returns number of removed deltas
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func rollForwardCheckpoint(stub shim.ChaincodeStubInterface, accountID string, tokenType string,
+	minAge int64) (int64, error) {
+	err := recordOpenSnapshotBalances(stub, accountID)
+	if err != nil {
+		return 0, err
+	}
+	checkpoint, err := getCheckpoint(stub, accountID, tokenType)
+	if err != nil {
+		return 0, err
+	}
+	now, err := stub.GetTxTimestamp()
+	if err != nil {
+		return 0, err
+	}
+
+	accountTxIterator, err := getAccountEntries(stub, accountID, tokenType)
+	if err != nil {
+		return 0, err
 	}
 	defer accountTxIterator.Close()
 
-	// Iterate through result set and compute final amount of tokens
-	var finalTok int64
+	var rolledDeltas int64
 	for accountTxIterator.HasNext() {
-		// Get the next row
 		responseRange, err := accountTxIterator.Next()
 		if err != nil {
-			return shim.Error("pruneAccountTx: " + err.Error())
+			return 0, err
 		}
-
-		// Split the composite key into its component parts
-		_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+		compositeKeyParts, err := splitAccountEntryKey(stub, responseRange.Key)
 		if err != nil {
-			return shim.Error("pruneAccountTx: " + err.Error())
+			return 0, err
 		}
-
-		// Retrieve the amount of tokens and operation
 		operation := compositeKeyParts[1]
 		tokensStr := compositeKeyParts[2]
 		txID := compositeKeyParts[3]
 
-		// Convert the tokensStr string and perform the operation
-		tokens, err := strconv.ParseInt(tokensStr, 10, 64)
+		// Only valid Tx can be added to the checkpoint
+		txEntryKey, counterpart, err := getTxEntry(stub, "TxID~Sender~Recipient~Tok", accountID, operation, tokensStr,
+			txID, tokenType)
 		if err != nil {
-			return shim.Error("pruneAccountTx: " + err.Error())
+			return 0, err
 		}
-
-		// check if the TxID is in "TxID~Sender~Recipient~Tok" index. If not then it is not valid Tx yet
-		// It can be pending Tx
-		txParticipantsTokIterator, err := stub.GetStateByPartialCompositeKey("TxID~Sender~Recipient~Tok",
-			[]string{txID})
-		if err != nil {
-			return shim.Error("pruneAccountTx: " + err.Error())
+		if txEntryKey == "" {
+			continue
 		}
-		defer txParticipantsTokIterator.Close()
 
-		if !txParticipantsTokIterator.HasNext() {
-			continue
+		// Tx entries created before timestamps were recorded are old enough
+		if minAge > 0 {
+			txTimestamp, err := stub.GetState(txEntryKey)
+			if err != nil {
+				return 0, err
+			}
+			if len(txTimestamp) > 1 {
+				txTime, err := time.Parse(time.RFC3339, string(txTimestamp))
+				if err != nil {
+					return 0, err
+				}
+				if now.Seconds < txTime.Add(time.Duration(minAge)*time.Second).Unix() {
+					continue
+				}
+			}
 		}
 
-		// calculate the delta
+		tokens, err := strconv.ParseInt(tokensStr, 10, 64)
+		if err != nil {
+			return 0, err
+		}
 		switch operation {
 		case "+":
-			finalTok += tokens
+			checkpoint.Tokens, err = addTokens(checkpoint.Tokens, tokens)
 		case "-":
-			finalTok -= tokens
+			checkpoint.Tokens, err = addTokens(checkpoint.Tokens, -tokens)
 		default:
-			return shim.Error(fmt.Sprintf("Unrecognized operation %s", operation))
+			return 0, fmt.Errorf("Unrecognized operation %s", operation)
+		}
+		if err != nil {
+			return 0, err
 		}
 
-		// Maintain the index of "Account~op~Tok~TxID"
-		err = stub.DelState(responseRange.Key)
+		// Maintain both indexes
+		err = deleteAccountEntry(stub, accountID, operation, tokensStr, txID, tokenType)
 		if err != nil {
-			return shim.Error("pruneAccountTx: " + err.Error())
+			return 0, err
+		}
+		err = deleteTxEntryIfUnused(stub, txEntryKey, accountID, counterpart, operation, tokensStr, txID, tokenType)
+		if err != nil {
+			return 0, err
+		}
+		rolledDeltas++
+	}
+	if rolledDeltas == 0 {
+		return 0, nil
+	}
+
+	// Save the checkpoint
+	txTimestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return 0, err
+	}
+	checkpoint.TxID = stub.GetTxID()
+	checkpoint.Timestamp = string(txTimestamp)
+	checkpointAsBytes, err := json.Marshal(checkpoint)
+	if err != nil {
+		return 0, err
+	}
+	checkpointKey, err := stub.CreateCompositeKey("Checkpoint~AccountID", tokenTypeKeys([]string{accountID}, tokenType))
+	if err != nil {
+		return 0, err
+	}
+	err = stub.PutState(checkpointKey, checkpointAsBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	return rolledDeltas, nil
+}
+
+// tokenTypeConfigName - appends the token type to the name of the configuration value. Configuration
+// of the default token type is saved under the name without the token type, as before token types existed
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func tokenTypeConfigName(name string, tokenType string) string {
+	if tokenType == DefaultTokenType {
+		return name
+	}
+
+	return name + "~" + tokenType
+}
+
+// tokenTypeKeys - appends the token type to attributes of the composite key. Composite keys of the default
+// token type have no token type attribute, so entries created before token types were introduced are unchanged
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func tokenTypeKeys(attributes []string, tokenType string) []string {
+	if tokenType == DefaultTokenType {
+		return attributes
+	}
+
+	return append(attributes, tokenType)
+}
+
+// tokenTypeOfKey - returns the token type of the composite key that has n attributes without the token type
+//////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func tokenTypeOfKey(compositeKeyParts []string, n int) string {
+	if len(compositeKeyParts) > n {
+		return compositeKeyParts[n]
+	}
+
+	return DefaultTokenType
+}
+
+// getTokenTypeValue - returns the registered token type. The default token type exists even if it was not
+// registered by Init, e.g. in ledgers created before token types were introduced
+////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getTokenTypeValue(stub shim.ChaincodeStubInterface, symbol string) (*TokenType, error) {
+	tokenTypeKey, err := stub.CreateCompositeKey("TokenType~Symbol", []string{symbol})
+	if err != nil {
+		return nil, err
+	}
+	tokenTypeAsBytes, err := stub.GetState(tokenTypeKey)
+	if err != nil {
+		return nil, err
+	} else if tokenTypeAsBytes == nil {
+		if symbol == DefaultTokenType {
+			return &TokenType{"TOKENTYPE", DefaultTokenType, DefaultDecimals, ""}, nil
 		}
+		return nil, fmt.Errorf("Token type does not exist: %s", symbol)
+	}
+	var tokenType TokenType
+	err = json.Unmarshal(tokenTypeAsBytes, &tokenType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenType, nil
+}
+
+// checkTokenIssuer - returns error if the caller is not the issuer of the token type.
+// The administrator of the chaincode is the issuer of the default token type
+///////////////////////////////////////////////////////////////////////////////////////
+func checkTokenIssuer(stub shim.ChaincodeStubInterface, tokenType *TokenType) error {
+	if tokenType.Symbol == DefaultTokenType {
+		return checkAdmin(stub)
+	}
+
+	isIssuer, err := isCreator(stub, tokenType.Issuer)
+	if err != nil {
+		return err
+	}
+	if !isIssuer {
+		return fmt.Errorf("Caller is not the issuer of token type %s", tokenType.Symbol)
+	}
+
+	return nil
+}
 
-		// Get the Row Tx entry in the other index
-		responseTxParticipantsRange, err := txParticipantsTokIterator.Next()
+// getAccountTokenTypes - returns sorted symbols of all token types that have a checkpoint or delta of the account
+///////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getAccountTokenTypes(stub shim.ChaincodeStubInterface, accountID string) ([]string, error) {
+	tokenTypes := []string{}
+	found := make(map[string]bool)
+	indexes := []struct {
+		name       string
+		attributes int
+	}{{"Checkpoint~AccountID", 1}, {"Account~op~Tok~TxID", 4}, {"Account~Type~op~Tok~TxID", 1}}
+	for _, index := range indexes {
+		iterator, err := stub.GetStateByPartialCompositeKey(index.name, []string{accountID})
 		if err != nil {
-			return shim.Error("pruneAccountTx: " + err.Error())
+			return nil, err
 		}
+		for iterator.HasNext() {
+			responseRange, err := iterator.Next()
+			if err != nil {
+				iterator.Close()
+				return nil, err
+			}
+			_, compositeKeyParts, err := stub.SplitCompositeKey(responseRange.Key)
+			if err != nil {
+				iterator.Close()
+				return nil, err
+			}
+			tokenType := tokenTypeOfKey(compositeKeyParts, index.attributes)
+			if !found[tokenType] {
+				found[tokenType] = true
+				tokenTypes = append(tokenTypes, tokenType)
+			}
+		}
+		iterator.Close()
+	}
+	sort.Strings(tokenTypes)
 
-		// Maintain index of "TxID~Sender~Recipient~Tok"
-		err = stub.DelState(responseTxParticipantsRange.Key)
+	return tokenTypes, nil
+}
+
+// getAccountBalances - returns tokens of all token types of the account. The default token type is always included
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getAccountBalances(stub shim.ChaincodeStubInterface, accountID string) (map[string]int64, error) {
+	tokenTypes, err := getAccountTokenTypes(stub, accountID)
+	if err != nil {
+		return nil, err
+	}
+	balances := map[string]int64{DefaultTokenType: 0}
+	for _, tokenType := range tokenTypes {
+		balances[tokenType], _, err = getAccountBalance(stub, accountID, tokenType)
 		if err != nil {
-			return shim.Error("pruneAccountTx: " + err.Error())
+			return nil, err
 		}
 	}
 
-	newTxID := stub.GetTxID()
-	// Create the new composite key for the new entry
-	recipientIDOpTokCompositeKey, err := stub.CreateCompositeKey("Account~op~Tok~TxID",
-		[]string{accountID, "+", strconv.FormatInt(finalTok, 10), newTxID})
+	return balances, nil
+}
+
+// getExchangeRateValue - returns the current exchange rate of the token pair from chaincode state
+///////////////////////////////////////////////////////////////////////////////////////////////////
+func getExchangeRateValue(stub shim.ChaincodeStubInterface, fromType string, toType string) (*ExchangeRate, error) {
+	rateKey, err := stub.CreateCompositeKey("ExchangeRate~From~To", []string{fromType, toType})
 	if err != nil {
-		return shim.Error("pruneAccountTx: " + err.Error())
+		return nil, err
+	}
+	rateAsBytes, err := stub.GetState(rateKey)
+	if err != nil {
+		return nil, err
+	} else if rateAsBytes == nil {
+		return nil, fmt.Errorf("Exchange rate does not exist: %s/%s", fromType, toType)
+	}
+	var rate ExchangeRate
+	err = json.Unmarshal(rateAsBytes, &rate)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create the new composite key for the new entry
-	txParticipantsTokCompositeKey, err := stub.CreateCompositeKey("TxID~Sender~Recipient~Tok",
-		[]string{newTxID, "pruneTx", accountID, strconv.FormatInt(finalTok, 10)})
+	return &rate, nil
+}
+
+// parseAmount - parses decimal amount of tokens exactly into the smallest units of the token type.
+// The amount cannot have more decimal places than the token type, e.g. "0.0025" with 4 decimals is 25
+////////////////////////////////////////////////////////////////////////////////////////////////////////
+func parseAmount(amountStr string, decimals int) (int64, error) {
+	sign := ""
+	if strings.HasPrefix(amountStr, "-") {
+		sign = "-"
+		amountStr = amountStr[1:]
+	}
+	intPart := amountStr
+	fracPart := ""
+	if i := strings.Index(amountStr, "."); i >= 0 {
+		intPart = amountStr[:i]
+		fracPart = amountStr[i+1:]
+		if len(fracPart) == 0 {
+			return 0, fmt.Errorf("Expecting decimal number as amount of tokens: %s", sign+amountStr)
+		}
+	}
+	if len(intPart) == 0 || strings.Trim(intPart, "0123456789") != "" || strings.Trim(fracPart, "0123456789") != "" {
+		return 0, fmt.Errorf("Expecting decimal number as amount of tokens: %s", sign+amountStr)
+	}
+	if len(fracPart) > decimals {
+		return 0, fmt.Errorf("Amount of tokens %s has more than %d decimals.", sign+amountStr, decimals)
+	}
+
+	// Digits of the fraction are padded to the smallest unit
+	amount, err := strconv.ParseInt(sign+intPart+fracPart+strings.Repeat("0", decimals-len(fracPart)), 10, 64)
 	if err != nil {
-		return shim.Error("pruneAccountTx: " + err.Error())
+		return 0, fmt.Errorf("Amount of tokens %s would overflow.", sign+amountStr)
 	}
 
-	// Update the index with single Tx that agregates all that were deleted
-	// Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
-	value := []byte{0x00}
-	err = stub.PutState(recipientIDOpTokCompositeKey, value)
+	return amount, nil
+}
+
+// formatAmount - formats amount in the smallest units as decimal number of the token type.
+// Trailing zeros of the fraction are omitted, so amounts of tokens without decimals are plain integers
+/////////////////////////////////////////////////////////////////////////////////////////////////////////
+func formatAmount(amount int64, decimals int) string {
+	digits := strconv.FormatInt(amount, 10)
+	if decimals <= 0 {
+		return digits
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		digits = digits[1:]
+	}
+	if len(digits) <= decimals {
+		digits = strings.Repeat("0", decimals-len(digits)+1) + digits
+	}
+	intPart := digits[:len(digits)-decimals]
+	fracPart := strings.TrimRight(digits[len(digits)-decimals:], "0")
+	if len(fracPart) == 0 {
+		return sign + intPart
+	}
+
+	return sign + intPart + "." + fracPart
+}
+
+// addTokens - returns the sum of the amounts of tokens or error if the sum overflows
+//////////////////////////////////////////////////////////////////////////////////////
+func addTokens(a int64, b int64) (int64, error) {
+	if (b > 0 && a > math.MaxInt64-b) || (b < 0 && a < math.MinInt64-b) {
+		return 0, fmt.Errorf("Sum of tokens would overflow.")
+	}
+
+	return a + b, nil
+}
+
+// proposeTransfer - saves the transfer from multi-signature account as proposal approved by the caller.
+// The proposal expires after TransferProposalExpiry seconds
+///////////////////////////////////////////////////////////////////////////////////////////////////////////
+func proposeTransfer(stub shim.ChaincodeStubInterface, account *Account, proposal *TransferProposal) error {
+	// Recipient has to exist when the transfer is proposed
+	if proposal.Action != "delete" {
+		toAccountAsBytes, err := stub.GetState(proposal.ToAccountID)
+		if err != nil {
+			return err
+		} else if toAccountAsBytes == nil {
+			return fmt.Errorf("Account does not exist: %s", proposal.ToAccountID)
+		}
+	}
+
+	expiry, err := getConfigInt(stub, "TransferProposalExpiry", TransferProposalExpiry)
 	if err != nil {
-		return shim.Error("pruneAccountTx: " + err.Error())
+		return err
 	}
-	err = stub.PutState(txParticipantsTokCompositeKey, value)
+	now, err := stub.GetTxTimestamp()
 	if err != nil {
-		return shim.Error("pruneAccountTx: " + err.Error())
+		return err
 	}
+	proposal.Expiry = time.Unix(now.Seconds+expiry, 0).UTC().Format(time.RFC3339)
 
-	// Index updated
-	// Return new Tx ID
-	return shim.Success([]byte(newTxID))
+	return approveTransferProposal(stub, account, proposal)
+}
+
+// approveTransferProposal - adds approval of the owner who is the caller and executes the transfer
+// or deletion of the account when the threshold of the account is reached
+//////////////////////////////////////////////////////////////////////////////////////////////////////
+func approveTransferProposal(stub shim.ChaincodeStubInterface, account *Account, proposal *TransferProposal) error {
+	owner, err := getMultiSigOwner(stub, account)
+	if err != nil {
+		return err
+	}
+	for _, approval := range proposal.Approvals {
+		if approval == owner {
+			return fmt.Errorf("Transfer proposal %s was already approved by the caller.", proposal.ProposalID)
+		}
+	}
+	proposal.Approvals = append(proposal.Approvals, owner)
+
+	// The transfer is executed with the check of the sender's tokens
+	if len(proposal.Approvals) >= account.Threshold {
+		if proposal.Action == "delete" {
+			err = deleteAccount(stub, account)
+		} else {
+			err = putSafeTransfer(stub, account, proposal.ToAccountID, proposal.Amount, proposal.DataPurchase,
+				proposal.TokenType)
+		}
+		if err != nil {
+			return err
+		}
+		proposal.State = "Executed"
+		proposal.ExecutedTxID = stub.GetTxID()
+	}
+
+	return putTransferProposal(stub, proposal)
+}
+
+// getOpenTransferProposal - returns the transfer proposal that can be approved or cancelled and its account
+////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func getOpenTransferProposal(stub shim.ChaincodeStubInterface, proposalID string) (*TransferProposal, *Account, error) {
+	proposal, err := getTransferProposalValue(stub, proposalID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if proposal.State != "Proposed" {
+		return nil, nil, fmt.Errorf("Transfer proposal %s is %s.", proposalID, strings.ToLower(proposal.State))
+	}
+
+	accountAsBytes, err := stub.GetState(proposal.FromAccountID)
+	if err != nil {
+		return nil, nil, err
+	} else if accountAsBytes == nil {
+		return nil, nil, fmt.Errorf("Account does not exist: %s", proposal.FromAccountID)
+	}
+	var account Account
+	err = json.Unmarshal(accountAsBytes, &account)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return proposal, &account, nil
+}
+
+// isTransferProposalExpired - returns true if the time of the transaction is after the expiry of the proposal
+/////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+func isTransferProposalExpired(stub shim.ChaincodeStubInterface, proposal *TransferProposal) (bool, error) {
+	expiryTime, err := time.Parse(time.RFC3339, proposal.Expiry)
+	if err != nil {
+		return false, err
+	}
+	now, err := stub.GetTxTimestamp()
+	if err != nil {
+		return false, err
+	}
+
+	return now.Seconds >= expiryTime.Unix(), nil
+}
+
+// getTransferProposalValue - returns the transfer proposal from chaincode state
+///////////////////////////////////////////////////////////////////////////////////
+func getTransferProposalValue(stub shim.ChaincodeStubInterface, proposalID string) (*TransferProposal, error) {
+	proposalKey, err := stub.CreateCompositeKey("TransferProposal~ID", []string{proposalID})
+	if err != nil {
+		return nil, err
+	}
+	proposalAsBytes, err := stub.GetState(proposalKey)
+	if err != nil {
+		return nil, err
+	} else if proposalAsBytes == nil {
+		return nil, fmt.Errorf("Transfer proposal does not exist: %s", proposalID)
+	}
+	var proposal TransferProposal
+	err = json.Unmarshal(proposalAsBytes, &proposal)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proposal, nil
+}
+
+// putTransferProposal - saves the transfer proposal into chaincode state
+////////////////////////////////////////////////////////////////////////////
+func putTransferProposal(stub shim.ChaincodeStubInterface, proposal *TransferProposal) error {
+	proposalKey, err := stub.CreateCompositeKey("TransferProposal~ID", []string{proposal.ProposalID})
+	if err != nil {
+		return err
+	}
+	proposalAsBytes, err := json.Marshal(proposal)
+	if err != nil {
+		return err
+	}
+
+	return stub.PutState(proposalKey, proposalAsBytes)
 }
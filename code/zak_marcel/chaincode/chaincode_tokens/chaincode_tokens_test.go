@@ -1,12 +1,148 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
 )
 
+// newTestCreator - creates serialized identity with self-signed certificate
+func newTestCreator(mspID string, commonName string) []byte {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: commonName},
+		NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	certAsBytes, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	idBytes := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certAsBytes})
+	creator, _ := proto.Marshal(&msp.SerializedIdentity{Mspid: mspID, IdBytes: idBytes})
+	return creator
+}
+
+// identityStub wraps MockStub because MockStub does not return any creator
+type identityStub struct {
+	*shim.MockStub
+	creator []byte
+	args    [][]byte
+}
+
+func (stub *identityStub) GetCreator() ([]byte, error) {
+	return stub.creator, nil
+}
+
+func (stub *identityStub) GetArgs() [][]byte {
+	return stub.args
+}
+
+func (stub *identityStub) GetStringArgs() []string {
+	strargs := make([]string, 0, len(stub.args))
+	for _, barg := range stub.args {
+		strargs = append(strargs, string(barg))
+	}
+	return strargs
+}
+
+func (stub *identityStub) GetFunctionAndParameters() (string, []string) {
+	allargs := stub.GetStringArgs()
+	if len(allargs) == 0 {
+		return "", []string{}
+	}
+	return allargs[0], allargs[1:]
+}
+
+// GetStateByPartialCompositeKeyWithPagination - MockStub does not support pagination. As in the ledger,
+// the bookmark is the key where the page starts and it is empty when there are no more keys
+func (stub *identityStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string,
+	pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	partialCompositeKey, err := stub.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	startKey := partialCompositeKey
+	if bookmark != "" {
+		startKey = bookmark
+	}
+	endKey := partialCompositeKey + string(utf8.MaxRune)
+
+	// Find the key where the next page starts
+	iterator := shim.NewMockStateRangeQueryIterator(stub.MockStub, startKey, endKey)
+	defer iterator.Close()
+	var fetchedRecordsCount int32
+	nextKey := ""
+	for iterator.HasNext() {
+		responseRange, err := iterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if fetchedRecordsCount == pageSize {
+			nextKey = responseRange.Key
+			endKey = nextKey
+			break
+		}
+		fetchedRecordsCount++
+	}
+
+	metadata := &pb.QueryResponseMetadata{FetchedRecordsCount: fetchedRecordsCount, Bookmark: nextKey}
+	return shim.NewMockStateRangeQueryIterator(stub.MockStub, startKey, endKey), metadata, nil
+}
+
+// mockInvokeAs - invokes chaincode in the same way as MockInvoke but as the creator
+func mockInvokeAs(stub *shim.MockStub, creator []byte, uuid string, args [][]byte) pb.Response {
+	stub.MockTransactionStart(uuid)
+	res := new(Chaincode).Invoke(&identityStub{stub, creator, args})
+	stub.MockTransactionEnd(uuid)
+	return res
+}
+
+// timestampStub wraps identityStub because MockStub runs every transaction at the current time
+type timestampStub struct {
+	*identityStub
+	txTimestamp *timestamp.Timestamp
+}
+
+func (stub *timestampStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return stub.txTimestamp, nil
+}
+
+// mockInvokeAt - invokes chaincode in the same way as MockInvoke but at the time
+func mockInvokeAt(stub *shim.MockStub, txTime time.Time, uuid string, args [][]byte) pb.Response {
+	stub.MockTransactionStart(uuid)
+	res := new(Chaincode).Invoke(&timestampStub{&identityStub{stub, nil, args},
+		&timestamp.Timestamp{Seconds: txTime.Unix()}})
+	stub.MockTransactionEnd(uuid)
+	return res
+}
+
+// adChaincode mocks checkTXState of the ad chaincode
+type adChaincode struct {
+	txState string
+}
+
+func (cc *adChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (cc *adChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success([]byte(cc.txState))
+}
+
 func checkInit(t *testing.T, stub *shim.MockStub, args [][]byte) {
 	res := stub.MockInit("1", args)
 	if res.Status != shim.OK {
@@ -36,7 +172,7 @@ func checkState(t *testing.T, stub *shim.MockStub, name string, value string) {
 }
 
 func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
-	res := stub.MockInvoke("1", args)
+	res := mockInvokeAs(stub, nil, "1", args)
 	if res.Status != shim.OK {
 		fmt.Println("Invoke", args, "failed", string(res.Message))
 		t.Fail()
@@ -44,7 +180,7 @@ func checkInvoke(t *testing.T, stub *shim.MockStub, args [][]byte) {
 }
 
 func checkInvokeFail(t *testing.T, stub *shim.MockStub, args [][]byte) {
-	res := stub.MockInvoke("1", args)
+	res := mockInvokeAs(stub, nil, "1", args)
 	if res.Status == shim.OK {
 		fmt.Println("Invoke", args, "should fail but did not", string(res.Payload))
 		t.Fail()
@@ -52,7 +188,7 @@ func checkInvokeFail(t *testing.T, stub *shim.MockStub, args [][]byte) {
 }
 
 func checkInvokeResponse(t *testing.T, stub *shim.MockStub, args [][]byte, expectedPayload string) {
-	res := stub.MockInvoke("1", args)
+	res := mockInvokeAs(stub, nil, "1", args)
 	if res.Status != shim.OK {
 		fmt.Println("Invoke", args, "failed", string(res.Message))
 		t.Fail()
@@ -65,7 +201,7 @@ func checkInvokeResponse(t *testing.T, stub *shim.MockStub, args [][]byte, expec
 }
 
 func checkInvokeResponseFail(t *testing.T, stub *shim.MockStub, args [][]byte, expectedMessage string) {
-	res := stub.MockInvoke("1", args)
+	res := mockInvokeAs(stub, nil, "1", args)
 	if res.Status == shim.OK {
 		fmt.Println("Invoke", args, "should fail")
 		fmt.Println("Instead got payload:", string(res.Payload))
@@ -85,13 +221,13 @@ func Test_Init(t *testing.T) {
 	// It should Init 1 account with 10 000 tokens
 	checkInit(t, stub, [][]byte{[]byte("10000")})
 	checkState(t, stub, "1",
-		"{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":10000}")
+		"{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":10000,\"Status\":\"active\"}")
 
 	// It should Init 1 accounts with 0 tokens
 	stub = shim.NewMockStub("tokens_init_test", cc)
 	checkInit(t, stub, [][]byte{[]byte("0")})
 	checkState(t, stub, "1",
-		"{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":0}")
+		"{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":0,\"Status\":\"active\"}")
 
 	// It should not Init an account with negative number of tokens
 	stub = shim.NewMockStub("tokens_init_test", cc)
@@ -101,9 +237,85 @@ func Test_Init(t *testing.T) {
 	stub = shim.NewMockStub("tokens_init_test", cc)
 	checkInitFail(t, stub, [][]byte{})
 
-	// It should not Init with more args than 1
+	// It should not Init with more args than 5
+	stub = shim.NewMockStub("tokens_init_test", cc)
+	checkInitFail(t, stub, [][]byte{[]byte("1"), []byte("channel2"), []byte("chaincode_ad"), []byte("1"), []byte("1"),
+		[]byte("1")})
+
+	// It should Init with trusted chaincode of data entry ads
+	stub = shim.NewMockStub("tokens_init_test", cc)
+	checkInit(t, stub, [][]byte{[]byte("10000"), []byte("channel2"), []byte("chaincode_ad")})
+
+	// It should Init with fast transfer limit
+	stub = shim.NewMockStub("tokens_init_test", cc)
+	checkInit(t, stub, [][]byte{[]byte("10000"), []byte("5")})
+	checkInvokeResponse(t, stub, [][]byte{[]byte("getFastTransferLimit")}, "5")
+	stub = shim.NewMockStub("tokens_init_test", cc)
+	checkInit(t, stub, [][]byte{[]byte("10000"), []byte("channel2"), []byte("chaincode_ad"), []byte("7")})
+	checkInvokeResponse(t, stub, [][]byte{[]byte("getFastTransferLimit")}, "7")
+
+	// It should Init with treasury account of fees
+	stub = shim.NewMockStub("tokens_init_test", cc)
+	checkInit(t, stub, [][]byte{[]byte("10000"), []byte("channel2"), []byte("chaincode_ad"), []byte("7"), []byte("1")})
+	checkInvokeResponse(t, stub, [][]byte{[]byte("getFastTransferLimit")}, "7")
+	checkInvokeResponse(t, stub, [][]byte{[]byte("getFeeSchedule")}, "{\"Fast\":{\"Flat\":0,\"BasisPoints\":0},"+
+		"\"Safe\":{\"Flat\":0,\"BasisPoints\":0},\"DataPurchase\":{\"Flat\":0,\"BasisPoints\":0},\"TreasuryAccountID\":\"1\"}")
+
+	// It should Init with treasury account without other optional args and keep the treasury set before the upgrade
+	stub = shim.NewMockStub("tokens_init_test", cc)
+	checkInit(t, stub, [][]byte{[]byte("10000"), []byte(""), []byte(""), []byte(""), []byte("1")})
+	checkInvokeResponse(t, stub, [][]byte{[]byte("createAccount"), []byte("2"), []byte("treasury")}, "Account created")
+	checkInvokeResponse(t, stub, [][]byte{[]byte("setFeeTreasury"), []byte("2")}, "Fee treasury set")
+	checkInit(t, stub, [][]byte{[]byte("10000"), []byte(""), []byte(""), []byte(""), []byte("1")})
+	checkInvokeResponse(t, stub, [][]byte{[]byte("getFeeSchedule")}, "{\"Fast\":{\"Flat\":0,\"BasisPoints\":0},"+
+		"\"Safe\":{\"Flat\":0,\"BasisPoints\":0},\"DataPurchase\":{\"Flat\":0,\"BasisPoints\":0},\"TreasuryAccountID\":\"2\"}")
+
+	// It should keep the tokens, the total supply and the administrator at the upgrade
+	stub = shim.NewMockStub("tokens_init_test", cc)
+	checkInit(t, stub, [][]byte{[]byte("10000")})
+	checkInvokeResponse(t, stub, [][]byte{[]byte("createAccount"), []byte("2"), []byte("acc_name")}, "Account created")
+	checkInvoke(t, stub, [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("100"), []byte("false")})
+	otherUser := newTestCreator("City2MSP", "other_user")
+	stub.MockTransactionStart("upgrade")
+	res := new(Chaincode).Init(&identityStub{stub, otherUser, [][]byte{[]byte("20000")}})
+	stub.MockTransactionEnd("upgrade")
+	if res.Status != shim.OK {
+		fmt.Println("Upgrade failed", string(res.Message))
+		t.Fail()
+	}
+	checkInvokeResponse(t, stub, [][]byte{[]byte("getAccountTokens"), []byte("1")}, "9900")
+	checkInvokeResponse(t, stub, [][]byte{[]byte("getTotalSupply")}, "10000")
+	res = mockInvokeAs(stub, otherUser, "upgrade-mint", [][]byte{[]byte("mintTokens"), []byte("2"), []byte("1")})
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Upgrade should keep the administrator but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should compute the total supply at the upgrade of ledger that did not track it
+	stub.MockTransactionStart("migration")
+	stub.DelState("TotalSupply")
+	stub.MockTransactionEnd("migration")
+	checkInit(t, stub, [][]byte{[]byte("10000")})
+	checkInvokeResponse(t, stub, [][]byte{[]byte("getTotalSupply")}, "10000")
+
+	// It should parse the amounts at the upgrade in decimals of the registered default token type
+	stub = shim.NewMockStub("tokens_init_test", cc)
+	checkInit(t, stub, [][]byte{[]byte("0")})
+	checkInvokeResponse(t, stub, [][]byte{[]byte("setTokenDecimals"), []byte("TOK"), []byte("2")}, "Token decimals set")
+	checkInit(t, stub, [][]byte{[]byte("0"), []byte("0.05")})
+	checkInvokeResponse(t, stub, [][]byte{[]byte("getFastTransferLimit")}, "0.05")
+
+	// It should not Init with treasury account that does not exist
+	stub = shim.NewMockStub("tokens_init_test", cc)
+	checkInitFail(t, stub, [][]byte{[]byte("10000"), []byte(""), []byte(""), []byte(""), []byte("treasury")})
+
+	// It should not Init with only one of channel and name of the ad chaincode
+	stub = shim.NewMockStub("tokens_init_test", cc)
+	checkInitFail(t, stub, [][]byte{[]byte("10000"), []byte("channel2"), []byte("")})
+
+	// It should not Init with negative fast transfer limit
 	stub = shim.NewMockStub("tokens_init_test", cc)
-	checkInitFail(t, stub, [][]byte{[]byte("1"), []byte("1")})
+	checkInitFail(t, stub, [][]byte{[]byte("10000"), []byte("-1")})
 
 	// It should not Init with empty arg
 	stub = shim.NewMockStub("tokens_init_test", cc)
@@ -135,6 +347,12 @@ func Test_createAccount(t *testing.T) {
 	expectedMessage := "This account already exists: 2"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
+	// It should fail to create an account with ID of a system participant
+	for _, reservedID := range []string{"Init", "Mint", "Burn", "pruneTx", "Batch"} {
+		args = [][]byte{[]byte("createAccount"), []byte(reservedID), []byte("acc_name")}
+		checkInvokeResponseFail(t, stub, args, "Account ID is reserved: "+reservedID)
+	}
+
 	// It should fail with empty string arg
 	args = [][]byte{[]byte("createAccount"), []byte(""), []byte("acc_name")}
 	expectedMessage = "Argument at position 1 must be a non-empty string"
@@ -197,7 +415,7 @@ func Test_getAccountByID(t *testing.T) {
 
 	// It should get account with ID "1" that was Init
 	args := [][]byte{[]byte("getAccountByID"), []byte("1")}
-	expectedPayload := "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":10}"
+	expectedPayload := "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":10,\"Status\":\"active\"}"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 
 	// It should fail with empty string arg
@@ -251,7 +469,7 @@ func Test_getAccountByName(t *testing.T) {
 
 	// It should return one account
 	args := [][]byte{[]byte("getAccountByName"), []byte("Init_Account")}
-	expectedPayload := "[{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":10}]"
+	expectedPayload := "[{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":10,\"Status\":\"active\"}]"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 
 	// create second account
@@ -261,9 +479,9 @@ func Test_getAccountByName(t *testing.T) {
 
 	// It should return JSON array of two accounts
 	args = [][]byte{[]byte("getAccountByName"), []byte("Init_Account")}
-	expectedPayload = "[{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":10}" +
+	expectedPayload = "[{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":10,\"Status\":\"active\"}" +
 		"," +
-		"{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"2\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":0}]"
+		"{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"2\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":0,\"Status\":\"active\"}]"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 
 	// It should fail with empty string arg
@@ -303,7 +521,7 @@ func Test_sendTokensFast(t *testing.T) {
 	// It should transfer tokens that are for data purchase and create pendingTx
 	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("1"), []byte("true")}
 	expectedPayload = "2"
-	res := stub.MockInvoke("2", args)
+	res := mockInvokeAs(stub, nil, "2", args)
 	if res.Status != shim.OK {
 		fmt.Println("Invoke", args, "failed", string(res.Message))
 		t.Fail()
@@ -329,7 +547,7 @@ func Test_sendTokensFast(t *testing.T) {
 
 	// It should not transfer negative amount of tokens
 	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("-1"), []byte("false")}
-	expectedMessage = "Expecting positive integer as number of tokens to transfer."
+	expectedMessage = "Expecting positive amount of tokens to transfer."
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
 	// It should not transfer tokens if sender and recipient acc is the same
@@ -339,7 +557,7 @@ func Test_sendTokensFast(t *testing.T) {
 
 	// It should not transfer tokens if amount is not a number
 	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("lol"), []byte("false")}
-	expectedMessage = "Expecting positive integer as number of tokens to transfer."
+	expectedMessage = "Expecting positive amount of tokens to transfer."
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
 	// It should not transfer tokens if dataPurchase param is not bool value
@@ -367,14 +585,19 @@ func Test_sendTokensFast(t *testing.T) {
 	expectedMessage = "Argument at position 4 must be a non-empty string"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
-	// It should fail with more than 4 args
+	// It should fail with unknown token type
 	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("1"), []byte("false"), []byte("lol")}
-	expectedMessage = "Incorrect number of arguments. Expecting FromAccountId, ToAccountId, Amount, dataPurchase"
+	expectedMessage = "Token type does not exist: lol"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with more than 5 args
+	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("1"), []byte("false"), []byte("TOK"), []byte("lol")}
+	expectedMessage = "Incorrect number of arguments. Expecting FromAccountId, ToAccountId, Amount, dataPurchase and optional token type"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
 	// It should fail with less than 4 args
 	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("1")}
-	expectedMessage = "Incorrect number of arguments. Expecting FromAccountId, ToAccountId, Amount, dataPurchase"
+	expectedMessage = "Incorrect number of arguments. Expecting FromAccountId, ToAccountId, Amount, dataPurchase and optional token type"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
 	/*
@@ -418,7 +641,7 @@ func Test_sendTokensSafe(t *testing.T) {
 	// It should transfer tokens that are for data purchase and create pendingTx
 	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("100"), []byte("true")}
 	expectedPayload = "2"
-	res := stub.MockInvoke("2", args)
+	res := mockInvokeAs(stub, nil, "2", args)
 	if res.Status != shim.OK {
 		fmt.Println("Invoke", args, "failed", string(res.Message))
 		t.Fail()
@@ -449,12 +672,12 @@ func Test_sendTokensSafe(t *testing.T) {
 
 	// It should not transfer negative amount of tokens
 	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("-10"), []byte("false")}
-	expectedMessage = "Expecting positive integer as number of tokens to transfer."
+	expectedMessage = "Expecting positive amount of tokens to transfer."
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
 	// It should not transfer tokens if amount is not a number
 	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("lol"), []byte("false")}
-	expectedMessage = "Expecting positive integer as number of tokens to transfer."
+	expectedMessage = "Expecting positive amount of tokens to transfer."
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
 	// It should not transfer tokens if dataPurchase param is not bool value
@@ -482,14 +705,19 @@ func Test_sendTokensSafe(t *testing.T) {
 	expectedMessage = "Argument at position 4 must be a non-empty string"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
-	// It should fail with more than 4 args
+	// It should fail with unknown token type
 	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("100"), []byte("false"), []byte("lol")}
-	expectedMessage = "Incorrect number of arguments. Expecting FromAccountId, ToAccountId, Amount, dataPurchase"
+	expectedMessage = "Token type does not exist: lol"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with more than 5 args
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("100"), []byte("false"), []byte("TOK"), []byte("lol")}
+	expectedMessage = "Incorrect number of arguments. Expecting FromAccountId, ToAccountId, Amount, dataPurchase and optional token type"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
 	// It should fail with less than 4 args
 	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("1")}
-	expectedMessage = "Incorrect number of arguments. Expecting FromAccountId, ToAccountId, Amount, dataPurchase"
+	expectedMessage = "Incorrect number of arguments. Expecting FromAccountId, ToAccountId, Amount, dataPurchase and optional token type"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
 	/*
@@ -520,19 +748,55 @@ func Test_getTxDetails(t *testing.T) {
 	checkInvokeResponse(t, stub, args, expectedPayload)
 	// It should transfer tokens
 	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("1"), []byte("false")}
-	res := stub.MockInvoke("2", args)
+	res := mockInvokeAs(stub, nil, "2", args)
 	if res.Status != shim.OK {
 		fmt.Println("Invoke", args, "failed", string(res.Message))
 		t.Fail()
 	}
-	// get the TxID and participants
-	args = [][]byte{[]byte("getTxDetails"), res.Payload}
+	// get the TxID and participants in legacy format
+	txID := res.Payload
+	args = [][]byte{[]byte("getTxDetails"), txID, []byte("1")}
 	expectedPayload = "1->2->1->ValidTx"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 
+	// It should return Tx details in legacy format by default
+	args = [][]byte{[]byte("getTxDetails"), txID}
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should return Tx details as JSON object
+	args = [][]byte{[]byte("getTxDetails"), txID, []byte("2")}
+	res = mockInvokeAs(stub, nil, "3", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.FailNow()
+	}
+	var txDetails TxDetails
+	err := json.Unmarshal(res.Payload, &txDetails)
+	if err != nil || txDetails.TxID != "2" || txDetails.Sender != "1" || txDetails.Recipient != "2" ||
+		txDetails.Amount != "1" || txDetails.State != "ValidTx" || txDetails.Timestamp == "" {
+		fmt.Println("Unexpected Tx details:", string(res.Payload))
+		t.Fail()
+	}
+
+	// It should return pending Tx details
+	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("1"), []byte("true")}
+	res = mockInvokeAs(stub, nil, "4", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getTxDetails"), []byte("4"), []byte("1")}
+	expectedPayload = "1->2->1->PendingTx"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail with unknown version
+	args = [][]byte{[]byte("getTxDetails"), txID, []byte("3")}
+	expectedMessage := "Expecting 1 or 2 as version of the response."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
 	// It should fail with random TxID
 	args = [][]byte{[]byte("getTxDetails"), []byte("-4863asfaebh")}
-	expectedMessage := "Transaction was not found."
+	expectedMessage = "Transaction was not found."
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
 	// It should fail with empty string arg
@@ -540,8 +804,8 @@ func Test_getTxDetails(t *testing.T) {
 	expectedMessage = "Argument at position 1 must be a non-empty string"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
-	// It should fail with more than one args
-	args = [][]byte{[]byte("getTxDetails"), []byte("1"), []byte("lol")}
+	// It should fail with more than two args
+	args = [][]byte{[]byte("getTxDetails"), []byte("1"), []byte("2"), []byte("lol")}
 	expectedMessage = "Incorrect number of arguments. Expecting TxID"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 }
@@ -582,6 +846,20 @@ func Test_changePendingTx(t *testing.T) {
 		[]byte("")}
 	expectedMessage = "Argument at position 3 must be a non-empty string"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to changePendingTx when trusted chaincode is not set
+	args = [][]byte{[]byte("changePendingTx"), []byte("channel2"), []byte("chaincode_ad"),
+		[]byte("TxID-1")}
+	expectedMessage = "Trusted chaincode for ad is not set."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to changePendingTx with chaincode that is not trusted
+	stub = shim.NewMockStub("tokens_init_test", cc)
+	checkInit(t, stub, [][]byte{[]byte("10000"), []byte("channel2"), []byte("chaincode_ad")})
+	args = [][]byte{[]byte("changePendingTx"), []byte("channel2"), []byte("fake_ad"),
+		[]byte("TxID-1")}
+	expectedMessage = "Chaincode fake_ad on channel channel2 is not trusted for ad."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
 }
 
 func Test_pruneAccountTx(t *testing.T) {
@@ -597,27 +875,27 @@ func Test_pruneAccountTx(t *testing.T) {
 	checkInvokeResponse(t, stub, args, expectedPayload)
 	// It should transfer tokens
 	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("1"), []byte("false")}
-	res := stub.MockInvoke("2", args)
+	res := mockInvokeAs(stub, nil, "2", args)
 	if res.Status != shim.OK {
 		fmt.Println("Invoke", args, "failed", string(res.Message))
 		t.Fail()
 	}
 	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("1"), []byte("false")}
-	res = stub.MockInvoke("3", args)
+	res = mockInvokeAs(stub, nil, "3", args)
 	if res.Status != shim.OK {
 		fmt.Println("Invoke", args, "failed", string(res.Message))
 		t.Fail()
 	}
 	// prune Tx for acc ID
 	args = [][]byte{[]byte("pruneAccountTx"), []byte("2")}
-	res = stub.MockInvoke("4", args)
+	res = mockInvokeAs(stub, nil, "4", args)
 	if res.Status != shim.OK {
 		fmt.Println("Invoke", args, "failed", string(res.Message))
 		t.Fail()
 	}
 
 	// get the TxID and participants
-	args = [][]byte{[]byte("getTxDetails"), []byte("4")}
+	args = [][]byte{[]byte("getTxDetails"), []byte("4"), []byte("1")}
 	expectedPayload = "pruneTx->2->2->ValidTx"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 
@@ -626,9 +904,9 @@ func Test_pruneAccountTx(t *testing.T) {
 	expectedMessage := "Argument at position 1 must be a non-empty string"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
-	// It should fail with more than one args
-	args = [][]byte{[]byte("pruneAccountTx"), []byte("1"), []byte("lol")}
-	expectedMessage = "Incorrect number of arguments. Expecting account ID"
+	// It should fail with more than two args
+	args = [][]byte{[]byte("pruneAccountTx"), []byte("1"), []byte("TOK"), []byte("lol")}
+	expectedMessage = "Incorrect number of arguments. Expecting account ID and optional token type"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 }
 
@@ -651,10 +929,10 @@ func Test_updateAccountTokens(t *testing.T) {
 
 	// accounts should have the initial value because they were not updated yet
 	args = [][]byte{[]byte("getAccountByID"), []byte("1")}
-	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":10000}"
+	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":10000,\"Status\":\"active\"}"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 	args = [][]byte{[]byte("getAccountByID"), []byte("2")}
-	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"2\",\"Name\":\"acc_name\",\"OwnerID\":\"\",\"Tokens\":0}"
+	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"2\",\"Name\":\"acc_name\",\"OwnerID\":\"\",\"Tokens\":0,\"Status\":\"active\"}"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 
 	// Check if Tx was successful
@@ -668,19 +946,19 @@ func Test_updateAccountTokens(t *testing.T) {
 
 	// Update the amount of tokens on account 1
 	args = [][]byte{[]byte("updateAccountTokens"), []byte("1")}
-	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":9900}"
+	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":9900,\"Status\":\"active\"}"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 	// Update the amount of tokens on account 2
 	args = [][]byte{[]byte("updateAccountTokens"), []byte("2")}
-	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"2\",\"Name\":\"acc_name\",\"OwnerID\":\"\",\"Tokens\":100}"
+	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"2\",\"Name\":\"acc_name\",\"OwnerID\":\"\",\"Tokens\":100,\"Status\":\"active\"}"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 
 	// accounts should have the updated value
 	args = [][]byte{[]byte("getAccountByID"), []byte("1")}
-	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":9900}"
+	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":9900,\"Status\":\"active\"}"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 	args = [][]byte{[]byte("getAccountByID"), []byte("2")}
-	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"2\",\"Name\":\"acc_name\",\"OwnerID\":\"\",\"Tokens\":100}"
+	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"2\",\"Name\":\"acc_name\",\"OwnerID\":\"\",\"Tokens\":100,\"Status\":\"active\"}"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 
 	// It should fail with empty string arg
@@ -713,10 +991,10 @@ func Test_getAccountTokens(t *testing.T) {
 
 	// accounts should have the initial value because they were not updated yet
 	args = [][]byte{[]byte("getAccountByID"), []byte("1")}
-	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":10000}"
+	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":10000,\"Status\":\"active\"}"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 	args = [][]byte{[]byte("getAccountByID"), []byte("2")}
-	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"2\",\"Name\":\"acc_name\",\"OwnerID\":\"\",\"Tokens\":0}"
+	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"2\",\"Name\":\"acc_name\",\"OwnerID\":\"\",\"Tokens\":0,\"Status\":\"active\"}"
 	checkInvokeResponse(t, stub, args, expectedPayload)
 
 	// Check if Tx was successful
@@ -733,8 +1011,2233 @@ func Test_getAccountTokens(t *testing.T) {
 	expectedMessage := "Argument at position 1 must be a non-empty string"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
 
-	// It should fail with more than one args
+	// It should fail with unknown token type
 	args = [][]byte{[]byte("getAccountTokens"), []byte("1"), []byte("lol")}
-	expectedMessage = "Incorrect number of arguments. Expecting account ID"
+	expectedMessage = "Token type does not exist: lol"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_getAccountByNameWithPagination(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("get_acc_test", cc)
+
+	// Init 1 account with 10 tokens
+	checkInit(t, stub, [][]byte{[]byte("10")})
+
+	// create second account with the same name
+	args := [][]byte{[]byte("createAccount"), []byte("2"), []byte("Init_Account")}
+	expectedPayload := "Account created"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should return the first account and bookmark
+	args = [][]byte{[]byte("getAccountByNameWithPagination"), []byte("Init_Account"), []byte("1")}
+	res := mockInvokeAs(stub, nil, "1", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.FailNow()
+	}
+	var page struct {
+		Records  []json.RawMessage `json:"records"`
+		Bookmark string            `json:"bookmark"`
+		HasMore  bool              `json:"hasMore"`
+	}
+	err := json.Unmarshal(res.Payload, &page)
+	if err != nil || len(page.Records) != 1 || !page.HasMore || page.Bookmark == "" {
+		fmt.Println("Unexpected first page:", string(res.Payload))
+		t.FailNow()
+	}
+
+	// It should return the second account on the next page
+	args = [][]byte{[]byte("getAccountByNameWithPagination"), []byte("Init_Account"), []byte("1"), []byte(page.Bookmark)}
+	expectedPayload = "{\"records\":[" +
+		"{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"2\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":0,\"Status\":\"active\"}" +
+		"],\"bookmark\":\"\",\"hasMore\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail with page size that is not a number
+	args = [][]byte{[]byte("getAccountByNameWithPagination"), []byte("Init_Account"), []byte("lol")}
+	expectedMessage := "Expecting positive integer as page size."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with less than 2 args
+	args = [][]byte{[]byte("getAccountByNameWithPagination"), []byte("Init_Account")}
+	expectedMessage = "Incorrect number of arguments. Expecting name of account holder, page size and optional bookmark"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_accountOwnerVerification(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 10 000 tokens
+	checkInit(t, stub, [][]byte{[]byte("10000")})
+
+	owner := newTestCreator("City2MSP", "acc_owner")
+	otherUser := newTestCreator("City2MSP", "other_user")
+	otherOrg := newTestCreator("City1MSP", "acc_owner")
+
+	// create account owned by the owner
+	args := [][]byte{[]byte("createAccount"), []byte("2"), []byte("acc_name")}
+	res := mockInvokeAs(stub, owner, "1", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.FailNow()
+	}
+
+	// It should fail to send tokens from the account of another holder
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("1"), []byte("1"), []byte("false")}
+	res = mockInvokeAs(stub, otherUser, "2", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the holder of account 2" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("2"), []byte("1"), []byte("1"), []byte("false")}
+	res = mockInvokeAs(stub, otherUser, "3", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the holder of account 2" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail with the same common name from another MSP
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("1"), []byte("1"), []byte("false")}
+	res = mockInvokeAs(stub, otherOrg, "4", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the holder of account 2" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail to update, prune and delete the account of another holder
+	args = [][]byte{[]byte("updateAccountTokens"), []byte("2")}
+	res = mockInvokeAs(stub, otherUser, "5", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the holder of account 2" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("pruneAccountTx"), []byte("2")}
+	res = mockInvokeAs(stub, otherUser, "6", args)
+	if res.Status == shim.OK || res.Message != "pruneAccountTx: Caller is not the holder of account 2" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("deleteAccountByID"), []byte("2")}
+	res = mockInvokeAs(stub, otherUser, "7", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the holder of account 2" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail to send tokens from the account of another holder without identity
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("1"), []byte("1"), []byte("false")}
+	checkInvokeFail(t, stub, args)
+
+	// It should fail to send tokens from account that does not exist
+	args = [][]byte{[]byte("sendTokensFast"), []byte("5"), []byte("1"), []byte("1"), []byte("false")}
+	expectedMessage := "Account does not exist: 5"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should transfer tokens from the account by the holder with renewed certificate
+	renewedOwner := newTestCreator("City2MSP", "acc_owner")
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("1"), []byte("1"), []byte("false")}
+	res = mockInvokeAs(stub, renewedOwner, "8", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+
+	// It should update and prune the account by the holder
+	args = [][]byte{[]byte("updateAccountTokens"), []byte("2")}
+	res = mockInvokeAs(stub, owner, "9", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("pruneAccountTx"), []byte("2")}
+	res = mockInvokeAs(stub, owner, "10", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+
+	// It should transfer tokens from the account created before the identity was base64 encoded
+	legacyAccount, _ := json.Marshal(&Account{"ACCOUNT", "3", "acc_name", string(owner), 0, "", nil, 0, ""})
+	stub.MockTransactionStart("11")
+	stub.PutState("3", legacyAccount)
+	stub.MockTransactionEnd("11")
+	args = [][]byte{[]byte("sendTokensFast"), []byte("3"), []byte("1"), []byte("1"), []byte("false")}
+	res = mockInvokeAs(stub, owner, "12", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	res = mockInvokeAs(stub, otherUser, "13", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the holder of account 3" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+}
+
+func Test_setTrustedChaincode(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// It should Init with trusted chaincode of data entry ads
+	checkInit(t, stub, [][]byte{[]byte("10000"), []byte("channel2"), []byte("chaincode_ad")})
+	args := [][]byte{[]byte("getTrustedChaincode"), []byte("ad")}
+	expectedPayload := "{\"RecordType\":\"COUNTERPART\",\"Role\":\"ad\",\"Channel\":\"channel2\",\"ChaincodeName\":\"chaincode_ad\"}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should change trusted chaincode by the administrator
+	args = [][]byte{[]byte("setTrustedChaincode"), []byte("ad"), []byte("channel4"), []byte("chaincode_ad2")}
+	expectedPayload = "Trusted chaincode set"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getTrustedChaincode"), []byte("ad")}
+	expectedPayload = "{\"RecordType\":\"COUNTERPART\",\"Role\":\"ad\",\"Channel\":\"channel4\",\"ChaincodeName\":\"chaincode_ad2\"}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail to change trusted chaincode by another identity
+	args = [][]byte{[]byte("setTrustedChaincode"), []byte("ad"), []byte("channel5"), []byte("fake_ad")}
+	res := mockInvokeAs(stub, newTestCreator("City2MSP", "buyer"), "1", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail with unknown role
+	args = [][]byte{[]byte("setTrustedChaincode"), []byte("data"), []byte("channel1"), []byte("chaincode_data")}
+	expectedMessage := "Expecting ad as role of the chaincode"
 	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with less than 3 args
+	args = [][]byte{[]byte("setTrustedChaincode"), []byte("ad"), []byte("channel2")}
+	expectedMessage = "Incorrect number of arguments. Expecting role (ad), channel and chaincode name"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to get trusted chaincode that is not set
+	stub = shim.NewMockStub("tokens_init_test", cc)
+	checkInit(t, stub, [][]byte{[]byte("10000")})
+	args = [][]byte{[]byte("getTrustedChaincode"), []byte("ad")}
+	expectedMessage = "Trusted chaincode for ad is not set."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_refundPendingTx(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+	ad := &adChaincode{"Used"}
+	stub.MockPeerChaincode("chaincode_ad/channel2", shim.NewMockStub("chaincode_ad", ad))
+
+	// Init 1 account with 10 000 tokens
+	checkInit(t, stub, [][]byte{[]byte("10000"), []byte("channel2"), []byte("chaincode_ad")})
+
+	// create another acc without tokens
+	args := [][]byte{[]byte("createAccount"), []byte("2"), []byte("acc_name")}
+	expectedPayload := "Account created"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// send tokens for data purchase
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("100"), []byte("true")}
+	res := mockInvokeAs(stub, nil, "3", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail to refund pending Tx before expiry
+	args = [][]byte{[]byte("refundPendingTx"), []byte("channel2"), []byte("chaincode_ad"), []byte("3")}
+	checkInvokeFail(t, stub, args)
+
+	// It should return the expiry of the pending Tx, so the ad chaincode does not accept it after the expiry
+	args = [][]byte{[]byte("getTxDetails"), []byte("3"), []byte("2")}
+	res = mockInvokeAs(stub, nil, "3", args)
+	var txDetails TxDetails
+	err := json.Unmarshal(res.Payload, &txDetails)
+	txTime, _ := time.Parse(time.RFC3339, txDetails.Timestamp)
+	if res.Status != shim.OK || err != nil ||
+		txDetails.Expiry != txTime.Add(time.Duration(PendingTxExpiry)*time.Second).UTC().Format(time.RFC3339) {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+
+	// It should set the expiry
+	args = [][]byte{[]byte("setPendingTxExpiry"), []byte("0")}
+	expectedPayload = "Pending Tx expiry set"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getPendingTxExpiry")}
+	expectedPayload = "0"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail to refund pending Tx used for data purchase
+	args = [][]byte{[]byte("refundPendingTx"), []byte("channel2"), []byte("chaincode_ad"), []byte("3")}
+	expectedMessage := "This TxID was already used for data purchase."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to refund pending Tx by another identity
+	ad.txState = "Unused"
+	res = mockInvokeAs(stub, newTestCreator("City2MSP", "other_user"), "4", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the holder of account 1" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail to refund pending Tx with chaincode that is not trusted
+	args = [][]byte{[]byte("refundPendingTx"), []byte("channel2"), []byte("fake_ad"), []byte("3")}
+	expectedMessage = "Chaincode fake_ad on channel channel2 is not trusted for ad."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should refund unused pending Tx
+	args = [][]byte{[]byte("refundPendingTx"), []byte("channel2"), []byte("chaincode_ad"), []byte("3")}
+	expectedPayload = "3"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getAccountTokens"), []byte("1")}
+	expectedPayload = "10000"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getTxDetails"), []byte("3"), []byte("1")}
+	expectedPayload = "1->2->100->RefundedTx"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail to refund the Tx twice
+	args = [][]byte{[]byte("refundPendingTx"), []byte("channel2"), []byte("chaincode_ad"), []byte("3")}
+	expectedMessage = "Transaction was already used or does not exist."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to set the expiry by another identity
+	args = [][]byte{[]byte("setPendingTxExpiry"), []byte("60")}
+	res = mockInvokeAs(stub, newTestCreator("City2MSP", "other_user"), "5", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail to set negative expiry
+	args = [][]byte{[]byte("setPendingTxExpiry"), []byte("-1")}
+	expectedMessage = "Expecting positiv integer or zero as number of seconds."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with less than 3 args
+	args = [][]byte{[]byte("refundPendingTx"), []byte("channel2"), []byte("chaincode_ad")}
+	expectedMessage = "Incorrect number of arguments. Expecting 3"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_mintAndBurnTokens(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 10 000 tokens
+	checkInit(t, stub, [][]byte{[]byte("10000")})
+	args := [][]byte{[]byte("getTotalSupply")}
+	expectedPayload := "10000"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// create another acc without tokens
+	args = [][]byte{[]byte("createAccount"), []byte("2"), []byte("acc_name")}
+	expectedPayload = "Account created"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should mint tokens
+	args = [][]byte{[]byte("mintTokens"), []byte("2"), []byte("500")}
+	res := mockInvokeAs(stub, nil, "2", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getAccountTokens"), []byte("2")}
+	expectedPayload = "500"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getTxDetails"), []byte("2"), []byte("1")}
+	expectedPayload = "Mint->2->500->ValidTx"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getTotalSupply")}
+	expectedPayload = "10500"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should burn tokens
+	args = [][]byte{[]byte("burnTokens"), []byte("1"), []byte("2000")}
+	res = mockInvokeAs(stub, nil, "3", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getAccountTokens"), []byte("1")}
+	expectedPayload = "8000"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getTxDetails"), []byte("3"), []byte("1")}
+	expectedPayload = "1->Burn->2000->ValidTx"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getTotalSupply")}
+	expectedPayload = "8500"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail to burn more tokens than the account has
+	args = [][]byte{[]byte("burnTokens"), []byte("2"), []byte("501")}
+	expectedMessage := "Not enough tokens on the account"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to burn tokens over the recorded total supply until it is recomputed
+	stub.MockTransactionStart("migration")
+	totalSupplyKey, _ := stub.CreateCompositeKey("TotalSupply", []string{})
+	stub.DelState(totalSupplyKey)
+	stub.MockTransactionEnd("migration")
+	args = [][]byte{[]byte("burnTokens"), []byte("2"), []byte("500")}
+	expectedMessage = "Not enough tokens in circulation. Total supply has to be recomputed by recomputeTotalSupply."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+	args = [][]byte{[]byte("recomputeTotalSupply")}
+	expectedPayload = "8500"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getTotalSupply")}
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail to mint and burn tokens by another identity
+	otherUser := newTestCreator("City2MSP", "other_user")
+	args = [][]byte{[]byte("mintTokens"), []byte("2"), []byte("500")}
+	res = mockInvokeAs(stub, otherUser, "4", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("burnTokens"), []byte("2"), []byte("500")}
+	res = mockInvokeAs(stub, otherUser, "5", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("recomputeTotalSupply")}
+	res = mockInvokeAs(stub, otherUser, "6", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail to mint tokens to account that does not exist
+	args = [][]byte{[]byte("mintTokens"), []byte("5"), []byte("500")}
+	expectedMessage = "Account does not exist: 5"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to mint tokens over the limit of total supply
+	args = [][]byte{[]byte("mintTokens"), []byte("2"), []byte("9223372036854775807")}
+	expectedMessage = "Total supply of tokens would overflow."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with negative amount
+	args = [][]byte{[]byte("mintTokens"), []byte("2"), []byte("-1")}
+	expectedMessage = "Expecting positive amount of tokens to mint."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+	args = [][]byte{[]byte("burnTokens"), []byte("2"), []byte("0")}
+	expectedMessage = "Expecting positive amount of tokens to burn."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with less than 2 args
+	args = [][]byte{[]byte("mintTokens"), []byte("2")}
+	expectedMessage = "Incorrect number of arguments. Expecting account ID, amount and optional token type"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_auditLedger(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 10 000 tokens
+	checkInit(t, stub, [][]byte{[]byte("10000")})
+
+	// create other accounts without tokens
+	args := [][]byte{[]byte("createAccount"), []byte("2"), []byte("acc_name")}
+	expectedPayload := "Account created"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("createAccount"), []byte("3"), []byte("acc_name")}
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// valid, pending and pruned Tx
+	invokes := [][][]byte{
+		{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("100"), []byte("false")},
+		{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("5"), []byte("true")},
+		{[]byte("sendTokensSafe"), []byte("1"), []byte("3"), []byte("10"), []byte("false")},
+		{[]byte("sendTokensSafe"), []byte("3"), []byte("2"), []byte("10"), []byte("false")},
+		{[]byte("pruneAccountTx"), []byte("2")},
+	}
+	for i, args := range invokes {
+		res := mockInvokeAs(stub, nil, "TxID-"+strconv.Itoa(i), args)
+		if res.Status != shim.OK {
+			fmt.Println("Invoke", args, "failed", string(res.Message))
+			t.Fail()
+		}
+	}
+
+	// It should delete account with all its index entries
+	args = [][]byte{[]byte("deleteAccountByID"), []byte("3")}
+	expectedPayload = "Account deleted"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getAccountTokens"), []byte("3")}
+	expectedPayload = "0"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should pass the audit
+	args = [][]byte{[]byte("auditLedger")}
+	expectedPayload = "{\"TotalSupply\":10000,\"RecordedSupply\":10000,\"PendingAmount\":5,\"PendingTxCount\":1," +
+		"\"NegativeBalances\":[],\"OrphanRows\":[],\"Passed\":true}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should find the account entry without Tx entry
+	stub.MockTransactionStart("TxID-orphan")
+	orphanKey, _ := stub.CreateCompositeKey("Account~op~Tok~TxID", []string{"4", "-", "50", "TxID-orphan"})
+	stub.PutState(orphanKey, []byte{0x00})
+	stub.MockTransactionEnd("TxID-orphan")
+	args = [][]byte{[]byte("auditLedger")}
+	expectedPayload = "{\"TotalSupply\":9950,\"RecordedSupply\":10000,\"PendingAmount\":5,\"PendingTxCount\":1," +
+		"\"NegativeBalances\":[{\"AccountID\":\"4\",\"Tokens\":-50}]," +
+		"\"OrphanRows\":[{\"Index\":\"Account~op~Tok~TxID\",\"Key\":[\"4\",\"-\",\"50\",\"TxID-orphan\"]," +
+		"\"Reason\":\"Missing Tx entry\"}],\"Passed\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should find the Tx entry without the entry of one participant that was not compacted
+	stub.MockTransactionStart("TxID-orphan")
+	stub.DelState(orphanKey)
+	senderKey, _ := stub.CreateCompositeKey("Account~op~Tok~TxID", []string{"1", "-", "100", "TxID-0"})
+	stub.DelState(senderKey)
+	stub.MockTransactionEnd("TxID-orphan")
+	args = [][]byte{[]byte("auditLedger")}
+	expectedPayload = "{\"TotalSupply\":10100,\"RecordedSupply\":10000,\"PendingAmount\":5,\"PendingTxCount\":1," +
+		"\"NegativeBalances\":[]," +
+		"\"OrphanRows\":[{\"Index\":\"TxID~Sender~Recipient~Tok\",\"Key\":[\"TxID-0\",\"1\",\"2\",\"100\"]," +
+		"\"Reason\":\"Missing sender entry\"}],\"Passed\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail with more than one args
+	args = [][]byte{[]byte("auditLedger"), []byte("TOK"), []byte("1")}
+	expectedMessage := "Incorrect number of arguments. Expecting optional token type"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_repairIndexes(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 10 000 tokens
+	checkInit(t, stub, [][]byte{[]byte("10000")})
+
+	// create another acc without tokens
+	args := [][]byte{[]byte("createAccount"), []byte("2"), []byte("acc_name")}
+	expectedPayload := "Account created"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// valid and pending Tx
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("100"), []byte("false")}
+	mockInvokeAs(stub, nil, "TxID-1", args)
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("5"), []byte("true")}
+	mockInvokeAs(stub, nil, "TxID-2", args)
+
+	// Break the indexes
+	stub.MockTransactionStart("TxID-3")
+	senderEntryKey, _ := stub.CreateCompositeKey("Account~op~Tok~TxID", []string{"1", "-", "100", "TxID-1"})
+	stub.DelState(senderEntryKey)
+	pendingSenderEntryKey, _ := stub.CreateCompositeKey("Account~op~Tok~TxID", []string{"1", "-", "5", "TxID-2"})
+	stub.DelState(pendingSenderEntryKey)
+	orphanEntryKey, _ := stub.CreateCompositeKey("Account~op~Tok~TxID", []string{"2", "+", "7", "TxID-3"})
+	stub.PutState(orphanEntryKey, []byte{0x00})
+	stub.MockTransactionEnd("TxID-3")
+
+	// It should return planned changes in dry-run
+	args = [][]byte{[]byte("repairIndexes"), []byte("true"), []byte("accounts"), []byte("10")}
+	expectedPayload = "{\"records\":[" +
+		"{\"Key\":[\"Init_Account\",\"1\"],\"Changes\":[]}," +
+		"{\"Key\":[\"acc_name\",\"2\"],\"Changes\":[" +
+		"{\"Action\":\"delete\",\"Index\":\"Account~op~Tok~TxID\",\"Key\":[\"2\",\"+\",\"7\",\"TxID-3\"],\"Reason\":\"Missing Tx entry\"}," +
+		"{\"Action\":\"update\",\"Index\":\"Account\",\"Key\":[\"2\"],\"Reason\":\"Cached tokens 0, computed 100\"}]}" +
+		"],\"bookmark\":\"\",\"hasMore\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("repairIndexes"), []byte("true"), []byte("txs"), []byte("10")}
+	expectedPayload = "{\"records\":[" +
+		"{\"Key\":[\"1\",\"Init\",\"1\",\"10000\"],\"Changes\":[]}," +
+		"{\"Key\":[\"TxID-1\",\"1\",\"2\",\"100\"],\"Changes\":[" +
+		"{\"Action\":\"add\",\"Index\":\"Account~op~Tok~TxID\",\"Key\":[\"1\",\"-\",\"100\",\"TxID-1\"],\"Reason\":\"Missing sender entry\"}]}" +
+		"],\"bookmark\":\"\",\"hasMore\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("auditLedger")}
+	res := mockInvokeAs(stub, nil, "TxID-4", args)
+	if !strings.HasSuffix(string(res.Payload), "\"Passed\":false}") {
+		fmt.Println("Dry-run should not change state", string(res.Payload))
+		t.Fail()
+	}
+
+	// It should rebuild the entries of the pending and valid Tx, then remove the orphan entry by the keys of the dry-run
+	args = [][]byte{[]byte("repairIndexes"), []byte("false"), []byte("pendingTxs"), []byte("[[\"TxID-2\",\"1\",\"2\",\"5\"]]")}
+	expectedPayload = "[{\"Key\":[\"TxID-2\",\"1\",\"2\",\"5\"],\"Changes\":[" +
+		"{\"Action\":\"add\",\"Index\":\"Account~op~Tok~TxID\",\"Key\":[\"1\",\"-\",\"5\",\"TxID-2\"],\"Reason\":\"Missing sender entry\"}]}]"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("repairIndexes"), []byte("false"), []byte("txs"), []byte("[[\"TxID-1\",\"1\",\"2\",\"100\"]]")}
+	res = mockInvokeAs(stub, nil, "TxID-5", args)
+	if res.Status != shim.OK || !strings.Contains(string(res.Payload), "\"Key\":[\"1\",\"-\",\"100\",\"TxID-1\"],\"Reason\":\"Missing sender entry\"") {
+		fmt.Println("Invoke", args, "failed", res.Message, string(res.Payload))
+		t.Fail()
+	}
+	bookmark := ""
+	for i := 0; i < 3; i++ {
+		args = [][]byte{[]byte("repairIndexes"), []byte("true"), []byte("accounts"), []byte("1"), []byte(bookmark)}
+		res = mockInvokeAs(stub, nil, "TxID-6", args)
+		var page struct {
+			Records  []RepairResult `json:"records"`
+			Bookmark string         `json:"bookmark"`
+		}
+		err := json.Unmarshal(res.Payload, &page)
+		if res.Status != shim.OK || err != nil || len(page.Records) != 1 {
+			fmt.Println("Invoke", args, "failed", res.Message, string(res.Payload))
+			t.FailNow()
+		}
+		if len(page.Records[0].Changes) > 0 {
+			keys, _ := json.Marshal([][]string{page.Records[0].Key})
+			args = [][]byte{[]byte("repairIndexes"), []byte("false"), []byte("accounts"), keys}
+			checkInvoke(t, stub, args)
+		}
+		bookmark = page.Bookmark
+		if bookmark == "" {
+			break
+		}
+	}
+	if bookmark != "" {
+		fmt.Println("Repair of accounts should end after 2 pages")
+		t.Fail()
+	}
+
+	// It should fail to repair index entry that does not exist
+	args = [][]byte{[]byte("repairIndexes"), []byte("false"), []byte("txs"), []byte("[[\"TxID-9\",\"1\",\"2\",\"100\"]]")}
+	expectedMessage := "Index entry does not exist: TxID-9~1~2~100"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to repair more index entries than the limit
+	args = [][]byte{[]byte("repairIndexes"), []byte("true"), []byte("txs"), []byte("101")}
+	expectedMessage = "Page exceeded max number of index entries: 100"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+	tooManyKeys, _ := json.Marshal(make([][]string, MaxRepairKeys+1))
+	args = [][]byte{[]byte("repairIndexes"), []byte("false"), []byte("txs"), tooManyKeys}
+	expectedMessage = "Batch exceeded max number of index entries: 100"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to repair without keys or with bookmark
+	args = [][]byte{[]byte("repairIndexes"), []byte("false"), []byte("txs"), []byte("10")}
+	checkInvokeFail(t, stub, args)
+	args = [][]byte{[]byte("repairIndexes"), []byte("false"), []byte("txs"), []byte("[]"), []byte("bookmark")}
+	expectedMessage = "Incorrect number of arguments. Expecting dry-run flag, scope and keys of the index entries"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should pass the audit after the repair
+	args = [][]byte{[]byte("auditLedger")}
+	expectedPayload = "{\"TotalSupply\":10000,\"RecordedSupply\":10000,\"PendingAmount\":5,\"PendingTxCount\":1," +
+		"\"NegativeBalances\":[],\"OrphanRows\":[],\"Passed\":true}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getAccountByID"), []byte("1")}
+	expectedPayload = "{\"RecordType\":\"ACCOUNT\",\"AccountID\":\"1\",\"Name\":\"Init_Account\",\"OwnerID\":\"\",\"Tokens\":9895,\"Status\":\"active\"}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should not rebuild entries that were pruned
+	args = [][]byte{[]byte("pruneAccountTx"), []byte("2")}
+	checkInvoke(t, stub, args)
+	args = [][]byte{[]byte("repairIndexes"), []byte("true"), []byte("txs"), []byte("10")}
+	res = mockInvokeAs(stub, nil, "TxID-7", args)
+	if res.Status != shim.OK || strings.Contains(string(res.Payload), "\"Action\"") {
+		fmt.Println("Invoke", args, "should not plan any change", res.Message, string(res.Payload))
+		t.Fail()
+	}
+
+	// It should fail to repair account with more account entries than the limit
+	stub.MockTransactionStart("TxID-8")
+	for i := 0; i <= MaxRepairAccountEntries; i++ {
+		orphanEntryKey, _ = stub.CreateCompositeKey("Account~Type~op~Tok~TxID", []string{"2", "EUR", "+", "1", "Orphan-" + strconv.Itoa(i)})
+		stub.PutState(orphanEntryKey, []byte{0x00})
+	}
+	stub.MockTransactionEnd("TxID-8")
+	args = [][]byte{[]byte("repairIndexes"), []byte("true"), []byte("accounts"), []byte("10")}
+	expectedMessage = "Retrieval of record failed: Account 2 has more than 1000 account entries. Prune the account before the repair"
+	res = mockInvokeAs(stub, nil, "TxID-8", args)
+	if res.Status == shim.OK || res.Message != expectedMessage {
+		fmt.Println("Invoke", args, "should fail", res.Message)
+		t.Fail()
+	}
+
+	// It should fail to repair by another identity
+	otherUser := newTestCreator("City2MSP", "other_user")
+	args = [][]byte{[]byte("repairIndexes"), []byte("true"), []byte("accounts"), []byte("10")}
+	res = mockInvokeAs(stub, otherUser, "TxID-7", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail with unknown scope or dry-run flag
+	args = [][]byte{[]byte("repairIndexes"), []byte("true"), []byte("all"), []byte("10")}
+	expectedMessage = "Expecting accounts, txs or pendingTxs as scope."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+	args = [][]byte{[]byte("repairIndexes"), []byte("maybe"), []byte("accounts"), []byte("10")}
+	expectedMessage = "Expecting true or false as dry-run flag."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with less than 3 args
+	args = [][]byte{[]byte("repairIndexes"), []byte("true"), []byte("accounts")}
+	expectedMessage = "Incorrect number of arguments. Expecting dry-run flag, scope, page size and optional bookmark"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_setFastTransferLimit(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 10 000 tokens
+	checkInit(t, stub, [][]byte{[]byte("10000")})
+
+	// create another acc without tokens
+	args := [][]byte{[]byte("createAccount"), []byte("2"), []byte("acc_name")}
+	expectedPayload := "Account created"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should use the default limit
+	args = [][]byte{[]byte("getFastTransferLimit")}
+	expectedPayload = strconv.FormatInt(LimitTokens, 10)
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("10"), []byte("false")}
+	expectedMessage := "Exceeded max number of tokens for fast transaction. Use safe token transfer instead."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should set the limit of all accounts
+	args = [][]byte{[]byte("setFastTransferLimit"), []byte("10")}
+	expectedPayload = "Fast transfer limit set"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("10"), []byte("false")}
+	res := mockInvokeAs(stub, nil, "2", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+
+	// It should override the limit of single account
+	args = [][]byte{[]byte("setFastTransferLimit"), []byte("100"), []byte("1")}
+	expectedPayload = "Fast transfer limit set"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getFastTransferLimit"), []byte("1")}
+	expectedPayload = "100"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getFastTransferLimit"), []byte("2")}
+	expectedPayload = "10"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("100"), []byte("false")}
+	res = mockInvokeAs(stub, nil, "3", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("1"), []byte("100"), []byte("false")}
+	expectedMessage = "Exceeded max number of tokens for fast transaction. Use safe token transfer instead."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should remove the limit of single account
+	args = [][]byte{[]byte("deleteFastTransferLimit"), []byte("1")}
+	expectedPayload = "Fast transfer limit deleted"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getFastTransferLimit"), []byte("1")}
+	expectedPayload = "10"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should set the limits of another token type in its decimals
+	args = [][]byte{[]byte("registerTokenType"), []byte("EUR"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "Token type registered")
+	args = [][]byte{[]byte("setFastTransferLimit"), []byte("0.5"), []byte(""), []byte("EUR")}
+	expectedPayload = "Fast transfer limit set"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("setFastTransferLimit"), []byte("2"), []byte("1"), []byte("EUR")}
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getFastTransferLimit"), []byte(""), []byte("EUR")}
+	expectedPayload = "0.5"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getFastTransferLimit"), []byte("1"), []byte("EUR")}
+	expectedPayload = "2"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getFastTransferLimit"), []byte("1")}
+	expectedPayload = "10"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("1"), []byte("1"), []byte("false"), []byte("EUR")}
+	expectedMessage = "Exceeded max number of tokens for fast transaction. Use safe token transfer instead."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("1"), []byte("0.5"), []byte("false"), []byte("EUR")}
+	res = mockInvokeAs(stub, nil, "4", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("deleteFastTransferLimit"), []byte("1"), []byte("EUR")}
+	expectedPayload = "Fast transfer limit deleted"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getFastTransferLimit"), []byte("1"), []byte("EUR")}
+	expectedPayload = "0.5"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail to set the limit by another identity
+	otherUser := newTestCreator("City2MSP", "other_user")
+	args = [][]byte{[]byte("setFastTransferLimit"), []byte("1000"), []byte("2")}
+	res = mockInvokeAs(stub, otherUser, "4", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("deleteFastTransferLimit"), []byte("2")}
+	res = mockInvokeAs(stub, otherUser, "5", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail to set the limit of account that does not exist
+	args = [][]byte{[]byte("setFastTransferLimit"), []byte("100"), []byte("5")}
+	expectedMessage = "Account does not exist: 5"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with negative limit
+	args = [][]byte{[]byte("setFastTransferLimit"), []byte("-1")}
+	expectedMessage = "Expecting positiv amount or zero as fast transfer limit."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with more than 3 args
+	args = [][]byte{[]byte("setFastTransferLimit"), []byte("1"), []byte("1"), []byte("TOK"), []byte("1")}
+	expectedMessage = "Incorrect number of arguments. Expecting limit, optional account ID and optional token type"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_settleFastTransfers(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 10 000 tokens
+	checkInit(t, stub, [][]byte{[]byte("10000")})
+
+	// create another acc without tokens
+	args := [][]byte{[]byte("createAccount"), []byte("2"), []byte("acc_name")}
+	expectedPayload := "Account created"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// Account without tokens can go below zero by fast transfers
+	for i := 0; i < 3; i++ {
+		args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("1"), []byte("1"), []byte("false")}
+		res := mockInvokeAs(stub, nil, "TxID-"+strconv.Itoa(i), args)
+		if res.Status != shim.OK {
+			fmt.Println("Invoke", args, "failed", string(res.Message))
+			t.Fail()
+		}
+	}
+
+	// It should freeze the account with negative amount of tokens
+	args = [][]byte{[]byte("settleFastTransfers"), []byte("10")}
+	expectedPayload = "{\"records\":[{\"AccountID\":\"1\",\"Tokens\":{\"TOK\":10003},\"Status\":\"active\"}," +
+		"{\"AccountID\":\"2\",\"Tokens\":{\"TOK\":-3},\"Status\":\"frozen\"}],\"bookmark\":\"\",\"hasMore\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should reject both transfers from frozen account
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("1"), []byte("1"), []byte("false")}
+	expectedMessage := "Account 2 is frozen until its debt is covered."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("2"), []byte("1"), []byte("1"), []byte("false")}
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to activate the account until the debt is covered
+	args = [][]byte{[]byte("setAccountStatus"), []byte("2"), []byte("active")}
+	expectedMessage = "Account 2 cannot be activated until its debt is covered."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should activate the account when the debt is covered
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("5"), []byte("false")}
+	res := mockInvokeAs(stub, nil, "TxID-3", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("settleFastTransfers"), []byte("1")}
+	res = mockInvokeAs(stub, nil, "TxID-4", args)
+	var page struct {
+		Bookmark string `json:"bookmark"`
+	}
+	json.Unmarshal(res.Payload, &page)
+	args = [][]byte{[]byte("settleFastTransfers"), []byte("1"), []byte(page.Bookmark)}
+	expectedPayload = "{\"records\":[{\"AccountID\":\"2\",\"Tokens\":{\"TOK\":2},\"Status\":\"active\"}],\"bookmark\":\"\",\"hasMore\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("1"), []byte("1"), []byte("false")}
+	res = mockInvokeAs(stub, nil, "TxID-5", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+
+	// It should freeze the account with negative amount of tokens of another token type
+	args = [][]byte{[]byte("registerTokenType"), []byte("EUR"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "Token type registered")
+	args = [][]byte{[]byte("setFastTransferLimit"), []byte("1"), []byte(""), []byte("EUR")}
+	checkInvokeResponse(t, stub, args, "Fast transfer limit set")
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("1"), []byte("0.5"), []byte("false"), []byte("EUR")}
+	checkInvoke(t, stub, args)
+	args = [][]byte{[]byte("settleFastTransfers"), []byte("10")}
+	expectedPayload = "{\"records\":[{\"AccountID\":\"1\",\"Tokens\":{\"EUR\":0.5,\"TOK\":9999},\"Status\":\"active\"}," +
+		"{\"AccountID\":\"2\",\"Tokens\":{\"EUR\":-0.5,\"TOK\":1},\"Status\":\"frozen\"}],\"bookmark\":\"\",\"hasMore\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("setAccountStatus"), []byte("2"), []byte("active")}
+	expectedMessage = "Account 2 cannot be activated until its debt is covered."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("0.5"), []byte("false"), []byte("EUR")}
+	checkInvoke(t, stub, args)
+	args = [][]byte{[]byte("setAccountStatus"), []byte("2"), []byte("active")}
+	checkInvokeResponse(t, stub, args, "Account status set")
+
+	// It should not activate the account frozen by the administrator even without debt
+	args = [][]byte{[]byte("setAccountStatus"), []byte("2"), []byte("frozen")}
+	checkInvokeResponse(t, stub, args, "Account status set")
+	args = [][]byte{[]byte("settleFastTransfers"), []byte("10")}
+	expectedPayload = "{\"records\":[{\"AccountID\":\"1\",\"Tokens\":{\"EUR\":0,\"TOK\":9999},\"Status\":\"active\"}," +
+		"{\"AccountID\":\"2\",\"Tokens\":{\"EUR\":0,\"TOK\":1},\"Status\":\"frozen\"}],\"bookmark\":\"\",\"hasMore\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("1"), []byte("1"), []byte("false")}
+	expectedMessage = "Account 2 is frozen by the administrator."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+	args = [][]byte{[]byte("setAccountStatus"), []byte("2"), []byte("active")}
+	checkInvokeResponse(t, stub, args, "Account status set")
+
+	// It should reject transfers from and to closed account
+	args = [][]byte{[]byte("setAccountStatus"), []byte("2"), []byte("closed")}
+	expectedPayload = "Account status set"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("1"), []byte("1"), []byte("false")}
+	expectedMessage = "Account 2 is closed."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("1"), []byte("false")}
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to settle and set status by another identity
+	otherUser := newTestCreator("City2MSP", "other_user")
+	args = [][]byte{[]byte("settleFastTransfers"), []byte("10")}
+	res = mockInvokeAs(stub, otherUser, "TxID-6", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("setAccountStatus"), []byte("2"), []byte("active")}
+	res = mockInvokeAs(stub, otherUser, "TxID-7", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail with unknown status
+	args = [][]byte{[]byte("setAccountStatus"), []byte("2"), []byte("deleted")}
+	expectedMessage = "Expecting active, frozen or closed as status of the account."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail without args
+	args = [][]byte{[]byte("settleFastTransfers")}
+	expectedMessage = "Incorrect number of arguments. Expecting page size and optional bookmark"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_sendTokensFrom(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 10 000 tokens
+	checkInit(t, stub, [][]byte{[]byte("10000")})
+
+	device := newTestCreator("City2MSP", "iot_device")
+	otherUser := newTestCreator("City2MSP", "other_user")
+
+	// create account of the device and account of data publisher
+	args := [][]byte{[]byte("createAccount"), []byte("2"), []byte("device")}
+	res := mockInvokeAs(stub, device, "TxID-1", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.FailNow()
+	}
+	args = [][]byte{[]byte("createAccount"), []byte("3"), []byte("publisher")}
+	res = mockInvokeAs(stub, otherUser, "TxID-2", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.FailNow()
+	}
+
+	// It should approve spending by the device
+	args = [][]byte{[]byte("approve"), []byte("1"), []byte("2"), []byte("10")}
+	expectedPayload := "Allowance set"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getAllowance"), []byte("1"), []byte("2")}
+	expectedPayload = "10"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should send tokens from the owner account by the device
+	args = [][]byte{[]byte("sendTokensFrom"), []byte("1"), []byte("3"), []byte("4"), []byte("false")}
+	res = mockInvokeAs(stub, device, "TxID-3", args)
+	if res.Status != shim.OK || string(res.Payload) != "TxID-3" {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getAccountTokens"), []byte("1")}
+	expectedPayload = "9996"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getAccountTokens"), []byte("3")}
+	expectedPayload = "4"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getAllowance"), []byte("1"), []byte("2")}
+	expectedPayload = "6"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should pay for data purchase by pending Tx of the owner account
+	args = [][]byte{[]byte("sendTokensFrom"), []byte("1"), []byte("3"), []byte("6"), []byte("true")}
+	res = mockInvokeAs(stub, device, "TxID-4", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getTxDetails"), []byte("TxID-4"), []byte("1")}
+	expectedPayload = "1->3->6->PendingTx"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	// It should record the device as the spender of the purchase
+	args = [][]byte{[]byte("getTxDetails"), []byte("TxID-4"), []byte("2")}
+	res = mockInvokeAs(stub, nil, "TxID-4a", args)
+	var txDetails TxDetails
+	err := json.Unmarshal(res.Payload, &txDetails)
+	if res.Status != shim.OK || err != nil || txDetails.SpenderID != base64.StdEncoding.EncodeToString(device) {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getAllowance"), []byte("1"), []byte("2")}
+	expectedPayload = "0"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail to send more than the allowance
+	args = [][]byte{[]byte("sendTokensFrom"), []byte("1"), []byte("3"), []byte("1"), []byte("false")}
+	res = mockInvokeAs(stub, device, "TxID-5", args)
+	if res.Status == shim.OK || res.Message != "Not enough allowance to send tokens from account 1" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail to use the allowance by another identity
+	args = [][]byte{[]byte("approve"), []byte("1"), []byte("2"), []byte("10")}
+	expectedPayload = "Allowance set"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("sendTokensFrom"), []byte("1"), []byte("3"), []byte("1"), []byte("false")}
+	res = mockInvokeAs(stub, otherUser, "TxID-6", args)
+	if res.Status == shim.OK || res.Message != "Not enough allowance to send tokens from account 1" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail to approve spending from the account of another holder
+	args = [][]byte{[]byte("approve"), []byte("1"), []byte("3"), []byte("10")}
+	res = mockInvokeAs(stub, otherUser, "TxID-7", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the holder of account 1" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should remove the allowance
+	args = [][]byte{[]byte("approve"), []byte("1"), []byte("2"), []byte("0")}
+	expectedPayload = "Allowance removed"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("sendTokensFrom"), []byte("1"), []byte("3"), []byte("1"), []byte("false")}
+	res = mockInvokeAs(stub, device, "TxID-8", args)
+	if res.Status == shim.OK || res.Message != "Not enough allowance to send tokens from account 1" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail with negative allowance
+	args = [][]byte{[]byte("approve"), []byte("1"), []byte("2"), []byte("-1")}
+	expectedMessage := "Expecting positiv amount or zero as number of tokens to approve."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with less than 4 args
+	args = [][]byte{[]byte("sendTokensFrom"), []byte("1"), []byte("3"), []byte("1")}
+	expectedMessage = "Incorrect number of arguments. Expecting OwnerAccountId, ToAccountId, Amount, dataPurchase"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_sendTokensBatch(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 10 000 tokens
+	checkInit(t, stub, [][]byte{[]byte("10000")})
+
+	// create accounts of publishers
+	for _, accountID := range []string{"2", "3", "4"} {
+		args := [][]byte{[]byte("createAccount"), []byte(accountID), []byte("publisher")}
+		checkInvokeResponse(t, stub, args, "Account created")
+	}
+
+	// It should pay all publishers in single Tx
+	args := [][]byte{[]byte("sendTokensBatch"), []byte("1"),
+		[]byte("[{\"To\":\"2\",\"Amount\":\"10\"},{\"To\":\"3\",\"Amount\":20},{\"to\":\"4\",\"amount\":\"30\"}]"), []byte("false")}
+	res := mockInvokeAs(stub, nil, "TxID-1", args)
+	expectedPayload := "{\"TxID\":\"TxID-1\",\"Sender\":\"1\",\"Amount\":60,\"Fee\":0,\"Items\":[{\"To\":\"2\",\"Amount\":10}," +
+		"{\"To\":\"3\",\"Amount\":20},{\"To\":\"4\",\"Amount\":30}]}"
+	if res.Status != shim.OK || string(res.Payload) != expectedPayload {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+	for accountID, tokens := range map[string]string{"1": "9940", "2": "10", "3": "20", "4": "30"} {
+		args = [][]byte{[]byte("getAccountTokens"), []byte(accountID)}
+		checkInvokeResponse(t, stub, args, tokens)
+	}
+	args = [][]byte{[]byte("getTxDetails"), []byte("TxID-1"), []byte("1")}
+	expectedPayload = "1->Batch->60->ValidTx"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should keep indexes consistent after pruning
+	args = [][]byte{[]byte("pruneAccountTx"), []byte("1")}
+	mockInvokeAs(stub, nil, "TxID-2", args)
+	args = [][]byte{[]byte("pruneAccountTx"), []byte("3")}
+	mockInvokeAs(stub, nil, "TxID-3", args)
+	args = [][]byte{[]byte("auditLedger")}
+	expectedPayload = "{\"TotalSupply\":10000,\"RecordedSupply\":10000,\"PendingAmount\":0,\"PendingTxCount\":0," +
+		"\"NegativeBalances\":[],\"OrphanRows\":[],\"Passed\":true}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should pay for data purchase to single recipient
+	args = [][]byte{[]byte("sendTokensBatch"), []byte("1"), []byte("[{\"To\":\"2\",\"Amount\":5}]"), []byte("true")}
+	mockInvokeAs(stub, nil, "TxID-4", args)
+	args = [][]byte{[]byte("getTxDetails"), []byte("TxID-4"), []byte("1")}
+	expectedPayload = "1->2->5->PendingTx"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("sendTokensBatch"), []byte("1"),
+		[]byte("[{\"To\":\"2\",\"Amount\":5},{\"To\":\"3\",\"Amount\":5}]"), []byte("true")}
+	expectedMessage := "Data purchase can be paid only to a single recipient."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail if the sender does not have enough tokens
+	args = [][]byte{[]byte("sendTokensBatch"), []byte("2"),
+		[]byte("[{\"To\":\"3\",\"Amount\":5},{\"To\":\"4\",\"Amount\":6}]"), []byte("false")}
+	expectedMessage = "Not enough tokens on the sender's account"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with the same recipient twice
+	args = [][]byte{[]byte("sendTokensBatch"), []byte("1"),
+		[]byte("[{\"To\":\"2\",\"Amount\":5},{\"To\":\"2\",\"Amount\":5}]"), []byte("false")}
+	expectedMessage = "Recipient 2 is listed more than once."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with recipient that does not exist
+	args = [][]byte{[]byte("sendTokensBatch"), []byte("1"), []byte("[{\"To\":\"5\",\"Amount\":5}]"), []byte("false")}
+	expectedMessage = "Account does not exist: 5"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with empty list of recipients
+	args = [][]byte{[]byte("sendTokensBatch"), []byte("1"), []byte("[]"), []byte("false")}
+	expectedMessage = "Expecting non-empty JSON array of recipients and amounts."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail with non-positive amount
+	args = [][]byte{[]byte("sendTokensBatch"), []byte("1"), []byte("[{\"To\":\"2\",\"Amount\":0}]"), []byte("false")}
+	expectedMessage = "Expecting positive amount of tokens to transfer."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_getAccountTransactions(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 10 000 tokens
+	checkInit(t, stub, [][]byte{[]byte("10000")})
+
+	// create other accounts without tokens
+	args := [][]byte{[]byte("createAccount"), []byte("2"), []byte("acc_name")}
+	checkInvokeResponse(t, stub, args, "Account created")
+	args = [][]byte{[]byte("createAccount"), []byte("3"), []byte("acc_name")}
+	checkInvokeResponse(t, stub, args, "Account created")
+
+	// valid, pending and batch Tx
+	invokes := [][][]byte{
+		{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("100"), []byte("false")},
+		{[]byte("sendTokensSafe"), []byte("2"), []byte("1"), []byte("5"), []byte("true")},
+		{[]byte("sendTokensBatch"), []byte("1"), []byte("[{\"To\":\"2\",\"Amount\":7},{\"To\":\"3\",\"Amount\":8}]"), []byte("false")},
+	}
+	for i, args := range invokes {
+		res := mockInvokeAs(stub, nil, "TxID-"+strconv.Itoa(i), args)
+		if res.Status != shim.OK {
+			fmt.Println("Invoke", args, "failed", string(res.Message))
+			t.Fail()
+		}
+	}
+
+	// It should list all transactions of the account
+	var page struct {
+		Records  []AccountTx `json:"records"`
+		Bookmark string      `json:"bookmark"`
+		HasMore  bool        `json:"hasMore"`
+	}
+	args = [][]byte{[]byte("getAccountTransactions"), []byte("2"), []byte("10")}
+	res := mockInvokeAs(stub, nil, "TxID-3", args)
+	err := json.Unmarshal(res.Payload, &page)
+	expectedRecords := []AccountTx{
+		{"TxID-0", "in", "100", "TOK", "1", "ValidTx", ""},
+		{"TxID-2", "in", "7", "TOK", "1", "ValidTx", ""},
+		{"TxID-1", "out", "5", "TOK", "1", "PendingTx", ""},
+	}
+	if err != nil || len(page.Records) != len(expectedRecords) || page.HasMore {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.FailNow()
+	}
+	for i, record := range page.Records {
+		if record.Timestamp == "" {
+			fmt.Println("Expected time of transaction", record)
+			t.Fail()
+		}
+		record.Timestamp = ""
+		if record != expectedRecords[i] {
+			fmt.Println("Expected record:", expectedRecords[i])
+			fmt.Println("Instead got this:", record)
+			t.Fail()
+		}
+	}
+
+	// It should list transactions in pages
+	args = [][]byte{[]byte("getAccountTransactions"), []byte("1"), []byte("2")}
+	res = mockInvokeAs(stub, nil, "TxID-4", args)
+	json.Unmarshal(res.Payload, &page)
+	if len(page.Records) != 2 || !page.HasMore {
+		fmt.Println("Invoke", args, "failed", string(res.Payload))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getAccountTransactions"), []byte("1"), []byte("2"), []byte(page.Bookmark)}
+	res = mockInvokeAs(stub, nil, "TxID-5", args)
+	page.Records = nil
+	json.Unmarshal(res.Payload, &page)
+	if len(page.Records) != 1 || page.HasMore || page.Records[0].TxID != "TxID-2" ||
+		page.Records[0].Direction != "out" || page.Records[0].Amount != "15" || page.Records[0].Counterparty != "Batch" {
+		fmt.Println("Invoke", args, "failed", string(res.Payload))
+		t.Fail()
+	}
+
+	// It should fail without page size
+	args = [][]byte{[]byte("getAccountTransactions"), []byte("1")}
+	expectedMessage := "Incorrect number of arguments. Expecting account ID, page size and optional bookmark"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+}
+
+func Test_createBalanceSnapshot(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 10 000 tokens
+	checkInit(t, stub, [][]byte{[]byte("10000")})
+
+	// create another acc with tokens of another token type
+	args := [][]byte{[]byte("createAccount"), []byte("2"), []byte("acc_name")}
+	checkInvokeResponse(t, stub, args, "Account created")
+	args = [][]byte{[]byte("registerTokenType"), []byte("EUR"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "Token type registered")
+	args = [][]byte{[]byte("mintTokens"), []byte("2"), []byte("3.5"), []byte("EUR")}
+	checkInvoke(t, stub, args)
+
+	// valid and pending Tx
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("100"), []byte("false")}
+	mockInvokeAs(stub, nil, "TxID-1", args)
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("5"), []byte("true")}
+	mockInvokeAs(stub, nil, "TxID-2", args)
+
+	// It should record the snapshot in pages
+	args = [][]byte{[]byte("createBalanceSnapshot"), []byte("2026-09"), []byte("1")}
+	res := mockInvokeAs(stub, nil, "TxID-3", args)
+	var page struct {
+		Records  []AccountBalances `json:"records"`
+		Bookmark string            `json:"bookmark"`
+	}
+	json.Unmarshal(res.Payload, &page)
+	if res.Status != shim.OK || len(page.Records) != 1 || page.Records[0].AccountID != "1" ||
+		len(page.Records[0].Tokens) != 1 || page.Records[0].Tokens["TOK"] != 9895 {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+
+	// It should not return balances of incomplete snapshot
+	args = [][]byte{[]byte("getBalanceAt"), []byte("1"), []byte("2026-09")}
+	expectedMessage := "Snapshot is not complete yet: 2026-09"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should not open another snapshot or delete accounts until the snapshot is complete
+	args = [][]byte{[]byte("createBalanceSnapshot"), []byte("2026-10"), []byte("1")}
+	expectedMessage = "Snapshot is not complete yet: 2026-09"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+	args = [][]byte{[]byte("deleteAccountByID"), []byte("2")}
+	expectedMessage = "Account cannot be deleted until snapshot 2026-09 is complete."
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// Transfers and compaction after the time of the first page should not change the next pages
+	later := time.Now().Add(time.Hour)
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("50"), []byte("false")}
+	res = mockInvokeAt(stub, later, "TxID-4", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("pruneAccountTx"), []byte("2")}
+	res = mockInvokeAt(stub, later, "TxID-5", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+
+	args = [][]byte{[]byte("createBalanceSnapshot"), []byte("2026-09"), []byte("1"), []byte(page.Bookmark)}
+	expectedPayload := "{\"records\":[{\"AccountID\":\"2\",\"Tokens\":{\"EUR\":350,\"TOK\":100}}],\"bookmark\":\"\",\"hasMore\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// Later transfers should not change the snapshot
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("50"), []byte("false")}
+	mockInvokeAs(stub, nil, "TxID-6", args)
+
+	// It should return the balances of the snapshot
+	args = [][]byte{[]byte("getBalanceAt"), []byte("1"), []byte("2026-09")}
+	expectedPayload = "9895"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getBalanceAt"), []byte("2"), []byte("2026-09")}
+	expectedPayload = "100"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getBalanceAt"), []byte("2"), []byte("2026-09"), []byte("EUR")}
+	expectedPayload = "3.5"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getBalanceAt"), []byte("1"), []byte("2026-09"), []byte("EUR")}
+	expectedPayload = "0"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getBalanceSnapshot"), []byte("2026-09")}
+	res = mockInvokeAs(stub, nil, "TxID-7", args)
+	var snapshot BalanceSnapshot
+	json.Unmarshal(res.Payload, &snapshot)
+	if !snapshot.Complete || snapshot.Accounts != 2 || snapshot.TotalTokens["TOK"] != 9995 ||
+		snapshot.TotalTokens["EUR"] != 350 || snapshot.Timestamp == "" {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+
+	// It should not change the complete snapshot
+	args = [][]byte{[]byte("createBalanceSnapshot"), []byte("2026-09"), []byte("1")}
+	expectedMessage = "Snapshot already exists: 2026-09"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+	args = [][]byte{[]byte("createBalanceSnapshot"), []byte("2026-09"), []byte("1"), []byte(page.Bookmark)}
+	expectedMessage = "Snapshot is complete and cannot be changed: 2026-09"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail for account or snapshot that does not exist
+	args = [][]byte{[]byte("getBalanceAt"), []byte("3"), []byte("2026-09")}
+	expectedMessage = "Account 3 is not in snapshot 2026-09"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+	args = [][]byte{[]byte("getBalanceAt"), []byte("1"), []byte("2026-10")}
+	expectedMessage = "Snapshot does not exist: 2026-10"
+	checkInvokeResponseFail(t, stub, args, expectedMessage)
+
+	// It should fail to create snapshot by another identity
+	otherUser := newTestCreator("City2MSP", "other_user")
+	args = [][]byte{[]byte("createBalanceSnapshot"), []byte("2026-10"), []byte("10")}
+	res = mockInvokeAs(stub, otherUser, "TxID-8", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+}
+
+func Test_rollForwardCheckpoint(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 1 000 tokens
+	checkInit(t, stub, [][]byte{[]byte("1000")})
+	args := [][]byte{[]byte("createAccount"), []byte("2"), []byte("publisher")}
+	checkInvokeResponse(t, stub, args, "Account created")
+
+	// It should roll the checkpoint forward after 3 deltas
+	args = [][]byte{[]byte("setCheckpointDeltas"), []byte("3")}
+	checkInvokeResponse(t, stub, args, "Checkpoint deltas set")
+	args = [][]byte{[]byte("getCheckpointDeltas")}
+	checkInvokeResponse(t, stub, args, "3")
+	for i := 1; i <= 3; i++ {
+		args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("10"), []byte("false")}
+		res := mockInvokeAs(stub, nil, "TxID-"+strconv.Itoa(i), args)
+		if res.Status != shim.OK {
+			fmt.Println("Invoke", args, "failed", string(res.Message))
+			t.Fail()
+		}
+	}
+	checkpointKey, _ := stub.CreateCompositeKey("Checkpoint~AccountID", []string{"1"})
+	checkState(t, stub, checkpointKey, "{\"RecordType\":\"CHECKPOINT\",\"AccountID\":\"1\",\"TokenType\":\"TOK\",\"Tokens\":980,"+
+		"\"TxID\":\"TxID-3\",\"Timestamp\":\""+getCheckpointTimestamp(t, stub, "1")+"\"}")
+	balance, deltas, err := getAccountBalance(stub, "1", DefaultTokenType)
+	if err != nil || balance != 970 || deltas != 1 {
+		fmt.Println("Balance of account 1 is", balance, "with", deltas, "deltas", err)
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getAccountTokens"), []byte("1")}
+	checkInvokeResponse(t, stub, args, "970")
+	args = [][]byte{[]byte("getAccountTokens"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "30")
+
+	// It should keep deltas of pending transactions
+	args = [][]byte{[]byte("setCheckpointDeltas"), []byte("1")}
+	checkInvokeResponse(t, stub, args, "Checkpoint deltas set")
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("10"), []byte("true")}
+	mockInvokeAs(stub, nil, "TxID-4", args)
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("10"), []byte("false")}
+	mockInvokeAs(stub, nil, "TxID-5", args)
+
+	// The delta of the pending transaction is not counted as it cannot be rolled forward
+	balance, deltas, err = getAccountBalance(stub, "1", DefaultTokenType)
+	if err != nil || balance != 950 || deltas != 1 {
+		fmt.Println("Balance of account 1 is", balance, "with", deltas, "deltas", err)
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getTxDetails"), []byte("TxID-4"), []byte("1")}
+	checkInvokeResponse(t, stub, args, "1->2->10->PendingTx")
+	args = [][]byte{[]byte("auditLedger")}
+	expectedPayload := "{\"TotalSupply\":1000,\"RecordedSupply\":1000,\"PendingAmount\":10,\"PendingTxCount\":1," +
+		"\"NegativeBalances\":[],\"OrphanRows\":[],\"Passed\":true}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should fail for other than administrator
+	args = [][]byte{[]byte("setCheckpointDeltas"), []byte("5")}
+	res := mockInvokeAs(stub, newTestCreator("City2MSP", "other_user"), "TxID-6", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail", string(res.Message))
+		t.Fail()
+	}
+}
+
+func getCheckpointTimestamp(t *testing.T, stub *shim.MockStub, accountID string) string {
+	checkpoint, err := getCheckpoint(stub, accountID, DefaultTokenType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checkpoint.Timestamp
+}
+
+func Test_pruneDueAccounts(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 1 000 tokens
+	checkInit(t, stub, [][]byte{[]byte("1000")})
+	args := [][]byte{[]byte("createAccount"), []byte("2"), []byte("publisher")}
+	checkInvokeResponse(t, stub, args, "Account created")
+	for i := 1; i <= 3; i++ {
+		args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("10"), []byte("false")}
+		mockInvokeAs(stub, nil, "TxID-"+strconv.Itoa(i), args)
+	}
+
+	// It should compact accounts with more than 2 deltas
+	args = [][]byte{[]byte("getPrunePolicy")}
+	checkInvokeResponse(t, stub, args, "{\"MaxDeltas\":100,\"MinAge\":3600}")
+	args = [][]byte{[]byte("setPrunePolicy"), []byte("2"), []byte("0")}
+	checkInvokeResponse(t, stub, args, "Prune policy set")
+	args = [][]byte{[]byte("pruneDueAccounts"), []byte("10")}
+	expectedPayload := "{\"Accounts\":2,\"PrunedAccounts\":2,\"PrunedDeltas\":7,\"Bookmark\":\"\",\"HasMore\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	for accountID, tokens := range map[string]int64{"1": 970, "2": 30} {
+		balance, deltas, err := getAccountBalance(stub, accountID, DefaultTokenType)
+		if err != nil || balance != tokens || deltas != 0 {
+			fmt.Println("Balance of account", accountID, "is", balance, "with", deltas, "deltas", err)
+			t.Fail()
+		}
+	}
+	args = [][]byte{[]byte("auditLedger")}
+	expectedPayload = "{\"TotalSupply\":1000,\"RecordedSupply\":1000,\"PendingAmount\":0,\"PendingTxCount\":0," +
+		"\"NegativeBalances\":[],\"OrphanRows\":[],\"Passed\":true}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should keep deltas younger than min age
+	args = [][]byte{[]byte("setPrunePolicy"), []byte("1"), []byte("3600")}
+	checkInvokeResponse(t, stub, args, "Prune policy set")
+	for i := 4; i <= 5; i++ {
+		args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("10"), []byte("false")}
+		mockInvokeAs(stub, nil, "TxID-"+strconv.Itoa(i), args)
+	}
+	args = [][]byte{[]byte("pruneDueAccounts"), []byte("1")}
+	res := mockInvokeAs(stub, nil, "TxID-6", args)
+	var summary PruneSummary
+	err := json.Unmarshal(res.Payload, &summary)
+	if res.Status != shim.OK || err != nil || summary.Accounts != 1 || summary.PrunedAccounts != 0 ||
+		summary.Bookmark == "" || !summary.HasMore {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getAccountTokens"), []byte("1")}
+	checkInvokeResponse(t, stub, args, "950")
+
+	// It should roll forward checkpoints of accounts with checkpoint deltas regardless of min age
+	args = [][]byte{[]byte("setCheckpointDeltas"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "Checkpoint deltas set")
+	args = [][]byte{[]byte("pruneDueAccounts"), []byte("10")}
+	expectedPayload = "{\"Accounts\":2,\"PrunedAccounts\":2,\"PrunedDeltas\":4,\"Bookmark\":\"\",\"HasMore\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	for accountID, tokens := range map[string]int64{"1": 950, "2": 50} {
+		balance, deltas, err := getAccountBalance(stub, accountID, DefaultTokenType)
+		if err != nil || balance != tokens || deltas != 0 {
+			fmt.Println("Balance of account", accountID, "is", balance, "with", deltas, "deltas", err)
+			t.Fail()
+		}
+	}
+
+	// It should fail with invalid policy or for other than administrator
+	args = [][]byte{[]byte("setPrunePolicy"), []byte("0"), []byte("0")}
+	checkInvokeResponseFail(t, stub, args, "Expecting positive integer as max number of deltas.")
+	args = [][]byte{[]byte("pruneDueAccounts"), []byte("10")}
+	res = mockInvokeAs(stub, newTestCreator("City2MSP", "other_user"), "TxID-7", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail", string(res.Message))
+		t.Fail()
+	}
+}
+
+func Test_rollForwardReceivers(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 1 000 tokens, the account 2 only receives tokens
+	checkInit(t, stub, [][]byte{[]byte("1000")})
+	args := [][]byte{[]byte("createAccount"), []byte("2"), []byte("publisher")}
+	checkInvokeResponse(t, stub, args, "Account created")
+	args = [][]byte{[]byte("setCheckpointDeltas"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "Checkpoint deltas set")
+	for i := 1; i <= 3; i++ {
+		args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("10"), []byte("false")}
+		mockInvokeAs(stub, nil, "TxID-"+strconv.Itoa(i), args)
+	}
+
+	// It should count credits of the recipient without rolling it forward by the sender
+	receivedIterator, _ := stub.GetStateByPartialCompositeKey("Received~Account~Type~Tok~TxID", []string{"2", "TOK"})
+	var received int
+	for receivedIterator.HasNext() {
+		receivedIterator.Next()
+		received++
+	}
+	receivedIterator.Close()
+	balance, deltas, err := getAccountBalance(stub, "2", DefaultTokenType)
+	if err != nil || received != 3 || balance != 30 || deltas != 3 {
+		fmt.Println("Balance of account 2 is", balance, "with", deltas, "deltas and", received, "credits", err)
+		t.Fail()
+	}
+
+	// It should roll forward the recipient that received the checkpoint deltas
+	args = [][]byte{[]byte("rollForwardReceivers"), []byte("10")}
+	expectedPayload := "{\"Accounts\":2,\"RolledAccounts\":1,\"RolledDeltas\":3,\"Bookmark\":\"\",\"HasMore\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	balance, deltas, err = getAccountBalance(stub, "2", DefaultTokenType)
+	if err != nil || balance != 30 || deltas != 0 {
+		fmt.Println("Balance of account 2 is", balance, "with", deltas, "deltas", err)
+		t.Fail()
+	}
+	receivedIterator, _ = stub.GetStateByPartialCompositeKey("Received~Account~Type~Tok~TxID", []string{"2"})
+	if receivedIterator.HasNext() {
+		fmt.Println("Credits of account 2 were not removed with its deltas")
+		t.Fail()
+	}
+	receivedIterator.Close()
+	args = [][]byte{[]byte("auditLedger")}
+	expectedPayload = "{\"TotalSupply\":1000,\"RecordedSupply\":1000,\"PendingAmount\":0,\"PendingTxCount\":0," +
+		"\"NegativeBalances\":[],\"OrphanRows\":[],\"Passed\":true}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+
+	// It should keep recipients with less credits than the checkpoint deltas
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("10"), []byte("false")}
+	mockInvokeAs(stub, nil, "TxID-4", args)
+	args = [][]byte{[]byte("rollForwardReceivers"), []byte("1")}
+	res := mockInvokeAs(stub, nil, "TxID-5", args)
+	var summary RollForwardSummary
+	err = json.Unmarshal(res.Payload, &summary)
+	if res.Status != shim.OK || err != nil || summary.Accounts != 1 || summary.RolledAccounts != 0 ||
+		summary.Bookmark == "" || !summary.HasMore {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("rollForwardReceivers"), []byte("1"), []byte(summary.Bookmark)}
+	expectedPayload = "{\"Accounts\":1,\"RolledAccounts\":0,\"RolledDeltas\":0,\"Bookmark\":\"\",\"HasMore\":false}"
+	checkInvokeResponse(t, stub, args, expectedPayload)
+	args = [][]byte{[]byte("getAccountTokens"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "40")
+
+	// It should fail for other than administrator
+	args = [][]byte{[]byte("rollForwardReceivers"), []byte("10")}
+	res = mockInvokeAs(stub, newTestCreator("City2MSP", "other_user"), "TxID-6", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail", string(res.Message))
+		t.Fail()
+	}
+}
+
+func Test_tokenTypes(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+	city2 := newTestCreator("City2MSP", "city2_user")
+
+	// Init 1 account with 1 000 tokens of the default token type
+	checkInit(t, stub, [][]byte{[]byte("1000")})
+	args := [][]byte{[]byte("getTokenType"), []byte("TOK")}
+	res := mockInvokeAs(stub, nil, "TxID-1", args)
+	var tokenType TokenType
+	err := json.Unmarshal(res.Payload, &tokenType)
+	if res.Status != shim.OK || err != nil || tokenType.Symbol != "TOK" || tokenType.Decimals != 0 {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+
+	// It should register token type issued by the caller
+	args = [][]byte{[]byte("registerTokenType"), []byte("CITY2"), []byte("2")}
+	res = mockInvokeAs(stub, city2, "TxID-2", args)
+	if res.Status != shim.OK || string(res.Payload) != "Token type registered" {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("createAccount"), []byte("2"), []byte("city2")}
+	res = mockInvokeAs(stub, city2, "TxID-3", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+
+	// It should mint tokens only by the issuer
+	args = [][]byte{[]byte("mintTokens"), []byte("2"), []byte("500"), []byte("CITY2")}
+	res = mockInvokeAs(stub, newTestCreator("City1MSP", "other_user"), "TxID-4", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the issuer of token type CITY2" {
+		fmt.Println("Invoke", args, "should fail", string(res.Message))
+		t.Fail()
+	}
+	res = mockInvokeAs(stub, city2, "TxID-4", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getTotalSupply"), []byte("CITY2")}
+	checkInvokeResponse(t, stub, args, "500")
+	args = [][]byte{[]byte("getTotalSupply")}
+	checkInvokeResponse(t, stub, args, "1000")
+
+	// It should keep balances per token type
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("2"), []byte("1"), []byte("120"), []byte("false"), []byte("CITY2")}
+	res = mockInvokeAs(stub, city2, "TxID-5", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("1"), []byte("0.01"), []byte("false"), []byte("CITY2")}
+	res = mockInvokeAs(stub, city2, "TxID-6", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	for _, balance := range [][]string{{"1", "TOK", "1000"}, {"1", "CITY2", "120.01"}, {"2", "TOK", "0"}, {"2", "CITY2", "379.99"}} {
+		args = [][]byte{[]byte("getAccountTokens"), []byte(balance[0]), []byte(balance[1])}
+		checkInvokeResponse(t, stub, args, balance[2])
+	}
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("2"), []byte("1"), []byte("1"), []byte("false")}
+	res = mockInvokeAs(stub, city2, "TxID-7", args)
+	if res.Status == shim.OK || res.Message != "Not enough tokens on the sender's account" {
+		fmt.Println("Invoke", args, "should fail", string(res.Message))
+		t.Fail()
+	}
+
+	// It should key deltas of other token types by the token type ahead of the TxID
+	typeEntryKey, _ := stub.CreateCompositeKey("Account~Type~op~Tok~TxID", []string{"1", "CITY2", "+", "1", "TxID-6"})
+	if entryAsBytes, _ := stub.GetState(typeEntryKey); entryAsBytes == nil {
+		fmt.Println("Account entry of token type CITY2 does not exist")
+		t.Fail()
+	}
+	defaultEntryKey, _ := stub.CreateCompositeKey("Account~op~Tok~TxID", []string{"1", "+", "1", "TxID-6", "CITY2"})
+	if entryAsBytes, _ := stub.GetState(defaultEntryKey); entryAsBytes != nil {
+		fmt.Println("Account entry of token type CITY2 exists among entries of the default token type")
+		t.Fail()
+	}
+
+	// It should page transactions of other token types after the default token type
+	var page struct {
+		Records  []AccountTx `json:"records"`
+		Bookmark string      `json:"bookmark"`
+		HasMore  bool        `json:"hasMore"`
+	}
+	args = [][]byte{[]byte("getAccountTransactions"), []byte("1"), []byte("10")}
+	res = mockInvokeAs(stub, nil, "TxID-7", args)
+	err = json.Unmarshal(res.Payload, &page)
+	if res.Status != shim.OK || err != nil || len(page.Records) != 1 || page.Records[0].TokenType != "TOK" ||
+		!page.HasMore {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getAccountTransactions"), []byte("1"), []byte("10"), []byte(page.Bookmark)}
+	res = mockInvokeAs(stub, nil, "TxID-7", args)
+	page.Records = nil
+	err = json.Unmarshal(res.Payload, &page)
+	if res.Status != shim.OK || err != nil || len(page.Records) != 2 || page.Records[0].TokenType != "CITY2" ||
+		page.Records[0].Amount != "0.01" || page.HasMore {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+
+	// It should report the token type of the transaction
+	args = [][]byte{[]byte("getTxDetails"), []byte("TxID-5"), []byte("2")}
+	res = mockInvokeAs(stub, nil, "TxID-8", args)
+	var txDetails TxDetails
+	err = json.Unmarshal(res.Payload, &txDetails)
+	if res.Status != shim.OK || err != nil || txDetails.Amount != "120" || txDetails.TokenType != "CITY2" {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getTxDetails"), []byte("1"), []byte("1")}
+	checkInvokeResponse(t, stub, args, "Init->1->1000->ValidTx")
+
+	// It should prune and audit each token type separately
+	args = [][]byte{[]byte("pruneAccountTx"), []byte("2"), []byte("CITY2")}
+	res = mockInvokeAs(stub, city2, "TxID-9", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getAccountTokens"), []byte("2"), []byte("CITY2")}
+	checkInvokeResponse(t, stub, args, "379.99")
+	for _, symbol := range []string{"TOK", "CITY2"} {
+		args = [][]byte{[]byte("auditLedger"), []byte(symbol)}
+		res = mockInvokeAs(stub, nil, "TxID-10", args)
+		var report AuditReport
+		err = json.Unmarshal(res.Payload, &report)
+		if res.Status != shim.OK || err != nil || !report.Passed {
+			fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+			t.Fail()
+		}
+	}
+
+	// It should fail with data purchase in other than default token type
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("2"), []byte("1"), []byte("1"), []byte("true"), []byte("CITY2")}
+	res = mockInvokeAs(stub, city2, "TxID-11", args)
+	if res.Status == shim.OK || res.Message != "Data purchase can be paid only in TOK tokens." {
+		fmt.Println("Invoke", args, "should fail", string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail with existing token type
+	args = [][]byte{[]byte("registerTokenType"), []byte("CITY2"), []byte("0")}
+	checkInvokeResponseFail(t, stub, args, "Token type already exists: CITY2")
+	args = [][]byte{[]byte("registerTokenType"), []byte("TOK"), []byte("0")}
+	checkInvokeResponseFail(t, stub, args, "Token type already exists: TOK")
+	args = [][]byte{[]byte("registerTokenType"), []byte("CITY3"), []byte("19")}
+	checkInvokeResponseFail(t, stub, args, "Expecting integer from 0 to 18 as number of decimals.")
+}
+
+func Test_swapTokens(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+	city2 := newTestCreator("City2MSP", "city2_user")
+
+	// Init 1 account with 1 000 tokens, the treasury account of the administrator has 1 000 tokens of City2
+	checkInit(t, stub, [][]byte{[]byte("1000")})
+	args := [][]byte{[]byte("createAccount"), []byte("2"), []byte("treasury")}
+	checkInvokeResponse(t, stub, args, "Account created")
+	for i, args := range [][][]byte{
+		{[]byte("registerTokenType"), []byte("CITY2"), []byte("0")},
+		{[]byte("createAccount"), []byte("3"), []byte("city2")},
+		{[]byte("mintTokens"), []byte("2"), []byte("1000"), []byte("CITY2")},
+	} {
+		res := mockInvokeAs(stub, city2, "TxID-"+strconv.Itoa(i+1), args)
+		if res.Status != shim.OK {
+			fmt.Println("Invoke", args, "failed", string(res.Message))
+			t.Fail()
+		}
+	}
+
+	// It should fail to publish rate with treasury account which is not held by the administrator
+	args = [][]byte{[]byte("setExchangeRate"), []byte("TOK"), []byte("CITY2"), []byte("3"), []byte("2"), []byte("3")}
+	checkInvokeFail(t, stub, args)
+
+	// It should swap tokens by the current rate against the treasury account
+	args = [][]byte{[]byte("setExchangeRate"), []byte("TOK"), []byte("CITY2"), []byte("3"), []byte("2"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "Exchange rate set")
+	args = [][]byte{[]byte("swapTokens"), []byte("1"), []byte("TOK"), []byte("CITY2"), []byte("101")}
+	expectedPayload := "{\"TxID\":\"TxID-5\",\"AccountID\":\"1\",\"TreasuryAccountID\":\"2\",\"FromType\":\"TOK\"," +
+		"\"FromAmount\":101,\"ToType\":\"CITY2\",\"ToAmount\":151}"
+	res := mockInvokeAs(stub, nil, "TxID-5", args)
+	if res.Status != shim.OK || string(res.Payload) != expectedPayload {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+	for _, balance := range [][]string{{"1", "TOK", "899"}, {"1", "CITY2", "151"}, {"2", "TOK", "101"}, {"2", "CITY2", "849"}} {
+		args = [][]byte{[]byte("getAccountTokens"), []byte(balance[0]), []byte(balance[1])}
+		checkInvokeResponse(t, stub, args, balance[2])
+	}
+	args = [][]byte{[]byte("getTxDetails"), []byte("TxID-5"), []byte("1")}
+	checkInvokeResponse(t, stub, args, "1->2->101->ValidTx")
+	for _, symbol := range []string{"TOK", "CITY2"} {
+		args = [][]byte{[]byte("auditLedger"), []byte(symbol)}
+		res = mockInvokeAs(stub, nil, "TxID-6", args)
+		var report AuditReport
+		err := json.Unmarshal(res.Payload, &report)
+		if res.Status != shim.OK || err != nil || !report.Passed {
+			fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+			t.Fail()
+		}
+	}
+
+	// It should keep history of the rates
+	args = [][]byte{[]byte("setExchangeRate"), []byte("TOK"), []byte("CITY2"), []byte("100"), []byte("1"), []byte("2")}
+	mockInvokeAs(stub, nil, "TxID-7", args)
+	args = [][]byte{[]byte("getExchangeRate"), []byte("TOK"), []byte("CITY2")}
+	res = mockInvokeAs(stub, nil, "TxID-8", args)
+	var rate ExchangeRate
+	err := json.Unmarshal(res.Payload, &rate)
+	if res.Status != shim.OK || err != nil || rate.Numerator != 100 || rate.Denominator != 1 || rate.TxID != "TxID-7" {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+	var page struct {
+		Records []ExchangeRate `json:"records"`
+		HasMore bool           `json:"hasMore"`
+	}
+	args = [][]byte{[]byte("getExchangeRateHistory"), []byte("TOK"), []byte("CITY2"), []byte("10")}
+	res = mockInvokeAs(stub, nil, "TxID-9", args)
+	err = json.Unmarshal(res.Payload, &page)
+	if res.Status != shim.OK || err != nil || len(page.Records) != 2 || page.HasMore ||
+		page.Records[0].Numerator != 3 || page.Records[1].Numerator != 100 {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+
+	// It should fail without enough liquidity or tokens
+	args = [][]byte{[]byte("swapTokens"), []byte("1"), []byte("TOK"), []byte("CITY2"), []byte("10")}
+	checkInvokeResponseFail(t, stub, args, "Not enough tokens on the treasury account 2")
+	args = [][]byte{[]byte("swapTokens"), []byte("1"), []byte("TOK"), []byte("CITY2"), []byte("900")}
+	checkInvokeResponseFail(t, stub, args, "Not enough tokens on the sender's account")
+	args = [][]byte{[]byte("swapTokens"), []byte("1"), []byte("CITY2"), []byte("TOK"), []byte("1")}
+	checkInvokeResponseFail(t, stub, args, "Exchange rate does not exist: CITY2/TOK")
+	args = [][]byte{[]byte("setExchangeRate"), []byte("TOK"), []byte("CITY2"), []byte("1"), []byte("1000"), []byte("2")}
+	mockInvokeAs(stub, nil, "TxID-10", args)
+	args = [][]byte{[]byte("swapTokens"), []byte("1"), []byte("TOK"), []byte("CITY2"), []byte("1")}
+	checkInvokeResponseFail(t, stub, args, "Amount of tokens is too small to be swapped.")
+
+	// It should fail for other than administrator
+	args = [][]byte{[]byte("setExchangeRate"), []byte("CITY2"), []byte("TOK"), []byte("1"), []byte("1"), []byte("2")}
+	res = mockInvokeAs(stub, city2, "TxID-11", args)
+	if res.Status == shim.OK || res.Message != "Caller is not the administrator of the chaincode" {
+		fmt.Println("Invoke", args, "should fail", string(res.Message))
+		t.Fail()
+	}
+}
+
+func Test_decimalAmounts(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Amounts are parsed exactly into the smallest units
+	for _, amount := range []struct {
+		str      string
+		decimals int
+		units    int64
+		format   string
+	}{{"0.0025", 4, 25, "0.0025"}, {"1.5", 4, 15000, "1.5"}, {"007", 2, 700, "7"}, {"-0.1", 1, -1, "-0.1"},
+		{"9223372036854775807", 0, math.MaxInt64, "9223372036854775807"}} {
+		units, err := parseAmount(amount.str, amount.decimals)
+		if err != nil || units != amount.units || formatAmount(units, amount.decimals) != amount.format {
+			fmt.Println("Amount", amount.str, "was parsed as", units, err)
+			t.Fail()
+		}
+	}
+	for _, amount := range []string{"0.00251", "1.", ".5", "1e3", "+1", "0x10", "922337203685477.5808"} {
+		_, err := parseAmount(amount, 4)
+		if err == nil {
+			fmt.Println("Amount", amount, "should not be parsed")
+			t.Fail()
+		}
+	}
+	_, err := addTokens(math.MaxInt64, 1)
+	if err == nil || err.Error() != "Sum of tokens would overflow." {
+		fmt.Println("Sum of tokens should overflow", err)
+		t.Fail()
+	}
+
+	// Init without tokens so the decimals of the default token type can be changed
+	checkInit(t, stub, [][]byte{[]byte("0")})
+	args := [][]byte{[]byte("setTokenDecimals"), []byte("TOK"), []byte("4")}
+	checkInvokeResponse(t, stub, args, "Token decimals set")
+	args = [][]byte{[]byte("createAccount"), []byte("2"), []byte("acc_name")}
+	checkInvokeResponse(t, stub, args, "Account created")
+	args = [][]byte{[]byte("mintTokens"), []byte("1"), []byte("1.5")}
+	res := mockInvokeAs(stub, nil, "TxID-1", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("setFastTransferLimit"), []byte("0.0025")}
+	checkInvokeResponse(t, stub, args, "Fast transfer limit set")
+	args = [][]byte{[]byte("getFastTransferLimit")}
+	checkInvokeResponse(t, stub, args, "0.0025")
+
+	// It should transfer micro-payment
+	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("0.0025"), []byte("false")}
+	res = mockInvokeAs(stub, nil, "TxID-2", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("sendTokensFast"), []byte("1"), []byte("2"), []byte("0.00001"), []byte("false")}
+	checkInvokeResponseFail(t, stub, args, "Expecting positive amount of tokens to transfer.")
+	for _, balance := range [][]string{{"1", "1.4975"}, {"2", "0.0025"}} {
+		args = [][]byte{[]byte("getAccountTokens"), []byte(balance[0])}
+		checkInvokeResponse(t, stub, args, balance[1])
+	}
+	args = [][]byte{[]byte("getTotalSupply")}
+	checkInvokeResponse(t, stub, args, "1.5")
+	args = [][]byte{[]byte("getTxDetails"), []byte("TxID-2"), []byte("1")}
+	checkInvokeResponse(t, stub, args, "1->2->0.0025->ValidTx")
+	args = [][]byte{[]byte("getTxDetails"), []byte("TxID-2"), []byte("2")}
+	res = mockInvokeAs(stub, nil, "TxID-3", args)
+	if res.Status != shim.OK || !strings.Contains(string(res.Payload), "\"Amount\":0.0025,") {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+
+	// Amounts of batch transfer are decimal numbers as well
+	args = [][]byte{[]byte("sendTokensBatch"), []byte("1"), []byte("[{\"To\":\"2\",\"Amount\":\"0.0005\"}]"), []byte("false")}
+	res = mockInvokeAs(stub, nil, "TxID-5", args)
+	if res.Status != shim.OK || !strings.Contains(string(res.Payload), "\"Amount\":0.0005,") {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("sendTokensBatch"), []byte("1"), []byte("[{\"To\":\"2\",\"Amount\":\"0.00001\"}]"), []byte("false")}
+	checkInvokeResponseFail(t, stub, args, "Expecting positive amount of tokens to transfer.")
+
+	// Allowances and transactions of the account are decimal numbers as well
+	args = [][]byte{[]byte("approve"), []byte("1"), []byte("2"), []byte("0.125")}
+	checkInvokeResponse(t, stub, args, "Allowance set")
+	args = [][]byte{[]byte("getAllowance"), []byte("1"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "0.125")
+	args = [][]byte{[]byte("getAccountTransactions"), []byte("2"), []byte("10")}
+	res = mockInvokeAs(stub, nil, "TxID-4", args)
+	if res.Status != shim.OK || !strings.Contains(string(res.Payload), "\"Amount\":0.0025,") {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+
+	// It should fail to change decimals of tokens in circulation
+	args = [][]byte{[]byte("setTokenDecimals"), []byte("TOK"), []byte("2")}
+	checkInvokeResponseFail(t, stub, args, "Decimals cannot be changed while there are tokens of type TOK in circulation.")
+}
+
+func Test_transferFees(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 1 000 tokens. The account is the treasury of fees
+	checkInit(t, stub, [][]byte{[]byte("1000")})
+	for _, accountID := range []string{"2", "3"} {
+		args := [][]byte{[]byte("createAccount"), []byte(accountID), []byte("acc_name")}
+		checkInvokeResponse(t, stub, args, "Account created")
+	}
+
+	// It should set fees of each kind of transfer
+	for _, fee := range [][]string{{"fast", "1", "0"}, {"safe", "2", "10"}, {"dataPurchase", "0", "1.5"}} {
+		args := [][]byte{[]byte("setTransferFee"), []byte(fee[0]), []byte(fee[1]), []byte(fee[2])}
+		checkInvokeResponse(t, stub, args, "Transfer fee set")
+	}
+	args := [][]byte{[]byte("getFeeSchedule")}
+	checkInvokeResponse(t, stub, args, "{\"Fast\":{\"Flat\":1,\"BasisPoints\":0},\"Safe\":{\"Flat\":2,\"BasisPoints\":1000},"+
+		"\"DataPurchase\":{\"Flat\":0,\"BasisPoints\":150},\"TreasuryAccountID\":\"1\"}")
+	args = [][]byte{[]byte("setTransferFee"), []byte("batch"), []byte("1"), []byte("0")}
+	checkInvokeResponseFail(t, stub, args, "Expecting fast, safe or dataPurchase as kind of transfer.")
+	args = [][]byte{[]byte("setTransferFee"), []byte("fast"), []byte("1"), []byte("100.01")}
+	checkInvokeResponseFail(t, stub, args, "Expecting percentage from 0 to 100 with at most 2 decimals as fee.")
+
+	// The treasury account pays no fees
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("500"), []byte("false")}
+	res := mockInvokeAs(stub, nil, "TxID-1", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+
+	// It should credit fees to the treasury account
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("2"), []byte("3"), []byte("100"), []byte("false")}
+	res = mockInvokeAs(stub, nil, "TxID-2", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("3"), []byte("1"), []byte("false")}
+	res = mockInvokeAs(stub, nil, "TxID-3", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	for _, balance := range [][]string{{"1", "513"}, {"2", "386"}, {"3", "101"}} {
+		args = [][]byte{[]byte("getAccountTokens"), []byte(balance[0])}
+		checkInvokeResponse(t, stub, args, balance[1])
+	}
+	args = [][]byte{[]byte("getTxDetails"), []byte("TxID-2"), []byte("2")}
+	res = mockInvokeAs(stub, nil, "TxID-4", args)
+	var txDetails TxDetails
+	err := json.Unmarshal(res.Payload, &txDetails)
+	if res.Status != shim.OK || err != nil || txDetails.Amount != "100" || txDetails.Fee != "12" {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+
+	// It should check that the sender has enough tokens for the fee
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("2"), []byte("3"), []byte("360"), []byte("false")}
+	checkInvokeResponseFail(t, stub, args, "Not enough tokens on the sender's account")
+
+	// The fee of data purchase is valid even if the payment is pending
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("2"), []byte("3"), []byte("100"), []byte("true")}
+	res = mockInvokeAs(stub, nil, "TxID-5", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getTxDetails"), []byte("TxID-5"), []byte("2")}
+	res = mockInvokeAs(stub, nil, "TxID-6", args)
+	err = json.Unmarshal(res.Payload, &txDetails)
+	if res.Status != shim.OK || err != nil || txDetails.State != "PendingTx" || txDetails.Fee != "1" {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+	for _, balance := range [][]string{{"1", "514"}, {"2", "285"}, {"3", "101"}} {
+		args = [][]byte{[]byte("getAccountTokens"), []byte(balance[0])}
+		checkInvokeResponse(t, stub, args, balance[1])
+	}
+
+	// It should charge the fee for each recipient of the batch transfer
+	args = [][]byte{[]byte("sendTokensBatch"), []byte("2"), []byte("[{\"To\":\"3\",\"Amount\":10},{\"To\":\"1\",\"Amount\":20}]"),
+		[]byte("false")}
+	res = mockInvokeAs(stub, nil, "TxID-7", args)
+	if res.Status != shim.OK || !strings.Contains(string(res.Payload), "\"Amount\":30,\"Fee\":7,") {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+
+	// It should charge the fee of the transfer from allowance to the owner and spend it from the allowance
+	args = [][]byte{[]byte("approve"), []byte("2"), []byte("3"), []byte("30")}
+	checkInvokeResponse(t, stub, args, "Allowance set")
+	args = [][]byte{[]byte("sendTokensFrom"), []byte("2"), []byte("1"), []byte("20"), []byte("false")}
+	checkInvokeResponse(t, stub, args, "1")
+	args = [][]byte{[]byte("getAllowance"), []byte("2"), []byte("3")}
+	checkInvokeResponse(t, stub, args, "6")
+	args = [][]byte{[]byte("sendTokensFrom"), []byte("2"), []byte("1"), []byte("5"), []byte("false")}
+	checkInvokeResponseFail(t, stub, args, "Not enough allowance to send tokens from account 2")
+	for _, balance := range [][]string{{"1", "565"}, {"2", "224"}, {"3", "111"}} {
+		args = [][]byte{[]byte("getAccountTokens"), []byte(balance[0])}
+		checkInvokeResponse(t, stub, args, balance[1])
+	}
+
+	// It should change the treasury account to an existing account
+	args = [][]byte{[]byte("setFeeTreasury"), []byte("4")}
+	checkInvokeResponseFail(t, stub, args, "Account does not exist: 4")
+	args = [][]byte{[]byte("setFeeTreasury"), []byte("3")}
+	checkInvokeResponse(t, stub, args, "Fee treasury set")
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("2"), []byte("1"), []byte("10"), []byte("false")}
+	checkInvoke(t, stub, args)
+	for _, balance := range [][]string{{"1", "575"}, {"2", "211"}, {"3", "114"}} {
+		args = [][]byte{[]byte("getAccountTokens"), []byte(balance[0])}
+		checkInvokeResponse(t, stub, args, balance[1])
+	}
+
+	// Fees are consistent with the total supply
+	args = [][]byte{[]byte("auditLedger")}
+	res = mockInvokeAs(stub, nil, "TxID-9", args)
+	var report AuditReport
+	err = json.Unmarshal(res.Payload, &report)
+	if res.Status != shim.OK || err != nil || !report.Passed {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+}
+
+func Test_multiSigAccounts(t *testing.T) {
+	cc := new(Chaincode)
+	stub := shim.NewMockStub("tokens_init_test", cc)
+
+	// Init 1 account with 10 000 tokens
+	checkInit(t, stub, [][]byte{[]byte("10000")})
+
+	alice := newTestCreator("City1MSP", "alice")
+	bob := newTestCreator("City2MSP", "bob")
+	carol := newTestCreator("City2MSP", "carol")
+	otherUser := newTestCreator("City2MSP", "other_user")
+	owners, _ := json.Marshal([]string{base64.StdEncoding.EncodeToString(alice),
+		base64.StdEncoding.EncodeToString(bob), base64.StdEncoding.EncodeToString(carol)})
+
+	// It should create 2-of-3 account and fund it
+	args := [][]byte{[]byte("createMultiSigAccount"), []byte("2"), []byte("shared"), []byte("2"), owners}
+	res := mockInvokeAs(stub, alice, "TxID-1", args)
+	if res.Status != shim.OK || string(res.Payload) != "Account created" {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.FailNow()
+	}
+	args = [][]byte{[]byte("createAccount"), []byte("3"), []byte("acc_name")}
+	checkInvokeResponse(t, stub, args, "Account created")
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("1"), []byte("2"), []byte("100"), []byte("false")}
+	checkInvoke(t, stub, args)
+
+	// It should fail to create account with invalid threshold or owners
+	args = [][]byte{[]byte("createMultiSigAccount"), []byte("4"), []byte("shared"), []byte("4"), owners}
+	checkInvokeResponseFail(t, stub, args, "Expecting integer from 1 to number of owners as threshold.")
+	args = [][]byte{[]byte("createMultiSigAccount"), []byte("4"), []byte("shared"), []byte("1"), []byte("[\"owner\"]")}
+	checkInvokeResponseFail(t, stub, args, "Expecting base64 encoded serialized identity of each owner.")
+	duplicateOwners, _ := json.Marshal([]string{base64.StdEncoding.EncodeToString(alice),
+		base64.StdEncoding.EncodeToString(alice)})
+	args = [][]byte{[]byte("createMultiSigAccount"), []byte("4"), []byte("shared"), []byte("1"), duplicateOwners}
+	checkInvokeResponseFail(t, stub, args, "Owner is listed more than once.")
+	args = [][]byte{[]byte("createMultiSigAccount"), []byte("Mint"), []byte("shared"), []byte("2"), owners}
+	checkInvokeResponseFail(t, stub, args, "Account ID is reserved: Mint")
+
+	// It should propose the transfer without moving tokens
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("2"), []byte("3"), []byte("30"), []byte("false")}
+	res = mockInvokeAs(stub, alice, "TxID-2", args)
+	if res.Status != shim.OK || string(res.Payload) != "TxID-2" {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getAccountTokens"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "100")
+
+	// It should fail to transfer by fast transfer or by another identity
+	args = [][]byte{[]byte("sendTokensFast"), []byte("2"), []byte("3"), []byte("1"), []byte("false")}
+	res = mockInvokeAs(stub, alice, "TxID-3", args)
+	if res.Status == shim.OK || res.Message != "Account 2 is multi-signature account. Use sendTokensSafe to propose the transfer." {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should tell why other operations of the owner are not allowed
+	for _, operation := range []struct {
+		args    [][]byte
+		message string
+	}{
+		{[][]byte{[]byte("sendTokensBatch"), []byte("2"), []byte("[{\"To\":\"3\",\"Amount\":\"1\"}]"), []byte("false")},
+			"Account 2 is multi-signature account. Use sendTokensSafe to propose each transfer."},
+		{[][]byte{[]byte("approve"), []byte("2"), []byte("3"), []byte("1")},
+			"Account 2 is multi-signature account. It cannot approve allowances."},
+	} {
+		res = mockInvokeAs(stub, alice, "TxID-3", operation.args)
+		if res.Status == shim.OK || res.Message != operation.message {
+			fmt.Println("Invoke", operation.args, "should fail but got", res.Status, string(res.Message))
+			t.Fail()
+		}
+	}
+	args = [][]byte{[]byte("approveTransfer"), []byte("TxID-2")}
+	res = mockInvokeAs(stub, otherUser, "TxID-4", args)
+	if res.Status == shim.OK || res.Message != "Caller is not an owner of multi-signature account 2" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail to approve twice by the same owner
+	res = mockInvokeAs(stub, alice, "TxID-5", args)
+	if res.Status == shim.OK || res.Message != "Transfer proposal TxID-2 was already approved by the caller." {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should execute the transfer when the threshold is reached
+	res = mockInvokeAs(stub, bob, "TxID-6", args)
+	var proposal TransferProposal
+	err := json.Unmarshal(res.Payload, &proposal)
+	if res.Status != shim.OK || err != nil || proposal.State != "Executed" || proposal.ExecutedTxID != "TxID-6" ||
+		len(proposal.Approvals) != 2 {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+	for _, balance := range [][]string{{"2", "70"}, {"3", "30"}} {
+		args = [][]byte{[]byte("getAccountTokens"), []byte(balance[0])}
+		checkInvokeResponse(t, stub, args, balance[1])
+	}
+	args = [][]byte{[]byte("getTxDetails"), []byte("TxID-6"), []byte("1")}
+	checkInvokeResponse(t, stub, args, "2->3->30->ValidTx")
+	args = [][]byte{[]byte("approveTransfer"), []byte("TxID-2")}
+	res = mockInvokeAs(stub, carol, "TxID-7", args)
+	if res.Status == shim.OK || res.Message != "Transfer proposal TxID-2 is executed." {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should cancel the proposal by any owner
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("2"), []byte("3"), []byte("10"), []byte("false")}
+	res = mockInvokeAs(stub, bob, "TxID-8", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("cancelTransfer"), []byte("TxID-8")}
+	res = mockInvokeAs(stub, otherUser, "TxID-9", args)
+	if res.Status == shim.OK {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Payload))
+		t.Fail()
+	}
+	res = mockInvokeAs(stub, carol, "TxID-10", args)
+	if res.Status != shim.OK || string(res.Payload) != "Transfer proposal cancelled" {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("approveTransfer"), []byte("TxID-8")}
+	res = mockInvokeAs(stub, alice, "TxID-11", args)
+	if res.Status == shim.OK || res.Message != "Transfer proposal TxID-8 is cancelled." {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+
+	// It should fail to approve the expired proposal
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("2"), []byte("3"), []byte("10"), []byte("false")}
+	res = mockInvokeAs(stub, bob, "TxID-12", args)
+	if res.Status != shim.OK {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	stub.MockTransactionStart("TxID-13")
+	expired, _ := getTransferProposalValue(stub, "TxID-12")
+	expired.Expiry = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	putTransferProposal(stub, expired)
+	stub.MockTransactionEnd("TxID-13")
+	args = [][]byte{[]byte("approveTransfer"), []byte("TxID-12")}
+	res = mockInvokeAs(stub, alice, "TxID-14", args)
+	if res.Status == shim.OK || !strings.HasPrefix(res.Message, "Transfer proposal expired at ") {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getTransferProposal"), []byte("TxID-12")}
+	res = mockInvokeAs(stub, nil, "TxID-15", args)
+	err = json.Unmarshal(res.Payload, &proposal)
+	if res.Status != shim.OK || err != nil || proposal.State != "Expired" {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("getAccountTokens"), []byte("2")}
+	checkInvokeResponse(t, stub, args, "70")
+
+	// It should set the expiry of proposals
+	args = [][]byte{[]byte("setTransferProposalExpiry"), []byte("3600")}
+	checkInvokeResponse(t, stub, args, "Transfer proposal expiry set")
+	args = [][]byte{[]byte("getTransferProposalExpiry")}
+	checkInvokeResponse(t, stub, args, "3600")
+	args = [][]byte{[]byte("setTransferProposalExpiry"), []byte("0")}
+	checkInvokeResponseFail(t, stub, args, "Expecting positive integer as number of seconds.")
+
+	// It should propose deletion of the account and execute it when the threshold is reached
+	args = [][]byte{[]byte("deleteAccountByID"), []byte("2")}
+	res = mockInvokeAs(stub, otherUser, "TxID-16", args)
+	if res.Status == shim.OK || res.Message != "Caller is not an owner of multi-signature account 2" {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+	res = mockInvokeAs(stub, alice, "TxID-17", args)
+	if res.Status != shim.OK || string(res.Payload) != "TxID-17" {
+		fmt.Println("Invoke", args, "failed", string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("approveTransfer"), []byte("TxID-17")}
+	res = mockInvokeAs(stub, bob, "TxID-18", args)
+	if res.Status == shim.OK || res.Message != "Account cannot be deleted. Amount of tokens is not 0." {
+		fmt.Println("Invoke", args, "should fail but got", res.Status, string(res.Message))
+		t.Fail()
+	}
+	args = [][]byte{[]byte("sendTokensSafe"), []byte("2"), []byte("3"), []byte("70"), []byte("false")}
+	mockInvokeAs(stub, alice, "TxID-19", args)
+	args = [][]byte{[]byte("approveTransfer"), []byte("TxID-19")}
+	mockInvokeAs(stub, carol, "TxID-20", args)
+	args = [][]byte{[]byte("approveTransfer"), []byte("TxID-17")}
+	res = mockInvokeAs(stub, bob, "TxID-21", args)
+	err = json.Unmarshal(res.Payload, &proposal)
+	if res.Status != shim.OK || err != nil || proposal.State != "Executed" || proposal.Action != "delete" {
+		fmt.Println("Invoke", args, "failed", string(res.Message), string(res.Payload))
+		t.Fail()
+	}
+	if accountAsBytes, _ := stub.GetState("2"); accountAsBytes != nil {
+		fmt.Println("Account 2 was not deleted")
+		t.Fail()
+	}
 }
@@ -245,7 +245,8 @@ instantiateChaincode 0 chaincode_data
 echo "--> Instantiating chaincode_ad on Peer0/City1..."
 echo
 CHANNEL_NAME="${CHANNEL_NAME_BASE}2"
-PAYLOAD='{"Args":["1"]}'
+# trusted channels and chaincodes of data entries and tokens
+PAYLOAD='{"Args":["'"${CHANNEL_NAME_BASE}"'1", "chaincode_data", "'"${CHANNEL_NAME_BASE}"'3", "chaincode_tokens"]}'
 POLICY="OR ('City1MSP.member','City2MSP.member')"
 instantiateChaincode 0 chaincode_ad
 
@@ -253,7 +254,8 @@ instantiateChaincode 0 chaincode_ad
 echo "--> Instantiating chaincode_tokens on Peer0/City1..."
 echo
 CHANNEL_NAME="${CHANNEL_NAME_BASE}3"
-PAYLOAD='{"Args":["1000000"]}'
+# initial tokens and trusted channel and chaincode of data entry ads
+PAYLOAD='{"Args":["1000000", "'"${CHANNEL_NAME_BASE}"'2", "chaincode_ad"]}'
 POLICY="OR ('City1MSP.member','City2MSP.member')"
 # switch to peer 0 on City 1 so it owns account 1
 instantiateChaincode 0 chaincode_tokens
@@ -301,12 +303,13 @@ CHANNEL_NAME="${CHANNEL_NAME_BASE}3"
 PAYLOAD='{"Args":["updateAccountTokens", "1"]}'
 chaincodeInvoke 0 chaincode_tokens
 
-# Invoke on chaincode_tokens on Peer0/City1
-echo "--> Sending invoke transaction updateAccountTokens on Peer0/City1 on chaincode_tokens"
+# Invoke on chaincode_tokens on Peer0/City2
+echo "--> Sending invoke transaction updateAccountTokens on Peer0/City2 on chaincode_tokens"
 echo
 CHANNEL_NAME="${CHANNEL_NAME_BASE}3"
 PAYLOAD='{"Args":["updateAccountTokens", "2"]}'
-chaincodeInvoke 0 chaincode_tokens
+# switch to peer 0 on City2 because that is the owner of the account
+chaincodeInvoke 2 chaincode_tokens
 
 # peer chaincode invoke --tls true --cafile /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ordererOrganizations/zak.codes/orderers/orderer.zak.codes/msp/tlscacerts/tlsca.zak.codes-cert.pem -n chaincode_ad -c '{"Args":["revealPaidData", "channel1", "chaincode_data", "2", "20180321160000", "channel3", "chaincode_tokens", "txID"]}' -C channel2
 
@@ -124,9 +124,9 @@ chaincodeInvoke () {
 	# while 'peer chaincode' command can get the orderer endpoint from the peer (if join was successful),
 	# lets supply it directly as we know it using the "-o" option
 	if [ -z "$CORE_PEER_TLS_ENABLED" -o "$CORE_PEER_TLS_ENABLED" = "false" ]; then
-		peer chaincode invoke -o orderer.zak.codes:7050 -C $CHANNEL_NAME -n $CC_NAME -c "${PAYLOAD}" >&log.txt
+		peer chaincode invoke -o orderer.zak.codes:7050 -C $CHANNEL_NAME -n $CC_NAME -c "${PAYLOAD}" ${TRANSIENT:+--transient $TRANSIENT} >&log.txt
 	else
-		peer chaincode invoke -o orderer.zak.codes:7050  --tls $CORE_PEER_TLS_ENABLED --cafile $ORDERER_CA -C $CHANNEL_NAME -n $CC_NAME -c "${PAYLOAD}" >&log.txt
+		peer chaincode invoke -o orderer.zak.codes:7050  --tls $CORE_PEER_TLS_ENABLED --cafile $ORDERER_CA -C $CHANNEL_NAME -n $CC_NAME -c "${PAYLOAD}" ${TRANSIENT:+--transient $TRANSIENT} >&log.txt
 	fi
 	res=$?
 	cat log.txt
@@ -177,6 +177,18 @@ PAYLOAD='{"Args":["getAccountTokens", "2"]}'
 chaincodeQuery 0 chaincode_tokens
 ACC2_TOKENS=$RETURNED_QUERY
 
+# Invoke on chaincode_ad on Peer2/City2
+echo "--> Sending invoke transaction registerBuyerKey on Peer2/City2 on chaincode_ad"
+echo "--> Registering public key of the buyer. Paid data value is encrypted with this key <--"
+echo
+if [ ! -f buyer_key.pem ]; then
+	openssl genrsa -out buyer_key.pem 2048
+fi
+PUBLIC_KEY=$(openssl rsa -in buyer_key.pem -pubout 2>/dev/null | awk '{printf "%s\\n", $0}')
+CHANNEL_NAME="${CHANNEL_NAME_BASE}2"
+PAYLOAD='{"Args":["registerBuyerKey", "'"${PUBLIC_KEY}"'"]}'
+chaincodeInvoke 2 chaincode_ad
+
 # Invoke on chaincode_tokens on Peer2/City2
 echo "--> Sending invoke transaction sendTokensSafe on Peer2/City2 on chaincode_tokens"
 echo "--> Sending 10 tokens for data purchase from account 2 to account 1 on blockchain 3 <--"
@@ -217,11 +229,15 @@ PAYLOAD=$PAYLOAD$CREATION_TIME
 MIDDLE='", "channel3", "chaincode_tokens", '
 PAYLOAD=$PAYLOAD$MIDDLE$RETURNED_PAYLOAD
 PAYLOAD="${PAYLOAD}]}"
+# The publisher generates the key of the purchase and the seed of its encryption for the buyer.
+# Both are passed in the transient data, which is not recorded in the ledger
+TRANSIENT='{"purchaseKey":"'$(openssl rand -base64 32)'","oaepSeed":"'$(openssl rand -base64 32)'"}'
 chaincodeInvoke 0 chaincode_ad
+TRANSIENT=
 
 # Invoke on chaincode_tokens on Peer2/City2
 echo "--> Sending invoke transaction changePendingTx on Peer2/City2 on chaincode_tokens"
-echo "--> Now data entry has revealed value and Blocked tokens can be changed to available <--"
+echo "--> Now data entry value is encrypted for the buyer and Blocked tokens can be changed to available <--"
 echo
 sleep $DELAY # required sleep to wait for previous data to commit and being available
 CHANNEL_NAME="${CHANNEL_NAME_BASE}3"
@@ -0,0 +1,4 @@
+#!/bin/bash
+
+# Rolls forward checkpoints of the first 100 accounts that received the checkpoint deltas. Called by the administrator, e.g. from cron
+peer chaincode invoke --tls true --cafile /opt/gopath/src/github.com/hyperledger/fabric/peer/crypto/ordererOrganizations/zak.codes/orderers/orderer.zak.codes/msp/tlscacerts/tlsca.zak.codes-cert.pem -n chaincode_tokens -c '{"Args":["rollForwardReceivers", "100"]}' -C channel3